@@ -0,0 +1,338 @@
+// Package arc implements Authenticated Received Chain validation and
+// sealing (RFC 8617).
+package arc
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Polymail/go-falcon/dkim"
+)
+
+const (
+	MAX_INSTANCES = 50
+
+	SEAL_HEADER                   = "ARC-Seal"
+	MESSAGE_SIGNATURE_HEADER      = "ARC-Message-Signature"
+	AUTHENTICATION_RESULTS_HEADER = "ARC-Authentication-Results"
+)
+
+type ChainStatus string
+
+const (
+	ChainNone ChainStatus = "none"
+	ChainPass ChainStatus = "pass"
+	ChainFail ChainStatus = "fail"
+)
+
+// Result of chain validation.
+type Result struct {
+	Status    ChainStatus
+	Instances int    // number of ARC sets
+	Domain    string // d= of the latest seal
+	Error     string
+}
+
+// arc set of one instance
+
+type arcSet struct {
+	seal       *dkim.Header
+	signature  *dkim.Header
+	authResult *dkim.Header
+}
+
+// seal is a parsed ARC-Seal header
+
+type seal struct {
+	instance        int
+	algorithm       string
+	signature       []byte
+	domain          string
+	selector        string
+	chainValidation ChainStatus
+}
+
+func instanceOf(raw string) (int, error) {
+	value := raw[strings.Index(raw, ":")+1:]
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, "i=") {
+			return strconv.Atoi(strings.TrimSpace(part[2:]))
+		}
+	}
+	return 0, errors.New("arc: header without i= tag")
+}
+
+// collect arc sets by instance
+
+func collectSets(headers []dkim.Header) (map[int]*arcSet, int, error) {
+	sets := make(map[int]*arcSet)
+	maxInstance := 0
+	for i := range headers {
+		h := &headers[i]
+		var isSeal, isSignature, isAuthResult bool
+		switch h.Name {
+		case strings.ToLower(SEAL_HEADER):
+			isSeal = true
+		case strings.ToLower(MESSAGE_SIGNATURE_HEADER):
+			isSignature = true
+		case strings.ToLower(AUTHENTICATION_RESULTS_HEADER):
+			isAuthResult = true
+		default:
+			continue
+		}
+		instance, err := instanceOf(h.Raw)
+		if err != nil || instance < 1 || instance > MAX_INSTANCES {
+			return nil, 0, fmt.Errorf("arc: invalid instance in %s", strings.TrimSpace(h.Raw[:strings.Index(h.Raw, ":")]))
+		}
+		set, ok := sets[instance]
+		if !ok {
+			set = &arcSet{}
+			sets[instance] = set
+		}
+		switch {
+		case isSeal && set.seal == nil:
+			set.seal = h
+		case isSignature && set.signature == nil:
+			set.signature = h
+		case isAuthResult && set.authResult == nil:
+			set.authResult = h
+		default:
+			return nil, 0, fmt.Errorf("arc: duplicate header in set %d", instance)
+		}
+		if instance > maxInstance {
+			maxInstance = instance
+		}
+	}
+	for i := 1; i <= maxInstance; i++ {
+		set, ok := sets[i]
+		if !ok || set.seal == nil || set.signature == nil || set.authResult == nil {
+			return nil, 0, fmt.Errorf("arc: incomplete set %d", i)
+		}
+	}
+	return sets, maxInstance, nil
+}
+
+func parseSeal(raw string) (*seal, error) {
+	tags, err := dkim.ParseTags(raw[strings.Index(raw, ":")+1:])
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"i", "a", "b", "d", "s", "cv"} {
+		if _, ok := tags[name]; !ok {
+			return nil, fmt.Errorf("arc: seal missing required tag %q", name)
+		}
+	}
+	if _, ok := tags["h"]; ok {
+		return nil, errors.New("arc: seal must not have h= tag")
+	}
+	s := &seal{
+		algorithm:       strings.ToLower(tags["a"]),
+		domain:          strings.ToLower(tags["d"]),
+		selector:        strings.ToLower(tags["s"]),
+		chainValidation: ChainStatus(strings.ToLower(tags["cv"])),
+	}
+	if s.instance, err = strconv.Atoi(tags["i"]); err != nil {
+		return nil, errors.New("arc: malformed i= tag")
+	}
+	b := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, tags["b"])
+	if s.signature, err = base64.StdEncoding.DecodeString(b); err != nil {
+		return nil, errors.New("arc: malformed b= tag")
+	}
+	return s, nil
+}
+
+// data signed by seal of instance, RFC 8617 section 5.1.1
+
+func sealHashData(sets map[int]*arcSet, instance int) []byte {
+	var buf strings.Builder
+	for i := 1; i <= instance; i++ {
+		set := sets[i]
+		buf.WriteString(dkim.CanonicalHeader(set.authResult.Raw, dkim.CANON_RELAXED))
+		buf.WriteString(dkim.CanonicalHeader(set.signature.Raw, dkim.CANON_RELAXED))
+		if i == instance {
+			buf.WriteString(strings.TrimSuffix(dkim.CanonicalHeader(dkim.StripSignatureValue(set.seal.Raw), dkim.CANON_RELAXED), "\r\n"))
+		} else {
+			buf.WriteString(dkim.CanonicalHeader(set.seal.Raw, dkim.CANON_RELAXED))
+		}
+	}
+	return []byte(buf.String())
+}
+
+// validate chain
+
+// Validate checks ARC chain of raw message, RFC 8617 section 5.2.
+func Validate(raw []byte, resolver dkim.KeyResolver) *Result {
+	headers, body := dkim.SplitMessage(raw)
+	sets, instances, err := collectSets(headers)
+	if err != nil {
+		return &Result{Status: ChainFail, Error: err.Error()}
+	}
+	if instances == 0 {
+		return &Result{Status: ChainNone}
+	}
+	result := &Result{Status: ChainFail, Instances: instances}
+	latest, err := parseSeal(sets[instances].seal.Raw)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Domain = latest.domain
+	if latest.chainValidation == ChainFail {
+		result.Error = "arc: chain marked as failed by latest seal"
+		return result
+	}
+	// latest message signature
+	if err := verifyMessageSignature(headers, body, sets[instances], resolver); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	// all seals, from the latest
+	for i := instances; i >= 1; i-- {
+		s, err := parseSeal(sets[i].seal.Raw)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if (i == 1 && s.chainValidation != ChainNone) || (i > 1 && s.chainValidation != ChainPass) {
+			result.Error = fmt.Sprintf("arc: invalid cv=%s in seal %d", s.chainValidation, i)
+			return result
+		}
+		if err := verifySeal(s, sealHashData(sets, i), resolver); err != nil {
+			result.Error = fmt.Sprintf("arc: seal %d: %v", i, err)
+			return result
+		}
+	}
+	result.Status = ChainPass
+	return result
+}
+
+func verifyMessageSignature(headers []dkim.Header, body []byte, set *arcSet, resolver dkim.KeyResolver) error {
+	sig, err := dkim.ParseSignature(set.signature.Raw[strings.Index(set.signature.Raw, ":")+1:], true)
+	if err != nil {
+		return err
+	}
+	for _, name := range sig.Headers {
+		if name == strings.ToLower(SEAL_HEADER) {
+			return errors.New("arc: message signature covers ARC-Seal")
+		}
+	}
+	key, err := dkim.LookupPublicKey(resolver, sig.Domain, sig.Selector)
+	if err != nil {
+		return err
+	}
+	if err := dkim.VerifyBodyHash(sig, body); err != nil {
+		return err
+	}
+	return dkim.VerifyHeaderHash(sig, key, dkim.HeaderHashData(sig, headers, *set.signature))
+}
+
+func verifySeal(s *seal, data []byte, resolver dkim.KeyResolver) error {
+	key, err := dkim.LookupPublicKey(resolver, s.domain, s.selector)
+	if err != nil {
+		return err
+	}
+	return dkim.VerifyHeaderHash(&dkim.Signature{Algorithm: s.algorithm, Signature: s.signature}, key, data)
+}
+
+// sealing
+
+// SealOptions describes our ARC sealer.
+type SealOptions struct {
+	Domain   string
+	Selector string
+	Signer   crypto.Signer
+	Time     time.Time
+}
+
+// Seal returns ARC-Seal, ARC-Message-Signature and ARC-Authentication-Results
+// header fields (in this order, each with trailing CRLF) to prepend to raw
+// message. AuthResults is value of our Authentication-Results header and
+// chain is result of Validate of raw message.
+func Seal(raw []byte, authResults string, chain *Result, options *SealOptions) ([]string, error) {
+	headers, body := dkim.SplitMessage(raw)
+	sets, instances, err := collectSets(headers)
+	if err != nil {
+		// broken chain is sealed as failed
+		sets, instances = nil, 0
+		if chain == nil || chain.Status != ChainFail {
+			chain = &Result{Status: ChainFail}
+		}
+	}
+	if chain != nil && chain.Instances > instances {
+		instances = chain.Instances
+	}
+	instance := instances + 1
+	if instance > MAX_INSTANCES {
+		return nil, errors.New("arc: too many instances to seal")
+	}
+	chainValidation := ChainNone
+	if instance > 1 {
+		chainValidation = ChainPass
+		if chain == nil || chain.Status != ChainPass {
+			chainValidation = ChainFail
+		}
+	}
+	signTime := options.Time
+	if signTime.IsZero() {
+		signTime = time.Now()
+	}
+	// ARC-Authentication-Results
+	authResultHeader := dkim.Header{
+		Name: strings.ToLower(AUTHENTICATION_RESULTS_HEADER),
+		Raw:  fmt.Sprintf("%s: i=%d; %s\r\n", AUTHENTICATION_RESULTS_HEADER, instance, strings.TrimSpace(authResults)),
+	}
+	// ARC-Message-Signature over message without arc headers
+	var messageHeaders []dkim.Header
+	for _, h := range headers {
+		if !strings.HasPrefix(h.Name, "arc-") {
+			messageHeaders = append(messageHeaders, h)
+		}
+	}
+	signatureRaw, err := dkim.SignHeader(MESSAGE_SIGNATURE_HEADER, "i="+strconv.Itoa(instance), messageHeaders, body, &dkim.SignOptions{
+		Domain:   options.Domain,
+		Selector: options.Selector,
+		Signer:   options.Signer,
+		Time:     signTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signatureHeader := dkim.Header{Name: strings.ToLower(MESSAGE_SIGNATURE_HEADER), Raw: signatureRaw}
+	// ARC-Seal
+	algorithm, err := dkim.SignerAlgorithm(options.Signer)
+	if err != nil {
+		return nil, err
+	}
+	sealHeader := dkim.Header{
+		Name: strings.ToLower(SEAL_HEADER),
+		Raw:  fmt.Sprintf("%s: i=%d; a=%s; t=%d; cv=%s; d=%s; s=%s; b=\r\n", SEAL_HEADER, instance, algorithm, signTime.Unix(), chainValidation, options.Domain, options.Selector),
+	}
+	if sets == nil {
+		sets = make(map[int]*arcSet)
+	}
+	sets[instance] = &arcSet{seal: &sealHeader, signature: &signatureHeader, authResult: &authResultHeader}
+	var data []byte
+	if chainValidation == ChainFail {
+		// only the new set is signed for a failed chain
+		data = sealHashData(map[int]*arcSet{1: sets[instance]}, 1)
+	} else {
+		data = sealHashData(sets, instance)
+	}
+	signature, err := dkim.SignData(options.Signer, data)
+	if err != nil {
+		return nil, err
+	}
+	sealHeader.Raw = strings.TrimSuffix(sealHeader.Raw, "\r\n") + base64.StdEncoding.EncodeToString(signature) + "\r\n"
+	return []string{sealHeader.Raw, signatureHeader.Raw, authResultHeader.Raw}, nil
+}
@@ -0,0 +1,130 @@
+package arc
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"github.com/Polymail/go-falcon/dkim"
+)
+
+type mapKeyResolver map[string]string
+
+func (r mapKeyResolver) LookupKey(domain, selector string) ([]string, error) {
+	if record, ok := r[selector+"._domainkey."+domain]; ok {
+		return []string{record}, nil
+	}
+	return nil, dkim.ErrKeyNotFound
+}
+
+const testMessage = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n"
+
+func testSealers(t *testing.T) ([]*SealOptions, mapKeyResolver) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaRecord, _ := dkim.KeyRecord(rsaKey.Public())
+	edRecord, _ := dkim.KeyRecord(edKey.Public())
+	resolver := mapKeyResolver{
+		"arc._domainkey.lists.example.org": rsaRecord,
+		"ed._domainkey.forwarder.example":  edRecord,
+	}
+	sealers := []*SealOptions{
+		{Domain: "lists.example.org", Selector: "arc", Signer: crypto.Signer(rsaKey)},
+		{Domain: "forwarder.example", Selector: "ed", Signer: crypto.Signer(edKey)},
+	}
+	return sealers, resolver
+}
+
+func sealMessage(t *testing.T, message string, resolver dkim.KeyResolver, options *SealOptions) string {
+	chain := Validate([]byte(message), resolver)
+	headers, err := Seal([]byte(message), options.Domain+"; spf=pass smtp.mailfrom=example.com", chain, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(headers, "") + message
+}
+
+func TestValidateNone(t *testing.T) {
+	_, resolver := testSealers(t)
+	if result := Validate([]byte(testMessage), resolver); result.Status != ChainNone {
+		t.Errorf("expected none, got %+v", result)
+	}
+}
+
+func TestSealAndValidate(t *testing.T) {
+	sealers, resolver := testSealers(t)
+	message := sealMessage(t, testMessage, resolver, sealers[0])
+	result := Validate([]byte(message), resolver)
+	if result.Status != ChainPass || result.Instances != 1 || result.Domain != "lists.example.org" {
+		t.Fatalf("expected pass of one instance, got %+v", result)
+	}
+	if !strings.Contains(message, "cv=none") {
+		t.Errorf("first seal should have cv=none:\n%s", message)
+	}
+	// second hop
+	message = sealMessage(t, "X-Forwarded: yes\r\n"+message, resolver, sealers[1])
+	result = Validate([]byte(message), resolver)
+	if result.Status != ChainPass || result.Instances != 2 || result.Domain != "forwarder.example" {
+		t.Fatalf("expected pass of two instances, got %+v", result)
+	}
+	if !strings.Contains(message, "ARC-Seal: i=2; a=ed25519-sha256;") || !strings.Contains(message, "cv=pass") {
+		t.Errorf("second seal should have cv=pass:\n%s", message)
+	}
+}
+
+func TestValidateLFLineEndings(t *testing.T) {
+	sealers, resolver := testSealers(t)
+	message := strings.Replace(sealMessage(t, testMessage, resolver, sealers[0]), "\r\n", "\n", -1)
+	if result := Validate([]byte(message), resolver); result.Status != ChainPass {
+		t.Errorf("expected pass, got %+v", result)
+	}
+}
+
+func TestValidateTampered(t *testing.T) {
+	sealers, resolver := testSealers(t)
+	message := sealMessage(t, testMessage, resolver, sealers[0])
+	// body modified after sealing
+	if result := Validate([]byte(message+"P.S.\r\n"), resolver); result.Status != ChainFail {
+		t.Errorf("expected fail for modified body, got %+v", result)
+	}
+	// auth results of the set modified
+	tampered := strings.Replace(message, "spf=pass", "spf=fail", 1)
+	if result := Validate([]byte(tampered), resolver); result.Status != ChainFail {
+		t.Errorf("expected fail for modified auth results, got %+v", result)
+	}
+	// missing set header
+	lines := strings.SplitN(message, "\r\n", 2)
+	if result := Validate([]byte(lines[1]), resolver); result.Status != ChainFail {
+		t.Errorf("expected fail for incomplete set, got %+v", result)
+	}
+}
+
+func TestSealFailedChain(t *testing.T) {
+	sealers, resolver := testSealers(t)
+	message := sealMessage(t, testMessage, resolver, sealers[0])
+	message = strings.Replace(message, "Hi.", "Hello.", 1)
+	message = sealMessage(t, message, resolver, sealers[1])
+	if !strings.Contains(message, "i=2; a=ed25519-sha256; t=") || !strings.Contains(message, "cv=fail") {
+		t.Errorf("expected cv=fail seal:\n%s", message)
+	}
+	if result := Validate([]byte(message), resolver); result.Status != ChainFail {
+		t.Errorf("expected fail, got %+v", result)
+	}
+}
@@ -0,0 +1,91 @@
+// Package authres formats Authentication-Results header fields (RFC 8601).
+package authres
+
+import (
+	"strings"
+)
+
+const HEADER = "Authentication-Results"
+
+// Property is a "ptype.property=value" pair of a result, like header.d=example.com
+type Property struct {
+	Key   string
+	Value string
+}
+
+// Result of a single authentication method.
+type Result struct {
+	Method     string // spf, dkim, dmarc, arc
+	Value      string // pass, fail, ...
+	Comment    string
+	Reason     string
+	Properties []Property
+}
+
+// Format builds Authentication-Results header (without trailing CRLF)
+// with one folded line per method.
+func Format(authservID string, results []Result) string {
+	return HEADER + ": " + Value(authservID, results)
+}
+
+// Value builds value of Authentication-Results header, also used
+// by ARC-Authentication-Results.
+func Value(authservID string, results []Result) string {
+	if authservID == "" {
+		authservID = "localhost"
+	}
+	var buf strings.Builder
+	buf.WriteString(authservID)
+	if len(results) == 0 {
+		buf.WriteString("; none")
+		return buf.String()
+	}
+	for _, result := range results {
+		buf.WriteString(";\r\n\t" + result.Method + "=" + result.Value)
+		if result.Comment != "" {
+			buf.WriteString(" (" + result.Comment + ")")
+		}
+		if result.Reason != "" {
+			buf.WriteString(" reason=" + quoteValue(result.Reason))
+		}
+		for _, prop := range result.Properties {
+			if prop.Value == "" {
+				continue
+			}
+			buf.WriteString(" " + prop.Key + "=" + quoteValue(prop.Value))
+		}
+	}
+	return buf.String()
+}
+
+// Claims reports whether Authentication-Results value is of authservID,
+// such fields of incoming messages are forged (RFC 8601 section 5).
+func Claims(value, authservID string) bool {
+	if authservID == "" {
+		authservID = "localhost"
+	}
+	value = strings.TrimSpace(value)
+	// leading comments
+	for strings.HasPrefix(value, "(") {
+		end := strings.Index(value, ")")
+		if end == -1 {
+			return false
+		}
+		value = strings.TrimSpace(value[end+1:])
+	}
+	if end := strings.IndexAny(value, "; \t\r\n("); end != -1 {
+		value = value[:end]
+	}
+	return strings.EqualFold(value, authservID)
+}
+
+// quote value unless it is a token or an address
+
+func quoteValue(value string) string {
+	for _, r := range value {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>,;:\\\"/[]?=", r) {
+			return "\"" + strings.Replace(strings.Replace(value, "\\", "\\\\", -1), "\"", "\\\"", -1) + "\""
+		}
+	}
+	return value
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Breaker opens after Threshold consecutive failures. While open one probe
+// call per Cooldown is let through, a success closes it again.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{Threshold: threshold, Cooldown: cooldown, now: time.Now}
+}
+
+// Ready reports if call can go to protected backend.
+func (b *Breaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.Threshold {
+		return true
+	}
+	if now := b.now(); now.Sub(b.openedAt) >= b.Cooldown {
+		// half open, next probe after another cooldown
+		b.openedAt = now
+		return true
+	}
+	return false
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures == b.Threshold {
+		b.openedAt = b.now()
+	}
+}
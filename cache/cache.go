@@ -0,0 +1,146 @@
+// Package cache keeps inbox settings and rate limit counters in redis or in
+// process memory, with a circuit breaker falling back to memory while redis
+// fails.
+package cache
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/storage"
+)
+
+var (
+	ErrMiss = errors.New("cache: miss")
+)
+
+// Store caches inbox settings and forwarding rules and counts rate limits.
+type Store interface {
+	// GetInboxSettings returns ErrMiss for unknown or expired inbox.
+	GetInboxSettings(mailboxID int) (storage.InboxSettings, error)
+	SetInboxSettings(mailboxID int, settings storage.InboxSettings) error
+	DeleteInboxSettings(mailboxID int) error
+	// GetForwardingRules returns ErrMiss for unknown or expired inbox, inbox
+	// without rules has empty rules.
+	GetForwardingRules(mailboxID int) ([]storage.ForwardingRule, error)
+	SetForwardingRules(mailboxID int, rules []storage.ForwardingRule) error
+	DeleteForwardingRules(mailboxID int) error
+	// Limit counts event of cost units for key.
+	Limit(key string, limit Limit, cost int) (LimitResult, error)
+	// GetFingerprint returns message of fingerprint, ErrMiss for unknown or
+	// expired fingerprint.
+	GetFingerprint(key string) (int, error)
+	SetFingerprint(key string, messageID int, ttl time.Duration) error
+}
+
+// FallbackStore uses Primary while Breaker is closed and Fallback otherwise
+// or when Primary fails. Settings are written to both stores, so Fallback
+// is warm when Primary goes down.
+type FallbackStore struct {
+	Primary  Store
+	Fallback Store
+	Breaker  *Breaker
+}
+
+func NewFallbackStore(primary, fallback Store, breaker *Breaker) *FallbackStore {
+	return &FallbackStore{Primary: primary, Fallback: fallback, Breaker: breaker}
+}
+
+// record result of primary call, true if result can be used
+
+func (s *FallbackStore) primaryResult(op string, err error) bool {
+	if err == nil || err == ErrMiss {
+		s.Breaker.Success()
+		return true
+	}
+	s.Breaker.Failure()
+	log.Errorf("Cache %s failed, using memory: %v", op, err)
+	return false
+}
+
+func (s *FallbackStore) GetInboxSettings(mailboxID int) (storage.InboxSettings, error) {
+	if s.Breaker.Ready() {
+		settings, err := s.Primary.GetInboxSettings(mailboxID)
+		if s.primaryResult("GetInboxSettings", err) {
+			if err == nil {
+				s.Fallback.SetInboxSettings(mailboxID, settings)
+			}
+			return settings, err
+		}
+	}
+	return s.Fallback.GetInboxSettings(mailboxID)
+}
+
+func (s *FallbackStore) SetInboxSettings(mailboxID int, settings storage.InboxSettings) error {
+	err := s.Fallback.SetInboxSettings(mailboxID, settings)
+	if s.Breaker.Ready() {
+		s.primaryResult("SetInboxSettings", s.Primary.SetInboxSettings(mailboxID, settings))
+	}
+	return err
+}
+
+func (s *FallbackStore) DeleteInboxSettings(mailboxID int) error {
+	err := s.Fallback.DeleteInboxSettings(mailboxID)
+	if s.Breaker.Ready() {
+		s.primaryResult("DeleteInboxSettings", s.Primary.DeleteInboxSettings(mailboxID))
+	}
+	return err
+}
+
+func (s *FallbackStore) GetForwardingRules(mailboxID int) ([]storage.ForwardingRule, error) {
+	if s.Breaker.Ready() {
+		rules, err := s.Primary.GetForwardingRules(mailboxID)
+		if s.primaryResult("GetForwardingRules", err) {
+			if err == nil {
+				s.Fallback.SetForwardingRules(mailboxID, rules)
+			}
+			return rules, err
+		}
+	}
+	return s.Fallback.GetForwardingRules(mailboxID)
+}
+
+func (s *FallbackStore) SetForwardingRules(mailboxID int, rules []storage.ForwardingRule) error {
+	err := s.Fallback.SetForwardingRules(mailboxID, rules)
+	if s.Breaker.Ready() {
+		s.primaryResult("SetForwardingRules", s.Primary.SetForwardingRules(mailboxID, rules))
+	}
+	return err
+}
+
+func (s *FallbackStore) DeleteForwardingRules(mailboxID int) error {
+	err := s.Fallback.DeleteForwardingRules(mailboxID)
+	if s.Breaker.Ready() {
+		s.primaryResult("DeleteForwardingRules", s.Primary.DeleteForwardingRules(mailboxID))
+	}
+	return err
+}
+
+func (s *FallbackStore) Limit(key string, limit Limit, cost int) (LimitResult, error) {
+	if s.Breaker.Ready() {
+		result, err := s.Primary.Limit(key, limit, cost)
+		if s.primaryResult("Limit", err) {
+			return result, nil
+		}
+	}
+	return s.Fallback.Limit(key, limit, cost)
+}
+
+func (s *FallbackStore) GetFingerprint(key string) (int, error) {
+	if s.Breaker.Ready() {
+		messageID, err := s.Primary.GetFingerprint(key)
+		if s.primaryResult("GetFingerprint", err) {
+			return messageID, err
+		}
+	}
+	return s.Fallback.GetFingerprint(key)
+}
+
+func (s *FallbackStore) SetFingerprint(key string, messageID int, ttl time.Duration) error {
+	err := s.Fallback.SetFingerprint(key, messageID, ttl)
+	if s.Breaker.Ready() {
+		s.primaryResult("SetFingerprint", s.Primary.SetFingerprint(key, messageID, ttl))
+	}
+	return err
+}
@@ -0,0 +1,285 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Polymail/go-falcon/storage"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) time() time.Time {
+	return c.now
+}
+
+func newTestMemoryStore(size int, ttl time.Duration) (*MemoryStore, *testClock) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	store := NewMemoryStore(size, ttl)
+	store.now = clock.time
+	return store, clock
+}
+
+func TestMemorySettings(t *testing.T) {
+	store, clock := newTestMemoryStore(2, time.Minute)
+	if _, err := store.GetInboxSettings(1); err != ErrMiss {
+		t.Errorf("expected miss, got %v", err)
+	}
+	store.SetInboxSettings(1, storage.InboxSettings{MaxMessages: 10, RateLimit: 5})
+	store.SetInboxSettings(2, storage.InboxSettings{MaxMessages: 20, RateLimit: 5})
+	if settings, err := store.GetInboxSettings(1); err != nil || settings.MaxMessages != 10 {
+		t.Errorf("unexpected settings %+v %v", settings, err)
+	}
+	// 2 is least recently used
+	store.SetInboxSettings(3, storage.InboxSettings{MaxMessages: 30, RateLimit: 5})
+	if _, err := store.GetInboxSettings(2); err != ErrMiss {
+		t.Errorf("expected evicted settings, got %v", err)
+	}
+	if store.settings.len() != 2 {
+		t.Errorf("unexpected lru size %d", store.settings.len())
+	}
+	clock.now = clock.now.Add(2 * time.Minute)
+	if _, err := store.GetInboxSettings(1); err != ErrMiss {
+		t.Errorf("expected expired settings, got %v", err)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	store, clock := newTestMemoryStore(10, time.Minute)
+	limit := Limit{Rate: 3, Period: 3 * time.Second}
+	for i := 0; i < 3; i++ {
+		if result, _ := store.Limit("inbox-1", limit, 1); !result.Allowed || result.Remaining != 2-i {
+			t.Errorf("hit %d should be allowed: %+v", i, result)
+		}
+	}
+	result, _ := store.Limit("inbox-1", limit, 1)
+	if result.Allowed || result.RetryAfter != time.Second {
+		t.Errorf("hit over limit should be blocked for a second: %+v", result)
+	}
+	if result, _ := store.Limit("inbox-2", limit, 1); !result.Allowed {
+		t.Error("other key should be allowed")
+	}
+	// one event per second
+	clock.now = clock.now.Add(time.Second)
+	if result, _ := store.Limit("inbox-1", limit, 1); !result.Allowed {
+		t.Error("event after interval should be allowed")
+	}
+	if result, _ := store.Limit("inbox-1", limit, 1); result.Allowed {
+		t.Error("hit over limit should be blocked")
+	}
+	// cost, bigger than burst takes whole burst
+	bytes := Limit{Rate: 1000, Period: time.Hour, Burst: 500}
+	if result, _ := store.Limit("bytes", bytes, 400); !result.Allowed || result.Remaining != 100 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	result, _ = store.Limit("bytes", bytes, 200)
+	if result.Allowed || result.RetryAfter != 360*time.Second {
+		t.Errorf("expected retry after 100 bytes refill: %+v", result)
+	}
+	clock.now = clock.now.Add(time.Hour)
+	if result, _ := store.Limit("bytes", bytes, 10000); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("big event should take whole burst: %+v", result)
+	}
+	// disabled
+	if result, _ := store.Limit("inbox-1", Limit{}, 1); !result.Allowed {
+		t.Error("disabled limit should allow")
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	breaker := NewBreaker(2, 10*time.Second)
+	breaker.now = clock.time
+	breaker.Failure()
+	if !breaker.Ready() {
+		t.Error("breaker should be closed below threshold")
+	}
+	breaker.Failure()
+	if breaker.Ready() {
+		t.Error("breaker should be open")
+	}
+	clock.now = clock.now.Add(10 * time.Second)
+	if !breaker.Ready() {
+		t.Error("breaker should let probe through after cooldown")
+	}
+	if breaker.Ready() {
+		t.Error("breaker should let only one probe through")
+	}
+	breaker.Success()
+	if !breaker.Ready() {
+		t.Error("breaker should be closed after success")
+	}
+}
+
+type failingStore struct {
+	err   error
+	calls int
+}
+
+func (s *failingStore) GetInboxSettings(mailboxID int) (storage.InboxSettings, error) {
+	s.calls++
+	return storage.InboxSettings{}, s.err
+}
+
+func (s *failingStore) SetInboxSettings(mailboxID int, settings storage.InboxSettings) error {
+	s.calls++
+	return s.err
+}
+
+func (s *failingStore) DeleteInboxSettings(mailboxID int) error {
+	s.calls++
+	return s.err
+}
+
+func (s *failingStore) GetForwardingRules(mailboxID int) ([]storage.ForwardingRule, error) {
+	s.calls++
+	return nil, s.err
+}
+
+func (s *failingStore) SetForwardingRules(mailboxID int, rules []storage.ForwardingRule) error {
+	s.calls++
+	return s.err
+}
+
+func (s *failingStore) DeleteForwardingRules(mailboxID int) error {
+	s.calls++
+	return s.err
+}
+
+func (s *failingStore) Limit(key string, limit Limit, cost int) (LimitResult, error) {
+	s.calls++
+	return LimitResult{Allowed: true}, s.err
+}
+
+func (s *failingStore) GetFingerprint(key string) (int, error) {
+	s.calls++
+	return 0, s.err
+}
+
+func (s *failingStore) SetFingerprint(key string, messageID int, ttl time.Duration) error {
+	s.calls++
+	return s.err
+}
+
+func TestFallbackStore(t *testing.T) {
+	primary := &failingStore{err: errors.New("connection refused")}
+	memory, _ := newTestMemoryStore(10, time.Minute)
+	store := NewFallbackStore(primary, memory, NewBreaker(2, time.Minute))
+
+	if err := store.SetInboxSettings(1, storage.InboxSettings{MaxMessages: 10, RateLimit: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if settings, err := store.GetInboxSettings(1); err != nil || settings.MaxMessages != 10 {
+		t.Errorf("expected settings from memory, got %+v %v", settings, err)
+	}
+	// breaker is open now, primary is not called
+	calls := primary.calls
+	limit := Limit{Rate: 1, Period: time.Second}
+	if result, err := store.Limit("inbox-1", limit, 1); !result.Allowed || err != nil {
+		t.Errorf("first hit should be allowed by memory: %+v %v", result, err)
+	}
+	if result, _ := store.Limit("inbox-1", limit, 1); result.Allowed {
+		t.Error("second hit should be blocked by memory")
+	}
+	if primary.calls != calls {
+		t.Errorf("primary called with open breaker")
+	}
+	// miss of healthy primary is not a failure
+	primary.err = ErrMiss
+	store.Breaker.Success()
+	if _, err := store.GetInboxSettings(2); err != ErrMiss {
+		t.Errorf("expected miss, got %v", err)
+	}
+	if !store.Breaker.Ready() {
+		t.Error("miss should keep breaker closed")
+	}
+}
+
+type testSource struct {
+	settings map[int]storage.InboxSettings
+	rules    map[int][]storage.ForwardingRule
+	calls    int
+}
+
+func (s *testSource) GeInboxSettings(mailboxID int) (storage.InboxSettings, error) {
+	s.calls++
+	settings, ok := s.settings[mailboxID]
+	if !ok {
+		return settings, storage.ErrInboxNotFound
+	}
+	return settings, nil
+}
+
+func (s *testSource) GetForwardingRules(mailboxID int) ([]storage.ForwardingRule, error) {
+	s.calls++
+	return s.rules[mailboxID], nil
+}
+
+func TestLoadForwardingRules(t *testing.T) {
+	store, clock := newTestMemoryStore(10, time.Minute)
+	source := &testSource{rules: map[int][]storage.ForwardingRule{
+		1: {{Id: 3, Field: "subject", Pattern: "invoice", Action: "forward", Target: "max@example.com"}},
+	}}
+
+	// inbox without rules is cached too
+	for _, mailboxID := range []int{1, 1, 2, 2} {
+		rules, err := LoadForwardingRules(store, source, mailboxID)
+		if err != nil || len(rules) != len(source.rules[mailboxID]) {
+			t.Errorf("unexpected rules of inbox %d: %+v %v", mailboxID, rules, err)
+		}
+	}
+	if source.calls != 2 {
+		t.Errorf("expected one load per inbox, got %d", source.calls)
+	}
+	// invalidation
+	source.rules[2] = []storage.ForwardingRule{{Id: 4, Field: "sender", Action: "drop"}}
+	store.DeleteForwardingRules(2)
+	if rules, _ := LoadForwardingRules(store, source, 2); len(rules) != 1 || rules[0].Id != 4 {
+		t.Errorf("expected reload after invalidation, got %+v", rules)
+	}
+	// expiration
+	clock.now = clock.now.Add(2 * time.Minute)
+	LoadForwardingRules(store, source, 1)
+	if source.calls != 4 {
+		t.Errorf("expected reload after ttl, got %d loads", source.calls)
+	}
+}
+
+func TestLoadInboxSettings(t *testing.T) {
+	store, clock := newTestMemoryStore(10, time.Hour)
+	store.NegativeTTL = time.Minute
+	source := &testSource{settings: map[int]storage.InboxSettings{1: {}}}
+
+	// zero limits are cached too
+	for i := 0; i < 2; i++ {
+		if _, err := LoadInboxSettings(store, source, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if source.calls != 1 {
+		t.Errorf("expected one load of zero settings, got %d", source.calls)
+	}
+	// unknown inbox is cached for negative ttl
+	for i := 0; i < 2; i++ {
+		if _, err := LoadInboxSettings(store, source, 2); err != storage.ErrInboxNotFound {
+			t.Errorf("expected not found, got %v", err)
+		}
+	}
+	if source.calls != 2 {
+		t.Errorf("expected negative caching, got %d loads", source.calls)
+	}
+	source.settings[2] = storage.InboxSettings{MaxMessages: 5}
+	clock.now = clock.now.Add(2 * time.Minute)
+	if settings, err := LoadInboxSettings(store, source, 2); err != nil || settings.MaxMessages != 5 {
+		t.Errorf("expected reload after negative ttl, got %+v %v", settings, err)
+	}
+	// invalidation
+	source.settings[1] = storage.InboxSettings{MaxMessages: 7}
+	store.DeleteInboxSettings(1)
+	if settings, _ := LoadInboxSettings(store, source, 1); settings.MaxMessages != 7 {
+		t.Errorf("expected reload after invalidation, got %+v", settings)
+	}
+}
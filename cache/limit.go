@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"time"
+)
+
+// Limit allows Rate events per Period with bursts up to Burst events, Burst
+// is Rate if not set. Limits are enforced with GCRA (generic cell rate
+// algorithm): key keeps theoretical arrival time of next event.
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+// LimitResult of one check, RetryAfter is set if event is not allowed.
+type LimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Period > 0
+}
+
+// emission interval in microseconds, burst and cost capped by burst, so an
+// event bigger than burst takes whole burst instead of never passing
+func (l Limit) gcra(cost int) (float64, float64, float64) {
+	burst := l.Burst
+	if burst <= 0 {
+		burst = l.Rate
+	}
+	if cost < 1 {
+		cost = 1
+	}
+	if cost > burst {
+		cost = burst
+	}
+	interval := float64(l.Period/time.Microsecond) / float64(l.Rate)
+	return interval, float64(burst), float64(cost)
+}
+
+// gcra step with times in microseconds, returns result and new arrival time
+func gcraStep(now, tat float64, limit Limit, cost int) (LimitResult, float64) {
+	interval, burst, n := limit.gcra(cost)
+	if tat < now {
+		tat = now
+	}
+	newTat := tat + n*interval
+	allowAt := newTat - burst*interval
+	if now < allowAt {
+		return LimitResult{RetryAfter: time.Duration(allowAt-now) * time.Microsecond}, tat
+	}
+	return LimitResult{Allowed: true, Remaining: int((now - allowAt) / interval)}, newTat
+}
+
+func microseconds(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Microsecond))
+}
@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/Polymail/go-falcon/storage"
+)
+
+// MemoryStore keeps inbox settings, forwarding rules and arrival times of
+// rate limits in LRU caches of this process.
+type MemoryStore struct {
+	SettingsTTL time.Duration
+	NegativeTTL time.Duration // ttl of unknown inboxes, SettingsTTL if 0
+
+	mu           sync.Mutex
+	settings     *lru
+	rules        *lru
+	buckets      *lru
+	fingerprints *lru
+	now          func() time.Time
+}
+
+type settingsEntry struct {
+	settings storage.InboxSettings
+	expires  time.Time
+}
+
+type rulesEntry struct {
+	rules   []storage.ForwardingRule
+	expires time.Time
+}
+
+type fingerprintEntry struct {
+	messageID int
+	expires   time.Time
+}
+
+func NewMemoryStore(size int, settingsTTL time.Duration) *MemoryStore {
+	return &MemoryStore{
+		SettingsTTL:  settingsTTL,
+		settings:     newLRU(size),
+		rules:        newLRU(size),
+		buckets:      newLRU(size),
+		fingerprints: newLRU(size),
+		now:          time.Now,
+	}
+}
+
+func (s *MemoryStore) GetInboxSettings(mailboxID int) (storage.InboxSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.settings.get(mailboxID)
+	if !ok {
+		return storage.InboxSettings{}, ErrMiss
+	}
+	entry := value.(*settingsEntry)
+	if s.now().After(entry.expires) {
+		s.settings.remove(mailboxID)
+		return storage.InboxSettings{}, ErrMiss
+	}
+	return entry.settings, nil
+}
+
+func (s *MemoryStore) SetInboxSettings(mailboxID int, settings storage.InboxSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings.add(mailboxID, &settingsEntry{settings: settings, expires: s.now().Add(settingsTTL(settings, s.SettingsTTL, s.NegativeTTL))})
+	return nil
+}
+
+func (s *MemoryStore) DeleteInboxSettings(mailboxID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings.remove(mailboxID)
+	return nil
+}
+
+func (s *MemoryStore) GetForwardingRules(mailboxID int) ([]storage.ForwardingRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.rules.get(mailboxID)
+	if !ok {
+		return nil, ErrMiss
+	}
+	entry := value.(*rulesEntry)
+	if s.now().After(entry.expires) {
+		s.rules.remove(mailboxID)
+		return nil, ErrMiss
+	}
+	return entry.rules, nil
+}
+
+func (s *MemoryStore) SetForwardingRules(mailboxID int, rules []storage.ForwardingRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules.add(mailboxID, &rulesEntry{rules: rules, expires: s.now().Add(s.SettingsTTL)})
+	return nil
+}
+
+func (s *MemoryStore) DeleteForwardingRules(mailboxID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules.remove(mailboxID)
+	return nil
+}
+
+func (s *MemoryStore) Limit(key string, limit Limit, cost int) (LimitResult, error) {
+	if !limit.Enabled() {
+		return LimitResult{Allowed: true}, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := microseconds(s.now())
+	tat := now
+	if value, ok := s.buckets.get(key); ok {
+		tat = value.(float64)
+	}
+	result, tat := gcraStep(now, tat, limit, cost)
+	s.buckets.add(key, tat)
+	return result, nil
+}
+
+func (s *MemoryStore) GetFingerprint(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.fingerprints.get(key)
+	if !ok {
+		return 0, ErrMiss
+	}
+	entry := value.(*fingerprintEntry)
+	if s.now().After(entry.expires) {
+		s.fingerprints.remove(key)
+		return 0, ErrMiss
+	}
+	return entry.messageID, nil
+}
+
+func (s *MemoryStore) SetFingerprint(key string, messageID int, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fingerprints.add(key, &fingerprintEntry{messageID: messageID, expires: s.now().Add(ttl)})
+	return nil
+}
+
+// lru is not safe for concurrent use
+
+type lru struct {
+	size  int
+	ll    *list.List
+	items map[interface{}]*list.Element
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, ll: list.New(), items: make(map[interface{}]*list.Element)}
+}
+
+func (c *lru) get(key interface{}) (interface{}, bool) {
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*lruEntry).value, true
+	}
+	return nil, false
+}
+
+func (c *lru) add(key, value interface{}) {
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*lruEntry).value = value
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key, value})
+	if c.size > 0 && c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lru) remove(key interface{}) {
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+func (c *lru) len() int {
+	return c.ll.Len()
+}
@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Polymail/go-falcon/storage"
+	"github.com/garyburd/redigo/redis"
+)
+
+// RedisPool gives connections for the redis store.
+type RedisPool interface {
+	Get() redis.Conn
+}
+
+// gcra step of Limit, times in microseconds: now, interval, burst, cost
+var gcraScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local new_tat = tat + cost * interval
+local allow_at = new_tat - burst * interval
+if now < allow_at then
+	return {0, 0, string.format('%.0f', allow_at - now)}
+end
+redis.call('SET', KEYS[1], string.format('%.0f', new_tat), 'PX', math.max(1, math.ceil((new_tat - now) / 1000)))
+return {1, math.floor((now - allow_at) / interval), '0'}
+`)
+
+// RedisStore keeps settings and forwarding rules as JSON with TTL and arrival times of rate
+// limits shared by all servers.
+type RedisStore struct {
+	Pool        RedisPool
+	SettingsTTL time.Duration
+	NegativeTTL time.Duration // ttl of unknown inboxes, SettingsTTL if 0
+}
+
+func getRedisCacheInboxKey(mailboxID int) string {
+	return fmt.Sprintf("inboxes-settings_%d", mailboxID)
+}
+
+func (s *RedisStore) GetInboxSettings(mailboxID int) (storage.InboxSettings, error) {
+	var inboxSettings storage.InboxSettings
+
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	cacheData, err := redis.Bytes(redisCon.Do("GET", getRedisCacheInboxKey(mailboxID)))
+	if err == redis.ErrNil {
+		return inboxSettings, ErrMiss
+	}
+	if err != nil {
+		return inboxSettings, err
+	}
+	err = json.Unmarshal(cacheData, &inboxSettings)
+	return inboxSettings, err
+}
+
+func (s *RedisStore) SetInboxSettings(mailboxID int, settings storage.InboxSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	ttl := settingsTTL(settings, s.SettingsTTL, s.NegativeTTL)
+
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("SET", getRedisCacheInboxKey(mailboxID), data, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (s *RedisStore) DeleteInboxSettings(mailboxID int) error {
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	_, err := redisCon.Do("DEL", getRedisCacheInboxKey(mailboxID))
+	return err
+}
+
+func getRedisForwardingRulesKey(mailboxID int) string {
+	return fmt.Sprintf("forwarding-rules_%d", mailboxID)
+}
+
+func (s *RedisStore) GetForwardingRules(mailboxID int) ([]storage.ForwardingRule, error) {
+	var rules []storage.ForwardingRule
+
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	cacheData, err := redis.Bytes(redisCon.Do("GET", getRedisForwardingRulesKey(mailboxID)))
+	if err == redis.ErrNil {
+		return nil, ErrMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(cacheData, &rules)
+	return rules, err
+}
+
+func (s *RedisStore) SetForwardingRules(mailboxID int, rules []storage.ForwardingRule) error {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("SET", getRedisForwardingRulesKey(mailboxID), data, "PX", int64(s.SettingsTTL/time.Millisecond))
+	return err
+}
+
+func (s *RedisStore) DeleteForwardingRules(mailboxID int) error {
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	_, err := redisCon.Do("DEL", getRedisForwardingRulesKey(mailboxID))
+	return err
+}
+
+func (s *RedisStore) Limit(key string, limit Limit, cost int) (LimitResult, error) {
+	if !limit.Enabled() {
+		return LimitResult{Allowed: true}, nil
+	}
+	interval, burst, n := limit.gcra(cost)
+
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	reply, err := redis.Values(gcraScript.Do(redisCon, key, microseconds(time.Now()), interval, burst, n))
+	if err != nil {
+		return LimitResult{Allowed: true}, err
+	}
+	var (
+		allowed, remaining int
+		retryAfter         string
+	)
+	if _, err = redis.Scan(reply, &allowed, &remaining, &retryAfter); err != nil {
+		return LimitResult{Allowed: true}, err
+	}
+	retry, _ := strconv.ParseFloat(retryAfter, 64)
+	return LimitResult{
+		Allowed:    allowed == 1,
+		Remaining:  remaining,
+		RetryAfter: time.Duration(retry) * time.Microsecond,
+	}, nil
+}
+
+func getRedisFingerprintKey(key string) string {
+	return "fingerprints_" + key
+}
+
+func (s *RedisStore) GetFingerprint(key string) (int, error) {
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	messageID, err := redis.Int(redisCon.Do("GET", getRedisFingerprintKey(key)))
+	if err == redis.ErrNil {
+		return 0, ErrMiss
+	}
+	return messageID, err
+}
+
+func (s *RedisStore) SetFingerprint(key string, messageID int, ttl time.Duration) error {
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	_, err := redisCon.Do("SET", getRedisFingerprintKey(key), messageID, "PX", int64(ttl/time.Millisecond))
+	return err
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/storage"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	INVALIDATION_RETRY = 5 * time.Second
+)
+
+// SettingsSource loads inbox settings on cache miss.
+type SettingsSource interface {
+	GeInboxSettings(mailboxID int) (storage.InboxSettings, error)
+}
+
+// ForwardingRulesSource loads forwarding rules on cache miss.
+type ForwardingRulesSource interface {
+	GetForwardingRules(mailboxID int) ([]storage.ForwardingRule, error)
+}
+
+// ttl of cached settings, unknown inboxes expire after negativeTTL
+
+func settingsTTL(settings storage.InboxSettings, ttl, negativeTTL time.Duration) time.Duration {
+	if settings.NotFound && negativeTTL > 0 {
+		return negativeTTL
+	}
+	return ttl
+}
+
+// LoadInboxSettings returns cached settings or loads them from source.
+// Unknown inboxes are cached too and return storage.ErrInboxNotFound.
+func LoadInboxSettings(store Store, source SettingsSource, mailboxID int) (storage.InboxSettings, error) {
+	settings, err := store.GetInboxSettings(mailboxID)
+	if err == nil {
+		if settings.NotFound {
+			return settings, storage.ErrInboxNotFound
+		}
+		return settings, nil
+	}
+	settings, err = source.GeInboxSettings(mailboxID)
+	switch err {
+	case nil:
+		store.SetInboxSettings(mailboxID, settings)
+	case storage.ErrInboxNotFound:
+		store.SetInboxSettings(mailboxID, storage.InboxSettings{NotFound: true})
+	}
+	return settings, err
+}
+
+// LoadForwardingRules returns cached forwarding rules or loads them from
+// source. Inboxes without rules are cached too.
+func LoadForwardingRules(store Store, source ForwardingRulesSource, mailboxID int) ([]storage.ForwardingRule, error) {
+	rules, err := store.GetForwardingRules(mailboxID)
+	if err == nil {
+		return rules, nil
+	}
+	rules, err = source.GetForwardingRules(mailboxID)
+	if err == nil {
+		store.SetForwardingRules(mailboxID, rules)
+	}
+	return rules, err
+}
+
+// PublishInvalidation drops cached settings and forwarding rules of inboxes
+// on every server.
+func PublishInvalidation(pool RedisPool, channel string, mailboxIDs ...int) error {
+	redisCon := pool.Get()
+	defer redisCon.Close()
+
+	for _, mailboxID := range mailboxIDs {
+		if _, err := redisCon.Do("DEL", getRedisCacheInboxKey(mailboxID), getRedisForwardingRulesKey(mailboxID)); err != nil {
+			return err
+		}
+		if _, err := redisCon.Do("PUBLISH", channel, mailboxID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubscribeInvalidations drops settings and forwarding rules of inbox ids published to channel
+// from store, reconnects until stop is closed.
+func SubscribeInvalidations(pool RedisPool, channel string, store Store, stop <-chan struct{}) {
+	for {
+		err := receiveInvalidations(pool, channel, store, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Errorf("Settings invalidation subscription of %s: %v", channel, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(INVALIDATION_RETRY):
+		}
+	}
+}
+
+func receiveInvalidations(pool RedisPool, channel string, store Store, stop <-chan struct{}) error {
+	conn := redis.PubSubConn{Conn: pool.Get()}
+	defer conn.Close()
+
+	if err := conn.Subscribe(channel); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Unsubscribe()
+		case <-done:
+		}
+	}()
+	for {
+		switch msg := conn.Receive().(type) {
+		case redis.Message:
+			mailboxID, err := strconv.Atoi(strings.TrimSpace(string(msg.Data)))
+			if err != nil {
+				log.Errorf("Settings invalidation of %q: %v", msg.Data, err)
+				continue
+			}
+			log.Debugf("Settings of inbox %d invalidated", mailboxID)
+			store.DeleteInboxSettings(mailboxID)
+			store.DeleteForwardingRules(mailboxID)
+		case redis.Subscription:
+			if msg.Count == 0 {
+				return nil
+			}
+		case error:
+			return msg
+		}
+	}
+}
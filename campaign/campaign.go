@@ -0,0 +1,158 @@
+// Package campaign detects spam campaigns: bursts of messages to an inbox,
+// from one sender or with one subject fingerprint.
+package campaign
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/events"
+)
+
+const (
+	KIND_INBOX   = "inbox"
+	KIND_SENDER  = "sender"
+	KIND_SUBJECT = "subject"
+
+	ACTION_SKIP_NOTIFICATIONS = "skip_notifications"
+	ACTION_REJECT             = "reject"
+	ACTION_QUARANTINE         = "quarantine"
+)
+
+var (
+	subjectPrefixRE = regexp.MustCompile(`^\s*((re|fw|fwd|aw|wg)\s*:\s*)+`)
+	subjectDigitsRE = regexp.MustCompile(`[0-9]+`)
+	subjectSpaceRE  = regexp.MustCompile(`\s+`)
+)
+
+// Thresholds are messages per window above which campaign starts, 0
+// disables dimension.
+type Thresholds struct {
+	Inbox   int
+	Sender  int
+	Subject int
+}
+
+// Campaign is active burst of one dimension of inbox.
+type Campaign struct {
+	MailboxID int
+	Kind      string
+	Value     string // sender address or subject fingerprint
+	Started   time.Time
+	LastSeen  time.Time
+	Messages  int
+}
+
+// Detector counts messages with Store limits, so counts are shared by
+// servers using redis. Active campaigns are tracked by each server and end
+// after Window without messages.
+type Detector struct {
+	Store  cache.Store
+	Window time.Duration
+
+	mu     sync.Mutex
+	active map[string]*Campaign
+	now    func() time.Time
+}
+
+func NewDetector(store cache.Store, window time.Duration) *Detector {
+	return &Detector{Store: store, Window: window, active: make(map[string]*Campaign), now: time.Now}
+}
+
+// Fingerprint of subject ignores case, reply prefixes, numbers and spacing.
+func Fingerprint(subject string) string {
+	subject = strings.ToLower(subject)
+	subject = subjectPrefixRE.ReplaceAllString(subject, "")
+	subject = subjectDigitsRE.ReplaceAllString(subject, "#")
+	subject = strings.TrimSpace(subjectSpaceRE.ReplaceAllString(subject, " "))
+	sum := sha1.Sum([]byte(subject))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Check counts message and returns campaign it belongs to, nil if none. All
+// dimensions are counted, inbox campaign wins over sender and subject.
+func (d *Detector) Check(mailboxID int, sender, subject string, thresholds Thresholds) *Campaign {
+	dimensions := []struct {
+		kind      string
+		value     string
+		threshold int
+	}{
+		{KIND_INBOX, strconv.Itoa(mailboxID), thresholds.Inbox},
+		{KIND_SENDER, strings.ToLower(sender), thresholds.Sender},
+		{KIND_SUBJECT, Fingerprint(subject), thresholds.Subject},
+	}
+	var found *Campaign
+	for _, dimension := range dimensions {
+		if dimension.threshold <= 0 || dimension.value == "" {
+			continue
+		}
+		key := fmt.Sprintf("campaign-%s_%d_%s", dimension.kind, mailboxID, dimension.value)
+		result, _ := d.Store.Limit(key, cache.Limit{Rate: dimension.threshold, Period: d.Window}, 1)
+		if result.Allowed {
+			continue
+		}
+		c := d.seen(key, mailboxID, dimension.kind, dimension.value)
+		if found == nil {
+			found = c
+		}
+	}
+	return found
+}
+
+// record message of campaign, new campaign emits campaign.started
+
+func (d *Detector) seen(key string, mailboxID int, kind, value string) *Campaign {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	c, ok := d.active[key]
+	if !ok {
+		c = &Campaign{MailboxID: mailboxID, Kind: kind, Value: value, Started: now}
+		d.active[key] = c
+		events.Emit(events.CAMPAIGN_STARTED, mailboxID, 0, map[string]string{"kind": kind, "value": value})
+	}
+	c.LastSeen = now
+	c.Messages++
+	snapshot := *c
+	return &snapshot
+}
+
+// Sweep ends campaigns without messages for Window and emits campaign.ended.
+func (d *Detector) Sweep() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	for key, c := range d.active {
+		if now.Sub(c.LastSeen) < d.Window {
+			continue
+		}
+		delete(d.active, key)
+		events.Emit(events.CAMPAIGN_ENDED, c.MailboxID, 0, map[string]string{
+			"kind":     c.Kind,
+			"value":    c.Value,
+			"messages": strconv.Itoa(c.Messages),
+			"duration": strconv.Itoa(int(c.LastSeen.Sub(c.Started).Seconds())),
+		})
+	}
+}
+
+// Run sweeps campaigns every window until stop is closed.
+func (d *Detector) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(d.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.Sweep()
+		}
+	}
+}
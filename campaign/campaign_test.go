@@ -0,0 +1,71 @@
+package campaign
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/events"
+)
+
+type testPublisher struct {
+	events []*events.Event
+}
+
+func (p *testPublisher) Publish(e *events.Event) error {
+	p.events = append(p.events, e)
+	return nil
+}
+
+func TestFingerprint(t *testing.T) {
+	if Fingerprint("Re: Your order #12345 shipped") != Fingerprint("your ORDER #987  shipped") {
+		t.Error("subjects with different numbers should have same fingerprint")
+	}
+	if Fingerprint("Your order shipped") == Fingerprint("Your invoice") {
+		t.Error("different subjects should have different fingerprints")
+	}
+}
+
+func TestDetector(t *testing.T) {
+	publisher := &testPublisher{}
+	events.SetPublisher(publisher)
+	defer events.SetPublisher(nil)
+
+	now := time.Unix(1700000000, 0)
+	detector := NewDetector(cache.NewMemoryStore(100, time.Minute), 20*time.Second)
+	detector.now = func() time.Time { return now }
+	thresholds := Thresholds{Inbox: 0, Sender: 2, Subject: 3}
+
+	if c := detector.Check(1, "a@example.com", "Hello 1", thresholds); c != nil {
+		t.Errorf("unexpected campaign %+v", c)
+	}
+	if c := detector.Check(1, "A@example.com", "Hello 2", thresholds); c != nil {
+		t.Errorf("unexpected campaign %+v", c)
+	}
+	c := detector.Check(1, "a@example.com", "Hello 3", thresholds)
+	if c == nil || c.Kind != KIND_SENDER || c.Value != "a@example.com" || c.Messages != 1 {
+		t.Fatalf("expected sender campaign, got %+v", c)
+	}
+	// subject campaign of other sender, sender campaign of inbox 2 is separate
+	c = detector.Check(1, "b@example.com", "Hello 4", thresholds)
+	if c == nil || c.Kind != KIND_SUBJECT {
+		t.Fatalf("expected subject campaign, got %+v", c)
+	}
+	if c := detector.Check(2, "a@example.com", "Other", thresholds); c != nil {
+		t.Errorf("unexpected campaign of other inbox %+v", c)
+	}
+	if len(publisher.events) != 2 || publisher.events[0].Type != events.CAMPAIGN_STARTED || publisher.events[0].Data["kind"] != KIND_SENDER {
+		t.Fatalf("expected two started events, got %d", len(publisher.events))
+	}
+	// campaigns end after window without messages
+	now = now.Add(10 * time.Second)
+	detector.Sweep()
+	if len(publisher.events) != 2 {
+		t.Errorf("campaigns should be active")
+	}
+	now = now.Add(20 * time.Second)
+	detector.Sweep()
+	if len(publisher.events) != 4 || publisher.events[2].Type != events.CAMPAIGN_ENDED {
+		t.Errorf("expected ended events, got %d", len(publisher.events))
+	}
+}
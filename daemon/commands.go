@@ -0,0 +1,176 @@
+package daemon
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dmarc"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/redisworker"
+	"github.com/Polymail/go-falcon/worker"
+)
+
+// CommandArgs returns subcommand with arguments, empty to run server
+func CommandArgs() []string {
+	return flag.Args()
+}
+
+// RunCommand runs subcommand of daemon binary
+func RunCommand(globalConfig *config.Config, args []string) error {
+	var err error
+	switch args[0] {
+	case "dmarc-report":
+		err = dmarcReportCommand(globalConfig, args[1:])
+	case "retention":
+		err = retentionCommand(globalConfig, args[1:])
+	case "invalidate-settings":
+		err = invalidateSettingsCommand(globalConfig, args[1:])
+	case "migrate":
+		err = migrateCommand(globalConfig, args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		log.Errorf("%s: %v", args[0], err)
+	}
+	return err
+}
+
+// write daily DMARC aggregate reports
+
+func dmarcReportCommand(globalConfig *config.Config, args []string) error {
+	flags := flag.NewFlagSet("dmarc-report", flag.ContinueOnError)
+	date := flags.String("date", time.Now().UTC().AddDate(0, 0, -1).Format(redisworker.DMARC_DAY_FORMAT), "Day of report (UTC), yesterday by default")
+	dir := flags.String("dir", globalConfig.Dmarc.Reports.Dir, "Directory for xml reports")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !globalConfig.Redis.Enabled {
+		return errors.New("redis should be enabled")
+	}
+	day, err := time.Parse(redisworker.DMARC_DAY_FORMAT, *date)
+	if err != nil {
+		return err
+	}
+	aggregates, err := redisworker.GetDmarcAggregates(globalConfig, day)
+	if err != nil {
+		return err
+	}
+	for _, aggregate := range aggregates {
+		meta := &dmarc.ReportMetadata{
+			OrgName:  globalConfig.Dmarc.Reports.Org_Name,
+			Email:    globalConfig.Dmarc.Reports.Email,
+			ReportID: fmt.Sprintf("%s.%s.%d", aggregate.Domain, *date, day.Unix()),
+			Begin:    day,
+			End:      day.Add(24*time.Hour - time.Second),
+		}
+		report, err := dmarc.BuildAggregateReport(meta, aggregate.Domain, aggregate.Record, aggregate.Counts)
+		if err != nil {
+			return err
+		}
+		// receiver "!" policy-domain "!" begin-timestamp "!" end-timestamp, RFC 7489 section 7.2.1.1
+		filename := filepath.Join(*dir, fmt.Sprintf("%s!%s!%d!%d.xml", meta.OrgName, aggregate.Domain, meta.Begin.Unix(), meta.End.Unix()))
+		if err = ioutil.WriteFile(filename, report, 0644); err != nil {
+			return err
+		}
+		rua := []string{}
+		if aggregate.Record != nil {
+			rua = aggregate.Record.ReportURIs
+		}
+		log.Infof("DMARC report for %s written to %s, rua: %v", aggregate.Domain, filename, rua)
+	}
+	return nil
+}
+
+// drop cached settings of inboxes on every server
+
+func invalidateSettingsCommand(globalConfig *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: invalidate-settings <inbox id>...")
+	}
+	if !globalConfig.Redis.Enabled {
+		return errors.New("redis should be enabled")
+	}
+	var mailboxIDs []int
+	for _, arg := range args {
+		mailboxID, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid inbox id %q", arg)
+		}
+		mailboxIDs = append(mailboxIDs, mailboxID)
+	}
+	if err := cache.PublishInvalidation(globalConfig.RedisPool, globalConfig.Cache.Invalidation_Channel, mailboxIDs...); err != nil {
+		return err
+	}
+	log.Infof("Settings of inboxes %v invalidated", mailboxIDs)
+	return nil
+}
+
+// delete old messages of every inbox once
+
+func retentionCommand(globalConfig *config.Config, args []string) error {
+	report := worker.NewRetentionScheduler(globalConfig).RunOnce()
+	log.Infof("Retention removed %d messages (%d bytes) of %d inboxes: %v, errors: %d", report.Messages, report.Bytes, report.Inboxes, report.Reasons, report.Errors)
+	if report.Errors > 0 {
+		return fmt.Errorf("%d inboxes failed", report.Errors)
+	}
+	return nil
+}
+
+// apply, roll back or list schema migrations
+
+func migrateCommand(globalConfig *config.Config, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: migrate up [version] | down [steps] | status")
+	}
+	var (
+		number int
+		err    error
+	)
+	if len(args) == 2 {
+		if number, err = strconv.Atoi(args[1]); err != nil || number < 0 {
+			return fmt.Errorf("invalid number %q", args[1])
+		}
+	}
+	switch args[0] {
+	case "up":
+		migrations, err := globalConfig.DbPool.MigrateUp(number)
+		for _, migration := range migrations {
+			log.Infof("Migrated up %d %s", migration.Version, migration.Name)
+		}
+		if err == nil && len(migrations) == 0 {
+			log.Infof("Schema is up to date")
+		}
+		return err
+	case "down":
+		if len(args) == 1 {
+			number = 1
+		}
+		migrations, err := globalConfig.DbPool.MigrateDown(number)
+		for _, migration := range migrations {
+			log.Infof("Migrated down %d %s", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		statuses, err := globalConfig.DbPool.MigrationsStatus()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-28s  %s\n", status.Version, applied, status.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
@@ -0,0 +1,104 @@
+// Package dedup finds repeated deliveries of message to inbox by Message-ID
+// and normalized body, e.g. retries of clients which didn't get 250 reply.
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/log"
+)
+
+const (
+	ACTION_SKIP  = "skip"  // duplicate is dropped
+	ACTION_LINK  = "link"  // duplicate is stored with id of original, without notifications
+	ACTION_STORE = "store" // duplicates are not checked
+)
+
+var (
+	metrics = expvar.NewMap("dedup")
+)
+
+// Fingerprint of message, empty without Message-ID if requireMessageID.
+func Fingerprint(messageID string, raw []byte, requireMessageID bool) string {
+	messageID = strings.Trim(strings.TrimSpace(messageID), "<>")
+	if messageID == "" && requireMessageID {
+		return ""
+	}
+	body := sha256.Sum256(normalizeBody(raw))
+	sum := sha256.Sum256(append([]byte(messageID+"\x00"), body[:]...))
+	return hex.EncodeToString(sum[:])
+}
+
+// body of raw message with LF line ends, without trailing spaces and empty
+// lines, so relays changing line ends and padding give same hash
+
+func normalizeBody(raw []byte) []byte {
+	raw = bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1)
+	if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		raw = raw[i+2:]
+	} else {
+		raw = nil
+	}
+	lines := bytes.Split(raw, []byte("\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimRight(line, " \t")
+	}
+	return bytes.TrimRight(bytes.Join(lines, []byte("\n")), "\n")
+}
+
+// Detector remembers fingerprints of stored messages of inbox for Window.
+type Detector struct {
+	Store  cache.Store
+	Window time.Duration
+}
+
+func NewDetector(store cache.Store, window time.Duration) *Detector {
+	return &Detector{Store: store, Window: window}
+}
+
+func fingerprintKey(mailboxID int, fingerprint string) string {
+	return strconv.Itoa(mailboxID) + ":" + fingerprint
+}
+
+// Original returns id of stored message with fingerprint, 0 if message is
+// not duplicate or cache fails.
+func (d *Detector) Original(mailboxID int, fingerprint string) int {
+	if fingerprint == "" {
+		return 0
+	}
+	metrics.Add("checked", 1)
+	messageID, err := d.Store.GetFingerprint(fingerprintKey(mailboxID, fingerprint))
+	if err != nil {
+		if err != cache.ErrMiss {
+			metrics.Add("errors", 1)
+			log.Errorf("Dedup of inbox %d: %v", mailboxID, err)
+		}
+		return 0
+	}
+	metrics.Add("duplicates", 1)
+	return messageID
+}
+
+// Remember fingerprint of stored message, after store so failed messages
+// are not duplicates of retry.
+func (d *Detector) Remember(mailboxID int, fingerprint string, messageID int) {
+	if fingerprint == "" {
+		return
+	}
+	if err := d.Store.SetFingerprint(fingerprintKey(mailboxID, fingerprint), messageID, d.Window); err != nil {
+		metrics.Add("errors", 1)
+		log.Errorf("Dedup of inbox %d: %v", mailboxID, err)
+	}
+}
+
+// Count action taken for duplicate.
+func Count(action string) {
+	metrics.Add(action, 1)
+}
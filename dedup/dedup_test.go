@@ -0,0 +1,43 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Polymail/go-falcon/cache"
+)
+
+func TestFingerprint(t *testing.T) {
+	raw := []byte("Message-ID: <a@example.com>\r\nReceived: by mx1\r\n\r\nHello\r\nworld  \r\n\r\n")
+	retry := []byte("Received: by mx2\nMessage-ID: <a@example.com>\n\nHello\nworld\n")
+	if Fingerprint("<a@example.com>", raw, true) != Fingerprint(" a@example.com ", retry, true) {
+		t.Error("retry with other headers and line ends should have same fingerprint")
+	}
+	if Fingerprint("<a@example.com>", raw, true) == Fingerprint("<b@example.com>", raw, true) {
+		t.Error("other Message-ID should have other fingerprint")
+	}
+	if Fingerprint("<a@example.com>", raw, true) == Fingerprint("<a@example.com>", []byte("\r\n\r\nHello"), true) {
+		t.Error("other body should have other fingerprint")
+	}
+	if Fingerprint("", raw, true) != "" || Fingerprint("", raw, false) == "" {
+		t.Error("message without Message-ID should have fingerprint only if not required")
+	}
+}
+
+func TestDetector(t *testing.T) {
+	detector := NewDetector(cache.NewMemoryStore(10, time.Minute), time.Minute)
+	fingerprint := Fingerprint("<a@example.com>", []byte("\n\nHello"), true)
+	if detector.Original(1, fingerprint) != 0 {
+		t.Error("first message is not duplicate")
+	}
+	detector.Remember(1, fingerprint, 42)
+	if id := detector.Original(1, fingerprint); id != 42 {
+		t.Errorf("expected original 42, got %d", id)
+	}
+	if detector.Original(2, fingerprint) != 0 {
+		t.Error("fingerprints should be scoped to inbox")
+	}
+	if detector.Original(1, "") != 0 {
+		t.Error("empty fingerprint is not duplicate")
+	}
+}
@@ -0,0 +1,147 @@
+package dkim
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	CANON_SIMPLE  = "simple"
+	CANON_RELAXED = "relaxed"
+)
+
+// Header is a raw header field, including folding and the trailing CRLF.
+type Header struct {
+	Name string // lowercased field name
+	Raw  string
+}
+
+// SplitMessage splits message into header fields and body, normalizing
+// line endings to CRLF.
+func SplitMessage(raw []byte) ([]Header, []byte) {
+	msg := normalizeLineEndings(raw)
+	var (
+		headers []Header
+		body    []byte
+	)
+	for len(msg) > 0 {
+		idx := bytes.Index(msg, []byte("\r\n"))
+		if idx == -1 {
+			idx = len(msg)
+		}
+		line := string(msg[:idx])
+		next := idx + 2
+		if next > len(msg) {
+			next = len(msg)
+		}
+		if line == "" {
+			body = msg[next:]
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].Raw += line + "\r\n"
+		} else {
+			name := line
+			if colon := strings.Index(line, ":"); colon != -1 {
+				name = line[:colon]
+			}
+			headers = append(headers, Header{Name: strings.ToLower(strings.TrimSpace(name)), Raw: line + "\r\n"})
+		}
+		msg = msg[next:]
+	}
+	return headers, body
+}
+
+func normalizeLineEndings(raw []byte) []byte {
+	if !bytes.Contains(raw, []byte("\n")) {
+		return raw
+	}
+	out := make([]byte, 0, len(raw)+len(raw)/40)
+	for i, c := range raw {
+		if c == '\n' && (i == 0 || raw[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// CanonicalHeader canonicalizes header field, RFC 6376 section 3.4.1 and 3.4.2.
+func CanonicalHeader(raw, canon string) string {
+	if canon != CANON_RELAXED {
+		return raw
+	}
+	colon := strings.Index(raw, ":")
+	if colon == -1 {
+		return raw
+	}
+	name := strings.ToLower(strings.TrimRight(raw[:colon], " \t"))
+	value := raw[colon+1:]
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalize body, RFC 6376 section 3.4.3 and 3.4.4
+
+func canonicalBody(body []byte, canon string) []byte {
+	if canon == CANON_RELAXED {
+		lines := bytes.Split(body, []byte("\r\n"))
+		for i, line := range lines {
+			line = bytes.TrimRight(line, " \t")
+			lines[i] = collapseWhitespace(line)
+		}
+		body = bytes.Join(lines, []byte("\r\n"))
+	}
+	// ignore all empty lines at the end of the body
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) == 0 {
+		if canon == CANON_RELAXED {
+			return []byte{}
+		}
+		return []byte("\r\n")
+	}
+	return append(body, '\r', '\n')
+}
+
+func collapseWhitespace(line []byte) []byte {
+	out := make([]byte, 0, len(line))
+	inSpace := false
+	for _, c := range line {
+		if c == ' ' || c == '\t' {
+			if !inSpace {
+				out = append(out, ' ')
+			}
+			inSpace = true
+			continue
+		}
+		inSpace = false
+		out = append(out, c)
+	}
+	return out
+}
+
+// parse "relaxed/simple" style canonicalization tag, unknown algorithms are
+// errors
+
+func parseCanonicalization(value string) (string, string, error) {
+	headerCanon, bodyCanon := CANON_SIMPLE, CANON_SIMPLE
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(value)), "/", 2)
+	if parts[0] != "" {
+		headerCanon = parts[0]
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		bodyCanon = parts[1]
+	}
+	for _, canon := range []string{headerCanon, bodyCanon} {
+		if canon != CANON_SIMPLE && canon != CANON_RELAXED {
+			return "", "", fmt.Errorf("dkim: unknown canonicalization %q", canon)
+		}
+	}
+	return headerCanon, bodyCanon, nil
+}
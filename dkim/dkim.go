@@ -0,0 +1,450 @@
+// Package dkim implements DomainKeys Identified Mail signatures (RFC 6376)
+// with rsa-sha256 and ed25519-sha256 (RFC 8463) algorithms.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MAX_SIGNATURES = 5 // verify at most this signatures per message
+
+	ALGO_RSA_SHA256     = "rsa-sha256"
+	ALGO_ED25519_SHA256 = "ed25519-sha256"
+
+	SIGNATURE_HEADER = "DKIM-Signature"
+)
+
+var (
+	signatureValueRE = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+)
+
+type Status string
+
+const (
+	StatusNone      Status = "none"
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusNeutral   Status = "neutral"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+// Result of a single signature verification.
+type Result struct {
+	Status     Status
+	Domain     string
+	Selector   string
+	Identifier string
+	Algorithm  string
+	Signature  string // b= value, used for header.b
+	Testing    bool   // key is in testing mode (t=y)
+	Error      string
+}
+
+// Signature is a parsed DKIM-Signature (or ARC-Message-Signature) header.
+type Signature struct {
+	Tags map[string]string
+
+	Version     string
+	Algorithm   string
+	Signature   []byte
+	BodyHash    []byte
+	HeaderCanon string
+	BodyCanon   string
+	Domain      string
+	Selector    string
+	Identifier  string
+	Headers     []string
+	BodyLength  int64 // -1 when l= is absent
+	Timestamp   int64
+	Expiration  int64
+	Instance    int // i= tag of ARC headers
+}
+
+type verifyError struct {
+	status Status
+	err    error
+}
+
+func (e *verifyError) Error() string {
+	return e.err.Error()
+}
+
+func permFail(format string, args ...interface{}) error {
+	return &verifyError{status: StatusPermError, err: fmt.Errorf(format, args...)}
+}
+
+func failed(format string, args ...interface{}) error {
+	return &verifyError{status: StatusFail, err: fmt.Errorf(format, args...)}
+}
+
+// ParseTags parses tag=value list, RFC 6376 section 3.2.
+func ParseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		idx := strings.Index(part, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("dkim: malformed tag %q", part)
+		}
+		name := strings.TrimSpace(part[:idx])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("dkim: duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(part[idx+1:])
+	}
+	return tags, nil
+}
+
+func stripWhitespace(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+func headerValue(raw string) string {
+	if idx := strings.Index(raw, ":"); idx != -1 {
+		return raw[idx+1:]
+	}
+	return ""
+}
+
+// ParseSignature parses value of DKIM-Signature header. Required tags
+// are checked for DKIM signatures only when arc is false.
+func ParseSignature(value string, arc bool) (*Signature, error) {
+	tags, err := ParseTags(value)
+	if err != nil {
+		return nil, permFail("%v", err)
+	}
+	sig := &Signature{Tags: tags, Version: tags["v"], BodyLength: -1}
+	required := []string{"v", "a", "b", "bh", "d", "h", "s"}
+	if arc {
+		required = []string{"i", "a", "b", "bh", "d", "h", "s"}
+	}
+	for _, name := range required {
+		if _, ok := tags[name]; !ok {
+			return nil, permFail("dkim: signature missing required tag %q", name)
+		}
+	}
+	if !arc && sig.Version != "1" {
+		return nil, permFail("dkim: unsupported signature version %q", sig.Version)
+	}
+	sig.Algorithm = strings.ToLower(tags["a"])
+	if sig.Signature, err = base64.StdEncoding.DecodeString(stripWhitespace(tags["b"])); err != nil {
+		return nil, permFail("dkim: malformed b= tag")
+	}
+	if sig.BodyHash, err = base64.StdEncoding.DecodeString(stripWhitespace(tags["bh"])); err != nil {
+		return nil, permFail("dkim: malformed bh= tag")
+	}
+	if sig.HeaderCanon, sig.BodyCanon, err = parseCanonicalization(tags["c"]); err != nil {
+		return nil, permFail("%v", err)
+	}
+	sig.Domain = strings.ToLower(strings.TrimSuffix(tags["d"], "."))
+	sig.Selector = strings.ToLower(tags["s"])
+	for _, name := range strings.Split(tags["h"], ":") {
+		if name = strings.ToLower(stripWhitespace(name)); name != "" {
+			sig.Headers = append(sig.Headers, name)
+		}
+	}
+	if arc {
+		if sig.Instance, err = strconv.Atoi(tags["i"]); err != nil || sig.Instance < 1 {
+			return nil, permFail("dkim: malformed i= tag")
+		}
+	} else {
+		sig.Identifier = tags["i"]
+		if sig.Identifier == "" {
+			sig.Identifier = "@" + sig.Domain
+		}
+		idDomain := identifierDomain(sig.Identifier)
+		if idDomain != sig.Domain && !strings.HasSuffix(idDomain, "."+sig.Domain) {
+			return nil, permFail("dkim: i= domain is not a subdomain of d=")
+		}
+		if !containsHeader(sig.Headers, "from") {
+			return nil, permFail("dkim: From header is not signed")
+		}
+	}
+	if l, ok := tags["l"]; ok {
+		if sig.BodyLength, err = strconv.ParseInt(l, 10, 64); err != nil || sig.BodyLength < 0 {
+			return nil, permFail("dkim: malformed l= tag")
+		}
+	}
+	if t, ok := tags["t"]; ok {
+		sig.Timestamp, _ = strconv.ParseInt(t, 10, 64)
+	}
+	if x, ok := tags["x"]; ok {
+		sig.Expiration, _ = strconv.ParseInt(x, 10, 64)
+	}
+	return sig, nil
+}
+
+// domain of i= tag
+
+func identifierDomain(identifier string) string {
+	return strings.ToLower(identifier[strings.LastIndex(identifier, "@")+1:])
+}
+
+func containsHeader(headers []string, name string) bool {
+	for _, h := range headers {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// verify all DKIM signatures of message
+
+// Verify checks every DKIM-Signature header of raw message.
+func Verify(raw []byte, resolver KeyResolver) []Result {
+	var results []Result
+	headers, body := SplitMessage(raw)
+	for _, h := range headers {
+		if h.Name != strings.ToLower(SIGNATURE_HEADER) {
+			continue
+		}
+		if len(results) >= MAX_SIGNATURES {
+			break
+		}
+		results = append(results, verifySignature(headers, body, h, resolver))
+	}
+	if len(results) == 0 {
+		results = append(results, Result{Status: StatusNone})
+	}
+	return results
+}
+
+func verifySignature(headers []Header, body []byte, sigHeader Header, resolver KeyResolver) Result {
+	result := Result{Status: StatusPass}
+	sig, err := ParseSignature(headerValue(sigHeader.Raw), false)
+	if sig != nil {
+		result.Domain = sig.Domain
+		result.Selector = sig.Selector
+		result.Identifier = sig.Identifier
+		result.Algorithm = sig.Algorithm
+		result.Signature = stripWhitespace(sig.Tags["b"])
+	}
+	if err == nil {
+		if sig.Expiration > 0 && time.Now().Unix() > sig.Expiration {
+			// RFC 6376 section 6.1.1
+			err = permFail("dkim: signature expired")
+		}
+	}
+	var key *PublicKey
+	if err == nil {
+		key, err = LookupPublicKey(resolver, sig.Domain, sig.Selector)
+	}
+	if err == nil {
+		result.Testing = key.Testing
+		// t=s keys do not sign for subdomains, RFC 6376 section 3.6.1
+		if key.Strict && identifierDomain(sig.Identifier) != sig.Domain {
+			err = permFail("dkim: i= domain is not d= of strict key")
+		}
+	}
+	if err == nil {
+		err = VerifyBodyHash(sig, body)
+	}
+	if err == nil {
+		err = VerifyHeaderHash(sig, key, HeaderHashData(sig, headers, sigHeader))
+	}
+	if err != nil {
+		result.Status = StatusPermError
+		if ve, ok := err.(*verifyError); ok {
+			result.Status = ve.status
+		}
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// VerifyBodyHash compares bh= tag with hash of canonical body.
+func VerifyBodyHash(sig *Signature, body []byte) error {
+	if !bytes.Equal(sig.BodyHash, BodyHash(body, sig.BodyCanon, sig.BodyLength)) {
+		return failed("dkim: body hash did not verify")
+	}
+	return nil
+}
+
+// BodyHash returns sha256 of canonical body truncated to length (unless -1).
+func BodyHash(body []byte, canon string, length int64) []byte {
+	canonical := canonicalBody(body, canon)
+	if length >= 0 && int64(len(canonical)) > length {
+		canonical = canonical[:length]
+	}
+	sum := sha256.Sum256(canonical)
+	return sum[:]
+}
+
+// HeaderHashData returns data for header hash, RFC 6376 section 3.7.
+func HeaderHashData(sig *Signature, headers []Header, sigHeader Header) []byte {
+	var buf bytes.Buffer
+	used := make(map[int]bool)
+	for _, name := range sig.Headers {
+		// pick instances from the bottom up
+		for i := len(headers) - 1; i >= 0; i-- {
+			if headers[i].Name == name && !used[i] {
+				used[i] = true
+				buf.WriteString(CanonicalHeader(headers[i].Raw, sig.HeaderCanon))
+				break
+			}
+		}
+	}
+	buf.WriteString(strings.TrimSuffix(CanonicalHeader(StripSignatureValue(sigHeader.Raw), sig.HeaderCanon), "\r\n"))
+	return buf.Bytes()
+}
+
+// StripSignatureValue removes value of b= tag from signature header field.
+func StripSignatureValue(raw string) string {
+	colon := strings.Index(raw, ":")
+	if colon == -1 {
+		return raw
+	}
+	value := signatureValueRE.ReplaceAllString(strings.TrimSuffix(raw[colon+1:], "\r\n"), "$1$2")
+	return raw[:colon+1] + value + "\r\n"
+}
+
+// VerifyHeaderHash checks b= tag against headers data.
+func VerifyHeaderHash(sig *Signature, key *PublicKey, data []byte) error {
+	hashed := sha256.Sum256(data)
+	switch sig.Algorithm {
+	case ALGO_RSA_SHA256:
+		pub, ok := key.Key.(*rsa.PublicKey)
+		if !ok {
+			return permFail("dkim: key type does not match algorithm %s", sig.Algorithm)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sig.Signature); err != nil {
+			return failed("dkim: signature did not verify")
+		}
+	case ALGO_ED25519_SHA256:
+		pub, ok := key.Key.(ed25519.PublicKey)
+		if !ok {
+			return permFail("dkim: key type does not match algorithm %s", sig.Algorithm)
+		}
+		if !ed25519.Verify(pub, hashed[:], sig.Signature) {
+			return failed("dkim: signature did not verify")
+		}
+	default:
+		return permFail("dkim: unsupported algorithm %q", sig.Algorithm)
+	}
+	return nil
+}
+
+// sign message
+
+// SignOptions describes a signature to add to message.
+type SignOptions struct {
+	Domain      string
+	Selector    string
+	Identifier  string
+	Signer      crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey
+	HeaderCanon string
+	BodyCanon   string
+	HeaderKeys  []string // signed headers, "from" is always included
+	Time        time.Time
+}
+
+var defaultSignedHeaders = []string{"from", "to", "cc", "subject", "date", "message-id", "reply-to", "in-reply-to", "references", "mime-version", "content-type", "content-transfer-encoding"}
+
+// Sign returns DKIM-Signature header field (with trailing CRLF) for raw message.
+func Sign(raw []byte, options *SignOptions) (string, error) {
+	headers, body := SplitMessage(raw)
+	return SignHeader(SIGNATURE_HEADER, "v=1", headers, body, options)
+}
+
+// SignHeader builds signature header with given name and leading tags,
+// shared with ARC-Message-Signature.
+func SignHeader(name, leadingTags string, headers []Header, body []byte, options *SignOptions) (string, error) {
+	algorithm, err := SignerAlgorithm(options.Signer)
+	if err != nil {
+		return "", err
+	}
+	headerCanon, bodyCanon := options.HeaderCanon, options.BodyCanon
+	if headerCanon == "" {
+		headerCanon = CANON_RELAXED
+	}
+	if bodyCanon == "" {
+		bodyCanon = CANON_RELAXED
+	}
+	keys := options.HeaderKeys
+	if len(keys) == 0 {
+		keys = defaultSignedHeaders
+	}
+	var signed []string
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		for _, h := range headers {
+			if h.Name == key {
+				signed = append(signed, key)
+				break
+			}
+		}
+	}
+	if !containsHeader(signed, "from") && strings.EqualFold(name, SIGNATURE_HEADER) {
+		signed = append([]string{"from"}, signed...)
+	}
+	signTime := options.Time
+	if signTime.IsZero() {
+		signTime = time.Now()
+	}
+	tags := []string{
+		leadingTags,
+		"a=" + algorithm,
+		"c=" + headerCanon + "/" + bodyCanon,
+		"d=" + options.Domain,
+		"s=" + options.Selector,
+	}
+	if options.Identifier != "" {
+		tags = append(tags, "i="+options.Identifier)
+	}
+	tags = append(tags,
+		"t="+strconv.FormatInt(signTime.Unix(), 10),
+		"h="+strings.Join(signed, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(BodyHash(body, bodyCanon, -1)),
+		"b=",
+	)
+	sigHeader := Header{Name: strings.ToLower(name), Raw: name + ": " + strings.Join(tags, "; ") + "\r\n"}
+	sig := &Signature{HeaderCanon: headerCanon, Headers: signed}
+	signature, err := SignData(options.Signer, HeaderHashData(sig, headers, sigHeader))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(sigHeader.Raw, "\r\n") + base64.StdEncoding.EncodeToString(signature) + "\r\n", nil
+}
+
+// SignerAlgorithm returns signature algorithm of private key.
+func SignerAlgorithm(signer crypto.Signer) (string, error) {
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		return ALGO_RSA_SHA256, nil
+	case ed25519.PrivateKey:
+		return ALGO_ED25519_SHA256, nil
+	}
+	return "", errors.New("dkim: unsupported private key type")
+}
+
+// SignData signs sha256 hash of data.
+func SignData(signer crypto.Signer, data []byte) ([]byte, error) {
+	hashed := sha256.Sum256(data)
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		return signer.Sign(rand.Reader, hashed[:], crypto.Hash(0))
+	}
+	return signer.Sign(rand.Reader, hashed[:], crypto.SHA256)
+}
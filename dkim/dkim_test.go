@@ -0,0 +1,168 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+)
+
+// local key resolver
+
+type mapKeyResolver map[string]string
+
+func (r mapKeyResolver) LookupKey(domain, selector string) ([]string, error) {
+	if record, ok := r[selector+"._domainkey."+domain]; ok {
+		return []string{record}, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+const testMessage = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject:  Is dinner   ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func testKeys(t *testing.T) (crypto.Signer, crypto.Signer, mapKeyResolver) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaRecord, _ := KeyRecord(rsaKey.Public())
+	edRecord, _ := KeyRecord(edKey.Public())
+	resolver := mapKeyResolver{
+		"rsa._domainkey.football.example.com":     rsaRecord,
+		"ed._domainkey.football.example.com":      edRecord,
+		"revoked._domainkey.football.example.com": "v=DKIM1; p=",
+		"strict._domainkey.football.example.com":  rsaRecord + "; t=s",
+	}
+	return rsaKey, edKey, resolver
+}
+
+func signMessage(t *testing.T, message string, options *SignOptions) string {
+	signature, err := Sign([]byte(message), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature + message
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, edKey, resolver := testKeys(t)
+	for _, canon := range []string{CANON_SIMPLE, CANON_RELAXED} {
+		for selector, key := range map[string]crypto.Signer{"rsa": rsaKey, "ed": edKey} {
+			signed := signMessage(t, testMessage, &SignOptions{Domain: "football.example.com", Selector: selector, Signer: key, HeaderCanon: canon, BodyCanon: canon})
+			results := Verify([]byte(signed), resolver)
+			if len(results) != 1 || results[0].Status != StatusPass {
+				t.Errorf("%s %s: expected pass, got %+v", selector, canon, results)
+				continue
+			}
+			if results[0].Domain != "football.example.com" || results[0].Selector != selector {
+				t.Errorf("%s %s: unexpected result %+v", selector, canon, results[0])
+			}
+			// bare LF line endings, as stored by smtpd
+			results = Verify([]byte(strings.Replace(signed, "\r\n", "\n", -1)), resolver)
+			if results[0].Status != StatusPass {
+				t.Errorf("%s %s: expected pass with LF endings, got %+v", selector, canon, results)
+			}
+			// tampered body
+			results = Verify([]byte(strings.Replace(signed, "hungry", "angry", 1)), resolver)
+			if results[0].Status != StatusFail {
+				t.Errorf("%s %s: expected fail on body change, got %+v", selector, canon, results)
+			}
+			// tampered header
+			results = Verify([]byte(strings.Replace(signed, "Subject:  Is dinner", "Subject:  Is lunch", 1)), resolver)
+			if results[0].Status != StatusFail {
+				t.Errorf("%s %s: expected fail on header change, got %+v", selector, canon, results)
+			}
+		}
+	}
+}
+
+func TestVerifyRelaxedWhitespace(t *testing.T) {
+	rsaKey, _, resolver := testKeys(t)
+	signed := signMessage(t, testMessage, &SignOptions{Domain: "football.example.com", Selector: "rsa", Signer: rsaKey})
+	changed := strings.Replace(signed, "Subject:  Is dinner   ready?", "subject: Is dinner ready?  ", 1)
+	changed = strings.Replace(changed, "Joe.\r\n", "Joe. \t\r\n\r\n\r\n", 1)
+	if results := Verify([]byte(changed), resolver); results[0].Status != StatusPass {
+		t.Errorf("expected relaxed pass, got %+v", results)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	rsaKey, _, resolver := testKeys(t)
+	if results := Verify([]byte(testMessage), resolver); len(results) != 1 || results[0].Status != StatusNone {
+		t.Errorf("expected none for unsigned message, got %+v", results)
+	}
+	signed := signMessage(t, testMessage, &SignOptions{Domain: "football.example.com", Selector: "missing", Signer: rsaKey})
+	if results := Verify([]byte(signed), resolver); results[0].Status != StatusPermError {
+		t.Errorf("expected permerror for missing key, got %+v", results)
+	}
+	signed = signMessage(t, testMessage, &SignOptions{Domain: "football.example.com", Selector: "revoked", Signer: rsaKey})
+	if results := Verify([]byte(signed), resolver); results[0].Status != StatusPermError {
+		t.Errorf("expected permerror for revoked key, got %+v", results)
+	}
+	signed = "DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=rsa; h=to; bh=; b=\r\n" + testMessage
+	if results := Verify([]byte(signed), resolver); results[0].Status != StatusPermError {
+		t.Errorf("expected permerror for unsigned From, got %+v", results)
+	}
+	signed = "DKIM-Signature: v=1; a=rsa-sha256; d=football.example.com; s=rsa; h=from; x=1000000000; bh=; b=\r\n" + testMessage
+	if results := Verify([]byte(signed), resolver); results[0].Status != StatusPermError {
+		t.Errorf("expected permerror for expired signature, got %+v", results)
+	}
+	signed = signMessage(t, testMessage, &SignOptions{Domain: "football.example.com", Selector: "rsa", Signer: rsaKey, HeaderCanon: "nowsp"})
+	if results := Verify([]byte(signed), resolver); results[0].Status != StatusPermError {
+		t.Errorf("expected permerror for unknown canonicalization, got %+v", results)
+	}
+}
+
+func TestVerifyStrictKey(t *testing.T) {
+	rsaKey, _, resolver := testKeys(t)
+	signed := signMessage(t, testMessage, &SignOptions{Domain: "football.example.com", Selector: "strict", Signer: rsaKey, Identifier: "joe@football.example.com"})
+	if results := Verify([]byte(signed), resolver); results[0].Status != StatusPass {
+		t.Errorf("expected pass of i= in d=, got %+v", results)
+	}
+	signed = signMessage(t, testMessage, &SignOptions{Domain: "football.example.com", Selector: "strict", Signer: rsaKey, Identifier: "joe@news.football.example.com"})
+	if results := Verify([]byte(signed), resolver); results[0].Status != StatusPermError {
+		t.Errorf("expected permerror of subdomain i= with strict key, got %+v", results)
+	}
+	signed = signMessage(t, testMessage, &SignOptions{Domain: "football.example.com", Selector: "rsa", Signer: rsaKey, Identifier: "joe@news.football.example.com"})
+	if results := Verify([]byte(signed), resolver); results[0].Status != StatusPass {
+		t.Errorf("expected pass of subdomain i= without strict key, got %+v", results)
+	}
+}
+
+func TestCanonicalization(t *testing.T) {
+	// RFC 6376 section 3.4.5
+	headers, body := SplitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	relaxed := CanonicalHeader(headers[0].Raw, CANON_RELAXED) + CanonicalHeader(headers[1].Raw, CANON_RELAXED)
+	if relaxed != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("unexpected relaxed headers %q", relaxed)
+	}
+	simple := CanonicalHeader(headers[0].Raw, CANON_SIMPLE) + CanonicalHeader(headers[1].Raw, CANON_SIMPLE)
+	if simple != "A: X\r\nB : Y\t\r\n\tZ  \r\n" {
+		t.Errorf("unexpected simple headers %q", simple)
+	}
+	if got := string(canonicalBody(body, CANON_RELAXED)); got != " C\r\nD E\r\n" {
+		t.Errorf("unexpected relaxed body %q", got)
+	}
+	if got := string(canonicalBody(body, CANON_SIMPLE)); got != " C \r\nD \t E\r\n" {
+		t.Errorf("unexpected simple body %q", got)
+	}
+	if got := string(canonicalBody(nil, CANON_SIMPLE)); got != "\r\n" {
+		t.Errorf("unexpected simple empty body %q", got)
+	}
+}
@@ -0,0 +1,165 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrKeyNotFound = errors.New("dkim: no key for signature")
+)
+
+// KeyResolver returns TXT records of selector._domainkey.domain. Tests
+// supply keys locally by implementing it over a map.
+type KeyResolver interface {
+	LookupKey(domain, selector string) ([]string, error)
+}
+
+// DNSKeyResolver looks up keys with the system resolver.
+type DNSKeyResolver struct {
+	Timeout time.Duration
+}
+
+func NewDNSKeyResolver(timeout time.Duration) *DNSKeyResolver {
+	return &DNSKeyResolver{Timeout: timeout}
+}
+
+func (r *DNSKeyResolver) LookupKey(domain, selector string) ([]string, error) {
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	txts, err := net.DefaultResolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, ErrKeyNotFound
+	}
+	return txts, err
+}
+
+// PublicKey is a parsed key record, RFC 6376 section 3.6.1
+type PublicKey struct {
+	Key     crypto.PublicKey
+	Testing bool
+	Strict  bool
+}
+
+// LookupPublicKey fetches and parses public key of selector.
+func LookupPublicKey(resolver KeyResolver, domain, selector string) (*PublicKey, error) {
+	txts, err := resolver.LookupKey(domain, selector)
+	if err != nil {
+		if err == ErrKeyNotFound {
+			return nil, permFail("dkim: no key for signature")
+		}
+		return nil, &verifyError{status: StatusTempError, err: err}
+	}
+	if len(txts) == 0 {
+		return nil, permFail("dkim: no key for signature")
+	}
+	// a record may be split into several strings
+	return ParsePublicKey(strings.Join(txts, ""))
+}
+
+// ParsePublicKey parses DKIM key record.
+func ParsePublicKey(record string) (*PublicKey, error) {
+	tags, err := ParseTags(record)
+	if err != nil {
+		return nil, permFail("dkim: malformed key record: %v", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, permFail("dkim: unsupported key version %q", v)
+	}
+	p := stripWhitespace(tags["p"])
+	if p == "" {
+		return nil, permFail("dkim: key revoked")
+	}
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, permFail("dkim: malformed key data")
+	}
+	key := &PublicKey{}
+	for _, flag := range strings.Split(tags["t"], ":") {
+		switch strings.TrimSpace(flag) {
+		case "y":
+			key.Testing = true
+		case "s":
+			key.Strict = true
+		}
+	}
+	keyType := strings.ToLower(tags["k"])
+	switch keyType {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(data)
+			if err != nil {
+				return nil, permFail("dkim: malformed rsa key")
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, permFail("dkim: key is not rsa")
+		}
+		key.Key = rsaPub
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, permFail("dkim: malformed ed25519 key")
+		}
+		key.Key = ed25519.PublicKey(data)
+	default:
+		return nil, permFail("dkim: unsupported key type %q", keyType)
+	}
+	return key, nil
+}
+
+// KeyRecord returns TXT record value publishing pub.
+func KeyRecord(pub crypto.PublicKey) (string, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		data, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(data), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key), nil
+	}
+	return "", errors.New("dkim: unsupported public key type")
+}
+
+// LoadPrivateKey reads PEM encoded rsa (PKCS#1 or PKCS#8) or ed25519 (PKCS#8) key.
+func LoadPrivateKey(filename string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM data in private key file")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch signer := key.(type) {
+	case *rsa.PrivateKey:
+		return signer, nil
+	case ed25519.PrivateKey:
+		return signer, nil
+	}
+	return nil, errors.New("dkim: unsupported private key type")
+}
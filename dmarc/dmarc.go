@@ -0,0 +1,306 @@
+// Package dmarc implements DMARC policy evaluation (RFC 7489).
+package dmarc
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+type Result string
+
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+type Disposition string
+
+const (
+	DispositionNone       Disposition = "none"
+	DispositionQuarantine Disposition = "quarantine"
+	DispositionReject     Disposition = "reject"
+)
+
+const (
+	ALIGNMENT_RELAXED = "r"
+	ALIGNMENT_STRICT  = "s"
+)
+
+var (
+	ErrNotFound = errors.New("dmarc: no such DNS record")
+)
+
+// Resolver is used to fetch _dmarc TXT records.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// Record is a published DMARC policy, RFC 7489 section 6.3
+type Record struct {
+	Policy          Disposition
+	SubdomainPolicy Disposition
+	DkimAlignment   string
+	SpfAlignment    string
+	Percent         int
+	ReportURIs      []string // rua
+	FailureURIs     []string // ruf
+	FailureOptions  string
+}
+
+// Identifiers of a message to evaluate.
+type Identifiers struct {
+	FromDomain  string   // RFC5322.From domain
+	SpfResult   string   // spf result of MAIL FROM, or of HELO if it failed
+	SpfDomain   string   // domain of checked identity
+	DkimDomains []string // d= of dkim signatures which passed
+}
+
+// Evaluation result of a message.
+type Evaluation struct {
+	Result      Result
+	Disposition Disposition
+	Domain      string // domain the policy was found on
+	FromDomain  string
+	Record      *Record
+	SpfAligned  bool
+	DkimAligned bool
+	Error       string
+}
+
+// ParseRecord parses DMARC TXT record.
+func ParseRecord(txt string) (*Record, error) {
+	record := &Record{DkimAlignment: ALIGNMENT_RELAXED, SpfAlignment: ALIGNMENT_RELAXED, Percent: 100, FailureOptions: "0"}
+	parts := strings.Split(txt, ";")
+	if strings.TrimSpace(parts[0]) != "v=DMARC1" {
+		return nil, errors.New("dmarc: record must start with v=DMARC1")
+	}
+	hasPolicy := false
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		idx := strings.Index(part, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("dmarc: malformed tag %q", part)
+		}
+		name, value := strings.ToLower(strings.TrimSpace(part[:idx])), strings.TrimSpace(part[idx+1:])
+		switch name {
+		case "p", "sp":
+			disposition, err := parseDisposition(value)
+			if err != nil {
+				return nil, err
+			}
+			if name == "p" {
+				record.Policy = disposition
+				hasPolicy = true
+			} else {
+				record.SubdomainPolicy = disposition
+			}
+		case "adkim", "aspf":
+			value = strings.ToLower(value)
+			if value != ALIGNMENT_RELAXED && value != ALIGNMENT_STRICT {
+				return nil, fmt.Errorf("dmarc: invalid %s=%q", name, value)
+			}
+			if name == "adkim" {
+				record.DkimAlignment = value
+			} else {
+				record.SpfAlignment = value
+			}
+		case "pct":
+			pct, err := strconv.Atoi(value)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, fmt.Errorf("dmarc: invalid pct=%q", value)
+			}
+			record.Percent = pct
+		case "rua", "ruf":
+			var uris []string
+			for _, uri := range strings.Split(value, ",") {
+				if uri = strings.TrimSpace(uri); uri != "" {
+					uris = append(uris, uri)
+				}
+			}
+			if name == "rua" {
+				record.ReportURIs = uris
+			} else {
+				record.FailureURIs = uris
+			}
+		case "fo":
+			record.FailureOptions = value
+		}
+	}
+	if !hasPolicy {
+		return nil, errors.New("dmarc: record without p= tag")
+	}
+	if record.SubdomainPolicy == "" {
+		record.SubdomainPolicy = record.Policy
+	}
+	return record, nil
+}
+
+func parseDisposition(value string) (Disposition, error) {
+	switch Disposition(strings.ToLower(value)) {
+	case DispositionNone:
+		return DispositionNone, nil
+	case DispositionQuarantine:
+		return DispositionQuarantine, nil
+	case DispositionReject:
+		return DispositionReject, nil
+	}
+	return "", fmt.Errorf("dmarc: invalid policy %q", value)
+}
+
+// Lookup finds DMARC record for domain, falling back to its organizational
+// domain. Returns nil record when no policy is published.
+func Lookup(resolver Resolver, domain string) (*Record, string, error) {
+	record, err := lookupRecord(resolver, domain)
+	if record != nil || err != nil {
+		return record, domain, err
+	}
+	orgDomain := OrganizationalDomain(domain)
+	if orgDomain == domain {
+		return nil, domain, nil
+	}
+	record, err = lookupRecord(resolver, orgDomain)
+	return record, orgDomain, err
+}
+
+func lookupRecord(resolver Resolver, domain string) (*Record, error) {
+	txts, err := resolver.LookupTXT("_dmarc." + domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, &lookupError{err}
+	}
+	var found []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			found = append(found, txt)
+		}
+	}
+	// multiple records are treated as no record, RFC 7489 section 6.6.3
+	if len(found) != 1 {
+		return nil, nil
+	}
+	return ParseRecord(found[0])
+}
+
+// failed DNS lookup other than NXDOMAIN, temporary as policy may be found on
+// retry, unlike invalid record
+
+type lookupError struct {
+	err error
+}
+
+func (e *lookupError) Error() string {
+	return e.err.Error()
+}
+
+func (e *lookupError) Unwrap() error {
+	return e.err
+}
+
+func isNotFound(err error) bool {
+	if err == ErrNotFound {
+		return true
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
+
+// OrganizationalDomain returns registered domain (eTLD+1) of domain.
+func OrganizationalDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return orgDomain
+}
+
+// check identifier alignment, RFC 7489 section 3.1
+
+func isAligned(domain, fromDomain, mode string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" {
+		return false
+	}
+	if mode == ALIGNMENT_STRICT {
+		return domain == fromDomain
+	}
+	return OrganizationalDomain(domain) == OrganizationalDomain(fromDomain)
+}
+
+// Evaluate applies published policy of From domain to message identifiers.
+func Evaluate(resolver Resolver, ids *Identifiers) *Evaluation {
+	fromDomain := strings.TrimSuffix(strings.ToLower(ids.FromDomain), ".")
+	evaluation := &Evaluation{Result: None, Disposition: DispositionNone, FromDomain: fromDomain}
+	if fromDomain == "" {
+		evaluation.Result = PermError
+		evaluation.Error = "dmarc: no From domain"
+		return evaluation
+	}
+	record, policyDomain, err := Lookup(resolver, fromDomain)
+	evaluation.Domain = policyDomain
+	if err != nil {
+		evaluation.Error = err.Error()
+		if _, ok := err.(*lookupError); ok {
+			evaluation.Result = TempError
+		} else {
+			evaluation.Result = PermError
+		}
+		return evaluation
+	}
+	if record == nil {
+		return evaluation
+	}
+	evaluation.Record = record
+	if ids.SpfResult == "pass" {
+		evaluation.SpfAligned = isAligned(ids.SpfDomain, fromDomain, record.SpfAlignment)
+	}
+	for _, domain := range ids.DkimDomains {
+		if isAligned(domain, fromDomain, record.DkimAlignment) {
+			evaluation.DkimAligned = true
+			break
+		}
+	}
+	if evaluation.SpfAligned || evaluation.DkimAligned {
+		evaluation.Result = Pass
+		return evaluation
+	}
+	evaluation.Result = Fail
+	policy := record.Policy
+	if policyDomain != fromDomain {
+		policy = record.SubdomainPolicy
+	}
+	// pct sampling, messages outside of sample get the next less strict policy
+	if policy != DispositionNone && record.Percent < 100 && rand.Intn(100) >= record.Percent {
+		if policy == DispositionReject {
+			policy = DispositionQuarantine
+		} else {
+			policy = DispositionNone
+		}
+	}
+	evaluation.Disposition = policy
+	return evaluation
+}
+
+// PolicyComment returns "p=reject dis=none" comment for Authentication-Results.
+func (evaluation *Evaluation) PolicyComment() string {
+	if evaluation.Record == nil {
+		return ""
+	}
+	return fmt.Sprintf("p=%s dis=%s", strings.ToUpper(string(evaluation.Record.Policy)), strings.ToUpper(string(evaluation.Disposition)))
+}
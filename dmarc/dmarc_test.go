@@ -0,0 +1,122 @@
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupTXT(name string) ([]string, error) {
+	if txts, ok := r[name]; ok {
+		return txts, nil
+	}
+	return nil, ErrNotFound
+}
+
+type failingResolver struct {
+	err error
+}
+
+func (r failingResolver) LookupTXT(name string) ([]string, error) {
+	return nil, r.err
+}
+
+var testResolver = stubResolver{
+	"_dmarc.broken.example.net": {"v=DMARC1; p=drop"},
+	"_dmarc.example.com":        {"v=DMARC1; p=reject; sp=quarantine; rua=mailto:dmarc@example.com, mailto:x@example.net"},
+	"_dmarc.strict.example.org": {"v=DMARC1; p=quarantine; adkim=s; aspf=s"},
+	"_dmarc.none.example.net":   {"v=DMARC1; p=none"},
+	"_dmarc.double.example.net": {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+}
+
+type evaluateTest struct {
+	Ids         Identifiers
+	Result      Result
+	Disposition Disposition
+	Domain      string
+}
+
+var evaluateTests = []evaluateTest{
+	{Identifiers{FromDomain: "example.com", SpfResult: "pass", SpfDomain: "example.com"}, Pass, DispositionNone, "example.com"},
+	{Identifiers{FromDomain: "example.com", SpfResult: "pass", SpfDomain: "bounces.example.com"}, Pass, DispositionNone, "example.com"},
+	{Identifiers{FromDomain: "example.com", SpfResult: "fail", SpfDomain: "example.com", DkimDomains: []string{"mail.example.com"}}, Pass, DispositionNone, "example.com"},
+	{Identifiers{FromDomain: "example.com", SpfResult: "pass", SpfDomain: "other.com", DkimDomains: []string{"other.com"}}, Fail, DispositionReject, "example.com"},
+	{Identifiers{FromDomain: "news.example.com", SpfResult: "softfail", SpfDomain: "news.example.com"}, Fail, DispositionQuarantine, "example.com"},
+	{Identifiers{FromDomain: "strict.example.org", SpfResult: "pass", SpfDomain: "mail.strict.example.org", DkimDomains: []string{"example.org"}}, Fail, DispositionQuarantine, "strict.example.org"},
+	{Identifiers{FromDomain: "strict.example.org", DkimDomains: []string{"strict.example.org"}}, Pass, DispositionNone, "strict.example.org"},
+	{Identifiers{FromDomain: "none.example.net", SpfResult: "fail"}, Fail, DispositionNone, "none.example.net"},
+	{Identifiers{FromDomain: "double.example.net", SpfResult: "fail"}, None, DispositionNone, "example.net"},
+	{Identifiers{FromDomain: "nopolicy.org", SpfResult: "fail"}, None, DispositionNone, "nopolicy.org"},
+}
+
+func TestEvaluate(t *testing.T) {
+	for _, test := range evaluateTests {
+		ids := test.Ids
+		evaluation := Evaluate(testResolver, &ids)
+		if evaluation.Result != test.Result || evaluation.Disposition != test.Disposition || evaluation.Domain != test.Domain {
+			t.Errorf("Evaluate(%+v) = %s/%s on %q, expected %s/%s on %q", test.Ids, evaluation.Result, evaluation.Disposition, evaluation.Domain, test.Result, test.Disposition, test.Domain)
+		}
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	ids := &Identifiers{FromDomain: "example.com", SpfResult: "fail"}
+	for _, err := range []error{context.DeadlineExceeded, errors.New("connection refused"), &net.DNSError{Err: "server misbehaving", IsTemporary: true}} {
+		if evaluation := Evaluate(failingResolver{err}, ids); evaluation.Result != TempError {
+			t.Errorf("expected temperror of %v, got %s", err, evaluation.Result)
+		}
+	}
+	if evaluation := Evaluate(failingResolver{&net.DNSError{Err: "no such host", IsNotFound: true}}, ids); evaluation.Result != None {
+		t.Errorf("expected none of NXDOMAIN, got %s", evaluation.Result)
+	}
+	ids = &Identifiers{FromDomain: "broken.example.net", SpfResult: "fail"}
+	if evaluation := Evaluate(testResolver, ids); evaluation.Result != PermError {
+		t.Errorf("expected permerror of invalid record, got %s", evaluation.Result)
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	record, err := ParseRecord("v=DMARC1; p=reject; sp=none; pct=50; adkim=s; rua=mailto:a@example.com,mailto:b@example.com; fo=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Policy != DispositionReject || record.SubdomainPolicy != DispositionNone || record.Percent != 50 || record.DkimAlignment != ALIGNMENT_STRICT || record.SpfAlignment != ALIGNMENT_RELAXED || len(record.ReportURIs) != 2 || record.FailureOptions != "1" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	for _, invalid := range []string{"v=DMARC2; p=none", "v=DMARC1; sp=none", "v=DMARC1; p=drop", "v=DMARC1; p=none; pct=200"} {
+		if _, err := ParseRecord(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestBuildAggregateReport(t *testing.T) {
+	ids := &Identifiers{FromDomain: "example.com", SpfResult: "pass", SpfDomain: "other.com"}
+	evaluation := Evaluate(testResolver, ids)
+	row := NewAggregateRow("192.0.2.1", ids, evaluation, "", "")
+	begin := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	meta := &ReportMetadata{OrgName: "falcon", Email: "postmaster@falcon.test", ReportID: "1", Begin: begin, End: begin.Add(24 * time.Hour)}
+	report, err := BuildAggregateReport(meta, "example.com", evaluation.Record, map[string]int{row.Key(): 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"<org_name>falcon</org_name>",
+		"<begin>1792281600</begin>",
+		"<p>reject</p>",
+		"<source_ip>192.0.2.1</source_ip>",
+		"<count>3</count>",
+		"<disposition>reject</disposition>",
+		"<header_from>example.com</header_from>",
+		"<domain>other.com</domain>",
+	} {
+		if !strings.Contains(string(report), expected) {
+			t.Errorf("report does not contain %q:\n%s", expected, report)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package dmarc
+
+import (
+	"encoding/xml"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AggregateRow is one accumulated line of aggregate report data.
+type AggregateRow struct {
+	SourceIP     string
+	HeaderFrom   string
+	EnvelopeFrom string
+	Disposition  Disposition
+	DkimAligned  bool
+	SpfAligned   bool
+	DkimDomain   string
+	DkimResult   string
+	SpfDomain    string
+	SpfResult    string
+}
+
+// Key returns stable key of row, used to count equal rows.
+func (row *AggregateRow) Key() string {
+	return strings.Join([]string{
+		row.SourceIP, row.HeaderFrom, row.EnvelopeFrom, string(row.Disposition),
+		strconv.FormatBool(row.DkimAligned), strconv.FormatBool(row.SpfAligned),
+		row.DkimDomain, row.DkimResult, row.SpfDomain, row.SpfResult,
+	}, "|")
+}
+
+// ParseAggregateRowKey parses key created by AggregateRow.Key.
+func ParseAggregateRowKey(key string) (*AggregateRow, bool) {
+	parts := strings.Split(key, "|")
+	if len(parts) != 10 {
+		return nil, false
+	}
+	return &AggregateRow{
+		SourceIP:     parts[0],
+		HeaderFrom:   parts[1],
+		EnvelopeFrom: parts[2],
+		Disposition:  Disposition(parts[3]),
+		DkimAligned:  parts[4] == "true",
+		SpfAligned:   parts[5] == "true",
+		DkimDomain:   parts[6],
+		DkimResult:   parts[7],
+		SpfDomain:    parts[8],
+		SpfResult:    parts[9],
+	}, true
+}
+
+// NewAggregateRow builds aggregate row of evaluated message.
+func NewAggregateRow(sourceIP string, ids *Identifiers, evaluation *Evaluation, dkimDomain, dkimResult string) *AggregateRow {
+	return &AggregateRow{
+		SourceIP:     sourceIP,
+		HeaderFrom:   evaluation.FromDomain,
+		EnvelopeFrom: ids.SpfDomain,
+		Disposition:  evaluation.Disposition,
+		DkimAligned:  evaluation.DkimAligned,
+		SpfAligned:   evaluation.SpfAligned,
+		DkimDomain:   dkimDomain,
+		DkimResult:   dkimResult,
+		SpfDomain:    ids.SpfDomain,
+		SpfResult:    ids.SpfResult,
+	}
+}
+
+// ReportMetadata describes the reporting organization.
+type ReportMetadata struct {
+	OrgName  string
+	Email    string
+	ReportID string
+	Begin    time.Time
+	End      time.Time
+}
+
+// aggregate report xml, RFC 7489 appendix C
+
+type xmlFeedback struct {
+	XMLName         xml.Name           `xml:"feedback"`
+	Version         string             `xml:"version"`
+	ReportMetadata  xmlReportMetadata  `xml:"report_metadata"`
+	PolicyPublished xmlPolicyPublished `xml:"policy_published"`
+	Records         []xmlRecord        `xml:"record"`
+}
+
+type xmlReportMetadata struct {
+	OrgName   string       `xml:"org_name"`
+	Email     string       `xml:"email"`
+	ReportID  string       `xml:"report_id"`
+	DateRange xmlDateRange `xml:"date_range"`
+}
+
+type xmlDateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+type xmlPolicyPublished struct {
+	Domain string `xml:"domain"`
+	ADkim  string `xml:"adkim"`
+	ASpf   string `xml:"aspf"`
+	P      string `xml:"p"`
+	SP     string `xml:"sp"`
+	Pct    int    `xml:"pct"`
+	Fo     string `xml:"fo"`
+}
+
+type xmlRecord struct {
+	Row         xmlRow         `xml:"row"`
+	Identifiers xmlIdentifiers `xml:"identifiers"`
+	AuthResults xmlAuthResults `xml:"auth_results"`
+}
+
+type xmlRow struct {
+	SourceIP        string             `xml:"source_ip"`
+	Count           int                `xml:"count"`
+	PolicyEvaluated xmlPolicyEvaluated `xml:"policy_evaluated"`
+}
+
+type xmlPolicyEvaluated struct {
+	Disposition string `xml:"disposition"`
+	Dkim        string `xml:"dkim"`
+	Spf         string `xml:"spf"`
+}
+
+type xmlIdentifiers struct {
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+	HeaderFrom   string `xml:"header_from"`
+}
+
+type xmlAuthResults struct {
+	Dkim []xmlAuthResult `xml:"dkim,omitempty"`
+	Spf  []xmlAuthResult `xml:"spf"`
+}
+
+type xmlAuthResult struct {
+	Domain string `xml:"domain"`
+	Result string `xml:"result"`
+}
+
+func passOrFail(aligned bool) string {
+	if aligned {
+		return "pass"
+	}
+	return "fail"
+}
+
+// BuildAggregateReport renders aggregate report of policy domain, counts
+// are keyed by AggregateRow.Key.
+func BuildAggregateReport(meta *ReportMetadata, domain string, record *Record, counts map[string]int) ([]byte, error) {
+	feedback := xmlFeedback{
+		Version: "1.0",
+		ReportMetadata: xmlReportMetadata{
+			OrgName:   meta.OrgName,
+			Email:     meta.Email,
+			ReportID:  meta.ReportID,
+			DateRange: xmlDateRange{Begin: meta.Begin.Unix(), End: meta.End.Unix()},
+		},
+		PolicyPublished: xmlPolicyPublished{Domain: domain, ADkim: ALIGNMENT_RELAXED, ASpf: ALIGNMENT_RELAXED, P: string(DispositionNone), SP: string(DispositionNone), Pct: 100, Fo: "0"},
+	}
+	if record != nil {
+		feedback.PolicyPublished = xmlPolicyPublished{
+			Domain: domain,
+			ADkim:  record.DkimAlignment,
+			ASpf:   record.SpfAlignment,
+			P:      string(record.Policy),
+			SP:     string(record.SubdomainPolicy),
+			Pct:    record.Percent,
+			Fo:     record.FailureOptions,
+		}
+	}
+	for key, count := range counts {
+		row, ok := ParseAggregateRowKey(key)
+		if !ok {
+			continue
+		}
+		xmlRec := xmlRecord{
+			Row: xmlRow{
+				SourceIP: row.SourceIP,
+				Count:    count,
+				PolicyEvaluated: xmlPolicyEvaluated{
+					Disposition: string(row.Disposition),
+					Dkim:        passOrFail(row.DkimAligned),
+					Spf:         passOrFail(row.SpfAligned),
+				},
+			},
+			Identifiers: xmlIdentifiers{EnvelopeFrom: row.EnvelopeFrom, HeaderFrom: row.HeaderFrom},
+			AuthResults: xmlAuthResults{Spf: []xmlAuthResult{{Domain: row.SpfDomain, Result: row.SpfResult}}},
+		}
+		if row.DkimDomain != "" {
+			xmlRec.AuthResults.Dkim = []xmlAuthResult{{Domain: row.DkimDomain, Result: row.DkimResult}}
+		}
+		feedback.Records = append(feedback.Records, xmlRec)
+	}
+	// stable output
+	sort.Slice(feedback.Records, func(i, j int) bool {
+		if feedback.Records[i].Row.SourceIP != feedback.Records[j].Row.SourceIP {
+			return feedback.Records[i].Row.SourceIP < feedback.Records[j].Row.SourceIP
+		}
+		return feedback.Records[i].Row.Count > feedback.Records[j].Row.Count
+	})
+	data, err := xml.MarshalIndent(feedback, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
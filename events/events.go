@@ -0,0 +1,127 @@
+// Package events appends mail lifecycle events to a capped Redis Stream,
+// readable by consumer groups for replay.
+package events
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	MESSAGE_RECEIVED       = "message.received"
+	MESSAGE_STORED         = "message.stored"
+	MESSAGE_SPAM_SCORED    = "message.spam_scored"
+	MESSAGE_VIRUS_FOUND    = "message.virus_found"
+	MESSAGE_DELETED_BY_POP = "message.deleted_by_pop3"
+	MESSAGE_CLEANED_UP     = "message.cleaned_up"
+	AUTH_FAILED            = "auth.failed"
+	CAMPAIGN_STARTED       = "campaign.started"
+	CAMPAIGN_ENDED         = "campaign.ended"
+)
+
+var (
+	publisherMu sync.RWMutex
+	publisher   Publisher
+)
+
+// Event is one entry of the stream, Data holds type specific fields.
+type Event struct {
+	Type      string
+	MailboxID int
+	MessageID int
+	Time      time.Time
+	Data      map[string]string
+}
+
+// Publisher stores events.
+type Publisher interface {
+	Publish(e *Event) error
+}
+
+// RedisPool gives connections for the stream publisher.
+type RedisPool interface {
+	Get() redis.Conn
+}
+
+// SetPublisher sets publisher of Emit, nil disables events.
+func SetPublisher(p Publisher) {
+	publisherMu.Lock()
+	publisher = p
+	publisherMu.Unlock()
+}
+
+// Emit publishes event if publisher is set, errors are only logged.
+func Emit(eventType string, mailboxID, messageID int, data map[string]string) {
+	publisherMu.RLock()
+	p := publisher
+	publisherMu.RUnlock()
+	if p == nil {
+		return
+	}
+	e := &Event{Type: eventType, MailboxID: mailboxID, MessageID: messageID, Time: time.Now(), Data: data}
+	if err := p.Publish(e); err != nil {
+		log.Errorf("Event %s publish error: %v", eventType, err)
+	}
+}
+
+// EmitCleanedUp publishes message.cleaned_up events of deleted messages,
+// called once deletion is committed.
+func EmitCleanedUp(mailboxID int, messageIDs []int, data map[string]string) {
+	for _, messageID := range messageIDs {
+		Emit(MESSAGE_CLEANED_UP, mailboxID, messageID, data)
+	}
+}
+
+// stream entry fields, data keys are prefixed to not clash
+
+func (e *Event) Fields() []string {
+	fields := []string{
+		"type", e.Type,
+		"mailbox_id", strconv.Itoa(e.MailboxID),
+		"message_id", strconv.Itoa(e.MessageID),
+		"time", strconv.FormatInt(e.Time.UnixNano()/int64(time.Millisecond), 10),
+	}
+	for k, v := range e.Data {
+		fields = append(fields, "data."+k, v)
+	}
+	return fields
+}
+
+// StreamPublisher appends events with XADD and server generated IDs, the
+// stream is trimmed to about MaxLen entries.
+type StreamPublisher struct {
+	Pool   RedisPool
+	Stream string
+	MaxLen int
+}
+
+func (p *StreamPublisher) Publish(e *Event) error {
+	redisCon := p.Pool.Get()
+	defer redisCon.Close()
+
+	args := redis.Args{}.Add(p.Stream)
+	if p.MaxLen > 0 {
+		args = args.Add("MAXLEN", "~", p.MaxLen)
+	}
+	args = args.Add("*").AddFlat(e.Fields())
+	_, err := redisCon.Do("XADD", args...)
+	return err
+}
+
+// CreateGroup creates consumer group reading from start of stream, existing
+// groups are kept.
+func (p *StreamPublisher) CreateGroup(group string) error {
+	redisCon := p.Pool.Get()
+	defer redisCon.Close()
+
+	_, err := redisCon.Do("XGROUP", "CREATE", p.Stream, group, "0", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package events
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type testPublisher struct {
+	events []*Event
+	err    error
+}
+
+func (p *testPublisher) Publish(e *Event) error {
+	p.events = append(p.events, e)
+	return p.err
+}
+
+func TestEmit(t *testing.T) {
+	// no publisher
+	Emit(MESSAGE_STORED, 1, 2, nil)
+
+	p := &testPublisher{}
+	SetPublisher(p)
+	defer SetPublisher(nil)
+	Emit(MESSAGE_STORED, 1, 2, map[string]string{"size": "100"})
+	p.err = errors.New("down")
+	Emit(AUTH_FAILED, 0, 0, nil)
+	if len(p.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(p.events))
+	}
+	e := p.events[0]
+	if e.Type != MESSAGE_STORED || e.MailboxID != 1 || e.MessageID != 2 || e.Data["size"] != "100" || e.Time.IsZero() {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestEmitCleanedUp(t *testing.T) {
+	p := &testPublisher{}
+	SetPublisher(p)
+	defer SetPublisher(nil)
+	EmitCleanedUp(3, []int{7, 8}, map[string]string{"reason": "ttl"})
+	if len(p.events) != 2 || p.events[1].Type != MESSAGE_CLEANED_UP || p.events[1].MessageID != 8 || p.events[1].Data["reason"] != "ttl" {
+		t.Errorf("unexpected events %+v", p.events)
+	}
+}
+
+func TestFields(t *testing.T) {
+	e := &Event{
+		Type:      MESSAGE_VIRUS_FOUND,
+		MailboxID: 3,
+		MessageID: 42,
+		Time:      time.Unix(1700000000, 5000000),
+		Data:      map[string]string{"virus": "Eicar-Test-Signature"},
+	}
+	fields := e.Fields()
+	expected := map[string]string{
+		"type":       MESSAGE_VIRUS_FOUND,
+		"mailbox_id": "3",
+		"message_id": "42",
+		"time":       "1700000000005",
+		"data.virus": "Eicar-Test-Signature",
+	}
+	if len(fields) != 2*len(expected) {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		if expected[fields[i]] != fields[i+1] {
+			t.Errorf("field %s = %q, expected %q", fields[i], fields[i+1], expected[fields[i]])
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Package forward evaluates per-inbox forwarding rules of incoming messages.
+package forward
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+const (
+	FIELD_SENDER    = "sender"
+	FIELD_RECIPIENT = "recipient"
+	FIELD_SUBJECT   = "subject"
+	FIELD_HEADER    = "header"
+
+	ACTION_FORWARD = "forward" // forward to SMTP address
+	ACTION_WEBHOOK = "webhook" // POST message JSON to URL
+	ACTION_DROP    = "drop"    // do not store message
+
+	FORWARDED_HEADER = "X-Falcon-Forwarded" // trace of forwarded message
+)
+
+// Rule is a compiled forwarding rule.
+type Rule struct {
+	ID      int
+	Field   string
+	Header  string // header name for header field
+	Pattern *regexp.Regexp
+	Action  string
+	Target  string // address or URL
+}
+
+// Fields of message matched by rules.
+type Fields struct {
+	Sender     string   // envelope sender
+	Recipients []string // envelope recipients
+	Subject    string
+	Headers    mail.Header
+}
+
+// Compile checks and compiles rule, patterns are case insensitive.
+func Compile(id int, field, header, pattern, action, target string) (*Rule, error) {
+	rule := &Rule{
+		ID:     id,
+		Field:  strings.ToLower(strings.TrimSpace(field)),
+		Header: strings.TrimSpace(header),
+		Action: strings.ToLower(strings.TrimSpace(action)),
+		Target: strings.TrimSpace(target),
+	}
+	switch rule.Field {
+	case FIELD_SENDER, FIELD_RECIPIENT, FIELD_SUBJECT:
+	case FIELD_HEADER:
+		if rule.Header == "" {
+			return nil, fmt.Errorf("forward: rule %d matches header without name", id)
+		}
+	default:
+		return nil, fmt.Errorf("forward: rule %d has unknown field %q", id, field)
+	}
+	switch rule.Action {
+	case ACTION_FORWARD, ACTION_WEBHOOK:
+		if rule.Target == "" {
+			return nil, fmt.Errorf("forward: rule %d has no target", id)
+		}
+	case ACTION_DROP:
+	default:
+		return nil, fmt.Errorf("forward: rule %d has unknown action %q", id, action)
+	}
+	var err error
+	if rule.Pattern, err = regexp.Compile("(?i)" + pattern); err != nil {
+		return nil, fmt.Errorf("forward: rule %d has invalid pattern: %v", id, err)
+	}
+	return rule, nil
+}
+
+// Match reports whether rule matches message fields.
+func (rule *Rule) Match(fields *Fields) bool {
+	switch rule.Field {
+	case FIELD_SENDER:
+		return rule.Pattern.MatchString(fields.Sender)
+	case FIELD_RECIPIENT:
+		for _, rcpt := range fields.Recipients {
+			if rule.Pattern.MatchString(rcpt) {
+				return true
+			}
+		}
+	case FIELD_SUBJECT:
+		return rule.Pattern.MatchString(fields.Subject)
+	case FIELD_HEADER:
+		for _, value := range fields.Headers[textproto.CanonicalMIMEHeaderKey(rule.Header)] {
+			if rule.Pattern.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Evaluate returns matching rules in order. Evaluation stops at first
+// matching drop rule, dropped is true then and it is not returned.
+func Evaluate(rules []*Rule, fields *Fields) (matched []*Rule, dropped bool) {
+	for _, rule := range rules {
+		if !rule.Match(fields) {
+			continue
+		}
+		if rule.Action == ACTION_DROP {
+			return matched, true
+		}
+		matched = append(matched, rule)
+	}
+	return matched, false
+}
+
+// Forwarded reports whether message was forwarded from inbox already, its
+// forwarding would loop. Only trace headers signed with secret count, so
+// senders can not skip forwarding of inbox by adding one.
+func Forwarded(secret []byte, headers mail.Header, mailboxID int) bool {
+	for _, value := range headers[FORWARDED_HEADER] {
+		idx := strings.LastIndex(value, "; sig=")
+		if idx == -1 {
+			continue
+		}
+		signed := strings.TrimSpace(value[:idx])
+		if !hmac.Equal([]byte(strings.TrimSpace(value[idx+len("; sig="):])), []byte(forwardedSignature(secret, signed))) {
+			continue
+		}
+		if strings.HasSuffix(signed, fmt.Sprintf("; inbox=%d", mailboxID)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardedHeader returns trace header of message forwarded from inbox by
+// host, signed with secret.
+func ForwardedHeader(secret []byte, host string, mailboxID int) string {
+	value := fmt.Sprintf("%s; inbox=%d", host, mailboxID)
+	return fmt.Sprintf("%s: %s; sig=%s", FORWARDED_HEADER, value, forwardedSignature(secret, value))
+}
+
+// hex HMAC-SHA256 of trace header value
+
+func forwardedSignature(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
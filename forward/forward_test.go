@@ -0,0 +1,100 @@
+package forward
+
+import (
+	"encoding/json"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/Polymail/go-falcon/parser"
+)
+
+func mustCompile(t *testing.T, id int, field, header, pattern, action, target string) *Rule {
+	rule, err := Compile(id, field, header, pattern, action, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+var testFields = &Fields{
+	Sender:     "alerts@monitoring.example.com",
+	Recipients: []string{"inbox@falcon.test", "ops@falcon.test"},
+	Subject:    "[ALERT] disk is full",
+	Headers:    mail.Header{"X-Priority": {"1"}, "List-Id": {"<ops.example.com>"}},
+}
+
+func TestEvaluate(t *testing.T) {
+	rules := []*Rule{
+		mustCompile(t, 1, "subject", "", `^\[alert\]`, "webhook", "http://localhost/hook"),
+		mustCompile(t, 2, "sender", "", `@other\.com$`, "drop", ""),
+		mustCompile(t, 3, "header", "list-id", `ops\.example\.com`, "forward", "team@example.com"),
+		mustCompile(t, 4, "recipient", "", `^ops@`, "drop", ""),
+		mustCompile(t, 5, "subject", "", `.*`, "forward", "never@example.com"),
+	}
+	matched, dropped := Evaluate(rules, testFields)
+	if !dropped || len(matched) != 2 || matched[0].ID != 1 || matched[1].ID != 3 {
+		t.Errorf("unexpected evaluation: %v, dropped %v", matched, dropped)
+	}
+	matched, dropped = Evaluate(rules[:3], &Fields{Sender: "a@b.com", Subject: "hello"})
+	if dropped || len(matched) != 0 {
+		t.Errorf("expected no matches, got %v, dropped %v", matched, dropped)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, rule := range [][5]string{
+		{"body", "", ".*", "drop", ""},
+		{"header", "", ".*", "drop", ""},
+		{"subject", "", "(", "drop", ""},
+		{"subject", "", ".*", "bounce", ""},
+		{"subject", "", ".*", "webhook", ""},
+	} {
+		if _, err := Compile(1, rule[0], rule[1], rule[2], rule[3], rule[4]); err == nil {
+			t.Errorf("expected error for rule %v", rule)
+		}
+	}
+}
+
+func TestNewPayload(t *testing.T) {
+	email := &parser.ParsedEmail{MailboxID: 7, Subject: "[ALERT] disk is full", From: mail.Address{Name: "Alerts", Address: "alerts@monitoring.example.com"}}
+	email.Attachments = []parser.ParsedAttachment{{AttachmentFileName: "df.txt", AttachmentContentType: "text/plain", AttachmentBody: "full"}}
+	rule := mustCompile(t, 1, "subject", "", "alert", "webhook", "https://hooks.example.com/alerts")
+	data, err := json.Marshal(NewPayload(rule, email, 42, testFields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received Payload
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatal(err)
+	}
+	if received.RuleID != 1 || received.MailboxID != 7 || received.MessageID != 42 || received.From.Address != "alerts@monitoring.example.com" || len(received.Attachments) != 1 || received.Attachments[0].Size != 4 {
+		t.Errorf("unexpected payload %+v", received)
+	}
+}
+
+func TestForwarded(t *testing.T) {
+	secret := []byte("s3cret")
+	header := ForwardedHeader(secret, "mx.falcon.test", 7)
+	if !strings.HasPrefix(header, "X-Falcon-Forwarded: mx.falcon.test; inbox=7; sig=") {
+		t.Errorf("unexpected header %q", header)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(header + "\r\nSubject: hi\r\n\r\nbody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Forwarded(secret, msg.Header, 7) {
+		t.Error("message with trace header of inbox should be forwarded")
+	}
+	if Forwarded(secret, msg.Header, 8) {
+		t.Error("trace header of other inbox should not stop forwarding")
+	}
+	if Forwarded([]byte("other"), msg.Header, 7) {
+		t.Error("trace header of other secret should not stop forwarding")
+	}
+	// added by sender
+	forged := mail.Header{"X-Falcon-Forwarded": {"mx.falcon.test; inbox=7", "mx.falcon.test; inbox=7; sig=00ff"}}
+	if Forwarded(secret, forged, 7) {
+		t.Error("unsigned trace header should not stop forwarding")
+	}
+}
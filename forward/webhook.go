@@ -0,0 +1,68 @@
+package forward
+
+import (
+	"time"
+
+	"github.com/Polymail/go-falcon/parser"
+)
+
+// Address in message JSON.
+type Address struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// Attachment in message JSON, without body.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Size        int    `json:"size"`
+}
+
+// Payload is parsed message JSON posted by webhook action.
+type Payload struct {
+	RuleID      int                 `json:"rule_id"`
+	MailboxID   int                 `json:"mailbox_id"`
+	MessageID   int                 `json:"message_id"`
+	Sender      string              `json:"sender"`
+	Recipients  []string            `json:"recipients"`
+	Subject     string              `json:"subject"`
+	Date        time.Time           `json:"date"`
+	From        Address             `json:"from"`
+	To          Address             `json:"to"`
+	Headers     map[string][]string `json:"headers"`
+	HtmlPart    string              `json:"html_part"`
+	TextPart    string              `json:"text_part"`
+	Attachments []Attachment        `json:"attachments"`
+}
+
+// NewPayload builds message JSON of parsed email.
+func NewPayload(rule *Rule, email *parser.ParsedEmail, messageID int, fields *Fields) *Payload {
+	payload := &Payload{
+		MailboxID:   email.MailboxID,
+		MessageID:   messageID,
+		Sender:      fields.Sender,
+		Recipients:  fields.Recipients,
+		Subject:     email.Subject,
+		Date:        email.Date,
+		From:        Address{Name: email.From.Name, Address: email.From.Address},
+		To:          Address{Name: email.To.Name, Address: email.To.Address},
+		Headers:     email.Headers,
+		HtmlPart:    email.HtmlPart,
+		TextPart:    email.TextPart,
+		Attachments: []Attachment{},
+	}
+	if rule != nil {
+		payload.RuleID = rule.ID
+	}
+	for _, attachment := range email.Attachments {
+		payload.Attachments = append(payload.Attachments, Attachment{
+			Filename:    attachment.AttachmentFileName,
+			ContentType: attachment.AttachmentContentType,
+			ContentID:   attachment.AttachmentContentID,
+			Size:        len(attachment.AttachmentBody),
+		})
+	}
+	return payload
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/Polymail/go-falcon/config"
 	"github.com/Polymail/go-falcon/daemon"
 	"github.com/Polymail/go-falcon/log"
@@ -20,8 +22,23 @@ func main() {
 	}
 	// conf
 	log.Debugf("Loaded config: %+v", globalConfig)
+	// subcommands
+	if args := daemon.CommandArgs(); len(args) > 0 {
+		if daemon.RunCommand(globalConfig, args) != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	// check storage queries
+	if globalConfig.CheckStorage() != nil {
+		os.Exit(1)
+	}
+	// start event log
+	protocol.StartEventLog(globalConfig)
 	// start nginx proxy
 	proxy.StartNginxHTTPProxy(globalConfig)
+	// start search api
+	protocol.StartSearchServer(globalConfig)
 	// start pop3 server
 	protocol.StartPop3Server(globalConfig)
 	// start smtp server
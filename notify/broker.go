@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/streadway/amqp"
+)
+
+// nats
+
+// NATSSink publishes notifications to NATS subject.
+type NATSSink struct {
+	Conn    *nats.Conn
+	Subject string
+}
+
+func NewNATSSink(url, subject string) (*NATSSink, error) {
+	conn, err := nats.Connect(url, nats.Name("falcon"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &NATSSink{Conn: conn, Subject: subject}, nil
+}
+
+func (s *NATSSink) Name() string {
+	return SINK_NATS
+}
+
+func (s *NATSSink) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return s.Conn.Publish(inboxName(s.Subject, n.MailboxID), data)
+}
+
+// amqp
+
+// AMQPSink publishes persistent notifications to AMQP exchange, the
+// connection is reopened after errors.
+type AMQPSink struct {
+	URL        string
+	Exchange   string
+	RoutingKey string
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+func NewAMQPSink(url, exchange, routingKey string) (*AMQPSink, error) {
+	s := &AMQPSink{URL: url, Exchange: exchange, RoutingKey: routingKey}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *AMQPSink) connect() error {
+	conn, err := amqp.Dial(s.URL)
+	if err != nil {
+		return err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn, s.channel = conn, channel
+	return nil
+}
+
+func (s *AMQPSink) close() {
+	if s.channel != nil {
+		s.channel.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn, s.channel = nil, nil
+}
+
+func (s *AMQPSink) Name() string {
+	return SINK_AMQP
+}
+
+func (s *AMQPSink) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	msg := amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         data,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// one reconnect per notification
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.channel == nil {
+			if err = s.connect(); err != nil {
+				continue
+			}
+		}
+		err = s.channel.Publish(s.Exchange, inboxName(s.RoutingKey, n.MailboxID), false, false, msg)
+		if err == nil {
+			return nil
+		}
+		s.close()
+	}
+	return err
+}
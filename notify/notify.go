@@ -0,0 +1,99 @@
+// Package notify sends notifications about stored messages to configurable
+// sinks: Faye, Sidekiq, Redis Streams, Redis pub/sub, NATS and AMQP.
+package notify
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	SINK_FAYE    = "faye"
+	SINK_SIDEKIQ = "sidekiq"
+	SINK_STREAM  = "stream"
+	SINK_PUBSUB  = "pubsub"
+	SINK_NATS    = "nats"
+	SINK_AMQP    = "amqp"
+
+	INBOX_PLACEHOLDER = "[[inbox_id]]"
+)
+
+// per sink counters: "<sink>.sent", "<sink>.errors" and "<sink>.latency_us"
+var metrics = expvar.NewMap("notification_sinks")
+
+// Notification is sent to sinks after a message is stored.
+type Notification struct {
+	MailboxID int    `json:"mailbox_id"`
+	MessageID int    `json:"message_id"`
+	Subject   string `json:"subject"`
+	QueueID   string `json:"queue_id,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func NewNotification(mailboxID, messageID int, subject, queueID string) *Notification {
+	return &Notification{MailboxID: mailboxID, MessageID: messageID, Subject: subject, QueueID: queueID, Timestamp: time.Now().Unix()}
+}
+
+// Sink delivers notifications to one backend.
+type Sink interface {
+	Name() string
+	Notify(n *Notification) error
+}
+
+// RedisPool gives connections for redis sinks.
+type RedisPool interface {
+	Get() redis.Conn
+}
+
+// Dispatcher sends notifications to all sinks concurrently.
+type Dispatcher struct {
+	Sinks []Sink
+}
+
+func NewDispatcher(sinks ...Sink) *Dispatcher {
+	return &Dispatcher{Sinks: sinks}
+}
+
+// Notify waits for all sinks, errors of sinks are logged and counted and
+// the first one is returned.
+func (d *Dispatcher) Notify(n *Notification) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, sink := range d.Sinks {
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+			start := time.Now()
+			err := sink.Notify(n)
+			metrics.Add(sink.Name()+".latency_us", time.Since(start).Nanoseconds()/int64(time.Microsecond))
+			if err != nil {
+				metrics.Add(sink.Name()+".errors", 1)
+				log.Errorf("Notification sink %s error: %v", sink.Name(), err)
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %v", sink.Name(), err)
+				}
+				mu.Unlock()
+				return
+			}
+			metrics.Add(sink.Name()+".sent", 1)
+		}(sink)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// replace inbox placeholder of channel, subject or routing key
+func inboxName(template string, mailboxID int) string {
+	return strings.Replace(template, INBOX_PLACEHOLDER, strconv.Itoa(mailboxID), -1)
+}
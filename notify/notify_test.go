@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testSink struct {
+	name  string
+	err   error
+	calls int32
+}
+
+func (s *testSink) Name() string {
+	return s.name
+}
+
+func (s *testSink) Notify(n *Notification) error {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(10 * time.Millisecond)
+	return s.err
+}
+
+func metricValue(key string) string {
+	if v := metrics.Get(key); v != nil {
+		return v.String()
+	}
+	return ""
+}
+
+func TestDispatcher(t *testing.T) {
+	good := &testSink{name: "test-good"}
+	bad := &testSink{name: "test-bad", err: errors.New("down")}
+	other := &testSink{name: "test-other"}
+	dispatcher := NewDispatcher(good, bad, other)
+	start := time.Now()
+	err := dispatcher.Notify(NewNotification(1, 2, "hello", "65F1A2B3C4D5E6F708"))
+	if err == nil || !strings.Contains(err.Error(), "test-bad") {
+		t.Errorf("expected error of bad sink, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 25*time.Millisecond {
+		t.Errorf("sinks should run concurrently, took %v", elapsed)
+	}
+	if good.calls != 1 || bad.calls != 1 || other.calls != 1 {
+		t.Errorf("every sink should be called once: %d %d %d", good.calls, bad.calls, other.calls)
+	}
+	if metricValue("test-good.sent") != "1" || metricValue("test-bad.errors") != "1" || metricValue("test-bad.sent") != "" {
+		t.Errorf("unexpected metrics %s", expvar.Get("notification_sinks").String())
+	}
+}
+
+func TestFayeMessage(t *testing.T) {
+	sink := &FayeSink{Username: "admin", Password: `pa"ss`}
+	data, err := sink.message(&Notification{MailboxID: 3, MessageID: 42, QueueID: "65F1A2B3C4D5E6F708"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg fayeMessage
+	if err = json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("invalid json %s: %v", data, err)
+	}
+	if msg.Channel != "/inboxes/3" || msg.Ext["password"] != `pa"ss` || msg.Data["mailbox_id"] != "3" || msg.Data["message_id"] != "42" || msg.Data["queue_id"] != "65F1A2B3C4D5E6F708" {
+		t.Errorf("unexpected message %s", data)
+	}
+}
+
+func TestSidekiqJob(t *testing.T) {
+	n := &Notification{MailboxID: 3, MessageID: 42}
+	now := time.Unix(1700000000, 0)
+	// plain
+	sink := &SidekiqSink{Queue: "server", Class: "SmtpServerJob", Format: SIDEKIQ_FORMAT_PLAIN}
+	data, _ := sink.job(n, now)
+	var job map[string]interface{}
+	json.Unmarshal(data, &job)
+	args, _ := job["args"].([]interface{})
+	if job["class"] != "SmtpServerJob" || job["queue"] != "server" || len(args) != 2 || args[0] != 3.0 || args[1] != 42.0 || job["enqueued_at"] != 1700000000.0 {
+		t.Errorf("unexpected plain job %s", data)
+	}
+	// activejob
+	sink.Format = SIDEKIQ_FORMAT_ACTIVEJOB
+	data, _ = sink.job(n, now)
+	job = nil
+	json.Unmarshal(data, &job)
+	args, _ = job["args"].([]interface{})
+	if job["class"] != SIDEKIQ_ACTIVEJOB_CLASS || len(args) != 1 {
+		t.Fatalf("unexpected activejob job %s", data)
+	}
+	wrapped, _ := args[0].(map[string]interface{})
+	if wrapped["job_class"] != "SmtpServerJob" || wrapped["queue_name"] != "server" {
+		t.Errorf("unexpected activejob arguments %s", data)
+	}
+}
+
+func TestSidekiqKey(t *testing.T) {
+	sink := &SidekiqSink{Queue: "server"}
+	if key := sink.key("queues"); key != "queues" {
+		t.Errorf("unexpected key without namespace %q", key)
+	}
+	sink.Namespace = "{sidekiq}"
+	if key := sink.key("queue:server"); key != "{sidekiq}:queue:server" {
+		t.Errorf("unexpected key of namespace %q", key)
+	}
+}
+
+func TestInboxName(t *testing.T) {
+	if name := inboxName("falcon.inboxes.[[inbox_id]]", 7); name != "falcon.inboxes.7" {
+		t.Errorf("unexpected name %q", name)
+	}
+}
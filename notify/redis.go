@@ -0,0 +1,220 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Polymail/go-falcon/utils"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	FAYE_NOTIFICATION_TIMEOUT = 30
+
+	SIDEKIQ_FORMAT_PLAIN     = "plain"
+	SIDEKIQ_FORMAT_ACTIVEJOB = "activejob"
+	SIDEKIQ_ACTIVEJOB_CLASS  = "ActiveJob::QueueAdapters::SidekiqAdapter::JobWrapper"
+)
+
+// faye
+
+// FayeSink pushes messages to Faye clients subscribed to /inboxes/<id>
+// through Faye redis engine.
+type FayeSink struct {
+	Pool     RedisPool
+	Username string
+	Password string
+}
+
+type fayeMessage struct {
+	Channel string            `json:"channel"`
+	Ext     map[string]string `json:"ext"`
+	Data    map[string]string `json:"data"`
+}
+
+func (s *FayeSink) Name() string {
+	return SINK_FAYE
+}
+
+func (s *FayeSink) message(n *Notification) ([]byte, error) {
+	data := map[string]string{"mailbox_id": strconv.Itoa(n.MailboxID), "message_id": strconv.Itoa(n.MessageID)}
+	if n.QueueID != "" {
+		data["queue_id"] = n.QueueID
+	}
+	return json.Marshal(&fayeMessage{
+		Channel: "/inboxes/" + strconv.Itoa(n.MailboxID),
+		Ext:     map[string]string{"username": s.Username, "password": s.Password},
+		Data:    data,
+	})
+}
+
+func (s *FayeSink) Notify(n *Notification) error {
+	data, err := s.message(n)
+	if err != nil {
+		return err
+	}
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	clients, err := redis.Strings(redisCon.Do("SUNION", fmt.Sprintf("/channels/inboxes/%d", n.MailboxID)))
+	if err != nil {
+		return err
+	}
+	for _, clientId := range clients {
+		queue := fmt.Sprintf("/clients/%s/messages", clientId)
+		if _, err = redisCon.Do("RPUSH", queue, data); err != nil {
+			return err
+		}
+		if _, err = redisCon.Do("PUBLISH", "/notifications/messages", clientId); err != nil {
+			return err
+		}
+		// cleanup queue of gone client
+		cutoff := time.Now().UTC().UnixNano() - (1600 * FAYE_NOTIFICATION_TIMEOUT)
+		score, err := redis.Int64(redisCon.Do("ZSCORE", "/clients", clientId))
+		if err != nil {
+			continue
+		}
+		if score > cutoff {
+			redisCon.Do("DEL", queue)
+		}
+	}
+	return nil
+}
+
+// sidekiq
+
+// SidekiqSink enqueues Sidekiq job with mailbox and message ids as
+// arguments, plain or wrapped for ActiveJob. Queue keys are written in one
+// transaction, so with redis cluster Namespace should be a hash tag like
+// "{sidekiq}".
+type SidekiqSink struct {
+	Pool      RedisPool
+	Queue     string
+	Class     string
+	Format    string
+	Namespace string // key prefix of redis-namespace, empty for none
+}
+
+type sidekiqJob struct {
+	Retry      bool          `json:"retry"`
+	Queue      string        `json:"queue"`
+	Class      string        `json:"class"`
+	Args       []interface{} `json:"args"`
+	Jid        string        `json:"jid"`
+	CreatedAt  float64       `json:"created_at"`
+	EnqueuedAt float64       `json:"enqueued_at"`
+}
+
+type activeJob struct {
+	JobClass  string `json:"job_class"`
+	JobID     string `json:"job_id"`
+	QueueName string `json:"queue_name"`
+	Arguments []int  `json:"arguments"`
+}
+
+func (s *SidekiqSink) Name() string {
+	return SINK_SIDEKIQ
+}
+
+// key of sidekiq in namespace
+
+func (s *SidekiqSink) key(key string) string {
+	if s.Namespace == "" {
+		return key
+	}
+	return s.Namespace + ":" + key
+}
+
+func (s *SidekiqSink) job(n *Notification, now time.Time) ([]byte, error) {
+	timestamp := float64(now.UnixNano()) / float64(time.Second)
+	job := &sidekiqJob{
+		Retry:      true,
+		Queue:      s.Queue,
+		Class:      s.Class,
+		Args:       []interface{}{n.MailboxID, n.MessageID},
+		Jid:        utils.GenerateRandString(24),
+		CreatedAt:  timestamp,
+		EnqueuedAt: timestamp,
+	}
+	if s.Format != SIDEKIQ_FORMAT_PLAIN {
+		job.Class = SIDEKIQ_ACTIVEJOB_CLASS
+		job.Args = []interface{}{&activeJob{
+			JobClass:  s.Class,
+			JobID:     utils.GenerateRandString(20),
+			QueueName: s.Queue,
+			Arguments: []int{n.MailboxID, n.MessageID},
+		}}
+	}
+	return json.Marshal(job)
+}
+
+func (s *SidekiqSink) Notify(n *Notification) error {
+	data, err := s.job(n, time.Now())
+	if err != nil {
+		return err
+	}
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	redisCon.Send("MULTI")
+	redisCon.Send("SADD", s.key("queues"), s.Queue)
+	redisCon.Send("LPUSH", s.key(fmt.Sprintf("queue:%s", s.Queue)), data)
+	_, err = redisCon.Do("EXEC")
+	return err
+}
+
+// redis streams
+
+// StreamSink appends notifications to redis stream, trimmed to about MaxLen entries.
+type StreamSink struct {
+	Pool   RedisPool
+	Stream string
+	MaxLen int
+}
+
+func (s *StreamSink) Name() string {
+	return SINK_STREAM
+}
+
+func (s *StreamSink) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	args := redis.Args{}.Add(inboxName(s.Stream, n.MailboxID))
+	if s.MaxLen > 0 {
+		args = args.Add("MAXLEN", "~", s.MaxLen)
+	}
+	args = args.Add("*", "mailbox_id", n.MailboxID, "message_id", n.MessageID, "queue_id", n.QueueID, "data", data)
+	_, err = redisCon.Do("XADD", args...)
+	return err
+}
+
+// redis pub/sub
+
+// PubSubSink publishes notifications to redis channel.
+type PubSubSink struct {
+	Pool    RedisPool
+	Channel string
+}
+
+func (s *PubSubSink) Name() string {
+	return SINK_PUBSUB
+}
+
+func (s *PubSubSink) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	redisCon := s.Pool.Get()
+	defer redisCon.Close()
+
+	_, err = redisCon.Do("PUBLISH", inboxName(s.Channel, n.MailboxID), data)
+	return err
+}
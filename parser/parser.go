@@ -2,6 +2,7 @@ package parser
 
 import (
 	"bytes"
+	"github.com/Polymail/go-falcon/arc"
 	"github.com/Polymail/go-falcon/go_multipart_pacthed"
 	"github.com/Polymail/go-falcon/log"
 	"github.com/Polymail/go-falcon/protocol/smtpd"
@@ -34,12 +35,27 @@ type ParsedEmail struct {
 	To      mail.Address
 	Headers mail.Header
 
+	// all addresses of headers
+	FromList, ToList, CcList, BccList, ReplyToList []mail.Address
+	MessageID, InReplyTo                           string
+	References                                     []string
+	// headers of message, Headers are replaced by headers of attached message/rfc822
+	MessageHeaders mail.Header
+
+	// smtp MAIL FROM and RCPT TO
+	EnvelopeFrom string
+	EnvelopeTo   []string
+	// queue id of smtp server
+	QueueID string
+
 	HtmlPart string
 	TextPart string
 
 	Attachments []ParsedAttachment
 
 	EmailBody []byte
+
+	ArcResult *arc.Result // ARC chain status, nil if not validated
 }
 
 // parse headers
@@ -66,6 +82,48 @@ func getFromOrToHeader(email *ParsedEmail, headerType string) mail.Address {
 	return mailAddressRes
 }
 
+// all addresses of header, addresses of invalid list are parsed one by one
+
+func getAddressList(email *ParsedEmail, headerType string) []mail.Address {
+	var addresses []mail.Address
+	emailHeader := email.Headers.Get(headerType)
+	if emailHeader == "" {
+		return nil
+	}
+	list, err := mail.ParseAddressList(emailHeader)
+	if err == nil {
+		for _, address := range list {
+			address.Name = MimeHeaderDecode(address.Name)
+			addresses = append(addresses, *address)
+		}
+		return addresses
+	}
+	for _, part := range strings.Split(emailHeader, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		if address, err := mail.ParseAddress(part); err == nil {
+			address.Name = MimeHeaderDecode(address.Name)
+			addresses = append(addresses, *address)
+		} else {
+			addresses = append(addresses, extractFromToHeader(part))
+		}
+	}
+	return addresses
+}
+
+// message ids of References or In-Reply-To
+
+func getMessageIds(header string) []string {
+	var ids []string
+	for _, id := range strings.Fields(header) {
+		if id = strings.Trim(id, ","); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
 func (email *ParsedEmail) parseEmailHeaders(msg *mail.Message) {
 	var err error
 
@@ -82,6 +140,17 @@ func (email *ParsedEmail) parseEmailHeaders(msg *mail.Message) {
 	email.From = getFromOrToHeader(email, "From")
 	// to
 	email.To = getFromOrToHeader(email, "To")
+	// address lists
+	email.FromList = getAddressList(email, "From")
+	email.ToList = getAddressList(email, "To")
+	email.CcList = getAddressList(email, "Cc")
+	email.BccList = getAddressList(email, "Bcc")
+	email.ReplyToList = getAddressList(email, "Reply-To")
+	// thread
+	email.MessageID = strings.TrimSpace(email.Headers.Get("Message-Id"))
+	email.InReplyTo = strings.TrimSpace(email.Headers.Get("In-Reply-To"))
+	email.References = getMessageIds(email.Headers.Get("References"))
+	email.MessageHeaders = msg.Header
 }
 
 // select type of email
@@ -288,6 +357,13 @@ func ParseMail(env *smtpd.BasicEnvelope) (*ParsedEmail, error) {
 		return nil, err
 	}
 	email.RawMail = email.env.MailBody
+	email.QueueID = env.QueueId
+	if env.From != nil {
+		email.EnvelopeFrom = env.From.Email()
+	}
+	for _, rcpt := range env.Rcpts {
+		email.EnvelopeTo = append(email.EnvelopeTo, rcpt.Email())
+	}
 	email.parseEmailHeaders(msg)
 	email.parseEmailBody(mailBody)
 	return email, nil
@@ -1154,3 +1154,49 @@ func (s *ParserSuite) TestBadMailParser(c *C) {
 		}
 	}
 }
+
+// address lists, thread headers and envelope
+
+type testAddress string
+
+func (a testAddress) Email() string    { return string(a) }
+func (a testAddress) Hostname() string { return "" }
+func (a testAddress) Username() string { return "" }
+
+func (s *ParserSuite) TestHeaderLists(c *C) {
+	testBody := strings.Replace(`From: Leo <leo@example.com>
+To: "Max, Team" <max@example.com>, kate@example.com
+Cc: =?UTF-8?B?0JjQstCw0L0=?= <ivan@example.com>, broken <invalid
+Reply-To: support@example.com
+Message-ID: <1@example.com>
+In-Reply-To: <0@example.com>
+References: <a@example.com>
+ <0@example.com>
+Subject: Lists
+
+Body
+`, "\n", "\r\n", -1)
+	envelop := &smtpd.BasicEnvelope{
+		From:     testAddress("bounce@example.com"),
+		Rcpts:    []smtpd.MailAddress{testAddress("max@example.com"), testAddress("hidden@example.com")},
+		MailBody: []byte(testBody),
+	}
+	email, err := ParseMail(envelop)
+	c.Assert(err, IsNil)
+	c.Check(email.From.Address, Equals, "leo@example.com")
+	c.Assert(len(email.ToList), Equals, 2)
+	c.Check(email.ToList[0].Name, Equals, "Max, Team")
+	c.Check(email.ToList[1].Address, Equals, "kate@example.com")
+	c.Assert(len(email.CcList), Equals, 2)
+	c.Check(email.CcList[0].Name, Equals, "Иван")
+	c.Check(email.CcList[0].Address, Equals, "ivan@example.com")
+	c.Check(len(email.BccList), Equals, 0)
+	c.Assert(len(email.ReplyToList), Equals, 1)
+	c.Check(email.ReplyToList[0].Address, Equals, "support@example.com")
+	c.Check(email.MessageID, Equals, "<1@example.com>")
+	c.Check(email.InReplyTo, Equals, "<0@example.com>")
+	c.Check(strings.Join(email.References, " "), Equals, "<a@example.com> <0@example.com>")
+	c.Check(email.MessageHeaders.Get("Subject"), Equals, "Lists")
+	c.Check(email.EnvelopeFrom, Equals, "bounce@example.com")
+	c.Check(strings.Join(email.EnvelopeTo, " "), Equals, "max@example.com hidden@example.com")
+}
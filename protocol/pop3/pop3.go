@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/events"
 	"github.com/Polymail/go-falcon/log"
 	"github.com/Polymail/go-falcon/utils"
 	"io"
@@ -320,6 +321,12 @@ func (s *session) handleDel(line string) {
 			if err != nil {
 				s.sendlinef("-ERR no such message")
 			} else {
+				events.Emit(events.MESSAGE_DELETED_BY_POP, s.mailboxId, messageId, nil)
+				if index := s.srv.ServerConfig.SearchIndex(); index != nil {
+					if err = index.Delete(s.mailboxId, messageId); err != nil {
+						log.Errorf("Search index: %v", err)
+					}
+				}
 				s.sendlinef("+OK message 1 deleted")
 			}
 		} else {
@@ -501,6 +508,7 @@ func (s *session) authByDB(authMethod string) {
 	var err error
 	s.mailboxId, err = s.srv.ServerConfig.DbPool.CheckUser(authMethod, s.authUsername, s.authPassword, s.authCramMd5Login)
 	if err != nil {
+		events.Emit(events.AUTH_FAILED, 0, 0, map[string]string{"protocol": "pop3", "method": authMethod, "username": s.authUsername, "remote_addr": s.Addr().String()})
 		s.sendlinef("-ERR invalid username or password")
 		return
 	}
@@ -4,10 +4,14 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"fmt"
+	"github.com/Polymail/go-falcon/campaign"
 	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/events"
 	"github.com/Polymail/go-falcon/log"
 	"github.com/Polymail/go-falcon/protocol/pop3"
 	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spf"
+	"github.com/Polymail/go-falcon/trace"
 	"github.com/Polymail/go-falcon/worker"
 	"time"
 )
@@ -102,6 +106,29 @@ func goPop3Server(config *config.Config) {
 	}
 }
 
+// start event log
+
+func StartEventLog(config *config.Config) {
+	if !config.Events.Enabled {
+		return
+	}
+	if !config.Redis.Enabled {
+		log.Errorf("Event log disabled: redis should be enabled")
+		return
+	}
+	publisher := &events.StreamPublisher{
+		Pool:   config.RedisPool,
+		Stream: config.Events.Stream,
+		MaxLen: config.Events.Max_Len,
+	}
+	for _, group := range config.Events.Groups {
+		if err := publisher.CreateGroup(group); err != nil {
+			log.Errorf("Event log group %s: %v", group, err)
+		}
+	}
+	events.SetPublisher(publisher)
+}
+
 // start pop3 server
 
 func StartPop3Server(config *config.Config) {
@@ -130,6 +157,24 @@ func StartSmtpServer(config *config.Config) {
 		WriteTimeout: time.Duration(TCP_TIMEOUT) * time.Second,
 		ReadTimeout:  time.Duration(TCP_TIMEOUT) * time.Second,
 	}
+	// spf
+	if config.Spf.Enabled {
+		s.SpfChecker = &spf.Checker{
+			Resolver: spf.NewDNSResolver(time.Duration(config.Spf.Timeout) * time.Second),
+			Hostname: config.Adapter.Hostname,
+		}
+	}
+	// reverse DNS of Received header
+	if config.Trace_Headers.Received && config.Trace_Headers.Reverse_Dns {
+		s.Resolver = trace.NewDNSResolver(time.Duration(config.Trace_Headers.Dns_Timeout) * time.Second)
+	}
+	// spam campaigns
+	s.CampaignDetector = campaign.NewDetector(config.CacheStore, time.Duration(config.Campaign.Window)*time.Second)
+	go s.CampaignDetector.Run(nil)
+	// greylisting
+	if config.Greylisting.Enabled {
+		s.GreylistTrustedNets = smtpd.ParseTrustedNetworks(config.Greylisting.Trusted_Networks)
+	}
 	// tls certs
 	if config.Adapter.Tls {
 		cert, err := loadSmtpTLSCerts(config)
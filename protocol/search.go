@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/search"
+	"github.com/Polymail/go-falcon/utils"
+)
+
+// start search http api
+
+func StartSearchServer(config *config.Config) {
+	if !config.Search.Enabled {
+		return
+	}
+	var backend search.Backend = config.DbPool
+	if config.Search.Backend == search.BACKEND_BLEVE {
+		index := config.SearchIndex()
+		if index == nil {
+			log.Errorf("Search disabled: bleve index is not opened")
+			return
+		}
+		backend = index
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/search", &search.Handler{
+		Backend: backend,
+		Auth: func(username, password string) (int, error) {
+			return config.DbPool.CheckUser(utils.AUTH_PLAIN, username, password, "")
+		},
+		PerPage:    config.Search.Per_Page,
+		MaxPerPage: config.Search.Max_Per_Page,
+	})
+	serverBind := fmt.Sprintf("%s:%d", config.Search.Host, config.Search.Port)
+	log.Debugf("Search api working on %s", serverBind)
+	go func() {
+		if err := http.ListenAndServe(serverBind, mux); err != nil {
+			log.Errorf("Search api: %v", err)
+		}
+	}()
+}
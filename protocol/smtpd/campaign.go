@@ -0,0 +1,57 @@
+// Package smtpd implements an SMTP server. Hooks are provided to customize
+// its behavior. Campaign function check message for spam campaigns.
+
+package smtpd
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+
+	"github.com/Polymail/go-falcon/campaign"
+	"github.com/Polymail/go-falcon/log"
+)
+
+// decoded subject of message, empty if headers can not be parsed
+
+func messageSubject(data []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	subject := msg.Header.Get("Subject")
+	decoder := new(mime.WordDecoder)
+	if decoded, err := decoder.DecodeHeader(subject); err == nil {
+		return decoded
+	}
+	return subject
+}
+
+// check message after DATA, false if campaign message is rejected
+
+func (s *session) checkCampaign(data []byte) bool {
+	detector := s.srv.CampaignDetector
+	if detector == nil || s.mailboxId <= 0 {
+		return true
+	}
+	settings := s.srv.ServerConfig.Campaign
+	thresholds := campaign.Thresholds{
+		Inbox:   settings.Inbox_Threshold,
+		Sender:  settings.Sender_Threshold,
+		Subject: settings.Subject_Threshold,
+	}
+	if s.inboxSettings.CampaignThreshold > 0 {
+		thresholds.Inbox = s.inboxSettings.CampaignThreshold
+	}
+	c := detector.Check(s.mailboxId, s.mailFrom, messageSubject(data), thresholds)
+	if c == nil {
+		return true
+	}
+	log.Debugf("Spam campaign %s of %v: %d messages", c.Kind, s.mailboxId, c.Messages)
+	if settings.Action == campaign.ACTION_REJECT {
+		s.sendlinef("452 4.7.0 Spam campaign detected, try again later")
+		return false
+	}
+	s.env.AddCampaign(c.Kind)
+	return true
+}
@@ -0,0 +1,31 @@
+// Package smtpd implements an SMTP server. Hooks are provided to customize
+// its behavior. Inbox settings function check senders and message size.
+
+package smtpd
+
+// disabled inbox and senders not allowed by inbox, checked on MAIL FROM
+
+func (s *session) checkInboxSender(sender string) bool {
+	if s.mailboxId == 0 {
+		return true
+	}
+	if s.inboxSettings.Disabled {
+		s.sendlinef("550 5.7.1 Inbox is disabled")
+		return false
+	}
+	if !s.inboxSettings.IsSenderAllowed(sender) {
+		s.sendlinef("550 5.7.1 Sender %s is not allowed", sender)
+		return false
+	}
+	return true
+}
+
+// max message size, inbox setting can only lower adapter size
+
+func (s *session) maxMailSize() int {
+	size := s.srv.ServerConfig.Adapter.Max_Mail_Size
+	if s.inboxSettings.MaxMessageBytes > 0 && s.inboxSettings.MaxMessageBytes < size {
+		size = s.inboxSettings.MaxMessageBytes
+	}
+	return size
+}
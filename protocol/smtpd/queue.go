@@ -0,0 +1,18 @@
+package smtpd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// NewQueueId returns unique hex id of accepted message, sorted by time.
+func NewQueueId() string {
+	now := time.Now()
+	random := make([]byte, 5)
+	if _, err := rand.Read(random); err != nil {
+		binary.BigEndian.PutUint32(random[1:], uint32(now.UnixNano()))
+	}
+	return fmt.Sprintf("%08X%X", uint32(now.Unix()), random)
+}
@@ -0,0 +1,150 @@
+// Package smtpd implements an SMTP server. Hooks are provided to customize
+// its behavior. Redis function add greylisting functionality.
+
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/garyburd/redigo/redis"
+)
+
+// parse trusted networks of greylisting, single addresses are allowed
+
+func ParseTrustedNetworks(networks []string) []*net.IPNet {
+	var trusted []*net.IPNet
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			log.Errorf("Greylisting: invalid trusted network %q: %v", network, err)
+			continue
+		}
+		trusted = append(trusted, ipNet)
+	}
+	return trusted
+}
+
+// check greylisting of recipient, false if session deferred the recipient
+
+func (s *session) checkGreylisting(rcpt MailAddress) bool {
+	greylisting := s.srv.ServerConfig.Greylisting
+	if !greylisting.Enabled || !s.srv.ServerConfig.Redis.Enabled || s.authenticated {
+		return true
+	}
+	ip := s.remoteIP()
+	if ip == nil || s.isTrustedNetwork(ip) {
+		return true
+	}
+	clientNet := greylistClientNetwork(ip)
+	sender := strings.ToLower(s.mailFrom)
+	recipient := strings.ToLower(rcpt.Email())
+
+	redisCon := s.srv.ServerConfig.RedisPool.Get()
+	defer redisCon.Close()
+
+	// auto whitelisted client
+	if greylisting.Auto_Whitelist > 0 {
+		passes, err := redis.Int(redisCon.Do("GET", redisGreylistWhitelistKey(clientNet, sender)))
+		if err == nil && passes >= greylisting.Auto_Whitelist {
+			return true
+		}
+	}
+	// triplet passed before
+	passed, err := redis.Bool(redisCon.Do("EXISTS", redisGreylistPassKey(clientNet, sender, recipient)))
+	if err != nil {
+		// do not lose mail if redis is down
+		log.Errorf("redisGreylisting EXISTS error: %v", err)
+		return true
+	}
+	if passed {
+		redisCon.Do("EXPIRE", redisGreylistPassKey(clientNet, sender, recipient), greylisting.Lifetime)
+		return true
+	}
+	// first attempt of triplet
+	now := time.Now().Unix()
+	pendingKey := redisGreylistPendingKey(clientNet, sender, recipient)
+	created, err := redis.String(redisCon.Do("SET", pendingKey, now, "EX", greylisting.Retry_Window, "NX"))
+	if err != nil && err != redis.ErrNil {
+		log.Errorf("redisGreylisting SET error: %v", err)
+		return true
+	}
+	if created == "OK" {
+		s.deferGreylisted(greylisting.Delay)
+		return false
+	}
+	firstSeen, err := redis.Int64(redisCon.Do("GET", pendingKey))
+	if err != nil {
+		log.Errorf("redisGreylisting GET error: %v", err)
+		return true
+	}
+	if wait := firstSeen + int64(greylisting.Delay) - now; wait > 0 {
+		s.deferGreylisted(int(wait))
+		return false
+	}
+	// client retried correctly
+	redisCon.Send("MULTI")
+	redisCon.Send("SET", redisGreylistPassKey(clientNet, sender, recipient), now, "EX", greylisting.Lifetime)
+	redisCon.Send("DEL", pendingKey)
+	if greylisting.Auto_Whitelist > 0 {
+		redisCon.Send("INCR", redisGreylistWhitelistKey(clientNet, sender))
+		redisCon.Send("EXPIRE", redisGreylistWhitelistKey(clientNet, sender), greylisting.Lifetime)
+	}
+	if _, err = redisCon.Do("EXEC"); err != nil {
+		log.Errorf("redisGreylisting EXEC error: %v", err)
+	}
+	log.Debugf("Greylisting passed for %s, %q -> %q", clientNet, sender, recipient)
+	return true
+}
+
+func (s *session) deferGreylisted(wait int) {
+	log.Debugf("Greylisting deferred %s for %d seconds", s.remoteIP(), wait)
+	s.sendlinef("451 4.7.1 Greylisted, please try again in %d seconds", wait)
+}
+
+func (s *session) isTrustedNetwork(ip net.IP) bool {
+	for _, network := range s.srv.GreylistTrustedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// client /24 network for ipv4, /64 for ipv6
+
+func greylistClientNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// sender domain is whitelisted, not sender address, keys of client network
+// share hash tag for transactions in redis cluster
+
+func redisGreylistWhitelistKey(clientNet, sender string) string {
+	if idx := strings.LastIndex(sender, "@"); idx != -1 {
+		sender = sender[idx+1:]
+	}
+	return fmt.Sprintf("greylist-awl_{%s}_%s", clientNet, sender)
+}
+
+func redisGreylistPendingKey(clientNet, sender, recipient string) string {
+	return fmt.Sprintf("greylist-pending_{%s}_%s_%s", clientNet, sender, recipient)
+}
+
+func redisGreylistPassKey(clientNet, sender, recipient string) string {
+	return fmt.Sprintf("greylist-pass_{%s}_%s_%s", clientNet, sender, recipient)
+}
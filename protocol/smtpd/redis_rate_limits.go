@@ -5,59 +5,90 @@ package smtpd
 
 import (
 	"fmt"
-	"github.com/garyburd/redigo/redis"
+	"github.com/Polymail/go-falcon/cache"
 	"github.com/Polymail/go-falcon/log"
-	"github.com/Polymail/go-falcon/redisworker"
+	"github.com/Polymail/go-falcon/storage"
+	"math"
+	"strings"
 )
 
-func (s *session) getInboxRateLimit(mailboxId int) (int, error) {
-	inboxSettings, err := redisworker.GetCachedInboxSettings(s.srv.ServerConfig, mailboxId)
-	if err != nil || 0 == inboxSettings.MaxMessages || 0 == inboxSettings.RateLimit {
-		// inbox setting from database
-		inboxSettings, err = s.srv.ServerConfig.DbPool.GeInboxSettings(mailboxId)
-		// check settings
-		if err == nil {
-			// cache setting in redis
-			redisworker.StoreCachedInboxSettings(s.srv.ServerConfig, mailboxId, inboxSettings)
-		}
-	}
-	return inboxSettings.RateLimit, err
+const (
+	RATE_LIMIT_INBOX_MESSAGES  = "inbox-messages"
+	RATE_LIMIT_INBOX_BYTES     = "inbox-bytes"
+	RATE_LIMIT_IP_CONNECTIONS  = "ip-connections"
+	RATE_LIMIT_SENDER_MESSAGES = "sender-messages"
+)
+
+func (s *session) getInboxSettings(mailboxId int) (storage.InboxSettings, error) {
+	return cache.LoadInboxSettings(s.srv.ServerConfig.CacheStore, s.srv.ServerConfig.DbPool, mailboxId)
 }
 
-func (s *session) redisIsSessionBlocked() bool {
-	if !s.srv.ServerConfig.Redis.Enabled {
-		return false
+// check GCRA limit in redis, in memory if redis is disabled or fails, returns
+// seconds to wait if limit is exceeded
+
+func (s *session) checkRateLimit(dimension, id string, limit cache.Limit, cost int) int {
+	if !limit.Enabled() {
+		return 0
+	}
+	redisKey := fmt.Sprintf("rate-limit-%s_%s", dimension, id)
+	result, err := s.srv.ServerConfig.CacheStore.Limit(redisKey, limit, cost)
+	if err != nil {
+		log.Errorf("redisRateLimits %s error: %v", dimension, err)
+		return 0
+	}
+	if result.Allowed {
+		return 0
 	}
+	log.Debugf("Rate limit %s exceeded for %s, retry after %v", dimension, id, result.RetryAfter)
+	return int(math.Max(1, math.Ceil(result.RetryAfter.Seconds())))
+}
+
+// connections of client ip, checked before greeting
+
+func (s *session) ipConnectionsRetry() int {
+	ip := s.remoteIP()
+	if ip == nil {
+		return 0
+	}
+	return s.checkRateLimit(RATE_LIMIT_IP_CONNECTIONS, ip.String(), s.srv.ServerConfig.Rate_Limits.Ip_Connections.Limit(0), 1)
+}
+
+// messages of sender to inbox, checked on MAIL FROM
 
-	redisCon := s.srv.ServerConfig.RedisPool.Get()
-	defer redisCon.Close()
-
-	redisKey := s.redisRateLimitKey()
-	emailsKeyCount, err := redis.Int(redisCon.Do("INCR", redisKey))
-	if err == nil {
-		if 1 == emailsKeyCount {
-			// ttl of key begin
-			redisKeyTTL := 1
-			if s.rateLimit > 10 {
-				redisKeyTTL = 10
-			}
-			// ttl of key end
-			_, err = redisCon.Do("EXPIRE", redisKey, redisKeyTTL)
-			if err != nil {
-				log.Errorf("redisRateLimits EXPIRE error: %v", err)
-			}
-		}
-	} else {
-		log.Errorf("redisRateLimits INCR error: %v", err)
-	}
-
-	if err != nil || emailsKeyCount <= s.rateLimit {
+func (s *session) checkSenderRateLimit(sender string) bool {
+	id := fmt.Sprintf("%d_%s", s.mailboxId, strings.ToLower(sender))
+	limit := s.srv.ServerConfig.Rate_Limits.Sender_Messages.Limit(s.inboxSettings.SenderRateLimit)
+	if retry := s.checkRateLimit(RATE_LIMIT_SENDER_MESSAGES, id, limit, 1); retry > 0 {
+		s.sendlinef("451 4.7.0 Too many messages from %s, try again in %d seconds", sender, retry)
 		return false
 	}
+	return true
+}
+
+// messages of inbox, checked on DATA
 
+func (s *session) checkInboxRateLimit() bool {
+	if s.mailboxId == 0 {
+		return true
+	}
+	limit := s.srv.ServerConfig.Rate_Limits.Inbox_Messages.Limit(s.inboxSettings.RateLimit)
+	if retry := s.checkRateLimit(RATE_LIMIT_INBOX_MESSAGES, fmt.Sprintf("%d", s.mailboxId), limit, 1); retry > 0 {
+		s.sendlinef("451 4.7.0 Too many messages for inbox, try again in %d seconds", retry)
+		return false
+	}
 	return true
 }
 
-func (s *session) redisRateLimitKey() string {
-	return fmt.Sprintf("rate-inbox-limits-%d", s.mailboxId)
+// size of messages of inbox, checked after DATA
+
+func (s *session) checkInboxBytesRateLimit(size int) bool {
+	if s.mailboxId == 0 {
+		return true
+	}
+	limit := s.srv.ServerConfig.Rate_Limits.Inbox_Bytes.Limit(s.inboxSettings.BytesRateLimit)
+	if retry := s.checkRateLimit(RATE_LIMIT_INBOX_BYTES, fmt.Sprintf("%d", s.mailboxId), limit, size); retry > 0 {
+		s.sendlinef("451 4.7.0 Too much data for inbox, try again in %d seconds", retry)
+		return false
+	}
+	return true
 }
@@ -12,8 +12,13 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"github.com/Polymail/go-falcon/campaign"
 	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/events"
 	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/spf"
+	"github.com/Polymail/go-falcon/storage"
+	"github.com/Polymail/go-falcon/trace"
 	"github.com/Polymail/go-falcon/utils"
 	"io"
 	"io/ioutil"
@@ -44,6 +49,14 @@ type Server struct {
 
 	ServerConfig *config.Config
 
+	SpfChecker *spf.Checker // optional SPF checker, called after MAIL FROM
+
+	Resolver trace.Resolver // optional reverse DNS of clients for Received header
+
+	CampaignDetector *campaign.Detector // optional spam campaign detector, called after DATA
+
+	GreylistTrustedNets []*net.IPNet // networks not greylisted
+
 	// OnNewConnection, if non-nil, is called on new connections.
 	// If it returns non-nil, the connection is closed.
 	OnNewConnection func(c Connection) error
@@ -71,17 +84,29 @@ type Connection interface {
 type Envelope interface {
 	AddMailboxId(mailboxId int) error
 	AddSender(from MailAddress) error
+	AddRemoteClient(ip net.IP, helo string) error
 	AddRecipient(rcpt MailAddress) error
+	AddSpfResult(result, identity string) error
+	AddCampaign(kind string) error
+	AddQueueId(id string) error
+	AddAuthMethod(method string) error
 	BeginData() error
 	Write(line []byte) error
 	Close() error
 }
 
 type BasicEnvelope struct {
-	MailboxID int
-	From      MailAddress
-	Rcpts     []MailAddress
-	MailBody  []byte
+	MailboxID   int
+	From        MailAddress
+	Rcpts       []MailAddress
+	MailBody    []byte
+	RemoteIP    net.IP
+	Helo        string
+	SpfResult   string
+	SpfIdentity string // "helo" or "mailfrom", identity of SpfResult
+	Campaign    string // kind of spam campaign, empty if none
+	QueueId     string // id of accepted message, returned to client
+	AuthMethod  string // AUTH method of submission, empty for anonymous clients
 }
 
 func (e *BasicEnvelope) AddMailboxId(mailboxId int) error {
@@ -94,11 +119,38 @@ func (e *BasicEnvelope) AddSender(from MailAddress) error {
 	return nil
 }
 
+func (e *BasicEnvelope) AddRemoteClient(ip net.IP, helo string) error {
+	e.RemoteIP = ip
+	e.Helo = helo
+	return nil
+}
+
 func (e *BasicEnvelope) AddRecipient(rcpt MailAddress) error {
 	e.Rcpts = append(e.Rcpts, rcpt)
 	return nil
 }
 
+func (e *BasicEnvelope) AddSpfResult(result, identity string) error {
+	e.SpfResult = result
+	e.SpfIdentity = identity
+	return nil
+}
+
+func (e *BasicEnvelope) AddCampaign(kind string) error {
+	e.Campaign = kind
+	return nil
+}
+
+func (e *BasicEnvelope) AddQueueId(id string) error {
+	e.QueueId = id
+	return nil
+}
+
+func (e *BasicEnvelope) AddAuthMethod(method string) error {
+	e.AuthMethod = method
+	return nil
+}
+
 func (e *BasicEnvelope) BeginData() error {
 	if len(e.Rcpts) == 0 {
 		return SMTPError("554 5.5.1 Error: no valid recipients")
@@ -186,13 +238,25 @@ type session struct {
 	authLogin        bool   // bool for 2 step login auth
 	authCramMd5Login string // bytes for cram-md5 login
 
-	mailboxId    int    // id of mailbox
-	maxMessages  int    // max messages
-	authUsername string // auth login
-	authPassword string // auth password
+	mailboxId     int    // id of mailbox
+	maxMessages   int    // max messages
+	authUsername  string // auth login
+	authPassword  string // auth password
+	authenticated bool   // session is authenticated
+	authMethod    string // AUTH method checked by database, empty if not
+
+	inboxSettings storage.InboxSettings // settings of inbox, overrides rate limits
+
+	spfResult   spf.Result // SPF result for current envelope
+	spfIdentity string     // identity of spfResult, "helo" or "mailfrom"
+	spfHeader   string     // Received-SPF header for current envelope
 
-	rateLimit int  // rate limit from db
-	isBlocked bool // is session blocked
+	mailFrom string        // sender of current envelope
+	rcpts    []MailAddress // recipients of current envelope
+	queueId  string        // queue id of current envelope
+
+	reverseName   string // reverse DNS name of client
+	reverseLooked bool   // reverse DNS is done
 }
 
 func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
@@ -205,8 +269,6 @@ func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
 		authLogin:        false,
 		authCramMd5Login: "",
 		mailboxId:        0,
-		rateLimit:        srv.ServerConfig.Adapter.Rate_Limit,
-		isBlocked:        false,
 	}
 	return
 }
@@ -249,6 +311,11 @@ func (s *session) serve() {
 			return
 		}
 	}
+	// rate limit of client connections
+	if retry := s.ipConnectionsRetry(); retry > 0 {
+		s.sendlinef("421 4.7.0 Too many connections from %s, try again in %d seconds", s.remoteIP(), retry)
+		return
+	}
 	s.sendf("220 %s %s\r\n", s.srv.ServerConfig.Adapter.Welcome_Msg, s.srv.hostname())
 	for {
 		if s.srv.ReadTimeout != 0 {
@@ -384,14 +451,34 @@ func (s *session) handleMailFrom(email string) {
 	}
 	s.resetEnvelope()
 	fromEmail := addrString(email)
+	// inbox accepts sender
+	if !s.checkInboxSender(fromEmail.Email()) {
+		return
+	}
+	// rate limit of sender
+	if !s.checkSenderRateLimit(fromEmail.Email()) {
+		return
+	}
 	env, err := cb(s, fromEmail)
 	if err != nil {
 		log.Errorf("rejecting MAIL FROM %q: %v", email, err)
 		// TODO: send it back to client if warranted, like above
 		return
 	}
+	// spf
+	if !s.checkSpf(fromEmail) {
+		return
+	}
 	s.env = env
+	s.mailFrom = fromEmail.Email()
 	s.env.AddSender(fromEmail)
+	s.env.AddRemoteClient(s.remoteIP(), s.helloHost)
+	if s.authMethod != "" {
+		s.env.AddAuthMethod(s.authMethod)
+	}
+	if s.spfResult != "" {
+		s.env.AddSpfResult(string(s.spfResult), s.spfIdentity)
+	}
 	s.sendlinef("250 2.1.0 Ok")
 }
 
@@ -407,7 +494,7 @@ func (s *session) handleRcpt(line cmdLine) {
 		s.sendlinef("503 5.5.1 Error: need MAIL command")
 		return
 	}
-	if s.checkNeedAuthOrBlocked() {
+	if s.checkNeedAuth() {
 		return
 	}
 
@@ -422,12 +509,21 @@ func (s *session) handleRcpt(line cmdLine) {
 	rcptEmail := addrString(m[1])
 	if s.srv.ServerConfig.Email_Address_Mode.Enabled {
 		s.handleToAddressMode(rcptEmail)
+		// inbox of address mode is known after MAIL
+		if !s.checkInboxSender(s.mailFrom) {
+			return
+		}
+	}
+	// greylisting
+	if !s.checkGreylisting(rcptEmail) {
+		return
 	}
 	err := s.env.AddRecipient(rcptEmail)
 	if err != nil {
 		s.sendSMTPErrorOrLinef(err, "550 bad recipient")
 		return
 	}
+	s.rcpts = append(s.rcpts, rcptEmail)
 	s.sendlinef("250 2.1.0 Ok")
 }
 
@@ -462,10 +558,8 @@ func (s *session) handleData() {
 		s.sendlinef("503 5.5.1 Error: need RCPT command")
 		return
 	}
-	// rate limit
-	s.isBlocked = s.redisIsSessionBlocked()
 	// is need to block?
-	if s.checkNeedAuthOrBlocked() {
+	if s.checkNeedAuth() || !s.checkInboxRateLimit() {
 		return
 	} else {
 		// store mailbox id in envelop
@@ -483,13 +577,28 @@ func (s *session) handleData() {
 
 	data := &bytes.Buffer{}
 	reader := textproto.NewReader(s.br).DotReader()
-	_, err := io.CopyN(data, reader, int64(s.srv.ServerConfig.Adapter.Max_Mail_Size))
+	maxMailSize := s.maxMailSize()
+	_, err := io.CopyN(data, reader, int64(maxMailSize))
 
 	if err == io.EOF {
-		s.env.Write(data.Bytes())
+		// rate limit of inbox size
+		if !s.checkInboxBytesRateLimit(data.Len()) {
+			s.resetEnvelope()
+			return
+		}
+		// spam campaign
+		if !s.checkCampaign(data.Bytes()) {
+			s.resetEnvelope()
+			return
+		}
+		s.queueId = NewQueueId()
+		s.env.AddQueueId(s.queueId)
+		s.env.Write(s.prependTraceHeaders(data.Bytes()))
 		s.env.Close()
+		log.Infof("smtpd: queued %s for inbox %d from %q", s.queueId, s.mailboxId, s.mailFrom)
+		queueId := s.queueId
 		s.resetEnvelope()
-		s.sendlinef("250 2.0.0 Ok: queued")
+		s.sendlinef("250 2.0.0 Ok: queued as %s", queueId)
 		return
 	}
 
@@ -511,25 +620,96 @@ func (s *session) handleData() {
 		return
 	}
 
-	s.sendlinef(fmt.Sprintf("552 5.7.0 Message exceeded max message size of %d bytes", s.srv.ServerConfig.Adapter.Max_Mail_Size))
+	s.sendlinef(fmt.Sprintf("552 5.7.0 Message exceeded max message size of %d bytes", maxMailSize))
 	s.resetEnvelope()
 }
 
 func (s *session) resetEnvelope() {
 	s.env = nil
+	s.spfResult = ""
+	s.spfIdentity = ""
+	s.spfHeader = ""
+	s.mailFrom = ""
+	s.rcpts = nil
+	s.queueId = ""
+}
+
+// prepend trace headers to message, newest on top
+
+func (s *session) prependTraceHeaders(body []byte) []byte {
+	settings := s.srv.ServerConfig.Trace_Headers
+	var headers []string
+	if settings.Return_Path {
+		headers = append(headers, trace.ReturnPath(s.mailFrom))
+	}
+	// recipients of message with several ones would disclose Bcc
+	if len(s.rcpts) == 1 {
+		if settings.Original_To {
+			headers = append(headers, trace.OriginalTo(s.rcpts[0].Email()))
+		}
+		if settings.Delivered_To {
+			headers = append(headers, trace.DeliveredTo(deliveredAddress(s.rcpts[0])))
+		}
+	}
+	if settings.Received {
+		headers = append(headers, s.receivedHeader())
+	}
+	if s.spfHeader != "" {
+		headers = append(headers, s.spfHeader)
+	}
+	return utils.PrependHeaders(body, headers...)
+}
+
+// Received header of current envelope
+
+func (s *session) receivedHeader() string {
+	received := &trace.Received{
+		Helo:        s.helloHost,
+		ReverseName: s.clientName(),
+		IP:          s.remoteIP(),
+		By:          s.srv.hostname(),
+		ID:          s.queueId,
+		Time:        time.Now(),
+	}
+	var secure bool
+	if conn, ok := s.rwc.(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		received.TLS = &state
+		secure = true
+	}
+	received.Protocol = trace.Protocol(s.helloType, secure, s.authenticated)
+	if len(s.rcpts) == 1 {
+		received.For = s.rcpts[0].Email()
+	}
+	return received.Header()
+}
+
+// reverse DNS name of client, once per session
+
+func (s *session) clientName() string {
+	if !s.reverseLooked {
+		s.reverseName = trace.ReverseName(s.srv.Resolver, s.remoteIP())
+		s.reverseLooked = true
+	}
+	return s.reverseName
 }
 
-// check auth if need and not blocked
+// canonical address of recipient, without "+" part
 
-func (s *session) checkNeedAuthOrBlocked() bool {
+func deliveredAddress(rcpt MailAddress) string {
+	if rcpt.Username() == "" || rcpt.Hostname() == "" {
+		return rcpt.Email()
+	}
+	return rcpt.Username() + "@" + rcpt.Hostname()
+}
+
+// check auth if need
+
+func (s *session) checkNeedAuth() bool {
 	if s.srv.ServerConfig.Adapter.Auth && 0 == s.mailboxId {
 		s.sendlinef("530 5.7.0 Authentication required")
 		return true
 	}
-	if s.isBlocked {
-		s.sendlinef("550 5.7.0 Requested action not taken: too many emails per second")
-		return true
-	}
 	return false
 }
 
@@ -539,10 +719,13 @@ func (s *session) authByDB(authMethod string) {
 	if s.srv.ServerConfig.Adapter.Auth {
 		mailboxId, err := s.srv.ServerConfig.DbPool.CheckUser(authMethod, s.authUsername, s.authPassword, s.authCramMd5Login)
 		if err != nil {
+			events.Emit(events.AUTH_FAILED, 0, 0, map[string]string{"protocol": "smtp", "method": authMethod, "username": s.authUsername, "remote_addr": s.Addr().String()})
 			s.sendlinef("535 5.7.1 authentication failed")
 			return
 		}
 		s.setMailboxIdHook(mailboxId)
+		s.authMethod = authMethod
+		s.authenticated = true
 	}
 	s.sendlinef("235 2.0.0 OK, go ahead")
 }
@@ -551,9 +734,9 @@ func (s *session) authByDB(authMethod string) {
 
 func (s *session) setMailboxIdHook(mailboxId int) {
 	s.mailboxId = mailboxId
-	// get rate limit
-	if rateLimit, err := s.getInboxRateLimit(s.mailboxId); err == nil {
-		s.rateLimit = rateLimit
+	// get rate limits
+	if inboxSettings, err := s.getInboxSettings(s.mailboxId); err == nil {
+		s.inboxSettings = inboxSettings
 	}
 }
 
@@ -646,6 +829,11 @@ func (s *session) clearAuthData() {
 // handle AUTH
 
 func (s *session) handleAuth(auth string) {
+	// AUTH is advertised only with auth of adapter
+	if !s.srv.ServerConfig.Adapter.Auth {
+		s.sendlinef("502 5.5.1 Error: authentication not enabled")
+		return
+	}
 	var command, authToken string
 	if idx := strings.Index(auth, " "); idx != -1 {
 		command = strings.ToUpper(auth[:idx])
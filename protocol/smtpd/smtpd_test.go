@@ -0,0 +1,336 @@
+package smtpd
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/storage"
+	"github.com/garyburd/redigo/redis"
+)
+
+const testInboxId = 7
+
+// database of one inbox, every query returns its id
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{}, nil }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("transactions are not supported") }
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+func (fakeStmt) Query(args []driver.Value) (driver.Rows, error) { return &fakeRows{}, nil }
+
+type fakeRows struct{ done bool }
+
+func (r *fakeRows) Columns() []string { return []string{"id"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(testInboxId)
+	return nil
+}
+
+func init() {
+	sql.Register("smtpd_test", fakeDriver{})
+}
+
+// redis of strings, enough for greylisting
+
+type fakeRedis struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (r *fakeRedis) Get() redis.Conn { return &fakeRedisConn{redis: r} }
+func (r *fakeRedis) Close() error    { return nil }
+
+type fakeRedisConn struct {
+	redis   *fakeRedis
+	pending [][]interface{}
+}
+
+func (c *fakeRedisConn) Close() error { return nil }
+func (c *fakeRedisConn) Err() error   { return nil }
+func (c *fakeRedisConn) Flush() error { return nil }
+
+func (c *fakeRedisConn) Receive() (interface{}, error) {
+	return nil, errors.New("receive is not supported")
+}
+
+func (c *fakeRedisConn) Send(cmd string, args ...interface{}) error {
+	if cmd != "MULTI" {
+		c.pending = append(c.pending, append([]interface{}{cmd}, args...))
+	}
+	return nil
+}
+
+func (c *fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.redis.mu.Lock()
+	defer c.redis.mu.Unlock()
+	if cmd == "EXEC" {
+		var replies []interface{}
+		for _, command := range c.pending {
+			replies = append(replies, c.do(command[0].(string), command[1:]))
+		}
+		c.pending = nil
+		return replies, nil
+	}
+	return c.do(cmd, args), nil
+}
+
+func (c *fakeRedisConn) do(cmd string, args []interface{}) interface{} {
+	if c.redis.values == nil {
+		c.redis.values = make(map[string]string)
+	}
+	key := fmt.Sprint(args[0])
+	value, ok := c.redis.values[key]
+	switch cmd {
+	case "GET":
+		if !ok {
+			return nil
+		}
+		return []byte(value)
+	case "EXISTS":
+		if ok {
+			return int64(1)
+		}
+		return int64(0)
+	case "SET":
+		for _, arg := range args[2:] {
+			if arg == "NX" && ok {
+				return nil
+			}
+		}
+		c.redis.values[key] = fmt.Sprint(args[1])
+		return "OK"
+	case "DEL":
+		delete(c.redis.values, key)
+		return int64(1)
+	}
+	return int64(1)
+}
+
+// server of address mode inbox on local port
+
+type testServer struct {
+	srv       *Server
+	listener  net.Listener
+	envelopes chan *BasicEnvelope
+}
+
+type testEnvelope struct {
+	*BasicEnvelope
+	envelopes chan *BasicEnvelope
+}
+
+func (e *testEnvelope) Close() error {
+	e.envelopes <- e.BasicEnvelope
+	return nil
+}
+
+func newTestConfig(t *testing.T) *config.Config {
+	cfg := config.NewConfig()
+	cfg.Adapter.Welcome_Msg = "Falcon Test"
+	cfg.Adapter.Max_Mail_Size = 1 << 20
+	cfg.Email_Address_Mode.Enabled = true
+	cfg.Email_Address_Mode.Domains = []string{"falcon.test"}
+	db, err := storage.InitDatabase(&storage.StorageConfig{Adapter: "postgresql", Email_Address_Mode_Sql: "SELECT id FROM inboxes WHERE username = :username"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB.Close()
+	if db.DB, err = sql.Open("smtpd_test", ""); err != nil {
+		t.Fatal(err)
+	}
+	cfg.DbPool = db
+	cfg.CacheStore = cache.NewMemoryStore(100, time.Minute)
+	cfg.CacheStore.SetInboxSettings(testInboxId, storage.InboxSettings{})
+	return cfg
+}
+
+func startTestServer(t *testing.T, cfg *config.Config) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{listener: listener, envelopes: make(chan *BasicEnvelope, 10)}
+	ts.srv = &Server{
+		Hostname:     "mx.falcon.test",
+		ServerConfig: cfg,
+		OnNewMail: func(c Connection, from MailAddress) (Envelope, error) {
+			return &testEnvelope{BasicEnvelope: new(BasicEnvelope), envelopes: ts.envelopes}, nil
+		},
+	}
+	go ts.srv.Serve(listener)
+	t.Cleanup(func() { listener.Close() })
+	return ts
+}
+
+func (ts *testServer) dial(t *testing.T) *textproto.Conn {
+	conn, err := textproto.Dial("tcp", ts.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	expectReply(t, conn, 220)
+	return conn
+}
+
+// send command and check code of reply, returns message of reply
+
+func command(t *testing.T, conn *textproto.Conn, code int, format string, args ...interface{}) string {
+	t.Helper()
+	if err := conn.PrintfLine(format, args...); err != nil {
+		t.Fatal(err)
+	}
+	return expectReply(t, conn, code)
+}
+
+func expectReply(t *testing.T, conn *textproto.Conn, code int) string {
+	t.Helper()
+	_, message, err := conn.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("expected %d reply: %v", code, err)
+	}
+	return message
+}
+
+func TestAddressModeGreylisting(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Redis.Enabled = true
+	cfg.RedisPool = &fakeRedis{}
+	cfg.Greylisting.Enabled = true
+	cfg.Greylisting.Delay = 300
+	cfg.Greylisting.Retry_Window = 3600
+	cfg.Greylisting.Lifetime = 86400
+	conn := startTestServer(t, cfg).dial(t)
+
+	command(t, conn, 250, "HELO client.example.com")
+	command(t, conn, 250, "MAIL FROM:<leo@example.com>")
+	message := command(t, conn, 451, "RCPT TO:<max@falcon.test>")
+	if !strings.Contains(message, "Greylisted") {
+		t.Errorf("expected greylisted recipient, got %q", message)
+	}
+}
+
+func TestUnadvertisedAuthGreylisting(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Redis.Enabled = true
+	cfg.RedisPool = &fakeRedis{}
+	cfg.Greylisting.Enabled = true
+	cfg.Greylisting.Delay = 300
+	cfg.Greylisting.Retry_Window = 3600
+	cfg.Greylisting.Lifetime = 86400
+	conn := startTestServer(t, cfg).dial(t)
+
+	command(t, conn, 250, "EHLO client.example.com")
+	command(t, conn, 502, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00leo\x00secret")))
+	command(t, conn, 250, "MAIL FROM:<leo@example.com>")
+	command(t, conn, 451, "RCPT TO:<max@falcon.test>")
+}
+
+func TestAddressModeSenderNotAllowed(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.CacheStore.SetInboxSettings(testInboxId, storage.InboxSettings{AllowedSenders: []string{"@example.org"}})
+	conn := startTestServer(t, cfg).dial(t)
+
+	command(t, conn, 250, "HELO client.example.com")
+	command(t, conn, 250, "MAIL FROM:<leo@example.com>")
+	message := command(t, conn, 550, "RCPT TO:<max@falcon.test>")
+	if !strings.Contains(message, "leo@example.com is not allowed") {
+		t.Errorf("expected rejected sender, got %q", message)
+	}
+	command(t, conn, 250, "RSET")
+	command(t, conn, 250, "MAIL FROM:<leo@example.org>")
+	command(t, conn, 250, "RCPT TO:<max@falcon.test>")
+}
+
+// send message of one line, returns message of 250 reply
+
+func sendMessage(t *testing.T, conn *textproto.Conn, from string, rcpts ...string) string {
+	t.Helper()
+	command(t, conn, 250, "MAIL FROM:<%s>", from)
+	for _, rcpt := range rcpts {
+		command(t, conn, 250, "RCPT TO:<%s>", rcpt)
+	}
+	command(t, conn, 354, "DATA")
+	return command(t, conn, 250, "Subject: hello\r\n\r\nhi\r\n.")
+}
+
+func TestRecipientTraceHeaders(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Trace_Headers.Original_To = true
+	cfg.Trace_Headers.Delivered_To = true
+	ts := startTestServer(t, cfg)
+	conn := ts.dial(t)
+
+	command(t, conn, 250, "HELO client.example.com")
+	sendMessage(t, conn, "leo@example.com", "max+news@falcon.test")
+	body := string((<-ts.envelopes).MailBody)
+	if !strings.Contains(body, "X-Original-To: max+news@falcon.test") || !strings.Contains(body, "Delivered-To: max@falcon.test") {
+		t.Errorf("expected recipient headers of single recipient:\n%s", body)
+	}
+	// other recipients are Bcc of each other
+	sendMessage(t, conn, "leo@example.com", "max@falcon.test", "ann@falcon.test")
+	body = string((<-ts.envelopes).MailBody)
+	if strings.Contains(body, "X-Original-To") || strings.Contains(body, "Delivered-To") {
+		t.Errorf("unexpected recipient headers of several recipients:\n%s", body)
+	}
+}
+
+func TestQueuedReply(t *testing.T) {
+	ts := startTestServer(t, newTestConfig(t))
+	conn := ts.dial(t)
+
+	command(t, conn, 250, "HELO client.example.com")
+	message := sendMessage(t, conn, "leo@example.com", "max@falcon.test")
+	env := <-ts.envelopes
+	if env.QueueId == "" || message != "2.0.0 Ok: queued as "+env.QueueId {
+		t.Errorf("unexpected reply %q of queue id %q", message, env.QueueId)
+	}
+	if env.MailboxID != testInboxId {
+		t.Errorf("unexpected inbox %d", env.MailboxID)
+	}
+}
+
+func TestNewQueueId(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9A-F]{18}$`)
+	ids := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		id := NewQueueId()
+		if !format.MatchString(id) {
+			t.Fatalf("unexpected queue id %q", id)
+		}
+		if ids[id] {
+			t.Fatalf("duplicated queue id %q", id)
+		}
+		ids[id] = true
+	}
+}
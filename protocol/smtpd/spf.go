@@ -0,0 +1,65 @@
+package smtpd
+
+import (
+	"net"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/spf"
+)
+
+// check MAIL FROM (and HELO) identity, false if session should reject the sender
+
+func (s *session) checkSpf(from MailAddress) bool {
+	if !s.srv.ServerConfig.Spf.Enabled || s.srv.SpfChecker == nil {
+		return true
+	}
+	ip := s.remoteIP()
+	if ip == nil {
+		return true
+	}
+	helo := s.helloHost
+	var (
+		result spf.Result
+		err    error
+	)
+	identity := spf.IDENTITY_HELO
+	if s.srv.ServerConfig.Spf.Check_Helo && helo != "" {
+		result, err = s.srv.SpfChecker.CheckHelo(ip, helo)
+	}
+	// failed HELO is result of session, MAIL FROM is not checked
+	if result != spf.Fail {
+		identity = spf.IDENTITY_MAILFROM
+		result, err = s.srv.SpfChecker.CheckMailFrom(ip, from.Email(), helo)
+	}
+	if err != nil {
+		log.Debugf("SPF check of %q from %s: %v", from.Email(), ip, err)
+	}
+	log.Debugf("SPF result for %s %q from %s: %s", identity, from.Email(), ip, result)
+	if result == spf.Fail && s.srv.ServerConfig.Spf.Reject_Fail {
+		if identity == spf.IDENTITY_HELO {
+			s.sendlinef("550 5.7.23 SPF validation failed for HELO %s", helo)
+		} else {
+			s.sendlinef("550 5.7.23 SPF validation failed for %s", from.Email())
+		}
+		return false
+	}
+	s.spfResult = result
+	s.spfIdentity = identity
+	s.spfHeader = spf.ReceivedHeader(result, ip, identity, from.Email(), helo, s.srv.hostname())
+	return true
+}
+
+// client ip address
+
+func (s *session) remoteIP() net.IP {
+	switch addr := s.rwc.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
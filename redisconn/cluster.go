@@ -0,0 +1,386 @@
+package redisconn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	CLUSTER_SLOTS         = 16384
+	CLUSTER_MAX_REDIRECTS = 5
+)
+
+// ClusterPool routes commands to cluster nodes by hash slot of their first
+// key and follows MOVED and ASK redirects. Pipelines and transactions run
+// on the node of their first keyed command, so their keys should share
+// slot (use hash tags). The Sidekiq sink writes its queue keys in one
+// transaction and needs a hash tag namespace like "{sidekiq}".
+type ClusterPool struct {
+	opts *Options
+
+	mu     sync.RWMutex
+	pools  map[string]*redis.Pool
+	slots  []string // node address by slot
+	loaded bool
+}
+
+func NewClusterPool(opts *Options) *ClusterPool {
+	return &ClusterPool{
+		opts:  opts,
+		pools: make(map[string]*redis.Pool),
+		slots: make([]string, CLUSTER_SLOTS),
+	}
+}
+
+func (p *ClusterPool) Get() redis.Conn {
+	return &clusterConn{pool: p}
+}
+
+func (p *ClusterPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, pool := range p.pools {
+		pool.Close()
+		delete(p.pools, addr)
+	}
+	return nil
+}
+
+// pool of one node
+
+func (p *ClusterPool) nodePool(addr string) *redis.Pool {
+	p.mu.RLock()
+	pool, ok := p.pools[addr]
+	p.mu.RUnlock()
+	if ok {
+		return pool
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pool, ok = p.pools[addr]; !ok {
+		pool = newPool(p.opts, 0, func() (string, error) { return addr, nil }, false)
+		p.pools[addr] = pool
+	}
+	return pool
+}
+
+// Refresh loads slot map from first node which answers CLUSTER SLOTS.
+func (p *ClusterPool) Refresh() error {
+	p.mu.RLock()
+	addrs := append([]string{}, p.opts.ClusterAddrs...)
+	for addr := range p.pools {
+		addrs = append(addrs, addr)
+	}
+	p.mu.RUnlock()
+
+	var lastErr error
+	for _, addr := range addrs {
+		slots, err := p.loadSlots(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		p.mu.Lock()
+		p.slots = slots
+		p.loaded = true
+		p.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("redisconn: cluster slots not loaded: %v", lastErr)
+}
+
+func (p *ClusterPool) loadSlots(addr string) ([]string, error) {
+	c := p.nodePool(addr).Get()
+	defer c.Close()
+
+	reply, err := redis.Values(c.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	seedHost, _, _ := net.SplitHostPort(addr)
+	slots := make([]string, CLUSTER_SLOTS)
+	for _, r := range reply {
+		entry, err := redis.Values(r, nil)
+		if err != nil || len(entry) < 3 {
+			continue
+		}
+		start, _ := redis.Int(entry[0], nil)
+		end, _ := redis.Int(entry[1], nil)
+		node, err := redis.Values(entry[2], nil)
+		if err != nil || len(node) < 2 {
+			continue
+		}
+		host, _ := redis.String(node[0], nil)
+		port, _ := redis.Int(node[1], nil)
+		if host == "" {
+			host = seedHost
+		}
+		nodeAddr := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < CLUSTER_SLOTS; slot++ {
+			slots[slot] = nodeAddr
+		}
+	}
+	return slots, nil
+}
+
+// node address for key, any known node for empty key
+
+func (p *ClusterPool) addrForKey(key string) (string, error) {
+	p.mu.RLock()
+	loaded := p.loaded
+	p.mu.RUnlock()
+	if !loaded {
+		if err := p.Refresh(); err != nil {
+			return "", err
+		}
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if key != "" {
+		if addr := p.slots[Slot(key)]; addr != "" {
+			return addr, nil
+		}
+	}
+	for _, addr := range p.slots {
+		if addr != "" {
+			return addr, nil
+		}
+	}
+	return p.opts.ClusterAddrs[0], nil
+}
+
+func (p *ClusterPool) setSlot(slot int, addr string) {
+	p.mu.Lock()
+	p.slots[slot] = addr
+	p.mu.Unlock()
+}
+
+// run single command following redirects, slots are reloaded once after
+// connection errors of failed node
+
+func (p *ClusterPool) do(key, cmd string, args []interface{}) (interface{}, error) {
+	addr, err := p.addrForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	asking, refreshed := false, false
+	for i := 0; i < CLUSTER_MAX_REDIRECTS; i++ {
+		c := p.nodePool(addr).Get()
+		if asking {
+			c.Do("ASKING")
+		}
+		reply, err := c.Do(cmd, args...)
+		c.Close()
+		if redisErr, ok := err.(redis.Error); ok {
+			kind, slot, target := parseRedirect(redisErr)
+			switch kind {
+			case "MOVED":
+				p.setSlot(slot, target)
+				addr, asking = target, false
+				continue
+			case "ASK":
+				addr, asking = target, true
+				continue
+			}
+			return reply, err
+		}
+		if err != nil && !refreshed {
+			refreshed = true
+			if p.Refresh() == nil {
+				if addr, err = p.addrForKey(key); err == nil {
+					continue
+				}
+			}
+		}
+		return reply, err
+	}
+	return nil, errors.New("redisconn: too many cluster redirects")
+}
+
+// parse "MOVED 3999 127.0.0.1:6381" and "ASK 3999 127.0.0.1:6381"
+
+func parseRedirect(err redis.Error) (string, int, string) {
+	parts := strings.Fields(string(err))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return "", 0, ""
+	}
+	slot, convErr := strconv.Atoi(parts[1])
+	if convErr != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+		return "", 0, ""
+	}
+	return parts[0], slot, parts[2]
+}
+
+// clusterConn is redis.Conn of ClusterPool. Single commands are routed by
+// key, pipelined commands are bound to one node connection.
+type clusterConn struct {
+	pool    *ClusterPool
+	conn    redis.Conn
+	pending []clusterCommand
+	err     error
+}
+
+type clusterCommand struct {
+	name string
+	args []interface{}
+}
+
+func (c *clusterConn) Close() error {
+	c.pending = nil
+	if c.conn != nil {
+		err := c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (c *clusterConn) Err() error {
+	if c.conn != nil {
+		return c.conn.Err()
+	}
+	return c.err
+}
+
+// bind connection to node of key and replay pending commands
+
+func (c *clusterConn) bind(key string) error {
+	addr, err := c.pool.addrForKey(key)
+	if err != nil {
+		c.err = err
+		return err
+	}
+	c.conn = c.pool.nodePool(addr).Get()
+	for _, cmd := range c.pending {
+		if err = c.conn.Send(cmd.name, cmd.args...); err != nil {
+			return err
+		}
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	if c.conn == nil {
+		key, ok := commandKey(cmd, args)
+		if !ok {
+			c.pending = append(c.pending, clusterCommand{cmd, args})
+			return nil
+		}
+		if err := c.bind(key); err != nil {
+			return err
+		}
+	}
+	return c.conn.Send(cmd, args...)
+}
+
+func (c *clusterConn) Flush() error {
+	if c.conn == nil {
+		if len(c.pending) == 0 {
+			return nil
+		}
+		if err := c.bind(""); err != nil {
+			return err
+		}
+	}
+	return c.conn.Flush()
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	if c.conn == nil {
+		if len(c.pending) == 0 {
+			return nil, errors.New("redisconn: receive without pending commands")
+		}
+		if err := c.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	return c.conn.Receive()
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if c.conn != nil || len(c.pending) > 0 {
+		if c.conn == nil {
+			key, _ := commandKey(cmd, args)
+			if err := c.bind(key); err != nil {
+				return nil, err
+			}
+		}
+		return c.conn.Do(cmd, args...)
+	}
+	if cmd == "" {
+		return nil, nil
+	}
+	key, _ := commandKey(cmd, args)
+	return c.pool.do(key, cmd, args)
+}
+
+// first key of command, false for commands without keys
+
+func commandKey(cmd string, args []interface{}) (string, bool) {
+	switch strings.ToUpper(cmd) {
+	case "", "PING", "MULTI", "EXEC", "DISCARD", "ASKING", "AUTH", "SELECT", "SCRIPT", "INFO", "ROLE", "CLUSTER", "TIME":
+		return "", false
+	case "EVAL", "EVALSHA":
+		if len(args) > 2 {
+			if n, err := strconv.Atoi(argString(args[1])); err == nil && n > 0 {
+				return argString(args[2]), true
+			}
+		}
+		return "", false
+	case "XGROUP", "XINFO", "OBJECT":
+		if len(args) > 1 {
+			return argString(args[1]), true
+		}
+		return "", false
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	return argString(args[0]), true
+}
+
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Slot returns cluster hash slot of key, only hash tag {...} is hashed if
+// key has one.
+func Slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % CLUSTER_SLOTS)
+}
+
+// crc16 XMODEM used by redis cluster
+
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,180 @@
+// Package redisconn builds redis connection pools for a single server,
+// a master discovered with Redis Sentinel or a Redis Cluster.
+package redisconn
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Pool gives redis connections, callers close them after use.
+type Pool interface {
+	Get() redis.Conn
+	Close() error
+}
+
+// Options of connections and pool.
+type Options struct {
+	Addr     string // host:port of single server
+	Username string // ACL username, requires Password
+	Password string
+	Database int // ignored in cluster mode
+
+	TLS           bool
+	TLSServerName string
+	TLSSkipVerify bool
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	MaxIdle     int
+	MaxActive   int
+	Wait        bool // wait for free connection if MaxActive is reached
+	IdleTimeout time.Duration
+
+	SentinelMaster   string // master name, enables sentinel mode
+	SentinelAddrs    []string
+	SentinelUsername string
+	SentinelPassword string
+
+	ClusterAddrs []string // seed nodes, enables cluster mode
+}
+
+// NewPool returns pool by mode of options.
+func NewPool(opts *Options) Pool {
+	if len(opts.ClusterAddrs) > 0 {
+		return NewClusterPool(opts)
+	}
+	if opts.SentinelMaster != "" {
+		return newPool(opts, opts.Database, func() (string, error) {
+			return sentinelMaster(opts)
+		}, true)
+	}
+	return newPool(opts, opts.Database, func() (string, error) {
+		return opts.Addr, nil
+	}, false)
+}
+
+// pool of one server, in sentinel mode the role is checked after dial and
+// on borrow of idle connections to drop connections to demoted master
+func newPool(opts *Options, database int, addr func() (string, error), checkRole bool) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     opts.MaxIdle,
+		MaxActive:   opts.MaxActive,
+		Wait:        opts.Wait,
+		IdleTimeout: opts.IdleTimeout,
+		Dial: func() (redis.Conn, error) {
+			address, err := addr()
+			if err != nil {
+				return nil, err
+			}
+			c, err := dial(address, opts, opts.Username, opts.Password, database)
+			if err != nil {
+				return nil, err
+			}
+			if checkRole {
+				if err = checkMaster(c); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return c, nil
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Second {
+				return nil
+			}
+			if checkRole {
+				return checkMaster(c)
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// dial and authenticate connection, AUTH is sent with username for ACL
+
+func dial(addr string, opts *Options, username, password string, database int) (redis.Conn, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(opts.DialTimeout),
+		redis.DialReadTimeout(opts.ReadTimeout),
+		redis.DialWriteTimeout(opts.WriteTimeout),
+	}
+	if opts.TLS {
+		options = append(options,
+			redis.DialUseTLS(true),
+			redis.DialTLSConfig(&tls.Config{ServerName: opts.TLSServerName, InsecureSkipVerify: opts.TLSSkipVerify}))
+	}
+	c, err := redis.Dial("tcp", addr, options...)
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		args := redis.Args{}
+		if username != "" {
+			args = args.Add(username)
+		}
+		if _, err = c.Do("AUTH", args.Add(password)...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if database != 0 {
+		if _, err = c.Do("SELECT", database); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// ask sentinels for address of master
+
+func sentinelMaster(opts *Options) (string, error) {
+	if len(opts.SentinelAddrs) == 0 {
+		return "", errors.New("redisconn: no sentinel addresses")
+	}
+	var lastErr error
+	for _, addr := range opts.SentinelAddrs {
+		c, err := dial(addr, opts, opts.SentinelUsername, opts.SentinelPassword, 0)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		master, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", opts.SentinelMaster))
+		c.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(master) != 2 {
+			lastErr = fmt.Errorf("redisconn: sentinel %s does not know master %s", addr, opts.SentinelMaster)
+			continue
+		}
+		return net.JoinHostPort(master[0], master[1]), nil
+	}
+	return "", fmt.Errorf("redisconn: master %s not found: %v", opts.SentinelMaster, lastErr)
+}
+
+// check that connection is to master
+
+func checkMaster(c redis.Conn) error {
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errors.New("redisconn: empty ROLE reply")
+	}
+	if name, _ := redis.String(role[0], nil); name != "master" {
+		return fmt.Errorf("redisconn: server role is %s, not master", name)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package redisconn
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fake redis server answering commands with raw RESP replies
+
+type fakeServer struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	handler func(args []string) string
+	log     []string
+}
+
+func newFakeServer(t *testing.T, handler func(args []string) string) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, handler: handler}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.log...)
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				args, err := readCommand(r)
+				if err != nil {
+					return
+				}
+				s.mu.Lock()
+				s.log = append(s.log, strings.Join(args, " "))
+				s.mu.Unlock()
+				conn.Write([]byte(s.handler(args)))
+			}
+		}(conn)
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		if args[i], err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(args[i], "\r\n")
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func hostPort(addr string) (string, string) {
+	host, port, _ := net.SplitHostPort(addr)
+	return host, port
+}
+
+func TestSingleServerAuthAndDatabase(t *testing.T) {
+	server := newFakeServer(t, func(args []string) string {
+		if args[0] == "GET" {
+			return bulk("value")
+		}
+		return "+OK\r\n"
+	})
+	defer server.ln.Close()
+	pool := NewPool(&Options{Addr: server.addr(), Username: "falcon", Password: "secret", Database: 3, DialTimeout: time.Second})
+	defer pool.Close()
+	c := pool.Get()
+	defer c.Close()
+	value, err := redis.String(c.Do("GET", "key"))
+	if err != nil || value != "value" {
+		t.Fatalf("unexpected reply %q %v", value, err)
+	}
+	commands := server.commands()
+	if len(commands) != 3 || commands[0] != "AUTH falcon secret" || commands[1] != "SELECT 3" {
+		t.Errorf("unexpected commands %v", commands)
+	}
+}
+
+func TestSentinelMasterDiscovery(t *testing.T) {
+	master := newFakeServer(t, func(args []string) string {
+		switch args[0] {
+		case "ROLE":
+			return "*3\r\n" + bulk("master") + ":0\r\n*0\r\n"
+		case "GET":
+			return bulk("from-master")
+		}
+		return "+OK\r\n"
+	})
+	defer master.ln.Close()
+	host, port := hostPort(master.addr())
+	sentinel := newFakeServer(t, func(args []string) string {
+		if len(args) == 3 && args[0] == "SENTINEL" && args[2] == "mymaster" {
+			return "*2\r\n" + bulk(host) + bulk(port)
+		}
+		return "*-1\r\n"
+	})
+	defer sentinel.ln.Close()
+
+	pool := NewPool(&Options{
+		SentinelMaster:   "mymaster",
+		SentinelAddrs:    []string{"127.0.0.1:1", sentinel.addr()},
+		SentinelPassword: "sentinel-secret",
+		DialTimeout:      time.Second,
+	})
+	defer pool.Close()
+	c := pool.Get()
+	defer c.Close()
+	value, err := redis.String(c.Do("GET", "key"))
+	if err != nil || value != "from-master" {
+		t.Fatalf("unexpected reply %q %v", value, err)
+	}
+	if commands := sentinel.commands(); len(commands) != 2 || commands[0] != "AUTH sentinel-secret" {
+		t.Errorf("unexpected sentinel commands %v", commands)
+	}
+}
+
+func TestSentinelRejectsReplica(t *testing.T) {
+	replica := newFakeServer(t, func(args []string) string {
+		return "*5\r\n" + bulk("slave") + bulk("127.0.0.1") + ":6379\r\n" + bulk("connected") + ":0\r\n"
+	})
+	defer replica.ln.Close()
+	host, port := hostPort(replica.addr())
+	sentinel := newFakeServer(t, func(args []string) string {
+		return "*2\r\n" + bulk(host) + bulk(port)
+	})
+	defer sentinel.ln.Close()
+
+	pool := NewPool(&Options{SentinelMaster: "mymaster", SentinelAddrs: []string{sentinel.addr()}})
+	defer pool.Close()
+	c := pool.Get()
+	defer c.Close()
+	if _, err := c.Do("GET", "key"); err == nil || !strings.Contains(err.Error(), "not master") {
+		t.Errorf("expected role error, got %v", err)
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	var slotsReply string
+	handler := func(name string) func(args []string) string {
+		return func(args []string) string {
+			switch args[0] {
+			case "CLUSTER":
+				return slotsReply
+			case "GET":
+				return bulk(name + ":" + args[1])
+			}
+			return "+OK\r\n"
+		}
+	}
+	nodeA := newFakeServer(t, handler("a"))
+	defer nodeA.ln.Close()
+	nodeB := newFakeServer(t, handler("b"))
+	defer nodeB.ln.Close()
+	hostA, portA := hostPort(nodeA.addr())
+	hostB, portB := hostPort(nodeB.addr())
+	slotsReply = "*2\r\n" +
+		"*3\r\n:0\r\n:8191\r\n*2\r\n" + bulk(hostA) + ":" + portA + "\r\n" +
+		"*3\r\n:8192\r\n:16383\r\n*2\r\n" + bulk(hostB) + ":" + portB + "\r\n"
+
+	pool := NewPool(&Options{ClusterAddrs: []string{nodeA.addr()}})
+	defer pool.Close()
+	c := pool.Get()
+	defer c.Close()
+	// "foo" is in slot 12182, "bar" in 5061
+	for key, expected := range map[string]string{"foo": "b:foo", "bar": "a:bar", "{bar}.x": "a:{bar}.x"} {
+		value, err := redis.String(c.Do("GET", key))
+		if err != nil || value != expected {
+			t.Errorf("GET %s = %q %v, expected %q", key, value, err, expected)
+		}
+	}
+	// transaction is sent to node of first key
+	c.Send("MULTI")
+	c.Send("SET", "foo", "1")
+	c.Send("EXPIRE", "foo", 10)
+	if _, err := c.Do("EXEC"); err != nil {
+		t.Fatal(err)
+	}
+	commands := strings.Join(nodeB.commands(), "|")
+	if !strings.Contains(commands, "MULTI|SET foo 1|EXPIRE foo 10|EXEC") {
+		t.Errorf("transaction not sent to node b: %s", commands)
+	}
+}
+
+func TestClusterMoved(t *testing.T) {
+	nodeB := newFakeServer(t, func(args []string) string {
+		return bulk("b")
+	})
+	defer nodeB.ln.Close()
+	hostA := "127.0.0.1"
+	var portA string
+	nodeA := newFakeServer(t, func(args []string) string {
+		switch args[0] {
+		case "CLUSTER":
+			return "*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n" + bulk(hostA) + ":" + portA + "\r\n"
+		case "GET":
+			return fmt.Sprintf("-MOVED %d %s\r\n", Slot(args[1]), nodeB.addr())
+		}
+		return "+OK\r\n"
+	})
+	defer nodeA.ln.Close()
+	_, portA = hostPort(nodeA.addr())
+
+	pool := NewClusterPool(&Options{ClusterAddrs: []string{nodeA.addr()}})
+	defer pool.Close()
+	c := pool.Get()
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		value, err := redis.String(c.Do("GET", "foo"))
+		if err != nil || value != "b" {
+			t.Fatalf("unexpected reply %q %v", value, err)
+		}
+	}
+	// second GET goes directly to node b
+	gets := 0
+	for _, cmd := range nodeA.commands() {
+		if strings.HasPrefix(cmd, "GET") {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Errorf("expected one redirected GET on node a, got %d", gets)
+	}
+}
+
+func TestSlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31C3 {
+		t.Errorf("crc16 = %x", crc)
+	}
+	for key, slot := range map[string]int{"foo": 12182, "bar": 5061, "{user1000}.following": Slot("user1000"), "foo{}": Slot("foo{}")} {
+		if Slot(key) != slot {
+			t.Errorf("slot of %s = %d, expected %d", key, Slot(key), slot)
+		}
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []interface{}
+		key  string
+		ok   bool
+	}{
+		{"GET", []interface{}{"a"}, "a", true},
+		{"MULTI", nil, "", false},
+		{"EVALSHA", []interface{}{"sha", 1, []byte("k"), 5}, "k", true},
+		{"EVAL", []interface{}{"return 1", 0}, "", false},
+		{"XGROUP", []interface{}{"CREATE", "stream", "group", "0"}, "stream", true},
+	}
+	for _, test := range tests {
+		key, ok := commandKey(test.cmd, test.args)
+		if key != test.key || ok != test.ok {
+			t.Errorf("commandKey(%s) = %q %v", test.cmd, key, ok)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package redisworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dmarc"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	DMARC_AGGREGATE_TTL = 691200 // 8 days
+	DMARC_DAY_FORMAT    = "2006-01-02"
+)
+
+// DmarcAggregate is accumulated report data of one policy domain for a day.
+type DmarcAggregate struct {
+	Domain string
+	Record *dmarc.Record
+	Counts map[string]int // keyed by dmarc.AggregateRow.Key
+}
+
+// keys of a day share hash tag for transactions in redis cluster
+
+func getRedisDmarcDomainsKey(day string) string {
+	return fmt.Sprintf("dmarc-aggregate-domains_{%s}", day)
+}
+
+func getRedisDmarcRowsKey(day, domain string) string {
+	return fmt.Sprintf("dmarc-aggregate_{%s}_%s", day, domain)
+}
+
+func getRedisDmarcPolicyKey(day, domain string) string {
+	return fmt.Sprintf("dmarc-aggregate-policy_{%s}_%s", day, domain)
+}
+
+// accumulate aggregate report row
+
+func StoreDmarcAggregate(config *config.Config, evaluation *dmarc.Evaluation, row *dmarc.AggregateRow) error {
+	if evaluation.Record == nil || evaluation.Domain == "" {
+		return nil
+	}
+	policy, err := json.Marshal(evaluation.Record)
+	if err != nil {
+		return err
+	}
+	day := time.Now().UTC().Format(DMARC_DAY_FORMAT)
+
+	redisCon := config.RedisPool.Get()
+	defer redisCon.Close()
+
+	redisCon.Send("MULTI")
+	redisCon.Send("SADD", getRedisDmarcDomainsKey(day), evaluation.Domain)
+	redisCon.Send("EXPIRE", getRedisDmarcDomainsKey(day), DMARC_AGGREGATE_TTL)
+	redisCon.Send("HINCRBY", getRedisDmarcRowsKey(day, evaluation.Domain), row.Key(), 1)
+	redisCon.Send("EXPIRE", getRedisDmarcRowsKey(day, evaluation.Domain), DMARC_AGGREGATE_TTL)
+	redisCon.Send("SET", getRedisDmarcPolicyKey(day, evaluation.Domain), policy, "EX", DMARC_AGGREGATE_TTL)
+	_, err = redisCon.Do("EXEC")
+	if err != nil {
+		log.Errorf("redis dmarc aggregate command error: %v", err)
+	}
+	return err
+}
+
+// get aggregate report data of day
+
+func GetDmarcAggregates(config *config.Config, day time.Time) ([]*DmarcAggregate, error) {
+	var aggregates []*DmarcAggregate
+	dayStr := day.UTC().Format(DMARC_DAY_FORMAT)
+
+	redisCon := config.RedisPool.Get()
+	defer redisCon.Close()
+
+	domains, err := redis.Strings(redisCon.Do("SMEMBERS", getRedisDmarcDomainsKey(dayStr)))
+	if err != nil {
+		return nil, err
+	}
+	for _, domain := range domains {
+		aggregate := &DmarcAggregate{Domain: domain}
+		aggregate.Counts, err = redis.IntMap(redisCon.Do("HGETALL", getRedisDmarcRowsKey(dayStr, domain)))
+		if err != nil {
+			return nil, err
+		}
+		policy, err := redis.Bytes(redisCon.Do("GET", getRedisDmarcPolicyKey(dayStr, domain)))
+		if err == nil {
+			aggregate.Record = &dmarc.Record{}
+			if err = json.Unmarshal(policy, aggregate.Record); err != nil {
+				aggregate.Record = nil
+			}
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+	return aggregates, nil
+}
@@ -0,0 +1,107 @@
+package redisworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/relay"
+	"github.com/garyburd/redigo/redis"
+)
+
+// relay keys share {relay} hash tag for transactions in redis cluster
+const (
+	RELAY_QUEUE_KEY = "{relay}-queue"
+)
+
+// claim due members of queue by moving their score forward for lease
+var claimDueScript = redis.NewScript(1, `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, id in ipairs(ids) do
+	redis.call('ZADD', KEYS[1], ARGV[2], id)
+end
+return ids
+`)
+
+// RelayQueue is persistent relay.Queue in redis, scheduled in sorted set by
+// next attempt time.
+type RelayQueue struct {
+	config *config.Config
+}
+
+func NewRelayQueue(config *config.Config) *RelayQueue {
+	return &RelayQueue{config: config}
+}
+
+func getRedisRelayMessageKey(id string) string {
+	return fmt.Sprintf("{relay}-message_%s", id)
+}
+
+// add or reschedule message
+
+func (q *RelayQueue) Push(msg *relay.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	redisCon := q.config.RedisPool.Get()
+	defer redisCon.Close()
+
+	redisCon.Send("MULTI")
+	redisCon.Send("SET", getRedisRelayMessageKey(msg.ID), data)
+	redisCon.Send("ZADD", RELAY_QUEUE_KEY, msg.NextAttempt.Unix(), msg.ID)
+	_, err = redisCon.Do("EXEC")
+	if err != nil {
+		log.Errorf("redis relay push command error: %v", err)
+	}
+	return err
+}
+
+// claim due messages
+
+func (q *RelayQueue) Claim(now time.Time, lease time.Duration, limit int) ([]*relay.Message, error) {
+	redisCon := q.config.RedisPool.Get()
+	defer redisCon.Close()
+
+	ids, err := redis.Strings(claimDueScript.Do(redisCon, RELAY_QUEUE_KEY, now.Unix(), now.Add(lease).Unix(), limit))
+	if err != nil {
+		return nil, err
+	}
+	var messages []*relay.Message
+	for _, id := range ids {
+		data, err := redis.Bytes(redisCon.Do("GET", getRedisRelayMessageKey(id)))
+		if err == redis.ErrNil {
+			// lost message data
+			redisCon.Do("ZREM", RELAY_QUEUE_KEY, id)
+			continue
+		}
+		if err != nil {
+			return messages, err
+		}
+		msg := &relay.Message{}
+		if err = json.Unmarshal(data, msg); err != nil {
+			log.Errorf("Relay message %s is invalid: %v", id, err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// remove message
+
+func (q *RelayQueue) Remove(id string) error {
+	redisCon := q.config.RedisPool.Get()
+	defer redisCon.Close()
+
+	redisCon.Send("MULTI")
+	redisCon.Send("ZREM", RELAY_QUEUE_KEY, id)
+	redisCon.Send("DEL", getRedisRelayMessageKey(id))
+	_, err := redisCon.Do("EXEC")
+	if err != nil {
+		log.Errorf("redis relay remove command error: %v", err)
+	}
+	return err
+}
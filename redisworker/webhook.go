@@ -0,0 +1,136 @@
+package redisworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/webhook"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	WEBHOOK_QUEUE_KEY   = "{webhook}-queue" // deliveries share hash tag for redis cluster
+	WEBHOOK_LOG_TTL     = 604800            // 7 days
+	WEBHOOK_LOG_DEFAULT = 100
+)
+
+// WebhookQueue is persistent webhook.Queue in redis, scheduled in sorted
+// set by next attempt time.
+type WebhookQueue struct {
+	config *config.Config
+}
+
+func NewWebhookQueue(config *config.Config) *WebhookQueue {
+	return &WebhookQueue{config: config}
+}
+
+func getRedisWebhookDeliveryKey(id string) string {
+	return fmt.Sprintf("{webhook}-delivery_%s", id)
+}
+
+func getRedisWebhookLogKey(mailboxID int) string {
+	return fmt.Sprintf("webhook-attempts_%d", mailboxID)
+}
+
+// add or reschedule delivery
+
+func (q *WebhookQueue) Push(d *webhook.Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	redisCon := q.config.RedisPool.Get()
+	defer redisCon.Close()
+
+	redisCon.Send("MULTI")
+	redisCon.Send("SET", getRedisWebhookDeliveryKey(d.ID), data)
+	redisCon.Send("ZADD", WEBHOOK_QUEUE_KEY, d.NextAttempt.Unix(), d.ID)
+	_, err = redisCon.Do("EXEC")
+	if err != nil {
+		log.Errorf("redis webhook push command error: %v", err)
+	}
+	return err
+}
+
+// claim due deliveries
+
+func (q *WebhookQueue) Claim(now time.Time, lease time.Duration, limit int) ([]*webhook.Delivery, error) {
+	redisCon := q.config.RedisPool.Get()
+	defer redisCon.Close()
+
+	ids, err := redis.Strings(claimDueScript.Do(redisCon, WEBHOOK_QUEUE_KEY, now.Unix(), now.Add(lease).Unix(), limit))
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []*webhook.Delivery
+	for _, id := range ids {
+		data, err := redis.Bytes(redisCon.Do("GET", getRedisWebhookDeliveryKey(id)))
+		if err == redis.ErrNil {
+			redisCon.Do("ZREM", WEBHOOK_QUEUE_KEY, id)
+			continue
+		}
+		if err != nil {
+			return deliveries, err
+		}
+		d := &webhook.Delivery{}
+		if err = json.Unmarshal(data, d); err != nil {
+			log.Errorf("Webhook delivery %s is invalid: %v", id, err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// remove delivery
+
+func (q *WebhookQueue) Remove(id string) error {
+	redisCon := q.config.RedisPool.Get()
+	defer redisCon.Close()
+
+	redisCon.Send("MULTI")
+	redisCon.Send("ZREM", WEBHOOK_QUEUE_KEY, id)
+	redisCon.Send("DEL", getRedisWebhookDeliveryKey(id))
+	_, err := redisCon.Do("EXEC")
+	if err != nil {
+		log.Errorf("redis webhook remove command error: %v", err)
+	}
+	return err
+}
+
+// log delivery attempt of inbox, latest attempts first
+
+func LogWebhookAttempt(config *config.Config, attempt *webhook.Attempt) {
+	entry, err := json.Marshal(map[string]interface{}{
+		"delivery_id": attempt.Delivery.ID,
+		"url":         attempt.Delivery.URL,
+		"attempt":     attempt.Delivery.Attempts,
+		"status_code": attempt.StatusCode,
+		"duration_ms": attempt.Duration.Nanoseconds() / int64(time.Millisecond),
+		"error":       attempt.Error,
+		"final":       attempt.Final,
+		"at":          time.Now().Unix(),
+	})
+	if err != nil {
+		return
+	}
+	size := config.Webhook.Log_Size
+	if size <= 0 {
+		size = WEBHOOK_LOG_DEFAULT
+	}
+	redisKey := getRedisWebhookLogKey(attempt.Delivery.MailboxID)
+
+	redisCon := config.RedisPool.Get()
+	defer redisCon.Close()
+
+	redisCon.Send("MULTI")
+	redisCon.Send("LPUSH", redisKey, entry)
+	redisCon.Send("LTRIM", redisKey, 0, size-1)
+	redisCon.Send("EXPIRE", redisKey, WEBHOOK_LOG_TTL)
+	if _, err = redisCon.Do("EXEC"); err != nil {
+		log.Errorf("redis webhook log command error: %v", err)
+	}
+}
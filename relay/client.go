@@ -0,0 +1,200 @@
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MXResolver looks up MX records of recipient domains, spf.DNSResolver
+// implements it.
+type MXResolver interface {
+	LookupMX(name string) ([]*net.MX, error)
+}
+
+// recipient delivery result
+type rcptResult struct {
+	rcpt string
+	err  error
+}
+
+// deliver message to all pending recipients, grouped by domain
+
+func (r *Relay) deliver(msg *Message) []rcptResult {
+	var results []rcptResult
+	if r.SmartHost != "" {
+		return r.deliverToHosts(msg, []string{r.SmartHost}, msg.To)
+	}
+	byDomain := make(map[string][]string)
+	var domains []string
+	for _, rcpt := range msg.To {
+		domain := domainOf(rcpt)
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+	for _, domain := range domains {
+		hosts, err := r.lookupHosts(domain)
+		if err != nil {
+			for _, rcpt := range byDomain[domain] {
+				results = append(results, rcptResult{rcpt: rcpt, err: err})
+			}
+			continue
+		}
+		results = append(results, r.deliverToHosts(msg, hosts, byDomain[domain])...)
+	}
+	return results
+}
+
+// MX hosts of domain by preference, RFC 5321 section 5.1
+
+func (r *Relay) lookupHosts(domain string) ([]string, error) {
+	if domain == "" {
+		return nil, permanent("relay: recipient without domain")
+	}
+	if r.Resolver == nil {
+		return []string{net.JoinHostPort(domain, strconv.Itoa(r.Port))}, nil
+	}
+	mxs, err := r.Resolver.LookupMX(domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			// implicit MX
+			return []string{net.JoinHostPort(domain, strconv.Itoa(r.Port))}, nil
+		}
+		return nil, err
+	}
+	// null MX, RFC 7505
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, permanent("relay: domain %s does not accept mail", domain)
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), strconv.Itoa(r.Port)))
+	}
+	return hosts, nil
+}
+
+// try hosts in order until one of them answers
+
+func (r *Relay) deliverToHosts(msg *Message, hosts []string, rcpts []string) []rcptResult {
+	var err error
+	for _, host := range hosts {
+		var results []rcptResult
+		results, err = r.sendTo(host, msg, rcpts)
+		if err == nil {
+			return results
+		}
+		if isPermanent(err) {
+			break
+		}
+	}
+	results := make([]rcptResult, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		results = append(results, rcptResult{rcpt: rcpt, err: err})
+	}
+	return results
+}
+
+// one SMTP session, error is returned for all recipients of the session
+
+func (r *Relay) sendTo(addr string, msg *Message, rcpts []string) ([]rcptResult, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	conn, err := net.DialTimeout("tcp", addr, r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(r.Timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer c.Close()
+	if err = c.Hello(r.Hostname); err != nil {
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && r.StartTLS {
+		tlsConfig := &tls.Config{ServerName: host}
+		if r.TLSConfig != nil {
+			tlsConfig = r.TLSConfig.Clone()
+			if tlsConfig.ServerName == "" {
+				tlsConfig.ServerName = host
+			}
+		}
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return nil, err
+		}
+	} else if r.RequireTLS {
+		return nil, &textproto.Error{Code: 421, Msg: "relay: STARTTLS is not offered by " + host}
+	}
+	if r.Username != "" {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err = c.Auth(smtp.PlainAuth("", r.Username, r.Password, host)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = c.Mail(msg.From); err != nil {
+		return nil, err
+	}
+	var (
+		results  []rcptResult
+		accepted []int
+	)
+	for _, rcpt := range rcpts {
+		err := c.Rcpt(rcpt)
+		if err == nil {
+			accepted = append(accepted, len(results))
+		}
+		results = append(results, rcptResult{rcpt: rcpt, err: err})
+	}
+	if len(accepted) == 0 {
+		c.Quit()
+		return results, nil
+	}
+	w, err := c.Data()
+	if err == nil {
+		if _, err = w.Write(msg.Data); err == nil {
+			err = w.Close()
+		} else {
+			w.Close()
+		}
+	}
+	for _, i := range accepted {
+		results[i].err = err
+	}
+	c.Quit()
+	return results, nil
+}
+
+// permanent errors are bounced, all others retried
+
+func isPermanent(err error) bool {
+	switch e := err.(type) {
+	case *permanentError:
+		return true
+	case *textproto.Error:
+		return e.Code >= 500
+	}
+	return false
+}
+
+// diagnostic of delivery error for DSN
+
+func diagnostic(err error) string {
+	if e, ok := err.(*textproto.Error); ok {
+		return fmt.Sprintf("%03d %s", e.Code, e.Msg)
+	}
+	return err.Error()
+}
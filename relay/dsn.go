@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DSN_BOUNDARY_PREFIX = "falcon-dsn-"
+	DSN_MAX_HEADERS     = 64 * 1024 // returned headers of original message
+)
+
+// BuildDSN returns delivery status notification of failed recipients,
+// RFC 3464. Failures maps recipient to diagnostic.
+func BuildDSN(reportingMTA string, msg *Message, failures map[string]string, now time.Time) []byte {
+	if reportingMTA == "" {
+		reportingMTA = "localhost"
+	}
+	boundary := DSN_BOUNDARY_PREFIX + msg.ID
+	rcpts := make([]string, 0, len(failures))
+	for rcpt := range failures {
+		rcpts = append(rcpts, rcpt)
+	}
+	sort.Strings(rcpts)
+
+	var buf bytes.Buffer
+	// headers
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", reportingMTA)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", msg.From)
+	fmt.Fprintf(&buf, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s.dsn@%s>\r\n", msg.ID, reportingMTA)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n", boundary)
+	buf.WriteString("\r\n")
+	// human readable part
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "This is the mail system at host %s.\r\n\r\n", reportingMTA)
+	buf.WriteString("Your message could not be delivered to one or more recipients.\r\n\r\n")
+	for _, rcpt := range rcpts {
+		fmt.Fprintf(&buf, "<%s>: %s\r\n", rcpt, oneLine(failures[rcpt]))
+	}
+	buf.WriteString("\r\n")
+	// delivery status
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&buf, "Reporting-MTA: dns; %s\r\n", reportingMTA)
+	fmt.Fprintf(&buf, "X-Falcon-Queue-ID: %s\r\n", msg.ID)
+	fmt.Fprintf(&buf, "Arrival-Date: %s\r\n", msg.Created.Format(time.RFC1123Z))
+	for _, rcpt := range rcpts {
+		buf.WriteString("\r\n")
+		fmt.Fprintf(&buf, "Final-Recipient: rfc822; %s\r\n", rcpt)
+		buf.WriteString("Action: failed\r\n")
+		fmt.Fprintf(&buf, "Status: %s\r\n", dsnStatus(failures[rcpt]))
+		fmt.Fprintf(&buf, "Diagnostic-Code: smtp; %s\r\n", oneLine(failures[rcpt]))
+	}
+	buf.WriteString("\r\n")
+	// headers of original message
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+	buf.Write(originalHeaders(msg.Data))
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes()
+}
+
+// enhanced status code of diagnostic, 5.0.0 if none
+
+func dsnStatus(diagnostic string) string {
+	for _, field := range strings.Fields(diagnostic) {
+		parts := strings.Split(field, ".")
+		if len(parts) == 3 && (parts[0] == "5" || parts[0] == "4") && isDigits(parts[1]) && isDigits(parts[2]) {
+			return "5." + parts[1] + "." + parts[2]
+		}
+	}
+	return "5.0.0"
+}
+
+func isDigits(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func oneLine(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// header section of raw message with CRLF line endings
+
+func originalHeaders(data []byte) []byte {
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	if idx := bytes.Index(data, []byte("\n\n")); idx != -1 {
+		data = data[:idx+1]
+	}
+	if len(data) > DSN_MAX_HEADERS {
+		data = data[:DSN_MAX_HEADERS]
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+	}
+	return bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+}
@@ -0,0 +1,259 @@
+// Package relay delivers stored messages onward to real recipients, through
+// a smart host or directly to MX hosts of recipient domains.
+package relay
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+)
+
+const (
+	DEFAULT_PORT          = 25
+	DEFAULT_TIMEOUT       = 60 * time.Second
+	DEFAULT_RETRY_BASE    = 5 * time.Minute
+	DEFAULT_RETRY_MAX     = 4 * time.Hour
+	DEFAULT_MAX_AGE       = 5 * 24 * time.Hour
+	DEFAULT_POLL_INTERVAL = 10 * time.Second
+	DEFAULT_WORKERS       = 4
+	CLAIM_LEASE           = 15 * time.Minute // claimed message is due again after lease
+)
+
+// Message is an outbound message in delivery queue.
+type Message struct {
+	ID          string
+	MailboxID   int
+	From        string   // envelope sender, empty for bounces
+	To          []string // recipients not delivered yet
+	Data        []byte
+	Attempts    int
+	Created     time.Time
+	NextAttempt time.Time
+	LastError   string
+}
+
+// Queue is a persistent delivery queue.
+type Queue interface {
+	// Push adds message or reschedules it at msg.NextAttempt.
+	Push(msg *Message) error
+	// Claim returns up to limit due messages, claimed messages are not
+	// returned again until lease expires.
+	Claim(now time.Time, lease time.Duration, limit int) ([]*Message, error)
+	// Remove deletes message from queue.
+	Remove(id string) error
+}
+
+// Relay delivers queued messages.
+type Relay struct {
+	Hostname   string // HELO name and reporting MTA of bounces
+	SmartHost  string // host:port, empty to deliver to MX hosts
+	Username   string // smart host AUTH
+	Password   string
+	StartTLS   bool // use STARTTLS when offered
+	RequireTLS bool // fail delivery without STARTTLS
+	TLSConfig  *tls.Config
+	Port       int // port of MX hosts
+
+	Resolver MXResolver
+	Queue    Queue
+
+	Timeout      time.Duration
+	RetryBase    time.Duration
+	RetryMax     time.Duration
+	MaxAge       time.Duration // bounce after
+	PollInterval time.Duration
+	Workers      int
+
+	defaults sync.Once
+}
+
+func (r *Relay) setDefaults() {
+	if r.Port <= 0 {
+		r.Port = DEFAULT_PORT
+	}
+	if r.Timeout <= 0 {
+		r.Timeout = DEFAULT_TIMEOUT
+	}
+	if r.RetryBase <= 0 {
+		r.RetryBase = DEFAULT_RETRY_BASE
+	}
+	if r.RetryMax <= 0 {
+		r.RetryMax = DEFAULT_RETRY_MAX
+	}
+	if r.MaxAge <= 0 {
+		r.MaxAge = DEFAULT_MAX_AGE
+	}
+	if r.PollInterval <= 0 {
+		r.PollInterval = DEFAULT_POLL_INTERVAL
+	}
+	if r.Workers <= 0 {
+		r.Workers = DEFAULT_WORKERS
+	}
+}
+
+// NewMessageID returns random queue id.
+func NewMessageID() string {
+	buf := make([]byte, 10)
+	rand.Read(buf)
+	return strings.ToUpper(hex.EncodeToString(buf))
+}
+
+// Enqueue adds new message to queue for immediate delivery.
+func (r *Relay) Enqueue(mailboxID int, from string, to []string, data []byte) (*Message, error) {
+	now := time.Now()
+	msg := &Message{
+		ID:          NewMessageID(),
+		MailboxID:   mailboxID,
+		From:        from,
+		To:          to,
+		Data:        data,
+		Created:     now,
+		NextAttempt: now,
+	}
+	if err := r.Queue.Push(msg); err != nil {
+		return nil, err
+	}
+	log.Debugf("Relay: queued %s from %q to %v", msg.ID, from, to)
+	return msg, nil
+}
+
+// Run delivers due messages until stop is closed.
+func (r *Relay) Run(stop <-chan struct{}) {
+	r.defaults.Do(r.setDefaults)
+	jobs := make(chan *Message)
+	var wg sync.WaitGroup
+	for i := 0; i < r.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range jobs {
+				r.Attempt(msg)
+			}
+		}()
+	}
+	ticker := time.NewTicker(r.PollInterval)
+	defer func() {
+		ticker.Stop()
+		close(jobs)
+		wg.Wait()
+	}()
+	for {
+		messages, err := r.Queue.Claim(time.Now(), CLAIM_LEASE, r.Workers*10)
+		if err != nil {
+			log.Errorf("Relay: claim messages: %v", err)
+		}
+		for _, msg := range messages {
+			select {
+			case jobs <- msg:
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Attempt tries to deliver message once, then reschedules, bounces or
+// removes it from queue.
+func (r *Relay) Attempt(msg *Message) {
+	r.defaults.Do(r.setDefaults)
+	var (
+		pending  []string
+		failures = make(map[string]string)
+	)
+	for _, rcptErr := range r.deliver(msg) {
+		switch {
+		case rcptErr.err == nil:
+			log.Infof("Relay: %s delivered to %s", msg.ID, rcptErr.rcpt)
+		case isPermanent(rcptErr.err):
+			log.Infof("Relay: %s failed permanently for %s: %v", msg.ID, rcptErr.rcpt, rcptErr.err)
+			failures[rcptErr.rcpt] = diagnostic(rcptErr.err)
+		default:
+			log.Debugf("Relay: %s deferred for %s: %v", msg.ID, rcptErr.rcpt, rcptErr.err)
+			pending = append(pending, rcptErr.rcpt)
+			msg.LastError = diagnostic(rcptErr.err)
+		}
+	}
+	msg.Attempts++
+	if len(pending) > 0 && time.Since(msg.Created) >= r.MaxAge {
+		for _, rcpt := range pending {
+			failures[rcpt] = "delivery time expired, last error: " + msg.LastError
+		}
+		pending = nil
+	}
+	if len(failures) > 0 {
+		r.bounce(msg, failures)
+	}
+	if len(pending) == 0 {
+		if err := r.Queue.Remove(msg.ID); err != nil {
+			log.Errorf("Relay: remove %s: %v", msg.ID, err)
+		}
+		return
+	}
+	msg.To = pending
+	msg.NextAttempt = time.Now().Add(Backoff(msg.Attempts, r.RetryBase, r.RetryMax))
+	if err := r.Queue.Push(msg); err != nil {
+		log.Errorf("Relay: reschedule %s: %v", msg.ID, err)
+	}
+}
+
+// Backoff returns retry delay after attempts, doubled on each attempt.
+func Backoff(attempts int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// queue DSN to sender of message, bounces are never bounced
+
+func (r *Relay) bounce(msg *Message, failures map[string]string) {
+	if msg.From == "" {
+		log.Errorf("Relay: bounce %s failed for %v, dropped", msg.ID, failures)
+		return
+	}
+	dsn := BuildDSN(r.Hostname, msg, failures, time.Now())
+	bounce, err := r.Enqueue(msg.MailboxID, "", []string{msg.From}, dsn)
+	if err != nil {
+		log.Errorf("Relay: queue bounce of %s: %v", msg.ID, err)
+		return
+	}
+	log.Infof("Relay: %s bounced to %q as %s", msg.ID, msg.From, bounce.ID)
+}
+
+// domain of address
+
+func domainOf(address string) string {
+	if idx := strings.LastIndex(address, "@"); idx != -1 {
+		return strings.ToLower(address[idx+1:])
+	}
+	return ""
+}
+
+// permanent delivery error
+
+type permanentError struct {
+	msg string
+}
+
+func (e *permanentError) Error() string {
+	return e.msg
+}
+
+func permanent(format string, args ...interface{}) error {
+	return &permanentError{msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,240 @@
+package relay
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in memory queue
+
+type memoryQueue struct {
+	sync.Mutex
+	messages map[string]*Message
+}
+
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{messages: make(map[string]*Message)}
+}
+
+func (q *memoryQueue) Push(msg *Message) error {
+	q.Lock()
+	defer q.Unlock()
+	copied := *msg
+	q.messages[msg.ID] = &copied
+	return nil
+}
+
+func (q *memoryQueue) Claim(now time.Time, lease time.Duration, limit int) ([]*Message, error) {
+	q.Lock()
+	defer q.Unlock()
+	var due []*Message
+	for _, msg := range q.messages {
+		if len(due) < limit && !msg.NextAttempt.After(now) {
+			msg.NextAttempt = now.Add(lease)
+			copied := *msg
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (q *memoryQueue) Remove(id string) error {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.messages, id)
+	return nil
+}
+
+// fake SMTP server, recipients with "unknown" are rejected and with "later" deferred
+
+type fakeServer struct {
+	sync.Mutex
+	listener net.Listener
+	rcpts    []string
+	data     []string
+}
+
+func startFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-fake")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			reply("250 2.1.0 Ok")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			switch {
+			case strings.Contains(line, "unknown"):
+				reply("550 5.1.1 User unknown")
+			case strings.Contains(line, "later"):
+				reply("451 4.2.0 Try later")
+			default:
+				s.Lock()
+				s.rcpts = append(s.rcpts, line[len("RCPT TO:"):])
+				s.Unlock()
+				reply("250 2.1.5 Ok")
+			}
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data []string
+			for {
+				dataLine, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data = append(data, dataLine)
+			}
+			s.Lock()
+			s.data = append(s.data, strings.Join(data, ""))
+			s.Unlock()
+			reply("250 2.0.0 Ok: queued")
+		case cmd == "QUIT":
+			reply("221 2.0.0 Bye")
+			return
+		default:
+			reply("502 5.5.2 Error: command not recognized")
+		}
+	}
+}
+
+const testData = "From: sender@example.com\nTo: rcpt@example.net\nSubject: test\n\nHello\n"
+
+func testRelay(t *testing.T) (*Relay, *memoryQueue, *fakeServer) {
+	server := startFakeServer(t)
+	queue := newMemoryQueue()
+	r := &Relay{
+		Hostname:  "falcon.test",
+		SmartHost: server.listener.Addr().String(),
+		Queue:     queue,
+		Timeout:   5 * time.Second,
+	}
+	return r, queue, server
+}
+
+func TestAttemptDelivered(t *testing.T) {
+	r, queue, server := testRelay(t)
+	defer server.listener.Close()
+	msg, err := r.Enqueue(1, "sender@example.com", []string{"rcpt@example.net", "other@example.org"}, []byte(testData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Attempt(msg)
+	if len(queue.messages) != 0 {
+		t.Errorf("expected empty queue, got %d messages", len(queue.messages))
+	}
+	if len(server.rcpts) != 2 || len(server.data) != 1 {
+		t.Fatalf("unexpected delivery: %v, %d messages", server.rcpts, len(server.data))
+	}
+	if !strings.Contains(server.data[0], "Subject: test\r\n") {
+		t.Errorf("message should be sent with CRLF line endings: %q", server.data[0])
+	}
+}
+
+func TestAttemptDeferredAndBounced(t *testing.T) {
+	r, queue, server := testRelay(t)
+	defer server.listener.Close()
+	msg, _ := r.Enqueue(1, "sender@example.com", []string{"rcpt@example.net", "later@example.net", "unknown@example.net"}, []byte(testData))
+	r.Attempt(msg)
+	queued, ok := queue.messages[msg.ID]
+	if !ok {
+		t.Fatal("deferred message should stay in queue")
+	}
+	if queued.Attempts != 1 || len(queued.To) != 1 || queued.To[0] != "later@example.net" {
+		t.Errorf("unexpected rescheduled message %+v", queued)
+	}
+	if wait := time.Until(queued.NextAttempt); wait < DEFAULT_RETRY_BASE-time.Minute || wait > DEFAULT_RETRY_BASE {
+		t.Errorf("unexpected next attempt in %v", wait)
+	}
+	// bounce of unknown recipient
+	var bounce *Message
+	for _, m := range queue.messages {
+		if m.ID != msg.ID {
+			bounce = m
+		}
+	}
+	if bounce == nil || bounce.From != "" || len(bounce.To) != 1 || bounce.To[0] != "sender@example.com" {
+		t.Fatalf("expected bounce to sender, got %+v", bounce)
+	}
+	dsn := string(bounce.Data)
+	for _, expected := range []string{"Final-Recipient: rfc822; unknown@example.net", "Status: 5.1.1", "report-type=delivery-status", "Subject: test"} {
+		if !strings.Contains(dsn, expected) {
+			t.Errorf("bounce does not contain %q:\n%s", expected, dsn)
+		}
+	}
+	// expired message is bounced
+	queued.Created = time.Now().Add(-DEFAULT_MAX_AGE)
+	r.Attempt(queued)
+	if _, ok := queue.messages[msg.ID]; ok {
+		t.Error("expired message should be removed from queue")
+	}
+}
+
+func TestLookupHosts(t *testing.T) {
+	r := &Relay{Port: 25, Resolver: mapMXResolver{
+		"example.com": {{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}},
+		"null.test":   {{Host: ".", Pref: 0}},
+	}}
+	hosts, err := r.lookupHosts("example.com")
+	if err != nil || len(hosts) != 2 || hosts[0] != "mx1.example.com:25" || hosts[1] != "mx2.example.com:25" {
+		t.Errorf("unexpected hosts %v, %v", hosts, err)
+	}
+	if _, err = r.lookupHosts("null.test"); err == nil || !isPermanent(err) {
+		t.Errorf("expected permanent error for null MX, got %v", err)
+	}
+	if hosts, err = r.lookupHosts("nomx.test"); err != nil || len(hosts) != 1 || hosts[0] != "nomx.test:25" {
+		t.Errorf("expected implicit MX, got %v, %v", hosts, err)
+	}
+}
+
+type mapMXResolver map[string][]*net.MX
+
+func (r mapMXResolver) LookupMX(name string) ([]*net.MX, error) {
+	if mxs, ok := r[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := time.Minute, time.Hour
+	for attempts, expected := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 10: time.Hour} {
+		if delay := Backoff(attempts, base, max); delay != expected {
+			t.Errorf("Backoff(%d) = %v, expected %v", attempts, delay, expected)
+		}
+	}
+}
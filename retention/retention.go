@@ -0,0 +1,178 @@
+// Package retention deletes old messages of inboxes by age, total bytes and
+// count in small batches, independent of new mail.
+package retention
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/events"
+	"github.com/Polymail/go-falcon/log"
+)
+
+const (
+	REASON_AGE   = "age"
+	REASON_BYTES = "bytes"
+	REASON_COUNT = "count"
+)
+
+var (
+	metrics = expvar.NewMap("retention")
+)
+
+// Store selects and deletes messages, storage.DBConn in server.
+type Store interface {
+	RetentionInboxes() ([]int, error)
+	ExpiredMessages(mailboxID int, before time.Time, limit int) ([]int, error)
+	OversizeMessages(mailboxID int, maxBytes int64, limit int) ([]int, error)
+	OvercountMessages(mailboxID int, maxMessages int, limit int) ([]int, error)
+	DeleteMessages(mailboxID int, messageIDs []int) ([]int, int64, error)
+}
+
+// Policy of inbox, zero disables limit.
+type Policy struct {
+	MaxAge      time.Duration
+	MaxBytes    int64
+	MaxMessages int
+}
+
+// Report of removed messages.
+type Report struct {
+	Inboxes  int
+	Messages int
+	Bytes    int64
+	Reasons  map[string]int
+	Errors   int
+}
+
+func (r *Report) add(reason string, messages int, bytes int64) {
+	if r.Reasons == nil {
+		r.Reasons = make(map[string]int)
+	}
+	r.Messages += messages
+	r.Bytes += bytes
+	r.Reasons[reason] += messages
+}
+
+// Scheduler enforces policies of all inboxes every Interval. With Lock
+// store only one server of cluster runs each interval.
+type Scheduler struct {
+	Store      Store
+	Policy     func(mailboxID int) (Policy, error)
+	Lock       cache.Store
+	Interval   time.Duration
+	BatchSize  int
+	BatchPause time.Duration
+
+	now func() time.Time
+}
+
+func NewScheduler(store Store, policy func(mailboxID int) (Policy, error), interval time.Duration, batchSize int) *Scheduler {
+	return &Scheduler{Store: store, Policy: policy, Interval: interval, BatchSize: batchSize, now: time.Now}
+}
+
+// Run enforces policies until stop is closed.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if s.locked() {
+			report := s.RunOnce()
+			log.Infof("Retention removed %d messages (%d bytes) of %d inboxes: %v, errors: %d", report.Messages, report.Bytes, report.Inboxes, report.Reasons, report.Errors)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// one run per interval in cluster
+
+func (s *Scheduler) locked() bool {
+	if s.Lock == nil {
+		return true
+	}
+	result, err := s.Lock.Limit("retention-run", cache.Limit{Rate: 1, Period: s.Interval}, 1)
+	if err != nil {
+		log.Errorf("Retention lock: %v", err)
+	}
+	return result.Allowed
+}
+
+// RunOnce enforces policies of all inboxes.
+func (s *Scheduler) RunOnce() *Report {
+	report := &Report{}
+	mailboxIDs, err := s.Store.RetentionInboxes()
+	if err != nil {
+		report.Errors++
+		return report
+	}
+	for _, mailboxID := range mailboxIDs {
+		policy, err := s.Policy(mailboxID)
+		if err != nil {
+			report.Errors++
+			continue
+		}
+		report.Inboxes++
+		if err = s.Enforce(mailboxID, policy, report); err != nil {
+			report.Errors++
+		}
+	}
+	metrics.Add("runs", 1)
+	return report
+}
+
+// Enforce deletes messages of inbox past policy, oldest first.
+func (s *Scheduler) Enforce(mailboxID int, policy Policy, report *Report) error {
+	if policy.MaxAge > 0 {
+		before := s.now().Add(-policy.MaxAge)
+		if err := s.deleteBatches(mailboxID, REASON_AGE, report, func(limit int) ([]int, error) {
+			return s.Store.ExpiredMessages(mailboxID, before, limit)
+		}); err != nil {
+			return err
+		}
+	}
+	if policy.MaxBytes > 0 {
+		if err := s.deleteBatches(mailboxID, REASON_BYTES, report, func(limit int) ([]int, error) {
+			return s.Store.OversizeMessages(mailboxID, policy.MaxBytes, limit)
+		}); err != nil {
+			return err
+		}
+	}
+	if policy.MaxMessages > 0 {
+		if err := s.deleteBatches(mailboxID, REASON_COUNT, report, func(limit int) ([]int, error) {
+			return s.Store.OvercountMessages(mailboxID, policy.MaxMessages, limit)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete selected messages batch by batch until selection is short
+
+func (s *Scheduler) deleteBatches(mailboxID int, reason string, report *Report, selectBatch func(limit int) ([]int, error)) error {
+	for {
+		ids, err := selectBatch(s.BatchSize)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		deleted, bytes, err := s.Store.DeleteMessages(mailboxID, ids)
+		if err != nil {
+			return err
+		}
+		report.add(reason, len(deleted), bytes)
+		metrics.Add(reason+".messages", int64(len(deleted)))
+		metrics.Add(reason+".bytes", bytes)
+		events.EmitCleanedUp(mailboxID, deleted, map[string]string{"reason": reason})
+		if len(ids) < s.BatchSize || len(deleted) == 0 {
+			return nil
+		}
+		if s.BatchPause > 0 {
+			time.Sleep(s.BatchPause)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package retention
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Polymail/go-falcon/cache"
+)
+
+type testMessage struct {
+	id       int
+	size     int64
+	received time.Time
+}
+
+type testStore struct {
+	inboxes map[int][]testMessage // oldest first
+	deletes int
+}
+
+func (s *testStore) RetentionInboxes() ([]int, error) {
+	var ids []int
+	for id := range s.inboxes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func firstIds(messages []testMessage, limit int) []int {
+	var ids []int
+	for _, message := range messages {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, message.id)
+	}
+	return ids
+}
+
+func (s *testStore) ExpiredMessages(mailboxID int, before time.Time, limit int) ([]int, error) {
+	var expired []testMessage
+	for _, message := range s.inboxes[mailboxID] {
+		if message.received.Before(before) {
+			expired = append(expired, message)
+		}
+	}
+	return firstIds(expired, limit), nil
+}
+
+func (s *testStore) OversizeMessages(mailboxID int, maxBytes int64, limit int) ([]int, error) {
+	messages := s.inboxes[mailboxID]
+	var total int64
+	for i := len(messages) - 1; i >= 0; i-- {
+		total += messages[i].size
+		if total > maxBytes {
+			return firstIds(messages[:i+1], limit), nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *testStore) OvercountMessages(mailboxID int, maxMessages int, limit int) ([]int, error) {
+	messages := s.inboxes[mailboxID]
+	if len(messages) <= maxMessages {
+		return nil, nil
+	}
+	return firstIds(messages[:len(messages)-maxMessages], limit), nil
+}
+
+func (s *testStore) DeleteMessages(mailboxID int, messageIDs []int) ([]int, int64, error) {
+	s.deletes++
+	remove := make(map[int]bool)
+	for _, id := range messageIDs {
+		remove[id] = true
+	}
+	var (
+		kept    []testMessage
+		deleted []int
+		bytes   int64
+	)
+	for _, message := range s.inboxes[mailboxID] {
+		if remove[message.id] {
+			deleted = append(deleted, message.id)
+			bytes += message.size
+			continue
+		}
+		kept = append(kept, message)
+	}
+	s.inboxes[mailboxID] = kept
+	return deleted, bytes, nil
+}
+
+func TestRunOnce(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var messages []testMessage
+	for i := 1; i <= 10; i++ {
+		messages = append(messages, testMessage{id: i, size: 100, received: now.Add(time.Duration(i-10) * 24 * time.Hour)})
+	}
+	store := &testStore{inboxes: map[int][]testMessage{
+		1: messages,
+		2: {{id: 11, size: 100, received: now}},
+		3: {{id: 12, size: 100, received: now}},
+	}}
+	policies := map[int]Policy{
+		// age removes messages 1-2, bytes 3-5, count 6
+		1: {MaxAge: 7 * 24 * time.Hour, MaxBytes: 500, MaxMessages: 4},
+		2: {},
+	}
+	scheduler := NewScheduler(store, func(mailboxID int) (Policy, error) {
+		policy, ok := policies[mailboxID]
+		if !ok {
+			return policy, errors.New("unknown inbox")
+		}
+		return policy, nil
+	}, time.Hour, 2)
+	scheduler.now = func() time.Time { return now }
+
+	report := scheduler.RunOnce()
+	if report.Inboxes != 2 || report.Errors != 1 {
+		t.Errorf("unexpected inboxes %d and errors %d", report.Inboxes, report.Errors)
+	}
+	if report.Messages != 6 || report.Bytes != 600 {
+		t.Errorf("expected 6 messages of 600 bytes removed, got %d of %d", report.Messages, report.Bytes)
+	}
+	if report.Reasons[REASON_AGE] != 2 || report.Reasons[REASON_BYTES] != 3 || report.Reasons[REASON_COUNT] != 1 {
+		t.Errorf("unexpected reasons %v", report.Reasons)
+	}
+	if ids := firstIds(store.inboxes[1], 10); len(ids) != 4 || ids[0] != 7 {
+		t.Errorf("expected newest 4 messages kept, got %v", ids)
+	}
+	// batches of 2: age 2, bytes 2+1, count 1
+	if store.deletes != 4 {
+		t.Errorf("expected 4 batches, got %d", store.deletes)
+	}
+}
+
+func TestLock(t *testing.T) {
+	lock := cache.NewMemoryStore(10, time.Minute)
+	scheduler := NewScheduler(&testStore{}, nil, time.Hour, 10)
+	scheduler.Lock = lock
+	if !scheduler.locked() {
+		t.Error("first run should get lock")
+	}
+	if scheduler.locked() {
+		t.Error("second run in interval should not get lock")
+	}
+}
@@ -0,0 +1,106 @@
+//go:build bleve
+// +build bleve
+
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// bleve fields of Document
+var bleveFields = map[string]string{
+	FIELD_SUBJECT:    "subject",
+	FIELD_ADDRESS:    "address",
+	FIELD_BODY:       "body",
+	FIELD_ATTACHMENT: "attachment",
+}
+
+type bleveIndex struct {
+	index bleve.Index
+}
+
+// OpenBleve opens index at path, created if missing.
+func OpenBleve(path string) (Index, error) {
+	index, err := bleve.Open(path)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		index, err = bleve.New(path, bleve.NewIndexMapping())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bleve %s: %v", path, err)
+	}
+	return &bleveIndex{index: index}, nil
+}
+
+func bleveID(mailboxID, messageID int) string {
+	return strconv.Itoa(mailboxID) + "/" + strconv.Itoa(messageID)
+}
+
+func (b *bleveIndex) Index(doc *Document) error {
+	return b.index.Index(bleveID(doc.MailboxID, doc.MessageID), map[string]interface{}{
+		"inbox_id":   float64(doc.MailboxID),
+		"subject":    doc.Subject,
+		"from":       doc.From,
+		"address":    strings.Join(doc.Addresses, " "),
+		"body":       doc.Text + " " + StripHTML(doc.Html),
+		"attachment": strings.Join(doc.Attachments, " "),
+		"date":       doc.Date,
+	})
+}
+
+func (b *bleveIndex) Delete(mailboxID int, messageIDs ...int) error {
+	batch := b.index.NewBatch()
+	for _, messageID := range messageIDs {
+		batch.Delete(bleveID(mailboxID, messageID))
+	}
+	return b.index.Batch(batch)
+}
+
+func (b *bleveIndex) Search(q *Query) (*Result, error) {
+	inbox := float64(q.MailboxID)
+	inclusive := true
+	scope := bleve.NewNumericRangeInclusiveQuery(&inbox, &inbox, &inclusive, &inclusive)
+	scope.SetField("inbox_id")
+	queries := []query.Query{scope}
+	for _, clause := range q.Clauses {
+		text := strings.Join(clause.Words, " ")
+		if clause.Phrase {
+			match := bleve.NewMatchPhraseQuery(text)
+			match.SetField(bleveFields[clause.Field])
+			queries = append(queries, match)
+		} else {
+			match := bleve.NewMatchQuery(text)
+			match.SetField(bleveFields[clause.Field])
+			queries = append(queries, match)
+		}
+	}
+	request := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(queries...), q.PerPage, q.Offset(), false)
+	request.Fields = []string{"subject", "from", "date"}
+	found, err := b.index.Search(request)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Total: int(found.Total), Page: q.Page, PerPage: q.PerPage, Hits: []Hit{}}
+	for _, match := range found.Hits {
+		hit := Hit{Score: match.Score}
+		if i := strings.IndexByte(match.ID, '/'); i >= 0 {
+			hit.MessageID, _ = strconv.Atoi(match.ID[i+1:])
+		}
+		hit.Subject, _ = match.Fields["subject"].(string)
+		hit.From, _ = match.Fields["from"].(string)
+		if date, ok := match.Fields["date"].(string); ok {
+			hit.Date, _ = time.Parse(time.RFC3339, date)
+		}
+		result.Hits = append(result.Hits, hit)
+	}
+	return result, nil
+}
+
+func (b *bleveIndex) Close() error {
+	return b.index.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !bleve
+// +build !bleve
+
+package search
+
+import (
+	"errors"
+)
+
+// OpenBleve is available in binaries built with -tags bleve.
+func OpenBleve(path string) (Index, error) {
+	return nil, errors.New("bleve search is not built, use go build -tags bleve")
+}
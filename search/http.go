@@ -0,0 +1,75 @@
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Polymail/go-falcon/log"
+)
+
+// Handler serves GET /search?q=&page=&per_page= for inbox of basic auth
+// credentials, so every query is scoped to one inbox.
+type Handler struct {
+	Backend    Backend
+	Auth       func(username, password string) (int, error)
+	PerPage    int
+	MaxPerPage int
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		h.unauthorized(w)
+		return
+	}
+	mailboxID, err := h.Auth(username, password)
+	if err != nil {
+		h.unauthorized(w)
+		return
+	}
+	clauses, err := ParseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := &Query{
+		MailboxID: mailboxID,
+		Clauses:   clauses,
+		Page:      formInt(r, "page", 1),
+		PerPage:   formInt(r, "per_page", h.PerPage),
+	}
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PerPage < 1 {
+		query.PerPage = h.PerPage
+	}
+	if h.MaxPerPage > 0 && (query.PerPage < 1 || query.PerPage > h.MaxPerPage) {
+		query.PerPage = h.MaxPerPage
+	}
+	result, err := h.Backend.Search(query)
+	if err != nil {
+		log.Errorf("Search of inbox %d: %v", mailboxID, err)
+		http.Error(w, "search failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="falcon"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+func formInt(r *http.Request, name string, value int) int {
+	if n, err := strconv.Atoi(r.URL.Query().Get(name)); err == nil {
+		return n
+	}
+	return value
+}
@@ -0,0 +1,111 @@
+package search
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// fields of query, from and to are aliases of address
+const (
+	FIELD_ALL        = ""
+	FIELD_SUBJECT    = "subject"
+	FIELD_ADDRESS    = "address"
+	FIELD_BODY       = "body"
+	FIELD_ATTACHMENT = "attachment"
+)
+
+var (
+	fieldAliases = map[string]string{
+		"subject":    FIELD_SUBJECT,
+		"address":    FIELD_ADDRESS,
+		"from":       FIELD_ADDRESS,
+		"to":         FIELD_ADDRESS,
+		"body":       FIELD_BODY,
+		"attachment": FIELD_ATTACHMENT,
+		"filename":   FIELD_ATTACHMENT,
+	}
+	// weights of search_vector in postgres
+	fieldWeights = map[string]string{
+		FIELD_SUBJECT:    "A",
+		FIELD_ADDRESS:    "B",
+		FIELD_BODY:       "C",
+		FIELD_ATTACHMENT: "D",
+	}
+
+	ErrEmptyQuery = errors.New("empty search query")
+)
+
+// Clause of query, all clauses should match. Phrase words should follow
+// each other.
+type Clause struct {
+	Field  string
+	Words  []string
+	Phrase bool
+}
+
+// ParseQuery parses words, "quoted phrases" and field:word or
+// field:"phrase" clauses, e.g. subject:invoice from:leo@example.com "due date".
+func ParseQuery(text string) ([]Clause, error) {
+	var clauses []Clause
+	rest := strings.TrimSpace(text)
+	for rest != "" {
+		var clause Clause
+		if i := strings.IndexByte(rest, ':'); i > 0 && !strings.ContainsAny(rest[:i], " \t\"") {
+			// unknown fields are words, like 12:30
+			if field, ok := fieldAliases[strings.ToLower(rest[:i])]; ok {
+				clause.Field = field
+				rest = rest[i+1:]
+			}
+		}
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated phrase")
+			}
+			clause.Words = strings.FieldsFunc(rest[1:end+1], unicode.IsSpace)
+			clause.Phrase = true
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end < 0 {
+				end = len(rest)
+			}
+			clause.Words = []string{rest[:end]}
+			rest = rest[end:]
+		}
+		rest = strings.TrimSpace(rest)
+		if len(clause.Words) == 0 || clause.Words[0] == "" {
+			return nil, errors.New("empty clause")
+		}
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 0 {
+		return nil, ErrEmptyQuery
+	}
+	return clauses, nil
+}
+
+// TsQuery of clauses for postgres to_tsquery, words are quoted and split by
+// text search parser of database, fields limit weights of search_vector.
+func TsQuery(clauses []Clause) string {
+	var parts []string
+	for _, clause := range clauses {
+		weight := ""
+		if w, ok := fieldWeights[clause.Field]; ok {
+			weight = ":" + w
+		}
+		var words []string
+		for _, word := range clause.Words {
+			word = strings.Replace(word, `\`, `\\`, -1)
+			word = strings.Replace(word, `'`, `''`, -1)
+			words = append(words, "'"+word+"'"+weight)
+		}
+		if clause.Phrase {
+			parts = append(parts, "("+strings.Join(words, " <-> ")+")")
+		} else {
+			parts = append(parts, strings.Join(words, " & "))
+		}
+	}
+	return strings.Join(parts, " & ")
+}
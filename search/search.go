@@ -0,0 +1,82 @@
+// Package search finds stored messages of inbox by words, phrases and
+// fields, with postgres search_vector or embedded Bleve index.
+package search
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	BACKEND_POSTGRES = "postgres"
+	BACKEND_BLEVE    = "bleve"
+)
+
+var (
+	htmlTagsRE = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+)
+
+// Query of inbox, Page starts from 1.
+type Query struct {
+	MailboxID int
+	Clauses   []Clause
+	Page      int
+	PerPage   int
+}
+
+// Offset of first hit of page
+func (q *Query) Offset() int {
+	if q.Page < 1 {
+		return 0
+	}
+	return (q.Page - 1) * q.PerPage
+}
+
+// Hit is found message, best first.
+type Hit struct {
+	MessageID int       `json:"id"`
+	Subject   string    `json:"subject"`
+	From      string    `json:"from"`
+	Date      time.Time `json:"date"`
+	Score     float64   `json:"score"`
+}
+
+// Result is page of hits with total number of found messages.
+type Result struct {
+	Total   int   `json:"total"`
+	Page    int   `json:"page"`
+	PerPage int   `json:"per_page"`
+	Hits    []Hit `json:"messages"`
+}
+
+// Backend searches messages, storage.DBConn for postgres.
+type Backend interface {
+	Search(q *Query) (*Result, error)
+}
+
+// Document of message for Index.
+type Document struct {
+	MailboxID   int
+	MessageID   int
+	Subject     string
+	From        string
+	Addresses   []string
+	Text        string
+	Html        string
+	Attachments []string
+	Date        time.Time
+}
+
+// Index is backend with own index, updated by worker on store and delete.
+type Index interface {
+	Backend
+	Index(doc *Document) error
+	Delete(mailboxID int, messageIDs ...int) error
+	Close() error
+}
+
+// StripHTML returns text of html without tags, scripts and styles.
+func StripHTML(html string) string {
+	return strings.Join(strings.Fields(htmlTagsRE.ReplaceAllString(html, " ")), " ")
+}
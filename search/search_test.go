@@ -0,0 +1,109 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	clauses, err := ParseQuery(`invoice  subject:"due date" From:leo@example.com 12:30 filename:report.pdf`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Clause{
+		{Words: []string{"invoice"}},
+		{Field: FIELD_SUBJECT, Words: []string{"due", "date"}, Phrase: true},
+		{Field: FIELD_ADDRESS, Words: []string{"leo@example.com"}},
+		{Words: []string{"12:30"}},
+		{Field: FIELD_ATTACHMENT, Words: []string{"report.pdf"}},
+	}
+	if !reflect.DeepEqual(clauses, expected) {
+		t.Errorf("unexpected clauses %+v", clauses)
+	}
+	for _, text := range []string{"", "  ", `"open phrase`, `subject:""`} {
+		if _, err = ParseQuery(text); err == nil {
+			t.Errorf("%q: expected error", text)
+		}
+	}
+}
+
+func TestTsQuery(t *testing.T) {
+	clauses, _ := ParseQuery(`it's subject:"due date" body:a\b`)
+	if query := TsQuery(clauses); query != `'it''s' & ('due':A <-> 'date':A) & 'a\\b':C` {
+		t.Errorf("unexpected tsquery %s", query)
+	}
+}
+
+func TestStripHTML(t *testing.T) {
+	html := "<html><style>p {}</style><body><p>Hello,</p>\n<b>world</b><script>alert(1)</script></body></html>"
+	if text := StripHTML(html); text != "Hello, world" {
+		t.Errorf("unexpected text %q", text)
+	}
+}
+
+type testBackend struct {
+	query *Query
+}
+
+func (b *testBackend) Search(q *Query) (*Result, error) {
+	b.query = q
+	return &Result{Total: 1, Page: q.Page, PerPage: q.PerPage, Hits: []Hit{{MessageID: 7, Subject: "Invoice"}}}, nil
+}
+
+func TestHandler(t *testing.T) {
+	backend := &testBackend{}
+	handler := &Handler{
+		Backend: backend,
+		Auth: func(username, password string) (int, error) {
+			if username == "leo" && password == "pass" {
+				return 3, nil
+			}
+			return 0, errors.New("invalid password")
+		},
+		PerPage:    20,
+		MaxPerPage: 50,
+	}
+
+	request := httptest.NewRequest("GET", "/search?q=invoice", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", response.Code)
+	}
+
+	request = httptest.NewRequest("GET", "/search?q=invoice&page=2&per_page=500", nil)
+	request.SetBasicAuth("leo", "pass")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", response.Code, response.Body)
+	}
+	if backend.query.MailboxID != 3 || backend.query.Page != 2 || backend.query.PerPage != 50 || backend.query.Offset() != 50 {
+		t.Errorf("unexpected query %+v", backend.query)
+	}
+	var result Result
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil || len(result.Hits) != 1 || result.Hits[0].MessageID != 7 {
+		t.Errorf("unexpected result %s: %v", response.Body, err)
+	}
+
+	// per page of handler without max
+	handler.MaxPerPage = 0
+	request = httptest.NewRequest("GET", "/search?q=invoice&per_page=0", nil)
+	request.SetBasicAuth("leo", "pass")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if backend.query.PerPage != 20 {
+		t.Errorf("expected default per page, got %d", backend.query.PerPage)
+	}
+
+	request = httptest.NewRequest("GET", `/search?q="open`, nil)
+	request.SetBasicAuth("leo", "pass")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 of invalid query, got %d", response.Code)
+	}
+}
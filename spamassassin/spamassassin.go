@@ -39,9 +39,10 @@ type SpamassassinResponse struct {
 	Details         []SpamassassinHeader
 }
 
-// check email by spamassassin
+// check email by spamassassin, threshold of inbox overrides spamassassin
+// threshold if positive
 
-func CheckSpamEmail(config *config.Config, email []byte) (string, error) {
+func CheckSpamEmail(config *config.Config, email []byte, threshold float64) (string, error) {
 	spamassassin := &Spamassassin{
 		config:   config,
 		RawEmail: email,
@@ -51,6 +52,10 @@ func CheckSpamEmail(config *config.Config, email []byte) (string, error) {
 		return "", err
 	}
 	response := spamassassin.parseOutput(output)
+	if threshold > 0 {
+		response.Threshold = threshold
+		response.Spam = response.Score >= threshold
+	}
 	jsonResult, err := json.Marshal(response)
 	if err != nil {
 		return "", err
@@ -0,0 +1,33 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+)
+
+// ReceivedHeader builds the Received-SPF trace header (RFC 7208 section 9.1),
+// without the trailing CRLF.
+func ReceivedHeader(result Result, ip net.IP, identity, sender, helo, receiver string) string {
+	checked := sender
+	if identity == IDENTITY_HELO || checked == "" {
+		checked = "postmaster@" + helo
+	}
+	var comment string
+	switch result {
+	case Pass:
+		comment = fmt.Sprintf("%s: domain of %s designates %s as permitted sender", receiver, checked, ip)
+	case Fail:
+		comment = fmt.Sprintf("%s: domain of %s does not designate %s as permitted sender", receiver, checked, ip)
+	case SoftFail:
+		comment = fmt.Sprintf("%s: domain of transitioning %s does not designate %s as permitted sender", receiver, checked, ip)
+	case Neutral:
+		comment = fmt.Sprintf("%s: %s is neither permitted nor denied by domain of %s", receiver, ip, checked)
+	case None:
+		comment = fmt.Sprintf("%s: domain of %s does not designate permitted sender hosts", receiver, checked)
+	case TempError:
+		comment = fmt.Sprintf("%s: error in processing during lookup of %s", receiver, checked)
+	default:
+		comment = fmt.Sprintf("%s: domain of %s has an invalid SPF record", receiver, checked)
+	}
+	return fmt.Sprintf("Received-SPF: %s (%s) receiver=%s; client-ip=%s; envelope-from=\"%s\"; helo=%s; identity=%s;", result, comment, receiver, ip, sender, helo, identity)
+}
@@ -0,0 +1,174 @@
+package spf
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expand domain-spec, RFC 7208 section 7
+
+func (ev *evaluation) expandDomainSpec(spec, domain string) (string, error) {
+	expanded, err := ev.expandMacros(spec, domain)
+	if err != nil {
+		return "", err
+	}
+	expanded = strings.TrimSuffix(expanded, ".")
+	// truncate from the left to the 253 chars limit
+	for len(expanded) > 253 {
+		idx := strings.Index(expanded, ".")
+		if idx == -1 {
+			return "", &spfError{result: PermError, err: errInvalidDomainSpec}
+		}
+		expanded = expanded[idx+1:]
+	}
+	return strings.ToLower(expanded), nil
+}
+
+func (ev *evaluation) expandMacros(spec, domain string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		if c != '%' {
+			out.WriteByte(c)
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", permError("spf: invalid macro in %q", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end == -1 {
+				return "", permError("spf: unterminated macro in %q", spec)
+			}
+			value, err := ev.expandMacro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i += end
+		default:
+			return "", permError("spf: invalid macro in %q", spec)
+		}
+	}
+	return out.String(), nil
+}
+
+// expand single macro like "ir" or "d2" or "l-"
+
+func (ev *evaluation) expandMacro(macro, domain string) (string, error) {
+	if macro == "" {
+		return "", permError("spf: empty macro")
+	}
+	var value string
+	letter := macro[0]
+	switch letter | 0x20 {
+	case 's':
+		value = ev.sender
+	case 'l':
+		value = "postmaster"
+		if idx := strings.LastIndex(ev.sender, "@"); idx > 0 {
+			value = ev.sender[:idx]
+		}
+	case 'o':
+		value = domainOf(ev.sender)
+	case 'd':
+		value = domain
+	case 'i':
+		value = dottedIP(ev.ip)
+	case 'p':
+		value = "unknown"
+		if names := ev.validatedNames(); len(names) > 0 {
+			value = names[0]
+		}
+	case 'v':
+		value = "in-addr"
+		if ev.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = ev.helo
+	case 'c':
+		value = ev.ip.String()
+	case 'r':
+		value = ev.checker.Hostname
+		if value == "" {
+			value = "unknown"
+		}
+	case 't':
+		value = strconv.FormatInt(time.Now().Unix(), 10)
+	default:
+		return "", permError("spf: unknown macro letter %q", letter)
+	}
+
+	// transformers
+	rest := macro[1:]
+	digits := 0
+	for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+		digits = digits*10 + int(rest[0]-'0')
+		rest = rest[1:]
+	}
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", permError("spf: invalid macro delimiter in %q", macro)
+		}
+		delimiters = rest
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	value = strings.Join(parts, ".")
+	// uppercase macro letters are URL escaped
+	if letter >= 'A' && letter <= 'Z' {
+		value = urlEscape(value)
+	}
+	return value, nil
+}
+
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	const hexDigits = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hexDigits[b>>4]), string(hexDigits[b&0xf]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+func urlEscape(value string) string {
+	var out strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-._~", c) != -1 {
+			out.WriteByte(c)
+		} else {
+			out.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		}
+	}
+	return out.String()
+}
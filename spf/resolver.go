@@ -0,0 +1,76 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Resolver is used for all DNS queries made while evaluating SPF
+// records. Implementations should return ErrNotFound (or a *net.DNSError
+// with IsNotFound set) when the name has no records of the requested type.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(name string) ([]net.IP, error)
+	LookupMX(name string) ([]*net.MX, error)
+	LookupAddr(addr string) ([]string, error)
+}
+
+// DNSResolver resolves names with the system resolver.
+type DNSResolver struct {
+	Timeout time.Duration
+}
+
+func NewDNSResolver(timeout time.Duration) *DNSResolver {
+	return &DNSResolver{Timeout: timeout}
+}
+
+func (r *DNSResolver) context() (context.Context, context.CancelFunc) {
+	if r.Timeout > 0 {
+		return context.WithTimeout(context.Background(), r.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (r *DNSResolver) LookupTXT(name string) ([]string, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+	return net.DefaultResolver.LookupTXT(ctx, name)
+}
+
+func (r *DNSResolver) LookupIP(name string) ([]net.IP, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+func (r *DNSResolver) LookupMX(name string) ([]*net.MX, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+	return net.DefaultResolver.LookupMX(ctx, name)
+}
+
+func (r *DNSResolver) LookupAddr(addr string) ([]string, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+	return net.DefaultResolver.LookupAddr(ctx, addr)
+}
+
+// IsNotFound reports whether err means the queried name has no records.
+func IsNotFound(err error) bool {
+	if err == ErrNotFound {
+		return true
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
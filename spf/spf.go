@@ -0,0 +1,495 @@
+// Package spf implements Sender Policy Framework checks (RFC 7208).
+package spf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	MAX_DNS_LOOKUPS  = 10 // RFC 7208 section 4.6.4
+	MAX_VOID_LOOKUPS = 2  // RFC 7208 section 4.6.4
+	MAX_MX_RECORDS   = 10
+	MAX_PTR_RECORDS  = 10
+)
+
+type Result string
+
+const (
+	IDENTITY_HELO     = "helo"
+	IDENTITY_MAILFROM = "mailfrom"
+)
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+var (
+	ErrNotFound          = errors.New("spf: no such DNS record")
+	errTooManyLookups    = errors.New("spf: too many DNS lookups")
+	errTooManyVoids      = errors.New("spf: too many void DNS lookups")
+	errMultipleRecords   = errors.New("spf: multiple SPF records")
+	errInvalidDomainSpec = errors.New("spf: invalid domain spec")
+)
+
+// Checker evaluates the SPF policy of a domain for a connecting client.
+type Checker struct {
+	Resolver Resolver
+	Hostname string // receiving host, used by the %{r} macro and in headers
+}
+
+// evaluation state shared by a check_host() call and its nested includes
+type evaluation struct {
+	checker *Checker
+	ip      net.IP
+	sender  string
+	helo    string
+	lookups int
+	voids   int
+}
+
+type spfError struct {
+	result Result
+	err    error
+}
+
+func (e *spfError) Error() string {
+	return e.err.Error()
+}
+
+func permError(format string, args ...interface{}) error {
+	return &spfError{result: PermError, err: fmt.Errorf(format, args...)}
+}
+
+func tempError(err error) error {
+	return &spfError{result: TempError, err: err}
+}
+
+// check host
+
+// CheckHost runs check_host() for domain. Sender is the MAIL FROM address
+// (or postmaster@helo for the HELO identity).
+func (c *Checker) CheckHost(ip net.IP, domain, sender, helo string) (Result, error) {
+	if ip == nil {
+		return None, errors.New("spf: no client ip")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if !isValidDomain(domain) {
+		return None, nil
+	}
+	ev := &evaluation{checker: c, ip: ip, sender: sender, helo: helo}
+	return ev.checkHost(domain)
+}
+
+// CheckMailFrom evaluates the MAIL FROM identity, falling back
+// to the HELO identity for the null reverse-path.
+func (c *Checker) CheckMailFrom(ip net.IP, sender, helo string) (Result, error) {
+	if sender == "" {
+		return c.CheckHelo(ip, helo)
+	}
+	domain := domainOf(sender)
+	if domain == "" {
+		domain = helo
+	}
+	if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+	return c.CheckHost(ip, domain, sender, helo)
+}
+
+// CheckHelo evaluates the HELO identity.
+func (c *Checker) CheckHelo(ip net.IP, helo string) (Result, error) {
+	return c.CheckHost(ip, helo, "postmaster@"+helo, helo)
+}
+
+func (ev *evaluation) checkHost(domain string) (Result, error) {
+	record, err := ev.lookupRecord(domain)
+	if err != nil {
+		if se, ok := err.(*spfError); ok {
+			return se.result, se.err
+		}
+		return TempError, err
+	}
+	if record == "" {
+		return None, nil
+	}
+	result, err := ev.evaluate(domain, record)
+	if se, ok := err.(*spfError); ok {
+		return se.result, se.err
+	}
+	return result, err
+}
+
+// lookupRecord returns the SPF record of domain or "" if there is none
+
+func (ev *evaluation) lookupRecord(domain string) (string, error) {
+	txts, err := ev.checker.Resolver.LookupTXT(domain)
+	if err != nil {
+		if IsNotFound(err) {
+			return "", nil
+		}
+		return "", tempError(err)
+	}
+	record := ""
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			if record != "" {
+				return "", &spfError{result: PermError, err: errMultipleRecords}
+			}
+			record = txt
+		}
+	}
+	return record, nil
+}
+
+// evaluate record terms from left to right
+
+func (ev *evaluation) evaluate(domain, record string) (Result, error) {
+	var redirect string
+	terms := strings.Fields(record)[1:]
+	for _, term := range terms {
+		if name, value, ok := splitModifier(term); ok {
+			switch name {
+			case "redirect":
+				if redirect != "" {
+					return PermError, permError("spf: duplicate redirect modifier")
+				}
+				redirect = value
+			case "exp":
+				// explanations are not fetched
+			}
+			continue
+		}
+		qualifier := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = Fail, term[1:]
+		case '~':
+			qualifier, term = SoftFail, term[1:]
+		case '?':
+			qualifier, term = Neutral, term[1:]
+		}
+		matched, err := ev.matchMechanism(domain, term)
+		if err != nil {
+			return PermError, err
+		}
+		if matched {
+			return qualifier, nil
+		}
+	}
+	if redirect != "" {
+		if err := ev.countLookup(); err != nil {
+			return PermError, err
+		}
+		target, err := ev.expandDomainSpec(redirect, domain)
+		if err != nil {
+			return PermError, err
+		}
+		result, err := ev.checkHost(target)
+		if result == None {
+			return PermError, permError("spf: redirect to %q without SPF record", target)
+		}
+		return result, err
+	}
+	return Neutral, nil
+}
+
+func splitModifier(term string) (string, string, bool) {
+	idx := strings.Index(term, "=")
+	if idx <= 0 {
+		return "", "", false
+	}
+	name := strings.ToLower(term[:idx])
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return "", "", false
+		}
+	}
+	return name, term[idx+1:], true
+}
+
+// match mechanism against client ip
+
+func (ev *evaluation) matchMechanism(domain, term string) (bool, error) {
+	name, arg := term, ""
+	if idx := strings.IndexAny(term, ":/"); idx != -1 {
+		name, arg = term[:idx], term[idx:]
+	}
+	name = strings.ToLower(name)
+	switch name {
+	case "all":
+		if arg != "" {
+			return false, permError("spf: invalid mechanism %q", term)
+		}
+		return true, nil
+	case "include":
+		if err := ev.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := ev.expandDomainSpec(strings.TrimPrefix(arg, ":"), domain)
+		if err != nil || target == "" {
+			return false, permError("spf: invalid include %q", term)
+		}
+		result, err := ev.checkHost(target)
+		switch result {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, tempError(err)
+		default:
+			return false, permError("spf: include %q returned %s", target, result)
+		}
+	case "a":
+		if err := ev.countLookup(); err != nil {
+			return false, err
+		}
+		host, ip4Mask, ip6Mask, err := ev.parseTarget(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := ev.lookupIP(host)
+		if err != nil {
+			return false, err
+		}
+		return ev.matchIPs(ips, ip4Mask, ip6Mask), nil
+	case "mx":
+		if err := ev.countLookup(); err != nil {
+			return false, err
+		}
+		host, ip4Mask, ip6Mask, err := ev.parseTarget(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := ev.checker.Resolver.LookupMX(host)
+		if err != nil {
+			if IsNotFound(err) {
+				return false, ev.countVoid()
+			}
+			return false, tempError(err)
+		}
+		if len(mxs) > MAX_MX_RECORDS {
+			return false, permError("spf: too many MX records for %q", host)
+		}
+		for _, mx := range mxs {
+			ips, err := ev.lookupIP(strings.TrimSuffix(mx.Host, "."))
+			if err != nil {
+				return false, err
+			}
+			if ev.matchIPs(ips, ip4Mask, ip6Mask) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "ptr":
+		if err := ev.countLookup(); err != nil {
+			return false, err
+		}
+		host := domain
+		if arg != "" {
+			var err error
+			host, err = ev.expandDomainSpec(strings.TrimPrefix(arg, ":"), domain)
+			if err != nil {
+				return false, err
+			}
+		}
+		return ev.matchPtr(host), nil
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, permError("spf: invalid mechanism %q", term)
+		}
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			if name == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, permError("spf: invalid network %q", term)
+		}
+		if (name == "ip4") != (ipNet.IP.To4() != nil) {
+			return false, permError("spf: invalid network %q", term)
+		}
+		return ipNet.Contains(ev.ip), nil
+	case "exists":
+		if err := ev.countLookup(); err != nil {
+			return false, err
+		}
+		host, err := ev.expandDomainSpec(strings.TrimPrefix(arg, ":"), domain)
+		if err != nil || host == "" {
+			return false, permError("spf: invalid exists %q", term)
+		}
+		ips, err := ev.checker.Resolver.LookupIP(host)
+		if err != nil {
+			if IsNotFound(err) {
+				return false, ev.countVoid()
+			}
+			return false, tempError(err)
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, permError("spf: unknown mechanism %q", term)
+}
+
+// parse ":domain/cidr4//cidr6" arguments of a and mx mechanisms
+
+func (ev *evaluation) parseTarget(arg, domain string) (string, int, int, error) {
+	var err error
+	ip4Mask, ip6Mask := 32, 128
+	host := domain
+	if idx := strings.Index(arg, "//"); idx != -1 {
+		ip6Mask, err = strconv.Atoi(arg[idx+2:])
+		if err != nil || ip6Mask < 0 || ip6Mask > 128 {
+			return "", 0, 0, permError("spf: invalid ip6 cidr %q", arg)
+		}
+		arg = arg[:idx]
+	}
+	if idx := strings.LastIndex(arg, "/"); idx != -1 {
+		ip4Mask, err = strconv.Atoi(arg[idx+1:])
+		if err != nil || ip4Mask < 0 || ip4Mask > 32 {
+			return "", 0, 0, permError("spf: invalid ip4 cidr %q", arg)
+		}
+		arg = arg[:idx]
+	}
+	if strings.HasPrefix(arg, ":") {
+		host, err = ev.expandDomainSpec(arg[1:], domain)
+		if err != nil || host == "" {
+			return "", 0, 0, permError("spf: invalid domain spec %q", arg)
+		}
+	}
+	return host, ip4Mask, ip6Mask, nil
+}
+
+func (ev *evaluation) lookupIP(host string) ([]net.IP, error) {
+	ips, err := ev.checker.Resolver.LookupIP(host)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, ev.countVoid()
+		}
+		return nil, tempError(err)
+	}
+	return ips, nil
+}
+
+func (ev *evaluation) matchIPs(ips []net.IP, ip4Mask, ip6Mask int) bool {
+	for _, ip := range ips {
+		var mask net.IPMask
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			mask = net.CIDRMask(ip4Mask, 32)
+		} else {
+			mask = net.CIDRMask(ip6Mask, 128)
+		}
+		if len(ip) != len(ev.ip) {
+			continue
+		}
+		if ip.Mask(mask).Equal(ev.ip.Mask(mask)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validated reverse names of client ip, RFC 7208 section 5.5
+
+func (ev *evaluation) validatedNames() []string {
+	var validated []string
+	names, err := ev.checker.Resolver.LookupAddr(ev.ip.String())
+	if err != nil {
+		return validated
+	}
+	if len(names) > MAX_PTR_RECORDS {
+		names = names[:MAX_PTR_RECORDS]
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		ips, err := ev.checker.Resolver.LookupIP(name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(ev.ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+	return validated
+}
+
+func (ev *evaluation) matchPtr(domain string) bool {
+	domain = strings.ToLower(domain)
+	for _, name := range ev.validatedNames() {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup limits
+
+func (ev *evaluation) countLookup() error {
+	ev.lookups++
+	if ev.lookups > MAX_DNS_LOOKUPS {
+		return &spfError{result: PermError, err: errTooManyLookups}
+	}
+	return nil
+}
+
+func (ev *evaluation) countVoid() error {
+	ev.voids++
+	if ev.voids > MAX_VOID_LOOKUPS {
+		return &spfError{result: PermError, err: errTooManyVoids}
+	}
+	return nil
+}
+
+// helpers
+
+func domainOf(address string) string {
+	if idx := strings.LastIndex(address, "@"); idx != -1 {
+		return strings.ToLower(address[idx+1:])
+	}
+	return ""
+}
+
+func isValidDomain(domain string) bool {
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
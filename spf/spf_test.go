@@ -0,0 +1,188 @@
+package spf
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// stub resolver
+
+type stubResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	ptr  map[string][]string
+	fail map[string]bool
+}
+
+func (r *stubResolver) LookupTXT(name string) ([]string, error) {
+	if r.fail[name] {
+		return nil, errors.New("timeout")
+	}
+	if txts, ok := r.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (r *stubResolver) LookupIP(name string) ([]net.IP, error) {
+	addrs, ok := r.ip[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, net.ParseIP(addr))
+	}
+	return ips, nil
+}
+
+func (r *stubResolver) LookupMX(name string) ([]*net.MX, error) {
+	hosts, ok := r.mx[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var mxs []*net.MX
+	for i, host := range hosts {
+		mxs = append(mxs, &net.MX{Host: host + ".", Pref: uint16(i * 10)})
+	}
+	return mxs, nil
+}
+
+func (r *stubResolver) LookupAddr(addr string) ([]string, error) {
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, ErrNotFound
+}
+
+var testResolver = &stubResolver{
+	txt: map[string][]string{
+		"example.com":          {"v=spf1 ip4:192.0.2.0/24 a:mail.example.com mx include:_spf.example.net -all", "google-site-verification=x"},
+		"_spf.example.net":     {"v=spf1 ip6:2001:db8::/32 ~all"},
+		"soft.example.com":     {"v=spf1 ~all"},
+		"neutral.example.com":  {"v=spf1 ?all"},
+		"redirect.example.com": {"v=spf1 redirect=example.com"},
+		"broken.example.com":   {"v=spf1 ip4:999.0.0.1 -all"},
+		"double.example.com":   {"v=spf1 -all", "v=spf1 +all"},
+		"macro.example.com":    {"v=spf1 exists:%{ir}.%{l1r-}.lists.example.com -all"},
+		"ptr.example.com":      {"v=spf1 ptr -all"},
+		"loop.example.com":     {"v=spf1 include:loop.example.com -all"},
+		"temp.example.com":     {"v=spf1 include:down.example.com -all"},
+		"helo.example.com":     {"v=spf1 a -all"},
+	},
+	ip: map[string][]string{
+		"mail.example.com":                      {"198.51.100.10"},
+		"mx1.example.com":                       {"203.0.113.5"},
+		"helo.example.com":                      {"203.0.113.77"},
+		"host.ptr.example.com":                  {"203.0.113.9"},
+		"9.113.0.203.bar.foo.lists.example.com": {"127.0.0.2"},
+	},
+	mx: map[string][]string{
+		"example.com": {"mx1.example.com"},
+	},
+	ptr: map[string][]string{
+		"203.0.113.9": {"host.ptr.example.com."},
+	},
+	fail: map[string]bool{
+		"down.example.com": true,
+	},
+}
+
+type spfTest struct {
+	IP     string
+	Sender string
+	Helo   string
+	Result Result
+}
+
+var spfTests = []spfTest{
+	{"192.0.2.15", "user@example.com", "client.example.org", Pass},
+	{"198.51.100.10", "user@example.com", "client.example.org", Pass},
+	{"203.0.113.5", "user@example.com", "client.example.org", Pass},
+	{"2001:db8::1", "user@example.com", "client.example.org", Pass},
+	{"203.0.113.200", "user@example.com", "client.example.org", Fail},
+	{"203.0.113.200", "user@soft.example.com", "client.example.org", SoftFail},
+	{"203.0.113.200", "user@neutral.example.com", "client.example.org", Neutral},
+	{"192.0.2.15", "user@redirect.example.com", "client.example.org", Pass},
+	{"203.0.113.200", "user@redirect.example.com", "client.example.org", Fail},
+	{"203.0.113.200", "user@none.example.com", "client.example.org", None},
+	{"203.0.113.200", "user@broken.example.com", "client.example.org", PermError},
+	{"203.0.113.200", "user@double.example.com", "client.example.org", PermError},
+	{"203.0.113.9", "bar.foo@macro.example.com", "client.example.org", Pass},
+	{"203.0.113.10", "bar.foo@macro.example.com", "client.example.org", Fail},
+	{"203.0.113.9", "user@ptr.example.com", "client.example.org", Pass},
+	{"203.0.113.10", "user@ptr.example.com", "client.example.org", Fail},
+	{"203.0.113.10", "user@loop.example.com", "client.example.org", PermError},
+	{"203.0.113.10", "user@temp.example.com", "client.example.org", TempError},
+	{"203.0.113.77", "", "helo.example.com", Pass},
+	{"203.0.113.78", "", "helo.example.com", Fail},
+}
+
+func TestCheckMailFrom(t *testing.T) {
+	checker := &Checker{Resolver: testResolver, Hostname: "mx.falcon.test"}
+	for _, test := range spfTests {
+		result, _ := checker.CheckMailFrom(net.ParseIP(test.IP), test.Sender, test.Helo)
+		if result != test.Result {
+			t.Errorf("CheckMailFrom(%s, %q, %q) = %s, expected %s", test.IP, test.Sender, test.Helo, result, test.Result)
+		}
+	}
+}
+
+func TestMacroExpansion(t *testing.T) {
+	ev := &evaluation{
+		checker: &Checker{Resolver: testResolver, Hostname: "mx.falcon.test"},
+		ip:      net.ParseIP("192.0.2.3").To4(),
+		sender:  "strong-bad@email.example.com",
+		helo:    "mx.example.org",
+	}
+	macroTests := [][2]string{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"%{h}", "mx.example.org"},
+		{"%%%_%-", "% %20"},
+	}
+	for _, test := range macroTests {
+		expanded, err := ev.expandMacros(test[0], "email.example.com")
+		if err != nil {
+			t.Errorf("expandMacros(%q) error: %v", test[0], err)
+			continue
+		}
+		if expanded != test[1] {
+			t.Errorf("expandMacros(%q) = %q, expected %q", test[0], expanded, test[1])
+		}
+	}
+	ev.ip = net.ParseIP("2001:db8::cb01")
+	expanded, _ := ev.expandMacros("%{ir}.%{v}", "email.example.com")
+	if !strings.HasPrefix(expanded, "1.0.b.c.0.0.0.0") || !strings.HasSuffix(expanded, "8.b.d.0.1.0.0.2.ip6") {
+		t.Errorf("unexpected ip6 expansion %q", expanded)
+	}
+}
+
+func TestReceivedHeader(t *testing.T) {
+	header := ReceivedHeader(Pass, net.ParseIP("192.0.2.1"), IDENTITY_MAILFROM, "user@example.com", "client.example.org", "mx.falcon.test")
+	expected := "Received-SPF: pass (mx.falcon.test: domain of user@example.com designates 192.0.2.1 as permitted sender) receiver=mx.falcon.test; client-ip=192.0.2.1; envelope-from=\"user@example.com\"; helo=client.example.org; identity=mailfrom;"
+	if header != expected {
+		t.Errorf("ReceivedHeader = %q, expected %q", header, expected)
+	}
+	header = ReceivedHeader(Fail, net.ParseIP("192.0.2.1"), IDENTITY_HELO, "user@example.com", "client.example.org", "mx.falcon.test")
+	expected = "Received-SPF: fail (mx.falcon.test: domain of postmaster@client.example.org does not designate 192.0.2.1 as permitted sender) receiver=mx.falcon.test; client-ip=192.0.2.1; envelope-from=\"user@example.com\"; helo=client.example.org; identity=helo;"
+	if header != expected {
+		t.Errorf("ReceivedHeader of helo = %q, expected %q", header, expected)
+	}
+}
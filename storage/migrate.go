@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+)
+
+const (
+	// table of applied versions, schema_migrations is often taken by
+	// application owning inboxes
+	MIGRATIONS_TABLE = "falcon_schema_migrations"
+	// pg_advisory_xact_lock key, one migrating server at a time
+	MIGRATIONS_LOCK = 7244911
+)
+
+// Migration of default schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus of known migration, AppliedAt is nil for pending
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// check migrations are ordered with unique versions
+
+func checkMigrations(migrations []Migration) error {
+	for i, migration := range migrations {
+		if migration.Version <= 0 || migration.Up == "" || migration.Down == "" {
+			return fmt.Errorf("migration %d %q is incomplete", migration.Version, migration.Name)
+		}
+		if i > 0 && migration.Version <= migrations[i-1].Version {
+			return fmt.Errorf("migration %d is out of order", migration.Version)
+		}
+	}
+	return nil
+}
+
+func (db *DBConn) createMigrationsTable() error {
+	_, err := db.DB.Exec("CREATE TABLE IF NOT EXISTS " + MIGRATIONS_TABLE + " (version integer NOT NULL PRIMARY KEY, name character varying(255), applied_at timestamp with time zone NOT NULL DEFAULT NOW())")
+	return err
+}
+
+// applied versions with time
+
+func (db *DBConn) appliedMigrations() (map[int]time.Time, error) {
+	if err := db.createMigrationsTable(); err != nil {
+		return nil, err
+	}
+	rows, err := db.DB.Query("SELECT version, applied_at FROM " + MIGRATIONS_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// MigrationsStatus returns all known migrations with time of apply.
+func (db *DBConn) MigrationsStatus() ([]MigrationStatus, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		log.Errorf("Migrations SQL error: %v", err)
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	for _, migration := range Migrations {
+		status := MigrationStatus{Migration: migration}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// MigrateUp applies pending migrations up to version, all if version is 0.
+// Every migration runs in own transaction.
+func (db *DBConn) MigrateUp(version int) ([]Migration, error) {
+	if err := checkMigrations(Migrations); err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, migration := range Migrations {
+		if version > 0 && migration.Version > version {
+			break
+		}
+		ok, err := db.runMigration(migration, true)
+		if err != nil {
+			log.Errorf("Migration %d up error: %v", migration.Version, err)
+			return done, fmt.Errorf("migration %d: %v", migration.Version, err)
+		}
+		if ok {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+// MigrateDown rolls back last steps applied migrations, newest first.
+func (db *DBConn) MigrateDown(steps int) ([]Migration, error) {
+	if err := checkMigrations(Migrations); err != nil {
+		return nil, err
+	}
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		log.Errorf("Migrations SQL error: %v", err)
+		return nil, err
+	}
+	var done []Migration
+	for i := len(Migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := Migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		ok, err := db.runMigration(migration, false)
+		if err != nil {
+			log.Errorf("Migration %d down error: %v", migration.Version, err)
+			return done, fmt.Errorf("migration %d: %v", migration.Version, err)
+		}
+		if ok {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+// run migration under lock, false if other server already did it
+
+func (db *DBConn) runMigration(migration Migration, up bool) (bool, error) {
+	if err := db.createMigrationsTable(); err != nil {
+		return false, err
+	}
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", MIGRATIONS_LOCK); err != nil {
+		return false, err
+	}
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM "+MIGRATIONS_TABLE+" WHERE version = $1)", migration.Version).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if exists == up {
+		return false, nil
+	}
+	if up {
+		err = execMigration(tx, migration.Up, "INSERT INTO "+MIGRATIONS_TABLE+" (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+	} else {
+		err = execMigration(tx, migration.Down, "DELETE FROM "+MIGRATIONS_TABLE+" WHERE version = $1", migration.Version)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func execMigration(tx *sql.Tx, script, record string, args ...interface{}) error {
+	// without arguments script may have many statements
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	_, err := tx.Exec(record, args...)
+	return err
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"database/sql"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/Polymail/go-falcon/search"
+)
+
+// integration tests run against local database of FALCON_TEST_DATABASE_URL,
+// e.g. postgres://leo@localhost:5432/falcon_test?sslmode=disable
+
+func testDatabase(t *testing.T) *DBConn {
+	url := os.Getenv("FALCON_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("FALCON_TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &DBConn{DB: db, config: &StorageConfig{}}
+}
+
+func TestMigrationsOrder(t *testing.T) {
+	if err := checkMigrations(Migrations); err != nil {
+		t.Error(err)
+	}
+	if err := checkMigrations([]Migration{{Version: 2, Up: "up", Down: "down"}, {Version: 1, Up: "up", Down: "down"}}); err == nil {
+		t.Error("expected error of unordered migrations")
+	}
+	if err := checkMigrations([]Migration{{Version: 1, Up: "up"}}); err == nil {
+		t.Error("expected error of migration without down")
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db := testDatabase(t)
+	if _, err := db.MigrateDown(len(Migrations)); err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := db.MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != len(Migrations) {
+		t.Fatalf("expected %d migrations applied, got %d", len(Migrations), len(migrations))
+	}
+	if migrations, _ = db.MigrateUp(0); len(migrations) != 0 {
+		t.Errorf("expected nothing to apply, got %d", len(migrations))
+	}
+	statuses, err := db.MigrationsStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			t.Errorf("migration %d is not applied", status.Version)
+		}
+	}
+
+	// partitions of new inbox
+	var inboxId int
+	err = db.DB.QueryRow("INSERT INTO inboxes(domain, username, password, created_at, updated_at) VALUES ('example.com', 'test', 'pass', NOW(), NOW()) RETURNING id").Scan(&inboxId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, db, "messages_"+strconv.Itoa(inboxId)) {
+		t.Error("partition should be created with first message")
+	}
+	db.config.Partition_Sql = "SELECT falcon_create_inbox_partitions(:inbox_id)"
+	db.config.Messages_Sql = "INSERT INTO messages(inbox_id, subject, raw_body, email_size) VALUES(:inbox_id, :subject, :raw_body, :email_size) RETURNING id"
+	if db.queries, err = compileQueries(db.config); err != nil {
+		t.Fatal(err)
+	}
+	db.partitions = &partitionSet{}
+	if _, err = db.StoreMail(&Message{MailboxID: inboxId, Subject: "test", Raw: []byte("body")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"messages", "attachments"} {
+		if !tableExists(t, db, table+"_"+strconv.Itoa(inboxId)) {
+			t.Errorf("partition %s_%d is not created", table, inboxId)
+		}
+	}
+	if _, err = db.DB.Exec("DELETE FROM inboxes WHERE id = $1", inboxId); err != nil {
+		t.Fatal(err)
+	}
+	if tableExists(t, db, "messages_"+strconv.Itoa(inboxId)) {
+		t.Error("partition should be dropped with inbox")
+	}
+
+	if migrations, err = db.MigrateDown(len(Migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != len(Migrations) || migrations[0].Version != Migrations[len(Migrations)-1].Version {
+		t.Errorf("expected all migrations rolled back newest first, got %v", migrations)
+	}
+	statuses, _ = db.MigrationsStatus()
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			t.Errorf("migration %d is still applied", status.Version)
+		}
+	}
+}
+
+func TestMigrateInheritedTables(t *testing.T) {
+	db := testDatabase(t)
+	if _, err := db.MigrateDown(len(Migrations)); err != nil {
+		t.Fatal(err)
+	}
+	defer db.MigrateDown(len(Migrations))
+	if _, err := db.MigrateUp(5); err != nil {
+		t.Fatal(err)
+	}
+	var inboxId int
+	err := db.DB.QueryRow("INSERT INTO inboxes(domain, username, password) VALUES ('example.com', 'test', 'pass') RETURNING id").Scan(&inboxId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one message in table of inbox, one in parent
+	for _, table := range []string{"messages_" + strconv.Itoa(inboxId), "messages"} {
+		if _, err = db.DB.Exec("INSERT INTO "+table+"(inbox_id, subject) VALUES ($1, 'test')", inboxId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = db.MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err = db.DB.QueryRow("SELECT COUNT(*) FROM messages_" + strconv.Itoa(inboxId)).Scan(&count); err != nil || count != 2 {
+		t.Errorf("expected 2 messages in partition, got %d: %v", count, err)
+	}
+	if _, err = db.MigrateDown(1); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DB.QueryRow("SELECT COUNT(*) FROM messages WHERE inbox_id = $1", inboxId).Scan(&count); err != nil || count != 2 {
+		t.Errorf("expected 2 messages after rollback, got %d: %v", count, err)
+	}
+}
+
+func tableExists(t *testing.T, db *DBConn, table string) bool {
+	var exists bool
+	if err := db.DB.QueryRow("SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func TestSearch(t *testing.T) {
+	db := testDatabase(t)
+	if _, err := db.MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	defer db.MigrateDown(len(Migrations))
+	var inboxId int
+	err := db.DB.QueryRow("INSERT INTO inboxes(domain, username, password) VALUES ('example.com', 'search', 'pass') RETURNING id").Scan(&inboxId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.config.Partition_Sql = "SELECT falcon_create_inbox_partitions(:inbox_id)"
+	db.config.Messages_Sql = "INSERT INTO messages(inbox_id, subject, from_email, text_body, html_body) VALUES(:inbox_id, :subject, :from_email, :text_body, :html_body) RETURNING id"
+	db.config.Attachments_Sql = "INSERT INTO attachments(inbox_id, message_id, filename) VALUES(:inbox_id, :message_id, :filename) RETURNING id"
+	db.config.Search_Sql = "SELECT id, subject, from_email, sent_at, ts_rank(search_vector, query) AS rank, COUNT(*) OVER () FROM messages, to_tsquery('simple', :query) query WHERE inbox_id = :inbox_id AND search_vector @@ query ORDER BY rank DESC, id DESC LIMIT :limit OFFSET :offset"
+	if db.queries, err = compileQueries(db.config); err != nil {
+		t.Fatal(err)
+	}
+	db.partitions = &partitionSet{}
+	first, err := db.StoreMail(&Message{MailboxID: inboxId, Subject: "Invoice of May", From: "leo@example.com", Text: "due date is Friday"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.StoreAttachment(inboxId, first, "report.pdf", "attachment", "application/pdf", "", "base64", ""); err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.StoreMail(&Message{MailboxID: inboxId, Subject: "Hello", From: "max@example.com", Html: "<p>invoice <b>attached</b></p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for text, expected := range map[string][]int{
+		"invoice":               {first, second},
+		"subject:invoice":       {first},
+		`"due date"`:            {first},
+		`"date due"`:            nil,
+		"from:max@example.com":  {second},
+		"body:attached":         {second},
+		"attachment:report.pdf": {first},
+	} {
+		clauses, _ := search.ParseQuery(text)
+		result, err := db.Search(&search.Query{MailboxID: inboxId, Clauses: clauses, Page: 1, PerPage: 10})
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		var ids []int
+		for _, hit := range result.Hits {
+			ids = append(ids, hit.MessageID)
+		}
+		sort.Ints(ids)
+		if !reflect.DeepEqual(ids, expected) || result.Total != len(expected) {
+			t.Errorf("%s: expected %v, got %v of %d", text, expected, ids, result.Total)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package storage
+
+// functions and trigger of legacy INHERITS tables, created with inbox
+
+const inheritedTables = `
+CREATE FUNCTION falcon_create_inbox_tables(inbox integer) RETURNS void AS $$
+BEGIN
+  EXECUTE format('CREATE TABLE IF NOT EXISTS messages_%s (CHECK (inbox_id = %s)) INHERITS (messages)', inbox, inbox);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS index_messages_%s_on_inbox_id ON messages_%s USING btree (inbox_id)', inbox, inbox);
+  EXECUTE format('CREATE TABLE IF NOT EXISTS attachments_%s (CHECK (inbox_id = %s)) INHERITS (attachments)', inbox, inbox);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS index_attachments_%s_on_inbox_id ON attachments_%s USING btree (inbox_id)', inbox, inbox);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS index_attachments_%s_on_content_id ON attachments_%s USING btree (content_id)', inbox, inbox);
+  EXECUTE format('CREATE INDEX IF NOT EXISTS index_attachments_%s_on_attachment_type ON attachments_%s USING btree (attachment_type)', inbox, inbox);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION falcon_inbox_created() RETURNS trigger AS $$
+BEGIN
+  PERFORM falcon_create_inbox_tables(NEW.id);
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER falcon_inbox_tables AFTER INSERT ON inboxes
+  FOR EACH ROW EXECUTE PROCEDURE falcon_inbox_created();
+`
+
+// Migrations of default schema, in order of version. Applied migrations
+// should never change, schema changes are new versions.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create inboxes, messages and attachments",
+		Up: `
+CREATE TABLE inboxes (
+  id serial NOT NULL,
+  company_id integer,
+  name character varying(255),
+  domain character varying(255) NOT NULL,
+  username character varying(255) NOT NULL,
+  password character varying(255) NOT NULL,
+  max_size integer DEFAULT 0,
+  email_username character varying,
+  email_username_enabled boolean NOT NULL DEFAULT false,
+  created_at timestamp without time zone,
+  updated_at timestamp without time zone,
+  CONSTRAINT inboxes_pkey PRIMARY KEY (id)
+);
+CREATE INDEX index_inboxes_on_company_id ON inboxes USING btree (company_id);
+CREATE UNIQUE INDEX index_inboxes_on_username ON inboxes USING btree (username);
+CREATE UNIQUE INDEX index_inboxes_on_email_username ON inboxes USING btree (email_username);
+
+CREATE TABLE messages (
+  id serial NOT NULL,
+  inbox_id integer,
+  subject character varying(1000),
+  sent_at timestamp without time zone,
+  from_email character varying(255),
+  from_name character varying(255),
+  to_email character varying(255),
+  to_name character varying(255),
+  text_body text,
+  html_body text,
+  raw_body text,
+  email_size integer DEFAULT 0,
+  created_at timestamp without time zone,
+  updated_at timestamp without time zone,
+  CONSTRAINT messages_pkey PRIMARY KEY (id)
+);
+CREATE INDEX index_messages_on_inbox_id ON messages USING btree (inbox_id);
+
+CREATE TABLE attachments (
+  id serial NOT NULL,
+  inbox_id integer,
+  message_id integer,
+  filename character varying(1000),
+  attachment_type character varying(255),
+  content_type character varying(255),
+  content_id character varying(255),
+  transfer_encoding character varying(255),
+  attachment_body bytea,
+  attachment_size integer DEFAULT 0,
+  created_at timestamp without time zone,
+  updated_at timestamp without time zone,
+  CONSTRAINT attachments_pkey PRIMARY KEY (id)
+);
+CREATE INDEX index_attachments_on_message_id ON attachments USING btree (message_id);
+`,
+		Down: `
+DROP TABLE attachments CASCADE;
+DROP TABLE messages CASCADE;
+DROP TABLE inboxes;
+`,
+	},
+	{
+		Version: 2,
+		Name:    "create messages_N and attachments_N tables of every inbox",
+		Up: inheritedTables + `
+SELECT falcon_create_inbox_tables(id) FROM inboxes;
+`,
+		Down: `
+DROP TRIGGER falcon_inbox_tables ON inboxes;
+DROP FUNCTION falcon_inbox_created();
+DROP FUNCTION falcon_create_inbox_tables(integer);
+`,
+	},
+	{
+		Version: 3,
+		Name:    "add message reports",
+		Up: `
+ALTER TABLE messages
+  ADD COLUMN spam_report text,
+  ADD COLUMN viruses_report text,
+  ADD COLUMN spf_result character varying(255),
+  ADD COLUMN dkim_report text,
+  ADD COLUMN dmarc_result text,
+  ADD COLUMN campaign character varying(255),
+  ADD COLUMN quarantined boolean NOT NULL DEFAULT false;
+`,
+		Down: `
+ALTER TABLE messages
+  DROP COLUMN spam_report,
+  DROP COLUMN viruses_report,
+  DROP COLUMN spf_result,
+  DROP COLUMN dkim_report,
+  DROP COLUMN dmarc_result,
+  DROP COLUMN campaign,
+  DROP COLUMN quarantined;
+`,
+	},
+	{
+		Version: 4,
+		Name:    "add inbox settings, relay and webhook",
+		Up: `
+ALTER TABLE inboxes
+  ADD COLUMN enabled boolean NOT NULL DEFAULT true,
+  ADD COLUMN rate_limit integer DEFAULT 0,
+  ADD COLUMN bytes_rate_limit integer DEFAULT 0,
+  ADD COLUMN sender_rate_limit integer DEFAULT 0,
+  ADD COLUMN campaign_threshold integer DEFAULT 0,
+  ADD COLUMN max_message_bytes integer DEFAULT 0,
+  ADD COLUMN retention_days integer DEFAULT 0,
+  ADD COLUMN max_bytes bigint DEFAULT 0,
+  ADD COLUMN spam_threshold double precision DEFAULT 0,
+  ADD COLUMN allowed_senders character varying(255)[],
+  ADD COLUMN forward_targets character varying(255)[],
+  ADD COLUMN relay_enabled boolean NOT NULL DEFAULT false,
+  ADD COLUMN webhook_url character varying(1000),
+  ADD COLUMN webhook_secret character varying(255);
+`,
+		Down: `
+ALTER TABLE inboxes
+  DROP COLUMN enabled,
+  DROP COLUMN rate_limit,
+  DROP COLUMN bytes_rate_limit,
+  DROP COLUMN sender_rate_limit,
+  DROP COLUMN campaign_threshold,
+  DROP COLUMN max_message_bytes,
+  DROP COLUMN retention_days,
+  DROP COLUMN max_bytes,
+  DROP COLUMN spam_threshold,
+  DROP COLUMN allowed_senders,
+  DROP COLUMN forward_targets,
+  DROP COLUMN relay_enabled,
+  DROP COLUMN webhook_url,
+  DROP COLUMN webhook_secret;
+`,
+	},
+	{
+		Version: 5,
+		Name:    "create forwarding rules",
+		Up: `
+CREATE TABLE forwarding_rules (
+  id serial NOT NULL,
+  inbox_id integer NOT NULL REFERENCES inboxes (id) ON DELETE CASCADE,
+  position integer NOT NULL DEFAULT 0,
+  match_field character varying(255) NOT NULL,
+  match_header character varying(255),
+  pattern character varying(1000) NOT NULL,
+  action character varying(255) NOT NULL,
+  target character varying(1000),
+  created_at timestamp without time zone,
+  updated_at timestamp without time zone,
+  CONSTRAINT forwarding_rules_pkey PRIMARY KEY (id)
+);
+CREATE INDEX index_forwarding_rules_on_inbox_id ON forwarding_rules USING btree (inbox_id, position);
+`,
+		Down: `
+DROP TABLE forwarding_rules;
+`,
+	},
+	{
+		Version: 6,
+		Name:    "partition messages and attachments by inbox",
+		Up: `
+DROP TRIGGER falcon_inbox_tables ON inboxes;
+DROP FUNCTION falcon_inbox_created();
+DROP FUNCTION falcon_create_inbox_tables(integer);
+
+ALTER TABLE messages RENAME TO messages_inherited;
+ALTER TABLE messages_inherited RENAME CONSTRAINT messages_pkey TO messages_inherited_pkey;
+ALTER TABLE attachments RENAME TO attachments_inherited;
+ALTER TABLE attachments_inherited RENAME CONSTRAINT attachments_pkey TO attachments_inherited_pkey;
+ALTER INDEX index_attachments_on_message_id RENAME TO index_attachments_inherited_on_message_id;
+
+CREATE TABLE messages (
+  LIKE messages_inherited INCLUDING DEFAULTS,
+  CONSTRAINT messages_pkey PRIMARY KEY (inbox_id, id)
+) PARTITION BY LIST (inbox_id);
+CREATE TABLE attachments (
+  LIKE attachments_inherited INCLUDING DEFAULTS,
+  CONSTRAINT attachments_pkey PRIMARY KEY (inbox_id, id)
+) PARTITION BY LIST (inbox_id);
+CREATE INDEX index_attachments_on_message_id ON attachments USING btree (inbox_id, message_id);
+ALTER SEQUENCE messages_id_seq OWNED BY messages.id;
+ALTER SEQUENCE attachments_id_seq OWNED BY attachments.id;
+
+CREATE FUNCTION falcon_create_inbox_partitions(inbox integer) RETURNS void AS $$
+BEGIN
+  EXECUTE format('CREATE TABLE IF NOT EXISTS messages_%s PARTITION OF messages FOR VALUES IN (%s)', inbox, inbox);
+  EXECUTE format('CREATE TABLE IF NOT EXISTS attachments_%s PARTITION OF attachments FOR VALUES IN (%s)', inbox, inbox);
+END;
+$$ LANGUAGE plpgsql;
+
+-- detached before drop, so parent is locked only for detach
+CREATE FUNCTION falcon_drop_inbox_partitions(inbox integer) RETURNS void AS $$
+DECLARE
+  parent text;
+BEGIN
+  FOREACH parent IN ARRAY ARRAY['messages', 'attachments'] LOOP
+    IF to_regclass(format('%s_%s', parent, inbox)) IS NOT NULL THEN
+      EXECUTE format('ALTER TABLE %s DETACH PARTITION %s_%s', parent, parent, inbox);
+      EXECUTE format('DROP TABLE %s_%s', parent, inbox);
+    END IF;
+  END LOOP;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION falcon_inbox_deleted() RETURNS trigger AS $$
+BEGIN
+  PERFORM falcon_drop_inbox_partitions(OLD.id);
+  RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER falcon_inbox_partitions AFTER DELETE ON inboxes
+  FOR EACH ROW EXECUTE PROCEDURE falcon_inbox_deleted();
+
+-- inherited tables of inboxes become partitions, rows of parents are moved
+DO $$
+DECLARE
+  child record;
+  inbox integer;
+BEGIN
+  FOR child IN SELECT c.relname AS name, p.relname AS parent FROM pg_inherits i
+      JOIN pg_class c ON c.oid = i.inhrelid JOIN pg_class p ON p.oid = i.inhparent
+      WHERE p.relname IN ('messages_inherited', 'attachments_inherited') LOOP
+    inbox := substring(child.name from '_([0-9]+)$')::integer;
+    EXECUTE format('ALTER TABLE %I NO INHERIT %I', child.name, child.parent);
+    EXECUTE format('ALTER TABLE %I ALTER COLUMN id SET NOT NULL, ALTER COLUMN inbox_id SET NOT NULL', child.name);
+    EXECUTE format('ALTER TABLE %I ATTACH PARTITION %I FOR VALUES IN (%s)', replace(child.parent, '_inherited', ''), child.name, inbox);
+  END LOOP;
+  FOR inbox IN SELECT inbox_id FROM messages_inherited WHERE inbox_id IS NOT NULL
+      UNION SELECT inbox_id FROM attachments_inherited WHERE inbox_id IS NOT NULL LOOP
+    PERFORM falcon_create_inbox_partitions(inbox);
+  END LOOP;
+  INSERT INTO messages SELECT * FROM messages_inherited WHERE inbox_id IS NOT NULL;
+  INSERT INTO attachments SELECT * FROM attachments_inherited WHERE inbox_id IS NOT NULL;
+  DROP TABLE messages_inherited;
+  DROP TABLE attachments_inherited;
+END;
+$$;
+`,
+		Down: `
+DROP TRIGGER falcon_inbox_partitions ON inboxes;
+DROP FUNCTION falcon_inbox_deleted();
+DROP FUNCTION falcon_drop_inbox_partitions(integer);
+DROP FUNCTION falcon_create_inbox_partitions(integer);
+
+ALTER TABLE messages RENAME TO messages_partitioned;
+ALTER TABLE messages_partitioned RENAME CONSTRAINT messages_pkey TO messages_partitioned_pkey;
+ALTER TABLE attachments RENAME TO attachments_partitioned;
+ALTER TABLE attachments_partitioned RENAME CONSTRAINT attachments_pkey TO attachments_partitioned_pkey;
+ALTER INDEX index_attachments_on_message_id RENAME TO index_attachments_partitioned_on_message_id;
+
+CREATE TABLE messages (
+  LIKE messages_partitioned INCLUDING DEFAULTS,
+  CONSTRAINT messages_pkey PRIMARY KEY (id)
+);
+CREATE INDEX index_messages_on_inbox_id ON messages USING btree (inbox_id);
+CREATE TABLE attachments (
+  LIKE attachments_partitioned INCLUDING DEFAULTS,
+  CONSTRAINT attachments_pkey PRIMARY KEY (id)
+);
+CREATE INDEX index_attachments_on_message_id ON attachments USING btree (message_id);
+ALTER SEQUENCE messages_id_seq OWNED BY messages.id;
+ALTER SEQUENCE attachments_id_seq OWNED BY attachments.id;
+
+DO $$
+DECLARE
+  child record;
+BEGIN
+  FOR child IN SELECT c.relname AS name, p.relname AS parent FROM pg_inherits i
+      JOIN pg_class c ON c.oid = i.inhrelid JOIN pg_class p ON p.oid = i.inhparent
+      WHERE p.relname IN ('messages_partitioned', 'attachments_partitioned') LOOP
+    EXECUTE format('ALTER TABLE %I DETACH PARTITION %I', child.parent, child.name);
+    EXECUTE format('ALTER TABLE %I INHERIT %I', child.name, replace(child.parent, '_partitioned', ''));
+    EXECUTE format('ALTER TABLE %I ADD CHECK (inbox_id = %s)', child.name, substring(child.name from '_([0-9]+)$'));
+  END LOOP;
+  DROP TABLE messages_partitioned;
+  DROP TABLE attachments_partitioned;
+END;
+$$;
+` + inheritedTables,
+	},
+	{
+		Version: 7,
+		Name:    "add search vector of messages",
+		Up: `
+ALTER TABLE messages ADD COLUMN search_vector tsvector;
+
+-- weights are fields of search: A subject, B addresses, C text and html body, D attachment filenames
+CREATE FUNCTION falcon_search_vector(subject text, from_email text, from_name text, to_email text, to_name text, text_body text, html_body text) RETURNS tsvector AS $$
+  SELECT setweight(to_tsvector('simple', coalesce(subject, '')), 'A') ||
+    setweight(to_tsvector('simple', concat_ws(' ', from_email, from_name, to_email, to_name)), 'B') ||
+    setweight(to_tsvector('simple', concat_ws(' ', text_body,
+      regexp_replace(regexp_replace(html_body, '<(script|style)[^>]*>.*?</(script|style)>', ' ', 'gi'), '<[^>]*>', ' ', 'g'))), 'C')
+$$ LANGUAGE sql IMMUTABLE;
+
+CREATE FUNCTION falcon_message_searchable() RETURNS trigger AS $$
+BEGIN
+  NEW.search_vector := falcon_search_vector(NEW.subject, NEW.from_email, NEW.from_name, NEW.to_email, NEW.to_name, NEW.text_body, NEW.html_body);
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER falcon_message_search BEFORE INSERT OR UPDATE OF subject, from_email, from_name, to_email, to_name, text_body, html_body ON messages
+  FOR EACH ROW EXECUTE PROCEDURE falcon_message_searchable();
+
+CREATE FUNCTION falcon_attachment_searchable() RETURNS trigger AS $$
+BEGIN
+  UPDATE messages SET search_vector = coalesce(search_vector, ''::tsvector) || setweight(to_tsvector('simple', coalesce(NEW.filename, '')), 'D')
+    WHERE inbox_id = NEW.inbox_id AND id = NEW.message_id;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER falcon_attachment_search AFTER INSERT ON attachments
+  FOR EACH ROW EXECUTE PROCEDURE falcon_attachment_searchable();
+
+UPDATE messages SET search_vector = falcon_search_vector(subject, from_email, from_name, to_email, to_name, text_body, html_body) ||
+  coalesce((SELECT setweight(to_tsvector('simple', string_agg(filename, ' ')), 'D') FROM attachments
+    WHERE attachments.inbox_id = messages.inbox_id AND attachments.message_id = messages.id), ''::tsvector);
+
+CREATE INDEX index_messages_on_search_vector ON messages USING gin (search_vector);
+`,
+		Down: `
+DROP TRIGGER falcon_attachment_search ON attachments;
+DROP FUNCTION falcon_attachment_searchable();
+DROP TRIGGER falcon_message_search ON messages;
+DROP FUNCTION falcon_message_searchable();
+DROP FUNCTION falcon_search_vector(text, text, text, text, text, text, text);
+ALTER TABLE messages DROP COLUMN search_vector;
+`,
+	},
+	{
+		Version: 8,
+		Name:    "add message fingerprints",
+		Up: `
+ALTER TABLE messages
+  ADD COLUMN fingerprint character varying(64),
+  ADD COLUMN duplicate_of integer;
+ALTER TABLE inboxes ADD COLUMN duplicate_action character varying(255);
+`,
+		Down: `
+ALTER TABLE inboxes DROP COLUMN duplicate_action;
+ALTER TABLE messages
+  DROP COLUMN fingerprint,
+  DROP COLUMN duplicate_of;
+`,
+	},
+	{
+		Version: 9,
+		Name:    "add addresses, thread headers and envelope of messages",
+		Up: `
+ALTER TABLE messages
+  ADD COLUMN from_addresses jsonb,
+  ADD COLUMN to_addresses jsonb,
+  ADD COLUMN cc_addresses jsonb,
+  ADD COLUMN bcc_addresses jsonb,
+  ADD COLUMN reply_to_addresses jsonb,
+  ADD COLUMN message_id_header character varying(998),
+  ADD COLUMN in_reply_to character varying(998),
+  ADD COLUMN references_header text,
+  ADD COLUMN envelope_from character varying(255),
+  ADD COLUMN envelope_to text[],
+  ADD COLUMN headers jsonb;
+CREATE INDEX index_messages_on_message_id_header ON messages USING btree (inbox_id, message_id_header);
+`,
+		Down: `
+ALTER TABLE messages
+  DROP COLUMN from_addresses,
+  DROP COLUMN to_addresses,
+  DROP COLUMN cc_addresses,
+  DROP COLUMN bcc_addresses,
+  DROP COLUMN reply_to_addresses,
+  DROP COLUMN message_id_header,
+  DROP COLUMN in_reply_to,
+  DROP COLUMN references_header,
+  DROP COLUMN envelope_from,
+  DROP COLUMN envelope_to,
+  DROP COLUMN headers;
+`,
+	},
+	{
+		Version: 10,
+		Name:    "add queue id of messages",
+		Up: `
+ALTER TABLE messages ADD COLUMN queue_id character varying(32);
+CREATE INDEX index_messages_on_queue_id ON messages USING btree (queue_id);
+`,
+		Down: `
+ALTER TABLE messages DROP COLUMN queue_id;
+`,
+	},
+	{
+		Version: 11,
+		Name:    "strip each script and style of search vector",
+		Up: `
+-- postgres takes greediness of the pattern from its first quantifier, non-greedy
+-- tag keeps text between two scripts
+CREATE OR REPLACE FUNCTION falcon_search_vector(subject text, from_email text, from_name text, to_email text, to_name text, text_body text, html_body text) RETURNS tsvector AS $$
+  SELECT setweight(to_tsvector('simple', coalesce(subject, '')), 'A') ||
+    setweight(to_tsvector('simple', concat_ws(' ', from_email, from_name, to_email, to_name)), 'B') ||
+    setweight(to_tsvector('simple', concat_ws(' ', text_body,
+      regexp_replace(regexp_replace(html_body, '<(script|style)[^>]*?>.*?</(script|style)>', ' ', 'gi'), '<[^>]*>', ' ', 'g'))), 'C')
+$$ LANGUAGE sql IMMUTABLE;
+
+UPDATE messages SET search_vector = falcon_search_vector(subject, from_email, from_name, to_email, to_name, text_body, html_body) ||
+  coalesce((SELECT setweight(to_tsvector('simple', string_agg(filename, ' ')), 'D') FROM attachments
+    WHERE attachments.inbox_id = messages.inbox_id AND attachments.message_id = messages.id), ''::tsvector)
+  WHERE html_body ~* '<(script|style)';
+`,
+		Down: `
+CREATE OR REPLACE FUNCTION falcon_search_vector(subject text, from_email text, from_name text, to_email text, to_name text, text_body text, html_body text) RETURNS tsvector AS $$
+  SELECT setweight(to_tsvector('simple', coalesce(subject, '')), 'A') ||
+    setweight(to_tsvector('simple', concat_ws(' ', from_email, from_name, to_email, to_name)), 'B') ||
+    setweight(to_tsvector('simple', concat_ws(' ', text_body,
+      regexp_replace(regexp_replace(html_body, '<(script|style)[^>]*>.*?</(script|style)>', ' ', 'gi'), '<[^>]*>', ' ', 'g'))), 'C')
+$$ LANGUAGE sql IMMUTABLE;
+`,
+	},
+}
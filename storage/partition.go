@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/Polymail/go-falcon/log"
+)
+
+// known partitions of inboxes, shared by transactions of pool
+
+type partitionSet struct {
+	created sync.Map
+}
+
+// EnsurePartition creates partitions of inbox by partition_sql once per
+// process, before first message. Runs outside of transaction, so partition
+// exists for retries and concurrent messages.
+func (db *DBConn) EnsurePartition(mailboxId int) error {
+	if _, ok := db.queries["partition_sql"]; !ok || db.partitions == nil {
+		return nil
+	}
+	if _, ok := db.partitions.created.Load(mailboxId); ok {
+		return nil
+	}
+	sql, args := db.statement("partition_sql", mailboxId, params{"inbox_id": mailboxId})
+	if _, err := db.DB.Exec(sql, args...); err != nil {
+		log.Errorf("Partition SQL error: %v", err)
+		return err
+	}
+	db.partitions.created.Store(mailboxId, true)
+	return nil
+}
+
+// forget partition of inbox, e.g. dropped with inbox and created again
+
+func (db *DBConn) forgetPartition(mailboxId int) {
+	if db.partitions != nil {
+		db.partitions.created.Delete(mailboxId)
+	}
+}
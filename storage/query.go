@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Polymail/go-falcon/log"
+)
+
+var (
+	positionalRE = regexp.MustCompile(`\$([0-9]+)`)
+)
+
+// operation of StorageConfig template, params are in order of legacy
+// positional $N contract, extra params are only available by name
+
+type operation struct {
+	name   string
+	sql    func(c *StorageConfig) string
+	params []string
+	extra  []string
+}
+
+var operations = []operation{
+	{"auth_sql", func(c *StorageConfig) string { return c.Auth_Sql }, []string{"username"}, nil},
+	{"settings_sql", func(c *StorageConfig) string { return c.Settings_Sql }, []string{"inbox_id"}, nil},
+	{"partition_sql", func(c *StorageConfig) string { return c.Partition_Sql }, []string{"inbox_id"}, nil},
+	{"messages_sql", func(c *StorageConfig) string { return c.Messages_Sql },
+		[]string{"inbox_id", "subject", "sent_at", "from_email", "from_name", "to_email", "to_name", "html_body", "text_body", "raw_body", "email_size"},
+		[]string{"cc", "reply_to", "message_id_header", "spam_score", "spam", "fingerprint", "duplicate_of",
+			"from_addresses", "to_addresses", "cc_addresses", "bcc_addresses", "reply_to_addresses", "in_reply_to", "references",
+			"envelope_from", "envelope_to", "headers", "queue_id"}},
+	{"attachments_sql", func(c *StorageConfig) string { return c.Attachments_Sql },
+		[]string{"inbox_id", "message_id", "filename", "attachment_type", "content_type", "content_id", "transfer_encoding", "attachment_body", "attachment_size"}, nil},
+	{"max_messages_cleanup_sql", func(c *StorageConfig) string { return c.Max_Messages_Cleanup_Sql }, []string{"inbox_id", "max_messages"}, nil},
+	{"max_attachments_cleanup_sql", func(c *StorageConfig) string { return c.Max_Attachments_Cleanup_Sql }, []string{"inbox_id", "message_id"}, nil},
+	{"retention_inboxes_sql", func(c *StorageConfig) string { return c.Retention_Inboxes_Sql }, nil, nil},
+	{"retention_expired_sql", func(c *StorageConfig) string { return c.Retention_Expired_Sql }, []string{"inbox_id", "before", "limit"}, nil},
+	{"retention_oversize_sql", func(c *StorageConfig) string { return c.Retention_Oversize_Sql }, []string{"inbox_id", "max_bytes", "limit"}, nil},
+	{"retention_overcount_sql", func(c *StorageConfig) string { return c.Retention_Overcount_Sql }, []string{"inbox_id", "max_messages", "limit"}, nil},
+	{"retention_delete_attachments_sql", func(c *StorageConfig) string { return c.Retention_Delete_Attachments_Sql }, []string{"inbox_id", "message_ids"}, nil},
+	{"retention_delete_messages_sql", func(c *StorageConfig) string { return c.Retention_Delete_Messages_Sql }, []string{"inbox_id", "message_ids"}, nil},
+	{"spamassassin_sql", func(c *StorageConfig) string { return c.Spamassassin_Sql }, []string{"inbox_id", "message_id", "spam_report"}, nil},
+	{"clamav_sql", func(c *StorageConfig) string { return c.Clamav_Sql }, []string{"inbox_id", "message_id", "viruses_report"}, nil},
+	{"spf_sql", func(c *StorageConfig) string { return c.Spf_Sql }, []string{"inbox_id", "message_id", "spf_result"}, nil},
+	{"dkim_sql", func(c *StorageConfig) string { return c.Dkim_Sql }, []string{"inbox_id", "message_id", "dkim_report"}, nil},
+	{"dmarc_sql", func(c *StorageConfig) string { return c.Dmarc_Sql }, []string{"inbox_id", "message_id", "dmarc_result"}, nil},
+	{"relay_sql", func(c *StorageConfig) string { return c.Relay_Sql }, []string{"inbox_id"}, nil},
+	{"forwarding_rules_sql", func(c *StorageConfig) string { return c.Forwarding_Rules_Sql }, []string{"inbox_id"}, nil},
+	{"webhook_sql", func(c *StorageConfig) string { return c.Webhook_Sql }, []string{"inbox_id"}, nil},
+	{"campaign_sql", func(c *StorageConfig) string { return c.Campaign_Sql }, []string{"inbox_id", "message_id", "campaign", "quarantined"}, nil},
+	{"quarantine_sql", func(c *StorageConfig) string { return c.Quarantine_Sql }, []string{"inbox_id", "message_id", "reason"}, nil},
+	{"search_sql", func(c *StorageConfig) string { return c.Search_Sql }, []string{"inbox_id", "query", "limit", "offset"}, nil},
+	{"pop3_count_and_size_messages", func(c *StorageConfig) string { return c.Pop3_Count_And_Size_Messages }, []string{"inbox_id"}, nil},
+	{"pop3_messages_list", func(c *StorageConfig) string { return c.Pop3_Messages_List }, []string{"inbox_id"}, nil},
+	{"pop3_message_one", func(c *StorageConfig) string { return c.Pop3_Message_One }, []string{"inbox_id", "message_id"}, nil},
+	{"pop3_message_delete", func(c *StorageConfig) string { return c.Pop3_Message_Delete }, []string{"inbox_id", "message_id"}, nil},
+	{"email_address_mode_sql", func(c *StorageConfig) string { return c.Email_Address_Mode_Sql }, []string{"username"}, nil},
+}
+
+// params of operation by name
+type params map[string]interface{}
+
+// compiled template, names are parameters in order of $N
+type namedQuery struct {
+	sql   string
+	names []string
+}
+
+// compileQuery replaces :name placeholders of template by $N. Templates
+// with $N keep legacy positional contract of operation params.
+func compileQuery(template string, provided, extra []string) (*namedQuery, error) {
+	available := make(map[string]bool)
+	for _, name := range append(append([]string{}, provided...), extra...) {
+		available[name] = true
+	}
+	query := &namedQuery{}
+	var (
+		out     strings.Builder
+		indexes = make(map[string]int)
+		quote   byte
+	)
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ':' && i+1 < len(template) && template[i+1] == ':':
+			// type cast
+			out.WriteString("::")
+			i++
+			continue
+		case c == ':' && i+1 < len(template) && isNameStart(template[i+1]):
+			j := i + 1
+			for j < len(template) && isNamePart(template[j]) {
+				j++
+			}
+			name := template[i+1 : j]
+			if !available[name] {
+				return nil, fmt.Errorf("unknown parameter :%s, available: %s", name, strings.Join(sortedNames(available), ", "))
+			}
+			index, ok := indexes[name]
+			if !ok {
+				query.names = append(query.names, name)
+				index = len(query.names)
+				indexes[name] = index
+			}
+			out.WriteString("$" + strconv.Itoa(index))
+			i = j - 1
+			continue
+		}
+		out.WriteByte(c)
+	}
+	if len(query.names) == 0 {
+		// legacy $N, only params used by template are passed
+		for _, match := range positionalRE.FindAllStringSubmatch(template, -1) {
+			n, _ := strconv.Atoi(match[1])
+			if n < 1 || n > len(provided) {
+				return nil, fmt.Errorf("parameter $%d out of %d positional parameters: %s", n, len(provided), strings.Join(provided, ", "))
+			}
+			if n > len(query.names) {
+				query.names = provided[:n]
+			}
+		}
+		query.sql = template
+		return query, nil
+	}
+	if hasPositional(template) {
+		return nil, fmt.Errorf("named and positional parameters are mixed")
+	}
+	query.sql = out.String()
+	return query, nil
+}
+
+// $N outside of quotes
+
+func hasPositional(template string) bool {
+	var quote byte
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$' && i+1 < len(template) && template[i+1] >= '0' && template[i+1] <= '9':
+			return true
+		}
+	}
+	return false
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNamePart(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+func sortedNames(names map[string]bool) []string {
+	var list []string
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// compile templates of config, empty templates are skipped
+
+func compileQueries(config *StorageConfig) (map[string]*namedQuery, error) {
+	queries := make(map[string]*namedQuery)
+	for _, op := range operations {
+		template := op.sql(config)
+		if template == "" {
+			continue
+		}
+		query, err := compileQuery(template, op.params, op.extra)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", op.name, err)
+		}
+		queries[op.name] = query
+	}
+	return queries, nil
+}
+
+// statement of operation for inbox with arguments in order of template
+
+func (db *DBConn) statement(name string, mailboxId int, values params) (string, []interface{}) {
+	query, ok := db.queries[name]
+	if !ok {
+		// not configured, database reports error of empty query
+		return "", nil
+	}
+	args := make([]interface{}, len(query.names))
+	for i, param := range query.names {
+		args[i] = values[param]
+	}
+	return strings.Replace(query.sql, "[[inbox_id]]", strconv.Itoa(mailboxId), -1), args
+}
+
+// CheckQueries prepares every configured template against database, so
+// syntax errors and unknown columns fail at startup. Templates of inbox
+// tables are skipped, tables exist only for known inboxes.
+func (db *DBConn) CheckQueries() error {
+	for _, op := range operations {
+		if _, ok := db.queries[op.name]; !ok {
+			continue
+		}
+		sql, _ := db.statement(op.name, 0, nil)
+		if strings.Contains(op.sql(db.config), "[[inbox_id]]") {
+			log.Debugf("Query %s of inbox tables is not checked", op.name)
+			continue
+		}
+		stmt, err := db.DB.Prepare(sql)
+		if err != nil {
+			return fmt.Errorf("%s: %v", op.name, err)
+		}
+		stmt.Close()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileNamedQuery(t *testing.T) {
+	query, err := compileQuery(
+		"UPDATE messages_[[inbox_id]] SET spam_report = :spam_report::jsonb, note = ':not_param' WHERE inbox_id = :inbox_id AND id = :message_id AND inbox_id = :inbox_id",
+		[]string{"inbox_id", "message_id", "spam_report"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "UPDATE messages_[[inbox_id]] SET spam_report = $1::jsonb, note = ':not_param' WHERE inbox_id = $2 AND id = $3 AND inbox_id = $2"
+	if query.sql != expected {
+		t.Errorf("unexpected sql %q", query.sql)
+	}
+	if !reflect.DeepEqual(query.names, []string{"spam_report", "inbox_id", "message_id"}) {
+		t.Errorf("unexpected names %v", query.names)
+	}
+}
+
+func TestCompileLegacyQuery(t *testing.T) {
+	provided := []string{"inbox_id", "message_id", "spam_report"}
+	query, err := compileQuery("UPDATE messages SET spam_report=$3 WHERE inbox_id = $1 AND id = $2 RETURNING id", provided, []string{"extra"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(query.names, provided) {
+		t.Errorf("unexpected names %v", query.names)
+	}
+	// only params used by template
+	query, _ = compileQuery("SELECT id FROM messages WHERE inbox_id = $1", provided, nil)
+	if !reflect.DeepEqual(query.names, []string{"inbox_id"}) {
+		t.Errorf("unexpected names %v", query.names)
+	}
+}
+
+func TestCompileQueryErrors(t *testing.T) {
+	for template, message := range map[string]string{
+		"SELECT :unknown":      "unknown parameter :unknown",
+		"SELECT $4":            "out of 3 positional parameters",
+		"SELECT :inbox_id, $2": "mixed",
+		"SELECT :extra FROM t WHERE id = :inbox_id": "",
+	} {
+		_, err := compileQuery(template, []string{"inbox_id", "message_id", "spam_report"}, []string{"extra"})
+		if message == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error %v", template, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: expected error %q, got %v", template, message, err)
+		}
+	}
+}
+
+func TestStatement(t *testing.T) {
+	queries, err := compileQueries(&StorageConfig{
+		Pop3_Message_One: "SELECT email_size, raw_body FROM messages_[[inbox_id]] WHERE id = :message_id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &DBConn{queries: queries}
+	sql, args := db.statement("pop3_message_one", 7, params{"inbox_id": 7, "message_id": 42})
+	if sql != "SELECT email_size, raw_body FROM messages_7 WHERE id = $1" || !reflect.DeepEqual(args, []interface{}{42}) {
+		t.Errorf("unexpected statement %q %v", sql, args)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if value := truncate("aé", 2); value != "a" {
+		t.Errorf("rune should not be cut, got %q", value)
+	}
+	if value := truncate("abc", 5); value != "abc" {
+		t.Errorf("unexpected %q", value)
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/lib/pq"
+)
+
+// RetentionInboxes lists inboxes checked by retention scheduler.
+func (db *DBConn) RetentionInboxes() ([]int, error) {
+	sql, args := db.statement("retention_inboxes_sql", 0, nil)
+	return db.queryIds("RetentionInboxes", sql, args...)
+}
+
+// ExpiredMessages returns up to limit oldest messages received before time.
+func (db *DBConn) ExpiredMessages(mailboxId int, before time.Time, limit int) ([]int, error) {
+	sql, args := db.statement("retention_expired_sql", mailboxId, params{"inbox_id": mailboxId, "before": before, "limit": limit})
+	return db.queryIds("ExpiredMessages", sql, args...)
+}
+
+// OversizeMessages returns up to limit oldest messages past maxBytes of
+// newest messages.
+func (db *DBConn) OversizeMessages(mailboxId int, maxBytes int64, limit int) ([]int, error) {
+	sql, args := db.statement("retention_oversize_sql", mailboxId, params{"inbox_id": mailboxId, "max_bytes": maxBytes, "limit": limit})
+	return db.queryIds("OversizeMessages", sql, args...)
+}
+
+// OvercountMessages returns up to limit oldest messages past maxMessages
+// newest messages.
+func (db *DBConn) OvercountMessages(mailboxId int, maxMessages int, limit int) ([]int, error) {
+	sql, args := db.statement("retention_overcount_sql", mailboxId, params{"inbox_id": mailboxId, "max_messages": maxMessages, "limit": limit})
+	return db.queryIds("OvercountMessages", sql, args...)
+}
+
+// DeleteMessages deletes attachments and messages in one transaction,
+// returns ids and bytes of deleted messages.
+func (db *DBConn) DeleteMessages(mailboxId int, messageIds []int) ([]int, int64, error) {
+	var (
+		deleted []int
+		bytes   int64
+	)
+	err := db.InTx(func(tx *DBConn) error {
+		deleted, bytes = nil, 0
+		values := params{"inbox_id": mailboxId, "message_ids": pq.Array(messageIds)}
+		sql, args := tx.statement("retention_delete_attachments_sql", mailboxId, values)
+		if _, err := tx.conn().Exec(sql, args...); err != nil {
+			return err
+		}
+		sql, args = tx.statement("retention_delete_messages_sql", mailboxId, values)
+		rows, err := tx.conn().Query(sql, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				id   int
+				size int64
+			)
+			if err = rows.Scan(&id, &size); err != nil {
+				return err
+			}
+			deleted = append(deleted, id)
+			bytes += size
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		log.Errorf("DeleteMessages SQL error: %v", err)
+		return nil, 0, err
+	}
+	return deleted, bytes, nil
+}
+
+// ids of first column
+
+func (db *DBConn) queryIds(name, sql string, args ...interface{}) ([]int, error) {
+	var ids []int
+	rows, err := db.conn().Query(sql, args...)
+	if err != nil {
+		log.Errorf("%s SQL error: %v", name, err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			log.Errorf("%s SQL error: %v", name, err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		log.Errorf("%s SQL error: %v", name, err)
+	}
+	return ids, err
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/search"
+	"github.com/lib/pq"
+)
+
+// Search messages of inbox by search_sql, postgres backend of search.
+func (db *DBConn) Search(q *search.Query) (*search.Result, error) {
+	result := &search.Result{Page: q.Page, PerPage: q.PerPage, Hits: []search.Hit{}}
+	values := params{"inbox_id": q.MailboxID, "query": search.TsQuery(q.Clauses), "limit": q.PerPage, "offset": q.Offset()}
+	sql, args := db.statement("search_sql", q.MailboxID, values)
+	rows, err := db.conn().Query(sql, args...)
+	if err != nil {
+		log.Errorf("Search SQL error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = scanHit(rows, result); err != nil {
+			log.Errorf("Search SQL error: %v", err)
+			return nil, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.Errorf("Search SQL error: %v", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// id, subject, from, date, rank and total count of row
+
+func scanHit(rows *sql.Rows, result *search.Result) error {
+	var (
+		hit           search.Hit
+		subject, from sql.NullString
+		date          pq.NullTime
+	)
+	if err := rows.Scan(&hit.MessageID, &subject, &from, &date, &hit.Score, &result.Total); err != nil {
+		return err
+	}
+	hit.Subject, hit.From, hit.Date = subject.String, from.String, date.Time
+	result.Hits = append(result.Hits, hit)
+	return nil
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Polymail/go-falcon/log"
+)
+
+var (
+	ErrInboxNotFound = errors.New("inbox not found")
+)
+
+// InboxSettings of inbox. Columns of Settings_Sql are mapped by name, unknown
+// names by legacy position: max_size, rate_limit, bytes_rate_limit,
+// sender_rate_limit, campaign_threshold.
+type InboxSettings struct {
+	MaxMessages, RateLimit int
+	// optional overrides of global limits, 0 keeps global limit
+	BytesRateLimit, SenderRateLimit, CampaignThreshold int
+	MaxMessageBytes                                    int
+	SpamThreshold                                      float64
+	// addresses or @domains allowed in MAIL FROM, empty allows all
+	AllowedSenders []string
+	// addresses every message is forwarded to
+	ForwardTargets []string
+	// days and total bytes of kept messages, 0 keeps global retention
+	RetentionDays int
+	MaxBytes      int64
+	// skip, link or store duplicate messages, empty keeps global action
+	DuplicateAction string
+	// inbox does not accept messages
+	Disabled bool
+	// negative cache entry of unknown inbox
+	NotFound bool
+}
+
+type settingsColumn func(settings *InboxSettings, value string) error
+
+var (
+	settingsColumns = map[string]settingsColumn{
+		"max_size":           intColumn(func(s *InboxSettings) *int { return &s.MaxMessages }),
+		"max_messages":       intColumn(func(s *InboxSettings) *int { return &s.MaxMessages }),
+		"rate_limit":         intColumn(func(s *InboxSettings) *int { return &s.RateLimit }),
+		"bytes_rate_limit":   intColumn(func(s *InboxSettings) *int { return &s.BytesRateLimit }),
+		"sender_rate_limit":  intColumn(func(s *InboxSettings) *int { return &s.SenderRateLimit }),
+		"campaign_threshold": intColumn(func(s *InboxSettings) *int { return &s.CampaignThreshold }),
+		"max_message_bytes":  intColumn(func(s *InboxSettings) *int { return &s.MaxMessageBytes }),
+		"retention_days":     intColumn(func(s *InboxSettings) *int { return &s.RetentionDays }),
+		"max_bytes": func(s *InboxSettings, value string) (err error) {
+			s.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+			return
+		},
+		"spam_threshold": func(s *InboxSettings, value string) (err error) {
+			s.SpamThreshold, err = strconv.ParseFloat(value, 64)
+			return
+		},
+		"allowed_senders": func(s *InboxSettings, value string) error {
+			s.AllowedSenders = listColumn(value)
+			return nil
+		},
+		"forward_targets": func(s *InboxSettings, value string) error {
+			s.ForwardTargets = listColumn(value)
+			return nil
+		},
+		"duplicate_action": func(s *InboxSettings, value string) error {
+			s.DuplicateAction = strings.ToLower(value)
+			return nil
+		},
+		"enabled": func(s *InboxSettings, value string) error {
+			enabled, err := strconv.ParseBool(value)
+			s.Disabled = !enabled
+			return err
+		},
+	}
+	settingsPositions = []string{"max_size", "rate_limit", "bytes_rate_limit", "sender_rate_limit", "campaign_threshold"}
+)
+
+func intColumn(field func(s *InboxSettings) *int) settingsColumn {
+	return func(s *InboxSettings, value string) (err error) {
+		*field(s), err = strconv.Atoi(value)
+		return
+	}
+}
+
+// comma separated list or postgres array
+
+func listColumn(value string) []string {
+	var list []string
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "{"), "}")
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.Trim(strings.TrimSpace(item), `"`))
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// set column of Settings_Sql, NULL keeps default
+
+func (settings *InboxSettings) setColumn(name string, position int, value sql.NullString) error {
+	if !value.Valid {
+		return nil
+	}
+	set, ok := settingsColumns[strings.ToLower(name)]
+	if !ok && position < len(settingsPositions) {
+		set, ok = settingsColumns[settingsPositions[position]]
+	}
+	if !ok {
+		return nil
+	}
+	if err := set(settings, strings.TrimSpace(value.String)); err != nil {
+		return fmt.Errorf("column %s: %v", name, err)
+	}
+	return nil
+}
+
+// IsSenderAllowed checks sender by address or @domain of AllowedSenders.
+func (settings *InboxSettings) IsSenderAllowed(sender string) bool {
+	if len(settings.AllowedSenders) == 0 {
+		return true
+	}
+	sender = strings.ToLower(sender)
+	domain := ""
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		domain = sender[at:]
+	}
+	for _, allowed := range settings.AllowedSenders {
+		if allowed == sender || (domain != "" && allowed == domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// get inbox settings, ErrInboxNotFound if inbox is unknown
+
+func (db *DBConn) GeInboxSettings(mailboxId int) (InboxSettings, error) {
+	var (
+		settings InboxSettings
+	)
+	query, args := db.statement("settings_sql", mailboxId, params{"inbox_id": mailboxId})
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		log.Errorf("Settings SQL error: %v", err)
+		return settings, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		err = rows.Err()
+		if err != nil {
+			log.Errorf("Settings SQL error: %v", err)
+			return settings, err
+		}
+		return settings, ErrInboxNotFound
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		log.Errorf("Settings SQL error: %v", err)
+		return settings, err
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err = rows.Scan(dest...); err != nil {
+		log.Errorf("Settings SQL error: %v", err)
+		return settings, err
+	}
+	for i, column := range columns {
+		if err = settings.setColumn(column, i, values[i]); err != nil {
+			log.Errorf("Settings SQL error: %v", err)
+			return settings, err
+		}
+	}
+	return settings, nil
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestSettingsColumns(t *testing.T) {
+	var settings InboxSettings
+	columns := []struct {
+		name  string
+		value sql.NullString
+	}{
+		{"max", sql.NullString{String: "100", Valid: true}},
+		{"rate_limit", sql.NullString{String: "5", Valid: true}},
+		{"spam_threshold", sql.NullString{String: "4.5", Valid: true}},
+		{"Allowed_Senders", sql.NullString{String: `{a@example.com,"@Example.org"}`, Valid: true}},
+		{"forward_targets", sql.NullString{String: "b@example.com, c@example.com", Valid: true}},
+		{"retention_days", sql.NullString{}},
+		{"duplicate_action", sql.NullString{String: "Link", Valid: true}},
+		{"enabled", sql.NullString{String: "false", Valid: true}},
+		{"unknown", sql.NullString{String: "x", Valid: true}},
+	}
+	for i, column := range columns {
+		if err := settings.setColumn(column.name, i, column.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := InboxSettings{
+		MaxMessages:     100,
+		RateLimit:       5,
+		SpamThreshold:   4.5,
+		AllowedSenders:  []string{"a@example.com", "@example.org"},
+		ForwardTargets:  []string{"b@example.com", "c@example.com"},
+		DuplicateAction: "link",
+		Disabled:        true,
+	}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+	if err := settings.setColumn("max_size", 0, sql.NullString{String: "x", Valid: true}); err == nil {
+		t.Error("expected error of invalid number")
+	}
+}
+
+func TestIsSenderAllowed(t *testing.T) {
+	settings := InboxSettings{AllowedSenders: []string{"a@example.com", "@example.org"}}
+	for sender, allowed := range map[string]bool{
+		"A@example.com":     true,
+		"b@example.com":     false,
+		"x@EXAMPLE.org":     true,
+		"x@sub.example.org": false,
+		"":                  false,
+	} {
+		if settings.IsSenderAllowed(sender) != allowed {
+			t.Errorf("sender %q allowed should be %v", sender, allowed)
+		}
+	}
+	if !(&InboxSettings{}).IsSenderAllowed("any@example.com") {
+		t.Error("empty list should allow all senders")
+	}
+}
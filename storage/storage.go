@@ -2,14 +2,16 @@ package storage
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Polymail/go-falcon/log"
 	"github.com/Polymail/go-falcon/utils"
-	_ "github.com/lib/pq"
-	"strconv"
+	"github.com/lib/pq"
+	"net/mail"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type StorageConfig struct {
@@ -22,10 +24,16 @@ type StorageConfig struct {
 	Pool      int
 	Pool_Idle int
 
+	Tx_Retries     int
+	Tx_Retry_Delay int // milliseconds, doubled on every retry
+
+	Check_Queries bool // prepare queries at startup
+
 	Auth_Sql string
 
 	Settings_Sql string
 
+	Partition_Sql   string // creates partitions of inbox before first message
 	Messages_Sql    string
 	Attachments_Sql string
 
@@ -33,10 +41,35 @@ type StorageConfig struct {
 	Max_Messages_Cleanup_Sql    string
 	Max_Attachments_Cleanup_Sql string
 
+	Retention_Inboxes_Sql            string
+	Retention_Expired_Sql            string
+	Retention_Oversize_Sql           string
+	Retention_Overcount_Sql          string
+	Retention_Delete_Attachments_Sql string
+	Retention_Delete_Messages_Sql    string
+
 	Spamassassin_Sql string
 
 	Clamav_Sql string
 
+	Spf_Sql string
+
+	Dkim_Sql string
+
+	Dmarc_Sql string
+
+	Relay_Sql string
+
+	Forwarding_Rules_Sql string
+
+	Webhook_Sql string
+
+	Campaign_Sql string
+
+	Quarantine_Sql string
+
+	Search_Sql string
+
 	Pop3_Count_And_Size_Messages string
 	Pop3_Messages_List           string
 	Pop3_Message_One             string
@@ -46,12 +79,69 @@ type StorageConfig struct {
 }
 
 type DBConn struct {
-	DB     *sql.DB
-	config *StorageConfig
+	DB         *sql.DB
+	config     *StorageConfig
+	queries    map[string]*namedQuery
+	partitions *partitionSet
+	tx         *sql.Tx // transaction of InTx
+}
+
+// Message stored by Messages_Sql, optional fields are available to named
+// templates only
+type Message struct {
+	MailboxID                  int
+	Subject                    string
+	Date                       time.Time
+	From, FromName, To, ToName string
+	Html, Text                 string
+	Raw                        []byte
+	// optional
+	Cc, ReplyTo, MessageID string
+	SpamScore              sql.NullFloat64
+	Spam                   sql.NullBool
+	Fingerprint            string
+	DuplicateOf            sql.NullInt64
+	// all addresses, stored as JSON arrays of name and address
+	FromList, ToList, CcList, BccList, ReplyToList []mail.Address
+	InReplyTo                                      string
+	References                                     []string
+	EnvelopeFrom                                   string
+	EnvelopeTo                                     []string
+	Headers                                        map[string][]string
+	QueueID                                        string
+}
+
+// address of JSON lists
+type addressJSON struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
 }
 
-type InboxSettings struct {
-	MaxMessages, RateLimit int
+// JSON of value, null for empty values
+
+func jsonParam(value interface{}, empty bool) interface{} {
+	if empty {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Errorf("Messages JSON error: %v", err)
+		return nil
+	}
+	return string(data)
+}
+
+func addressesParam(addresses []mail.Address) interface{} {
+	list := make([]addressJSON, len(addresses))
+	for i, address := range addresses {
+		list[i] = addressJSON{Name: address.Name, Address: address.Address}
+	}
+	return jsonParam(list, len(list) == 0)
+}
+
+type ForwardingRule struct {
+	Id                                     int
+	Field, Header, Pattern, Action, Target string
 }
 
 func InitDatabase(config *StorageConfig) (*DBConn, error) {
@@ -63,7 +153,12 @@ func InitDatabase(config *StorageConfig) (*DBConn, error) {
 		}
 		db.SetMaxOpenConns(config.Pool)
 		db.SetMaxIdleConns(config.Pool_Idle)
-		return &DBConn{DB: db, config: config}, err
+		queries, err := compileQueries(config)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &DBConn{DB: db, config: config, queries: queries, partitions: &partitionSet{}}, nil
 	default:
 		return nil, errors.New("invalid database adapter")
 	}
@@ -76,7 +171,8 @@ func (db *DBConn) IfUserExist(username string) bool {
 		id       int
 		password string
 	)
-	err := db.DB.QueryRow(db.config.Auth_Sql, username).Scan(&id, &password)
+	sql, args := db.statement("auth_sql", 0, params{"username": username})
+	err := db.DB.QueryRow(sql, args...).Scan(&id, &password)
 	if err != nil {
 		return false
 	}
@@ -91,7 +187,8 @@ func (db *DBConn) CheckUserWithPass(authMethod, username, cramPassword, cramSecr
 		password string
 	)
 	log.Debugf("AUTH by %s / %s", username, cramPassword)
-	err := db.DB.QueryRow(db.config.Auth_Sql, username).Scan(&id, &password)
+	sql, args := db.statement("auth_sql", 0, params{"username": username})
+	err := db.DB.QueryRow(sql, args...).Scan(&id, &password)
 	if err != nil {
 		log.Debugf("User %s doesn't found (sql should return 'id' and 'password' fields): %v", username, err)
 		return 0, "", err
@@ -120,7 +217,8 @@ func (db *DBConn) CheckAddressMode(username string) (int, error) {
 		id int
 	)
 	log.Debugf("CheckAddressMode by %s", username)
-	err := db.DB.QueryRow(db.config.Email_Address_Mode_Sql, username).Scan(&id)
+	sql, args := db.statement("email_address_mode_sql", 0, params{"username": username})
+	err := db.DB.QueryRow(sql, args...).Scan(&id)
 	if err != nil {
 		log.Debugf("User Address %s doesn't found in inboxes (sql should return 'id' field): %v", username, err)
 		return 0, err
@@ -130,42 +228,49 @@ func (db *DBConn) CheckAddressMode(username string) (int, error) {
 
 // save email
 
-func (db *DBConn) StoreMail(mailboxId int, subject string, date time.Time, from, from_name, to, to_name, html, text string, rawEmail []byte) (int, error) {
+func (db *DBConn) StoreMail(message *Message) (int, error) {
 	var (
 		id int
 	)
-	strBody := utils.CheckAndFixUtf8(string(rawEmail))
-	sql := strings.Replace(db.config.Messages_Sql, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
-	// normalize variables
-	if len(subject) > 1000 {
-		subject = subject[0:1000]
-	}
-	if len(from) > 255 {
-		from = from[0:255]
-	}
-	if len(from_name) > 255 {
-		from_name = from_name[0:255]
-	}
-	if len(to) > 255 {
-		to = to[0:255]
-	}
-	if len(to_name) > 255 {
-		to_name = to_name[0:255]
-	}
-	// sql
-	err := db.DB.QueryRow(sql,
-		mailboxId,
-		subject,
-		date.UTC(),
-		from,
-		from_name,
-		to,
-		to_name,
-		html,
-		text,
-		strBody,
-		len(strBody)).Scan(&id)
+	strBody := utils.CheckAndFixUtf8(string(message.Raw))
+	values := params{
+		"inbox_id":           message.MailboxID,
+		"subject":            truncate(message.Subject, 1000),
+		"sent_at":            message.Date.UTC(),
+		"from_email":         truncate(message.From, 255),
+		"from_name":          truncate(message.FromName, 255),
+		"to_email":           truncate(message.To, 255),
+		"to_name":            truncate(message.ToName, 255),
+		"html_body":          message.Html,
+		"text_body":          message.Text,
+		"raw_body":           strBody,
+		"email_size":         len(strBody),
+		"cc":                 message.Cc,
+		"reply_to":           truncate(message.ReplyTo, 255),
+		"message_id_header":  truncate(message.MessageID, 998),
+		"spam_score":         message.SpamScore,
+		"spam":               message.Spam,
+		"fingerprint":        message.Fingerprint,
+		"duplicate_of":       message.DuplicateOf,
+		"from_addresses":     addressesParam(message.FromList),
+		"to_addresses":       addressesParam(message.ToList),
+		"cc_addresses":       addressesParam(message.CcList),
+		"bcc_addresses":      addressesParam(message.BccList),
+		"reply_to_addresses": addressesParam(message.ReplyToList),
+		"in_reply_to":        truncate(message.InReplyTo, 998),
+		"references":         strings.Join(message.References, " "),
+		"envelope_from":      truncate(message.EnvelopeFrom, 255),
+		"envelope_to":        pq.Array(message.EnvelopeTo),
+		"headers":            jsonParam(message.Headers, len(message.Headers) == 0),
+		"queue_id":           message.QueueID,
+	}
+	if err := db.EnsurePartition(message.MailboxID); err != nil {
+		return 0, err
+	}
+	sql, args := db.statement("messages_sql", message.MailboxID, values)
+	err := db.conn().QueryRow(sql, args...).Scan(&id)
 	if err != nil {
+		db.forgetPartition(message.MailboxID)
 		log.Errorf("Messages SQL error: %v", err)
 		return 0, err
 	}
@@ -182,11 +287,8 @@ func (db *DBConn) UpdateSpamReport(mailboxId int, messageId int, spamReport stri
 	var (
 		id int
 	)
-	sql := strings.Replace(db.config.Spamassassin_Sql, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
-	err := db.DB.QueryRow(sql,
-		mailboxId,
-		messageId,
-		spamReport).Scan(&id)
+	sql, args := db.statement("spamassassin_sql", mailboxId, params{"inbox_id": mailboxId, "message_id": messageId, "spam_report": spamReport})
+	err := db.conn().QueryRow(sql, args...).Scan(&id)
 	if err != nil {
 		log.Errorf("Spamassassin SQL error: %v", err)
 		return 0, err
@@ -200,11 +302,8 @@ func (db *DBConn) UpdateVirusesReport(mailboxId int, messageId int, virusesRepor
 	var (
 		id int
 	)
-	sql := strings.Replace(db.config.Clamav_Sql, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
-	err := db.DB.QueryRow(sql,
-		mailboxId,
-		messageId,
-		virusesReport).Scan(&id)
+	sql, args := db.statement("clamav_sql", mailboxId, params{"inbox_id": mailboxId, "message_id": messageId, "viruses_report": virusesReport})
+	err := db.conn().QueryRow(sql, args...).Scan(&id)
 	if err != nil {
 		log.Errorf("Clamav SQL error: %v", err)
 		return 0, err
@@ -212,23 +311,99 @@ func (db *DBConn) UpdateVirusesReport(mailboxId int, messageId int, virusesRepor
 	return id, nil
 }
 
+// mark message of spam campaign
+
+func (db *DBConn) UpdateCampaign(mailboxId int, messageId int, campaign string, quarantined bool) (int, error) {
+	var (
+		id int
+	)
+	sql, args := db.statement("campaign_sql", mailboxId, params{"inbox_id": mailboxId, "message_id": messageId, "campaign": campaign, "quarantined": quarantined})
+	err := db.conn().QueryRow(sql, args...).Scan(&id)
+	if err != nil {
+		log.Errorf("Campaign SQL error: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// mark message quarantined by policy
+
+func (db *DBConn) QuarantineMessage(mailboxId int, messageId int, reason string) (int, error) {
+	var (
+		id int
+	)
+	sql, args := db.statement("quarantine_sql", mailboxId, params{"inbox_id": mailboxId, "message_id": messageId, "reason": reason})
+	err := db.conn().QueryRow(sql, args...).Scan(&id)
+	if err != nil {
+		log.Errorf("Quarantine SQL error: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// update spf result
+
+func (db *DBConn) UpdateSpfResult(mailboxId int, messageId int, spfResult string) (int, error) {
+	var (
+		id int
+	)
+	sql, args := db.statement("spf_sql", mailboxId, params{"inbox_id": mailboxId, "message_id": messageId, "spf_result": spfResult})
+	err := db.conn().QueryRow(sql, args...).Scan(&id)
+	if err != nil {
+		log.Errorf("Spf SQL error: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// update dkim report
+
+func (db *DBConn) UpdateDkimReport(mailboxId int, messageId int, dkimReport string) (int, error) {
+	var (
+		id int
+	)
+	sql, args := db.statement("dkim_sql", mailboxId, params{"inbox_id": mailboxId, "message_id": messageId, "dkim_report": dkimReport})
+	err := db.conn().QueryRow(sql, args...).Scan(&id)
+	if err != nil {
+		log.Errorf("Dkim SQL error: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// update dmarc result
+
+func (db *DBConn) UpdateDmarcResult(mailboxId int, messageId int, dmarcResult string) (int, error) {
+	var (
+		id int
+	)
+	sql, args := db.statement("dmarc_sql", mailboxId, params{"inbox_id": mailboxId, "message_id": messageId, "dmarc_result": dmarcResult})
+	err := db.conn().QueryRow(sql, args...).Scan(&id)
+	if err != nil {
+		log.Errorf("Dmarc SQL error: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
 // save attachment
 
 func (db *DBConn) StoreAttachment(mailboxId int, messageId int, filename, attachmentType, contentType, contentId, transferEncoding, strBody string) (int, error) {
 	var (
 		id int
 	)
-	sql := strings.Replace(db.config.Attachments_Sql, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
-	err := db.DB.QueryRow(sql,
-		mailboxId,
-		messageId,
-		filename,
-		attachmentType,
-		contentType,
-		contentId,
-		transferEncoding,
-		utils.EncodeBase64(strBody),
-		len(strBody)).Scan(&id)
+	sql, args := db.statement("attachments_sql", mailboxId, params{
+		"inbox_id":          mailboxId,
+		"message_id":        messageId,
+		"filename":          filename,
+		"attachment_type":   attachmentType,
+		"content_type":      contentType,
+		"content_id":        contentId,
+		"transfer_encoding": transferEncoding,
+		"attachment_body":   utils.EncodeBase64(strBody),
+		"attachment_size":   len(strBody),
+	})
+	err := db.conn().QueryRow(sql, args...).Scan(&id)
 	if err != nil {
 		log.Errorf("Attachments SQL error: %v", err)
 		return 0, err
@@ -240,67 +415,112 @@ func (db *DBConn) StoreAttachment(mailboxId int, messageId int, filename, attach
 	return id, nil
 }
 
-// get settings
+// get relay setting, is inbox released to real recipients
+
+func (db *DBConn) IsRelayEnabled(mailboxId int) (bool, error) {
+	var (
+		enabled bool
+	)
+	sql, args := db.statement("relay_sql", mailboxId, params{"inbox_id": mailboxId})
+	err := db.DB.QueryRow(sql, args...).Scan(&enabled)
+	if err != nil {
+		log.Errorf("Relay SQL error: %v", err)
+	}
+	return enabled, err
+}
+
+// get webhook of inbox, empty url if inbox has no webhook
+
+func (db *DBConn) GetInboxWebhook(mailboxId int) (string, string, error) {
+	var (
+		url    string
+		secret string
+	)
+	sql, args := db.statement("webhook_sql", mailboxId, params{"inbox_id": mailboxId})
+	err := db.DB.QueryRow(sql, args...).Scan(&url, &secret)
+	if err != nil {
+		log.Errorf("Webhook SQL error: %v", err)
+	}
+	return url, secret, err
+}
+
+// get forwarding rules of inbox, in order of evaluation
 
-func (db *DBConn) GeInboxSettings(mailboxId int) (InboxSettings, error) {
+func (db *DBConn) GetForwardingRules(mailboxId int) ([]ForwardingRule, error) {
 	var (
-		maxMessages int
-		rateLimit   int
+		rules []ForwardingRule
 	)
-	err := db.DB.QueryRow(db.config.Settings_Sql, mailboxId).Scan(&maxMessages, &rateLimit)
+	sql, args := db.statement("forwarding_rules_sql", mailboxId, params{"inbox_id": mailboxId})
+	rows, err := db.DB.Query(sql, args...)
 	if err != nil {
-		log.Errorf("Settings SQL error: %v", err)
+		log.Errorf("Forwarding rules SQL error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rule ForwardingRule
+		err := rows.Scan(&rule.Id, &rule.Field, &rule.Header, &rule.Pattern, &rule.Action, &rule.Target)
+		if err != nil {
+			log.Errorf("Forwarding rules SQL error: %v", err)
+			return nil, err
+		}
+		rules = append(rules, rule)
 	}
-	return InboxSettings{MaxMessages: maxMessages, RateLimit: rateLimit}, err
+	return rules, rows.Err()
 }
 
-// cleanup messages
-func (db *DBConn) CleanupMessages(mailboxId int, inboxSettings InboxSettings) error {
-	if db.config.Max_Messages_Enabled && inboxSettings.MaxMessages > 0 {
-		var (
-			sql    string
-			tmpId  int
-			msgIds []string
-		)
-		sql = strings.Replace(db.config.Max_Messages_Cleanup_Sql, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
-		rows, err := db.DB.Query(sql, mailboxId, inboxSettings.MaxMessages)
+// cleanup messages past max messages of inbox, returns ids of deleted messages.
+// It runs in transaction of stored message, so callers emit message.cleaned_up
+// events of the ids after commit (events.EmitCleanedUp)
+
+func (db *DBConn) CleanupMessages(mailboxId int, inboxSettings InboxSettings) ([]int, error) {
+	var (
+		tmpId  int
+		msgIds []int
+	)
+	if !db.config.Max_Messages_Enabled || inboxSettings.MaxMessages <= 0 {
+		return nil, nil
+	}
+	sql, args := db.statement("max_messages_cleanup_sql", mailboxId, params{"inbox_id": mailboxId, "max_messages": inboxSettings.MaxMessages})
+	rows, err := db.conn().Query(sql, args...)
+	if err != nil {
+		log.Errorf("CleanupMessages SQL error: %v", err)
+		return nil, err
+	}
+	for rows.Next() {
+		err := rows.Scan(&tmpId)
 		if err != nil {
+			rows.Close()
 			log.Errorf("CleanupMessages SQL error: %v", err)
-			return err
-		}
-		defer rows.Close()
-		for rows.Next() {
-			err := rows.Scan(&tmpId)
-			if err != nil {
-				log.Errorf("CleanupMessages SQL error: %v", err)
-				return err
-			}
-			msgIds = append(msgIds, strconv.Itoa(tmpId))
+			return nil, err
 		}
-		if len(msgIds) > 0 {
-			sql = strings.Replace(db.config.Max_Attachments_Cleanup_Sql, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
-			for _, msgId := range msgIds {
-				_, err := db.DB.Exec(sql, mailboxId, msgId)
-				if err != nil {
-					log.Errorf("CleanupMessages SQL error: %v", err)
-					return err
-				}
-			}
+		msgIds = append(msgIds, tmpId)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		log.Errorf("CleanupMessages SQL error: %v", err)
+		return nil, err
+	}
+	for _, msgId := range msgIds {
+		sql, args := db.statement("max_attachments_cleanup_sql", mailboxId, params{"inbox_id": mailboxId, "message_id": msgId})
+		_, err := db.conn().Exec(sql, args...)
+		if err != nil {
+			log.Errorf("CleanupMessages SQL error: %v", err)
+			return nil, err
 		}
 	}
-	return nil
+	return msgIds, nil
 }
 
 // pop3 count and sum
 
 func (db *DBConn) Pop3MessagesCountAndSum(mailboxId int) (int, int, error) {
 	var (
-		sql   string
 		count int
 		sum   int
 	)
-	sql = strings.Replace(db.config.Pop3_Count_And_Size_Messages, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
-	err := db.DB.QueryRow(sql, mailboxId).Scan(&count, &sum)
+	sql, args := db.statement("pop3_count_and_size_messages", mailboxId, params{"inbox_id": mailboxId})
+	err := db.DB.QueryRow(sql, args...).Scan(&count, &sum)
 	if err != nil {
 		log.Debugf("Pop3MessagesCountAndSum SQL error: %v", err) //empty results will be error
 		return 0, 0, err
@@ -312,14 +532,13 @@ func (db *DBConn) Pop3MessagesCountAndSum(mailboxId int) (int, int, error) {
 
 func (db *DBConn) Pop3MessagesList(mailboxId int) ([][2]int, error) {
 	var (
-		sql     string
 		tmpId   int
 		tmpSize int
 		msgIds  [][2]int
 	)
 
-	sql = strings.Replace(db.config.Pop3_Messages_List, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
-	rows, err := db.DB.Query(sql, mailboxId)
+	sql, args := db.statement("pop3_messages_list", mailboxId, params{"inbox_id": mailboxId})
+	rows, err := db.DB.Query(sql, args...)
 	if err != nil {
 		log.Errorf("Pop3MessagesList SQL error: %v", err)
 		return nil, err
@@ -340,13 +559,12 @@ func (db *DBConn) Pop3MessagesList(mailboxId int) ([][2]int, error) {
 
 func (db *DBConn) Pop3Message(mailboxId, messageId int) (int, string, error) {
 	var (
-		sql     string
 		msgSize int
 		msgBody string
 	)
 
-	sql = strings.Replace(db.config.Pop3_Message_One, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
-	err := db.DB.QueryRow(sql, mailboxId, messageId).Scan(&msgSize, &msgBody)
+	sql, args := db.statement("pop3_message_one", mailboxId, params{"inbox_id": mailboxId, "message_id": messageId})
+	err := db.DB.QueryRow(sql, args...).Scan(&msgSize, &msgBody)
 	if err != nil {
 		log.Debugf("Pop3Message SQL error: %v", err)
 		return 0, "", err
@@ -358,12 +576,11 @@ func (db *DBConn) Pop3Message(mailboxId, messageId int) (int, string, error) {
 
 func (db *DBConn) Pop3DeleteMessage(mailboxId, messageId int) error {
 	var (
-		sql   string
 		retId int
 	)
 
-	sql = strings.Replace(db.config.Pop3_Message_Delete, "[[inbox_id]]", strconv.Itoa(mailboxId), 1)
-	err := db.DB.QueryRow(sql, mailboxId, messageId).Scan(&retId)
+	sql, args := db.statement("pop3_message_delete", mailboxId, params{"inbox_id": mailboxId, "message_id": messageId})
+	err := db.DB.QueryRow(sql, args...).Scan(&retId)
 	if err != nil {
 		log.Debugf("Pop3DeleteMessage SQL error: %v", err)
 		return err
@@ -371,6 +588,18 @@ func (db *DBConn) Pop3DeleteMessage(mailboxId, messageId int) error {
 	return nil
 }
 
+// cut string to max bytes, keeping utf8 runes whole
+
+func truncate(value string, max int) string {
+	if len(value) <= max {
+		return value
+	}
+	for max > 0 && !utf8.RuneStart(value[max]) {
+		max--
+	}
+	return value[:max]
+}
+
 // close connection
 
 func (db *DBConn) Close() {
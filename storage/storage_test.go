@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func TestAddressesParam(t *testing.T) {
+	if value := addressesParam(nil); value != nil {
+		t.Errorf("expected NULL of empty list, got %v", value)
+	}
+	value := addressesParam([]mail.Address{{Name: "Leo", Address: "leo@example.com"}, {Address: "max@example.com"}})
+	expected := `[{"name":"Leo","address":"leo@example.com"},{"name":"","address":"max@example.com"}]`
+	if value != expected {
+		t.Errorf("expected %s, got %v", expected, value)
+	}
+	if value = jsonParam(map[string][]string{"X-Tag": {"a", "b"}}, false); value != `{"X-Tag":["a","b"]}` {
+		t.Errorf("unexpected headers %v", value)
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+	"github.com/lib/pq"
+)
+
+// queries of DBConn, run in transaction inside InTx
+
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (db *DBConn) conn() queryer {
+	if db.tx != nil {
+		return db.tx
+	}
+	return db.DB
+}
+
+// InTx runs fn with connection bound to transaction, committed if fn
+// returns nil. Serialization and connection errors retry whole fn, so fn
+// should only have database side effects. Nested InTx joins transaction.
+func (db *DBConn) InTx(fn func(tx *DBConn) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	delay := time.Duration(db.config.Tx_Retry_Delay) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := db.runTx(fn)
+		if err == nil || attempt >= db.config.Tx_Retries || !isRetryable(err) {
+			return err
+		}
+		log.Errorf("Transaction failed, retry %d of %d: %v", attempt+1, db.config.Tx_Retries, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (db *DBConn) runTx(fn func(tx *DBConn) error) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(&DBConn{DB: db.DB, config: db.config, queries: db.queries, partitions: db.partitions, tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// serialization failures, deadlocks and lost connections
+
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *pq.Error:
+		return e.Code == "40001" || e.Code == "40P01" || e.Code.Class() == "08"
+	case net.Error:
+		return true
+	}
+	return err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestIsRetryable(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "23505"}, false},
+		{driver.ErrBadConn, true},
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset")}, true},
+		{errors.New("Messages Not return last ID"), false},
+	} {
+		if isRetryable(test.err) != test.retryable {
+			t.Errorf("%v retryable should be %v", test.err, test.retryable)
+		}
+	}
+}
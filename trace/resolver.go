@@ -0,0 +1,48 @@
+package trace
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Resolver is used for reverse DNS of client ip.
+type Resolver interface {
+	LookupAddr(addr string) ([]string, error)
+}
+
+// DNSResolver resolves addresses with the system resolver.
+type DNSResolver struct {
+	Timeout time.Duration
+}
+
+func NewDNSResolver(timeout time.Duration) *DNSResolver {
+	return &DNSResolver{Timeout: timeout}
+}
+
+func (r *DNSResolver) context() (context.Context, context.CancelFunc) {
+	if r.Timeout > 0 {
+		return context.WithTimeout(context.Background(), r.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (r *DNSResolver) LookupAddr(addr string) ([]string, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+	return net.DefaultResolver.LookupAddr(ctx, addr)
+}
+
+// ReverseName returns first name of ip, empty if resolver is nil or
+// lookup fails.
+func ReverseName(resolver Resolver, ip net.IP) string {
+	if resolver == nil || ip == nil {
+		return ""
+	}
+	names, err := resolver.LookupAddr(ip.String())
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(names[0]), ".")
+}
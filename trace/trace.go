@@ -0,0 +1,101 @@
+// Package trace builds trace headers prepended to accepted messages:
+// Received (RFC 5321 section 4.4), Return-Path, Delivered-To and
+// X-Original-To.
+package trace
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Received describes one hop of message, empty fields are left out of header.
+type Received struct {
+	Helo        string               // HELO/EHLO argument of client
+	ReverseName string               // reverse DNS name of client ip
+	IP          net.IP               // client ip
+	By          string               // our hostname
+	Protocol    string               // SMTP, ESMTP, ESMTPS, ESMTPSA, LMTP...
+	TLS         *tls.ConnectionState // nil without TLS
+	ID          string               // queue id
+	For         string               // recipient, only for single recipient
+	Time        time.Time
+}
+
+// Protocol returns with protocol of RFC 3848 for greeting, TLS and auth.
+func Protocol(greeting string, secure, authenticated bool) string {
+	protocol := "ESMTP"
+	switch strings.ToUpper(greeting) {
+	case "HELO":
+		protocol = "SMTP"
+	case "LHLO":
+		protocol = "LMTP"
+	}
+	// HELO has no extensions, SMTPS and SMTPA are not defined
+	if protocol == "SMTP" {
+		return protocol
+	}
+	if secure {
+		protocol += "S"
+	}
+	if authenticated {
+		protocol += "A"
+	}
+	return protocol
+}
+
+// Header builds folded Received header, without the trailing CRLF.
+func (r *Received) Header() string {
+	helo := r.Helo
+	if helo == "" {
+		helo = "unknown"
+	}
+	from := helo
+	if r.IP != nil {
+		reverse := r.ReverseName
+		if reverse == "" {
+			reverse = "unknown"
+		}
+		from = fmt.Sprintf("%s (%s [%s])", helo, reverse, r.IP)
+	}
+	lines := []string{"Received: from " + from}
+	by := "by " + r.By
+	if r.Protocol != "" {
+		by += " with " + r.Protocol
+	}
+	if r.ID != "" {
+		by += " id " + r.ID
+	}
+	lines = append(lines, by)
+	if r.TLS != nil {
+		lines = append(lines, fmt.Sprintf("(version=%s cipher=%s)", tls.VersionName(r.TLS.Version), tls.CipherSuiteName(r.TLS.CipherSuite)))
+	}
+	date := r.Time
+	if date.IsZero() {
+		date = time.Now()
+	}
+	stamp := date.Format(time.RFC1123Z)
+	if r.For != "" {
+		lines = append(lines, fmt.Sprintf("for <%s>; %s", r.For, stamp))
+	} else {
+		lines[len(lines)-1] += "; " + stamp
+	}
+	return strings.Join(lines, "\r\n\t")
+}
+
+// ReturnPath header of MAIL FROM, empty sender is null reverse path.
+func ReturnPath(sender string) string {
+	return fmt.Sprintf("Return-Path: <%s>", sender)
+}
+
+// DeliveredTo header of final recipient.
+func DeliveredTo(rcpt string) string {
+	return "Delivered-To: " + rcpt
+}
+
+// OriginalTo header of recipient as given in RCPT TO.
+func OriginalTo(rcpt string) string {
+	return "X-Original-To: " + rcpt
+}
@@ -0,0 +1,82 @@
+package trace
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupAddr(addr string) ([]string, error) {
+	if names, ok := r[addr]; ok {
+		return names, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestProtocol(t *testing.T) {
+	for _, test := range []struct {
+		greeting     string
+		secure, auth bool
+		expected     string
+	}{
+		{"HELO", true, true, "SMTP"},
+		{"EHLO", false, false, "ESMTP"},
+		{"ehlo", true, false, "ESMTPS"},
+		{"EHLO", false, true, "ESMTPA"},
+		{"EHLO", true, true, "ESMTPSA"},
+		{"LHLO", true, false, "LMTPS"},
+	} {
+		if protocol := Protocol(test.greeting, test.secure, test.auth); protocol != test.expected {
+			t.Errorf("%s tls=%v auth=%v: expected %s, got %s", test.greeting, test.secure, test.auth, test.expected, protocol)
+		}
+	}
+}
+
+func TestReceivedHeader(t *testing.T) {
+	date := time.Date(2024, 5, 3, 10, 20, 30, 0, time.UTC)
+	received := &Received{
+		Helo:        "mail.example.com",
+		ReverseName: ReverseName(fakeResolver{"192.0.2.1": {"Mail.Example.com."}}, net.ParseIP("192.0.2.1")),
+		IP:          net.ParseIP("192.0.2.1"),
+		By:          "mx.falcon.test",
+		Protocol:    "ESMTPS",
+		TLS:         &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+		ID:          "4F2A9C",
+		For:         "leo@example.org",
+		Time:        date,
+	}
+	expected := "Received: from mail.example.com (mail.example.com [192.0.2.1])\r\n" +
+		"\tby mx.falcon.test with ESMTPS id 4F2A9C\r\n" +
+		"\t(version=TLS 1.3 cipher=TLS_AES_128_GCM_SHA256)\r\n" +
+		"\tfor <leo@example.org>; Fri, 03 May 2024 10:20:30 +0000"
+	if header := received.Header(); header != expected {
+		t.Errorf("expected %q, got %q", expected, header)
+	}
+
+	received = &Received{IP: net.ParseIP("192.0.2.2"), By: "mx.falcon.test", Protocol: "SMTP", Time: date}
+	received.ReverseName = ReverseName(fakeResolver{}, received.IP)
+	expected = "Received: from unknown (unknown [192.0.2.2])\r\n" +
+		"\tby mx.falcon.test with SMTP; Fri, 03 May 2024 10:20:30 +0000"
+	if header := received.Header(); header != expected {
+		t.Errorf("expected %q, got %q", expected, header)
+	}
+}
+
+func TestEnvelopeHeaders(t *testing.T) {
+	if header := ReturnPath(""); header != "Return-Path: <>" {
+		t.Errorf("unexpected null sender %q", header)
+	}
+	if header := ReturnPath("leo@example.com"); header != "Return-Path: <leo@example.com>" {
+		t.Errorf("unexpected sender %q", header)
+	}
+	if header := DeliveredTo("max@example.org"); header != "Delivered-To: max@example.org" {
+		t.Errorf("unexpected recipient %q", header)
+	}
+	if header := OriginalTo("Max+news@example.org"); header != "X-Original-To: Max+news@example.org" {
+		t.Errorf("unexpected original recipient %q", header)
+	}
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+)
+
+// prepend header fields to raw email, keeping line endings of the email
+
+func PrependHeaders(rawEmail []byte, headers ...string) []byte {
+	if len(headers) == 0 {
+		return rawEmail
+	}
+	lineEnding := "\n"
+	if idx := bytes.IndexByte(rawEmail, '\n'); idx > 0 && rawEmail[idx-1] == '\r' {
+		lineEnding = "\r\n"
+	}
+	var buf bytes.Buffer
+	for _, header := range headers {
+		header = strings.Replace(strings.TrimRight(header, "\r\n"), "\r\n", "\n", -1)
+		buf.WriteString(strings.Replace(header, "\n", lineEnding, -1))
+		buf.WriteString(lineEnding)
+	}
+	buf.Write(rawEmail)
+	return buf.Bytes()
+}
+
+// remove header fields of raw email for which remove is true, remove gets
+// name and unfolded value of each field
+
+func RemoveHeaders(rawEmail []byte, remove func(name, value string) bool) []byte {
+	var (
+		buf   bytes.Buffer
+		field []byte
+	)
+	flush := func() {
+		if len(field) == 0 {
+			return
+		}
+		if idx := bytes.IndexByte(field, ':'); idx == -1 || !remove(strings.TrimSpace(string(field[:idx])), unfoldHeader(field[idx+1:])) {
+			buf.Write(field)
+		}
+		field = nil
+	}
+	rest := rawEmail
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+		// empty line ends header
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			flush()
+		}
+		field = append(field, line...)
+		rest = rest[end:]
+	}
+	flush()
+	buf.Write(rest)
+	return buf.Bytes()
+}
+
+func unfoldHeader(value []byte) string {
+	value = bytes.Replace(value, []byte("\r\n"), nil, -1)
+	value = bytes.Replace(value, []byte("\n"), nil, -1)
+	return strings.TrimSpace(string(value))
+}
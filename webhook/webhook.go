@@ -0,0 +1,303 @@
+// Package webhook notifies HTTP endpoints about stored messages with signed
+// JSON payloads, retried from a persistent queue.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Polymail/go-falcon/log"
+)
+
+const (
+	SIGNATURE_HEADER = "X-Falcon-Signature"
+	TIMESTAMP_HEADER = "X-Falcon-Timestamp"
+	DELIVERY_HEADER  = "X-Falcon-Delivery"
+	CONTENT_TYPE     = "application/json"
+	USER_AGENT       = "Falcon-Webhook/1.0"
+
+	DEFAULT_TIMEOUT       = 10 * time.Second
+	DEFAULT_MAX_ATTEMPTS  = 10
+	DEFAULT_RETRY_BASE    = 30 * time.Second
+	DEFAULT_RETRY_MAX     = time.Hour
+	DEFAULT_POLL_INTERVAL = 10 * time.Second
+	DEFAULT_WORKERS       = 2
+	CLAIM_LEASE           = 5 * time.Minute // claimed delivery is due again after lease
+)
+
+// Payload is JSON body of message notification.
+type Payload struct {
+	Event       string   `json:"event"`
+	MailboxID   int      `json:"mailbox_id"`
+	MessageID   int      `json:"message_id"`
+	Subject     string   `json:"subject"`
+	QueueID     string   `json:"queue_id"`
+	From        string   `json:"from"`
+	FromName    string   `json:"from_name"`
+	To          string   `json:"to"`
+	ToName      string   `json:"to_name"`
+	Size        int      `json:"size"`
+	SpamScore   *float64 `json:"spam_score"`   // null if not checked
+	Spam        bool     `json:"spam"`         // spam by spamassassin threshold
+	VirusStatus string   `json:"virus_status"` // "clean", virus name or "unchecked"
+	Timestamp   int64    `json:"timestamp"`
+}
+
+// Delivery is a notification of one endpoint in retry queue.
+type Delivery struct {
+	ID          string
+	MailboxID   int
+	URL         string
+	Secret      string
+	Body        []byte
+	Attempts    int
+	Created     time.Time
+	NextAttempt time.Time
+	LastError   string
+}
+
+// Queue is persistent retry queue of deliveries.
+type Queue interface {
+	// Push adds delivery or reschedules it at d.NextAttempt.
+	Push(d *Delivery) error
+	// Claim returns up to limit due deliveries, claimed deliveries are not
+	// returned again until lease expires.
+	Claim(now time.Time, lease time.Duration, limit int) ([]*Delivery, error)
+	// Remove deletes delivery from queue.
+	Remove(id string) error
+}
+
+// Attempt is result of one delivery attempt.
+type Attempt struct {
+	Delivery   *Delivery
+	StatusCode int
+	Duration   time.Duration
+	Error      string
+	Final      bool // delivered or given up
+}
+
+// Notifier sends signed payloads to endpoints.
+type Notifier struct {
+	Client       *http.Client
+	Queue        Queue
+	MaxAttempts  int
+	RetryBase    time.Duration
+	RetryMax     time.Duration
+	PollInterval time.Duration
+	Workers      int
+	OnAttempt    func(attempt *Attempt) // optional attempt log
+
+	defaults sync.Once
+}
+
+func (n *Notifier) setDefaults() {
+	if n.Client == nil {
+		n.Client = &http.Client{Timeout: DEFAULT_TIMEOUT}
+	}
+	if n.MaxAttempts <= 0 {
+		n.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if n.RetryBase <= 0 {
+		n.RetryBase = DEFAULT_RETRY_BASE
+	}
+	if n.RetryMax <= 0 {
+		n.RetryMax = DEFAULT_RETRY_MAX
+	}
+	if n.PollInterval <= 0 {
+		n.PollInterval = DEFAULT_POLL_INTERVAL
+	}
+	if n.Workers <= 0 {
+		n.Workers = DEFAULT_WORKERS
+	}
+}
+
+// Sign returns hex HMAC-SHA256 of "timestamp.body" with secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks value of signature header, for receivers.
+func VerifySignature(secret string, timestamp int64, body []byte, signature string) bool {
+	expected := "sha256=" + Sign(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func newDeliveryID() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Notify queues payload for url and tries to deliver it at once, failed
+// delivery stays in queue for retries.
+func (n *Notifier) Notify(url, secret string, payload *Payload) error {
+	// persist before first attempt to survive restarts
+	d, err := n.push(payload.MailboxID, url, secret, payload, CLAIM_LEASE)
+	if err != nil {
+		return err
+	}
+	n.Attempt(d)
+	return nil
+}
+
+// Enqueue queues JSON of payload for url, it is delivered and retried by
+// workers of Run.
+func (n *Notifier) Enqueue(mailboxID int, url, secret string, payload interface{}) error {
+	_, err := n.push(mailboxID, url, secret, payload, 0)
+	return err
+}
+
+// push delivery of payload due after delay
+
+func (n *Notifier) push(mailboxID int, url, secret string, payload interface{}, delay time.Duration) (*Delivery, error) {
+	n.defaults.Do(n.setDefaults)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	d := &Delivery{
+		ID:          newDeliveryID(),
+		MailboxID:   mailboxID,
+		URL:         url,
+		Secret:      secret,
+		Body:        body,
+		Created:     now,
+		NextAttempt: now.Add(delay),
+	}
+	if err := n.Queue.Push(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Run retries due deliveries until stop is closed.
+func (n *Notifier) Run(stop <-chan struct{}) {
+	n.defaults.Do(n.setDefaults)
+	jobs := make(chan *Delivery)
+	var wg sync.WaitGroup
+	for i := 0; i < n.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range jobs {
+				n.Attempt(d)
+			}
+		}()
+	}
+	ticker := time.NewTicker(n.PollInterval)
+	defer func() {
+		ticker.Stop()
+		close(jobs)
+		wg.Wait()
+	}()
+	for {
+		deliveries, err := n.Queue.Claim(time.Now(), CLAIM_LEASE, n.Workers*10)
+		if err != nil {
+			log.Errorf("Webhook: claim deliveries: %v", err)
+		}
+		for _, d := range deliveries {
+			select {
+			case jobs <- d:
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Attempt posts delivery once, then removes or reschedules it.
+func (n *Notifier) Attempt(d *Delivery) {
+	n.defaults.Do(n.setDefaults)
+	start := time.Now()
+	statusCode, retry, err := n.post(d)
+	d.Attempts++
+	attempt := &Attempt{Delivery: d, StatusCode: statusCode, Duration: time.Since(start), Final: true}
+	if err != nil {
+		attempt.Error = err.Error()
+		d.LastError = err.Error()
+		attempt.Final = !retry || d.Attempts >= n.MaxAttempts
+	}
+	switch {
+	case err == nil:
+		log.Infof("Webhook: %s delivered to %s, status %d in %v", d.ID, d.URL, statusCode, attempt.Duration)
+	case attempt.Final:
+		log.Errorf("Webhook: %s to %s failed after %d attempts: %v", d.ID, d.URL, d.Attempts, err)
+	default:
+		log.Infof("Webhook: %s to %s attempt %d failed: %v", d.ID, d.URL, d.Attempts, err)
+	}
+	if n.OnAttempt != nil {
+		n.OnAttempt(attempt)
+	}
+	if attempt.Final {
+		if err := n.Queue.Remove(d.ID); err != nil {
+			log.Errorf("Webhook: remove %s: %v", d.ID, err)
+		}
+		return
+	}
+	d.NextAttempt = time.Now().Add(Backoff(d.Attempts, n.RetryBase, n.RetryMax))
+	if err := n.Queue.Push(d); err != nil {
+		log.Errorf("Webhook: reschedule %s: %v", d.ID, err)
+	}
+}
+
+// Backoff returns retry delay after attempts, doubled on each attempt.
+func Backoff(attempts int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// post signed body, retry is false for client errors
+
+func (n *Notifier) post(d *Delivery) (int, bool, error) {
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return 0, false, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", CONTENT_TYPE)
+	req.Header.Set("User-Agent", USER_AGENT)
+	req.Header.Set(DELIVERY_HEADER, d.ID)
+	req.Header.Set(TIMESTAMP_HEADER, strconv.FormatInt(timestamp, 10))
+	if d.Secret != "" {
+		req.Header.Set(SIGNATURE_HEADER, "sha256="+Sign(d.Secret, timestamp, d.Body))
+	}
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500
+	return resp.StatusCode, retry, fmt.Errorf("webhook returned %s", strings.TrimSpace(resp.Status))
+}
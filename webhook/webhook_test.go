@@ -0,0 +1,179 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// in memory queue
+
+type memoryQueue struct {
+	sync.Mutex
+	deliveries map[string]*Delivery
+}
+
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{deliveries: make(map[string]*Delivery)}
+}
+
+func (q *memoryQueue) Push(d *Delivery) error {
+	q.Lock()
+	defer q.Unlock()
+	copied := *d
+	q.deliveries[d.ID] = &copied
+	return nil
+}
+
+func (q *memoryQueue) Claim(now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	q.Lock()
+	defer q.Unlock()
+	var due []*Delivery
+	for _, d := range q.deliveries {
+		if len(due) < limit && !d.NextAttempt.After(now) {
+			d.NextAttempt = now.Add(lease)
+			copied := *d
+			due = append(due, &copied)
+		}
+	}
+	return due, nil
+}
+
+func (q *memoryQueue) Remove(id string) error {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.deliveries, id)
+	return nil
+}
+
+func (q *memoryQueue) only() *Delivery {
+	q.Lock()
+	defer q.Unlock()
+	for _, d := range q.deliveries {
+		return d
+	}
+	return nil
+}
+
+func TestNotifySigned(t *testing.T) {
+	var received Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(TIMESTAMP_HEADER), 10, 64)
+		if !VerifySignature("s3cret", timestamp, body, r.Header.Get(SIGNATURE_HEADER)) {
+			t.Errorf("invalid signature %q", r.Header.Get(SIGNATURE_HEADER))
+		}
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	queue := newMemoryQueue()
+	var attempts []*Attempt
+	notifier := &Notifier{Queue: queue, OnAttempt: func(a *Attempt) { attempts = append(attempts, a) }}
+	score := 3.5
+	payload := &Payload{Event: "message.stored", MailboxID: 1, MessageID: 2, Subject: "hello", Size: 120, SpamScore: &score, VirusStatus: "clean"}
+	if err := notifier.Notify(server.URL, "s3cret", payload); err != nil {
+		t.Fatal(err)
+	}
+	if received.MessageID != 2 || received.SpamScore == nil || *received.SpamScore != 3.5 || received.VirusStatus != "clean" {
+		t.Errorf("unexpected payload %+v", received)
+	}
+	if queue.only() != nil {
+		t.Error("delivered notification should be removed from queue")
+	}
+	if len(attempts) != 1 || attempts[0].StatusCode != 200 || !attempts[0].Final {
+		t.Errorf("unexpected attempts %+v", attempts)
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	received := make(chan map[string]int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]int
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer server.Close()
+
+	queue := newMemoryQueue()
+	notifier := &Notifier{Queue: queue, PollInterval: 10 * time.Millisecond}
+	if err := notifier.Enqueue(1, server.URL, "", map[string]int{"rule_id": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if d := queue.only(); d == nil || d.MailboxID != 1 || d.Attempts != 0 {
+		t.Fatalf("enqueued delivery should wait in queue, got %+v", d)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go notifier.Run(stop)
+	select {
+	case body := <-received:
+		if body["rule_id"] != 3 {
+			t.Errorf("unexpected body %v", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueued delivery was not posted")
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	queue := newMemoryQueue()
+	notifier := &Notifier{Queue: queue, RetryBase: time.Minute}
+	notifier.Notify(server.URL, "", &Payload{MailboxID: 1})
+	d := queue.only()
+	if d == nil || d.Attempts != 1 || d.LastError == "" {
+		t.Fatalf("failed delivery should be rescheduled, got %+v", d)
+	}
+	if wait := time.Until(d.NextAttempt); wait < 59*time.Second || wait > time.Minute {
+		t.Errorf("unexpected retry in %v", wait)
+	}
+	// due again, e.g. after restart
+	d.NextAttempt = time.Now()
+	queue.Push(d)
+	claimed, _ := queue.Claim(time.Now(), CLAIM_LEASE, 10)
+	if len(claimed) != 1 {
+		t.Fatalf("expected due delivery, got %d", len(claimed))
+	}
+	notifier.Attempt(claimed[0])
+	if queue.only() != nil || requests != 2 {
+		t.Errorf("retried delivery should be removed, %d requests", requests)
+	}
+}
+
+func TestNotifyClientErrorNotRetried(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+	queue := newMemoryQueue()
+	notifier := &Notifier{Queue: queue}
+	notifier.Notify(server.URL, "", &Payload{MailboxID: 1})
+	if queue.only() != nil {
+		t.Error("client error should not be retried")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if delay := Backoff(3, time.Second, time.Minute); delay != 4*time.Second {
+		t.Errorf("unexpected delay %v", delay)
+	}
+	if delay := Backoff(20, time.Second, time.Minute); delay != time.Minute {
+		t.Errorf("unexpected delay %v", delay)
+	}
+}
@@ -0,0 +1,292 @@
+package worker
+
+import (
+	"encoding/json"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/Polymail/go-falcon/arc"
+	"github.com/Polymail/go-falcon/authres"
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dkim"
+	"github.com/Polymail/go-falcon/dmarc"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/redisworker"
+	"github.com/Polymail/go-falcon/spf"
+	"github.com/Polymail/go-falcon/storage"
+	"github.com/Polymail/go-falcon/utils"
+)
+
+const (
+	AUTH_RESULTS_SIGNATURE_LEN = 8 // header.b prefix length
+
+	QUARANTINE_DMARC_REJECT     = "dmarc_reject"
+	QUARANTINE_DMARC_QUARANTINE = "dmarc_quarantine"
+)
+
+var (
+	dkimKeyResolver dkim.KeyResolver
+	dmarcResolver   dmarc.Resolver
+	arcSealer       *arc.SealOptions
+)
+
+// init authentication checks
+
+func initAuthentication(config *config.Config) {
+	if config.Dkim.Enabled && dkimKeyResolver == nil {
+		dkimKeyResolver = dkim.NewDNSKeyResolver(time.Duration(config.Dkim.Timeout) * time.Second)
+	}
+	if config.Dmarc.Enabled && dmarcResolver == nil {
+		dmarcResolver = spf.NewDNSResolver(time.Duration(config.Dmarc.Timeout) * time.Second)
+	}
+	// quarantine of enforced policy needs query, messages would fail to store
+	if (config.Dmarc.Reject_Enforce || config.Dmarc.Quarantine_Enforce) && config.Storage.Quarantine_Sql == "" {
+		log.Errorf("DMARC policy enforcement disabled: quarantine_sql is empty")
+		config.Dmarc.Reject_Enforce = false
+		config.Dmarc.Quarantine_Enforce = false
+	}
+	if config.Arc.Enabled && dkimKeyResolver == nil {
+		dkimKeyResolver = dkim.NewDNSKeyResolver(time.Duration(config.Arc.Timeout) * time.Second)
+	}
+	if config.Arc.Enabled && config.Arc.Seal && arcSealer == nil {
+		signer, err := dkim.LoadPrivateKey(config.Arc.Private_Key)
+		if err != nil {
+			log.Errorf("ARC sealing disabled, error loading private key %s: %v", config.Arc.Private_Key, err)
+			return
+		}
+		arcSealer = &arc.SealOptions{Domain: config.Arc.Domain, Selector: config.Arc.Selector, Signer: signer}
+	}
+}
+
+// authentication results of email
+
+type authenticationResults struct {
+	Spf   string
+	Dkim  []dkim.Result
+	Dmarc *dmarc.Evaluation
+	Arc   *arc.Result
+}
+
+// check email authentication and prepend Authentication-Results header
+// (and our ARC set, if sealing) to raw email
+
+func authenticateEmail(config *config.Config, envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail) *authenticationResults {
+	if !config.Spf.Enabled && !config.Dkim.Enabled && !config.Dmarc.Enabled && !config.Arc.Enabled {
+		return nil
+	}
+	results := &authenticationResults{Spf: envelop.SpfResult}
+	if config.Dkim.Enabled {
+		results.Dkim = dkim.Verify(email.RawMail, dkimKeyResolver)
+	}
+	if config.Dmarc.Enabled {
+		results.evaluateDmarc(config, envelop, email)
+	}
+	if config.Arc.Enabled {
+		results.Arc = arc.Validate(email.RawMail, dkimKeyResolver)
+		email.ArcResult = results.Arc
+		log.Debugf("ARC chain status: %s, instances: %d", results.Arc.Status, results.Arc.Instances)
+	}
+	removeForgedResults(config, email)
+	headerResults := results.headerResults(envelop)
+	headers := []string{authres.Format(config.Adapter.Hostname, headerResults)}
+	if arcSealer != nil {
+		arcHeaders, err := arc.Seal(email.RawMail, authres.Value(config.Adapter.Hostname, headerResults), results.Arc, arcSealer)
+		if err != nil {
+			log.Errorf("ARC seal: %v", err)
+		} else {
+			headers = append(arcHeaders, headers...)
+		}
+	}
+	email.RawMail = utils.PrependHeaders(email.RawMail, headers...)
+	return results
+}
+
+// remove incoming Authentication-Results of our authserv-id, receivers
+// would trust them as ours
+
+func removeForgedResults(config *config.Config, email *parser.ParsedEmail) {
+	forged := func(name, value string) bool {
+		return strings.EqualFold(name, authres.HEADER) && authres.Claims(value, config.Adapter.Hostname)
+	}
+	email.RawMail = utils.RemoveHeaders(email.RawMail, forged)
+	for _, headers := range []mail.Header{email.Headers, email.MessageHeaders} {
+		var kept []string
+		for _, value := range headers[authres.HEADER] {
+			if !forged(authres.HEADER, value) {
+				kept = append(kept, value)
+			}
+		}
+		if len(kept) > 0 {
+			headers[authres.HEADER] = kept
+		} else {
+			delete(headers, authres.HEADER)
+		}
+	}
+}
+
+// results for Authentication-Results header
+
+func (results *authenticationResults) headerResults(envelop *smtpd.BasicEnvelope) []authres.Result {
+	var headerResults []authres.Result
+	if results.Spf != "" {
+		spfResult := authres.Result{Method: "spf", Value: results.Spf}
+		if envelop.SpfIdentity == spf.IDENTITY_HELO {
+			spfResult.Properties = append(spfResult.Properties, authres.Property{Key: "smtp.helo", Value: envelop.Helo})
+		} else if envelop.From != nil && envelop.From.Email() != "" {
+			spfResult.Properties = append(spfResult.Properties, authres.Property{Key: "smtp.mailfrom", Value: envelop.From.Email()})
+		}
+		headerResults = append(headerResults, spfResult)
+	}
+	for _, result := range results.Dkim {
+		dkimResult := authres.Result{Method: "dkim", Value: string(result.Status)}
+		if result.Error != "" && result.Status != dkim.StatusPass {
+			dkimResult.Reason = result.Error
+		}
+		signature := result.Signature
+		if len(signature) > AUTH_RESULTS_SIGNATURE_LEN {
+			signature = signature[:AUTH_RESULTS_SIGNATURE_LEN]
+		}
+		dkimResult.Properties = []authres.Property{
+			{Key: "header.d", Value: result.Domain},
+			{Key: "header.s", Value: result.Selector},
+			{Key: "header.i", Value: result.Identifier},
+			{Key: "header.b", Value: signature},
+		}
+		headerResults = append(headerResults, dkimResult)
+	}
+	if results.Dmarc != nil {
+		dmarcResult := authres.Result{
+			Method:     "dmarc",
+			Value:      string(results.Dmarc.Result),
+			Comment:    results.Dmarc.PolicyComment(),
+			Properties: []authres.Property{{Key: "header.from", Value: results.Dmarc.FromDomain}},
+		}
+		headerResults = append(headerResults, dmarcResult)
+	}
+	if results.Arc != nil {
+		arcResult := authres.Result{Method: "arc", Value: string(results.Arc.Status)}
+		if results.Arc.Status == arc.ChainFail {
+			arcResult.Reason = results.Arc.Error
+		}
+		if envelop.RemoteIP != nil {
+			arcResult.Properties = []authres.Property{{Key: "smtp.remote-ip", Value: envelop.RemoteIP.String()}}
+		}
+		headerResults = append(headerResults, arcResult)
+	}
+	return headerResults
+}
+
+// evaluate dmarc policy of email and accumulate aggregate report data
+
+func (results *authenticationResults) evaluateDmarc(config *config.Config, envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail) {
+	ids := &dmarc.Identifiers{
+		FromDomain: domainOfAddress(email.From.Address),
+		SpfResult:  results.Spf,
+		SpfDomain:  envelop.Helo,
+	}
+	if envelop.SpfIdentity != spf.IDENTITY_HELO && envelop.From != nil && envelop.From.Hostname() != "" {
+		ids.SpfDomain = envelop.From.Hostname()
+	}
+	dkimDomain, dkimResult := "", ""
+	for _, result := range results.Dkim {
+		if result.Status == dkim.StatusNone {
+			continue
+		}
+		if result.Status == dkim.StatusPass {
+			ids.DkimDomains = append(ids.DkimDomains, result.Domain)
+		}
+		if dkimDomain == "" || (result.Status == dkim.StatusPass && dkimResult != string(dkim.StatusPass)) {
+			dkimDomain, dkimResult = result.Domain, string(result.Status)
+		}
+	}
+	results.Dmarc = dmarc.Evaluate(dmarcResolver, ids)
+	log.Debugf("DMARC result for %q: %s, disposition %s", ids.FromDomain, results.Dmarc.Result, results.Dmarc.Disposition)
+	// aggregate reports
+	if config.Dmarc.Reports.Enabled && config.Redis.Enabled && results.Dmarc.Record != nil {
+		sourceIP := ""
+		if envelop.RemoteIP != nil {
+			sourceIP = envelop.RemoteIP.String()
+		}
+		row := dmarc.NewAggregateRow(sourceIP, ids, results.Dmarc, dkimDomain, dkimResult)
+		redisworker.StoreDmarcAggregate(config, results.Dmarc, row)
+	}
+}
+
+// reason of quarantine by enforced dmarc policy, empty if message is
+// delivered, passed ARC chain of trusted sealer overrides policy
+
+func (results *authenticationResults) quarantineReason(config *config.Config) string {
+	if results == nil || results.Dmarc == nil {
+		return ""
+	}
+	var reason string
+	switch {
+	case results.Dmarc.Disposition == dmarc.DispositionReject && config.Dmarc.Reject_Enforce:
+		reason = QUARANTINE_DMARC_REJECT
+	case results.Dmarc.Disposition == dmarc.DispositionQuarantine && config.Dmarc.Quarantine_Enforce:
+		reason = QUARANTINE_DMARC_QUARANTINE
+	default:
+		return ""
+	}
+	if results.Arc != nil && results.Arc.Status == arc.ChainPass && isTrustedSealer(config, results.Arc.Domain) {
+		log.Infof("DMARC %s of %q overridden by ARC chain sealed by %s", results.Dmarc.Disposition, results.Dmarc.FromDomain, results.Arc.Domain)
+		return ""
+	}
+	return reason
+}
+
+// anyone can seal a chain, only trusted sealers vouch for forwarded mail
+
+func isTrustedSealer(config *config.Config, domain string) bool {
+	for _, sealer := range config.Arc.Trusted_Sealers {
+		if domain != "" && strings.EqualFold(sealer, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func domainOfAddress(address string) string {
+	if idx := strings.LastIndex(address, "@"); idx != -1 {
+		return strings.ToLower(address[idx+1:])
+	}
+	return ""
+}
+
+// store authentication results of stored message in transaction of message
+
+func storeAuthenticationResults(tx *storage.DBConn, config *config.Config, results *authenticationResults, mailboxID, messageID int) error {
+	if results == nil {
+		return nil
+	}
+	// spf
+	if config.Spf.Enabled && results.Spf != "" {
+		if _, err := tx.UpdateSpfResult(mailboxID, messageID, results.Spf); err != nil {
+			return err
+		}
+	}
+	// dkim
+	if config.Dkim.Enabled && len(results.Dkim) > 0 {
+		report, err := json.Marshal(results.Dkim)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.UpdateDkimReport(mailboxID, messageID, string(report)); err != nil {
+			return err
+		}
+	}
+	// dmarc
+	if config.Dmarc.Enabled && results.Dmarc != nil {
+		report, err := json.Marshal(results.Dmarc)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.UpdateDmarcResult(mailboxID, messageID, string(report)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
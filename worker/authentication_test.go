@@ -0,0 +1,71 @@
+package worker
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/Polymail/go-falcon/arc"
+	"github.com/Polymail/go-falcon/authres"
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dmarc"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spf"
+)
+
+func TestQuarantineReasonArcOverride(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Dmarc.Reject_Enforce = true
+	cfg.Arc.Trusted_Sealers = []string{"lists.example.org"}
+	results := &authenticationResults{
+		Dmarc: &dmarc.Evaluation{Result: dmarc.Fail, Disposition: dmarc.DispositionReject, FromDomain: "bank.example.com"},
+		Arc:   &arc.Result{Status: arc.ChainPass, Instances: 1, Domain: "attacker.example.net"},
+	}
+	if reason := results.quarantineReason(cfg); reason != QUARANTINE_DMARC_REJECT {
+		t.Errorf("passing chain of untrusted sealer should be quarantined, got %q", reason)
+	}
+	results.Arc.Domain = "Lists.Example.org"
+	if reason := results.quarantineReason(cfg); reason != "" {
+		t.Errorf("passing chain of trusted sealer should override policy, got %q", reason)
+	}
+	results.Arc.Status = arc.ChainFail
+	if reason := results.quarantineReason(cfg); reason != QUARANTINE_DMARC_REJECT {
+		t.Errorf("failed chain of trusted sealer should be quarantined, got %q", reason)
+	}
+}
+
+func TestForgedAuthenticationResults(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Adapter.Hostname = "mx.falcon.test"
+	cfg.Spf.Enabled = true
+	forged := "Authentication-Results: (injected) MX.falcon.test;\n\tdkim=pass header.d=bank.example.com;\n\tdmarc=pass"
+	relayed := "Authentication-Results: mx.example.org; spf=pass smtp.mailfrom=leo@example.org"
+	email := &parser.ParsedEmail{
+		RawMail:        []byte(forged + "\n" + relayed + "\nSubject: hi\n\nAuthentication-Results: mx.falcon.test; body\n"),
+		MessageHeaders: mail.Header{"Authentication-Results": {"(injected) MX.falcon.test; dkim=pass header.d=bank.example.com; dmarc=pass", "mx.example.org; spf=pass smtp.mailfrom=leo@example.org"}},
+	}
+	authenticateEmail(cfg, &smtpd.BasicEnvelope{SpfResult: "softfail"}, email)
+	raw := string(email.RawMail)
+	if strings.Contains(raw, "dkim=pass") || strings.Contains(raw, "dmarc=pass") {
+		t.Errorf("forged results should be removed:\n%s", raw)
+	}
+	if !strings.HasPrefix(raw, "Authentication-Results: mx.falcon.test;\n\tspf=softfail") {
+		t.Errorf("expected our results on top:\n%s", raw)
+	}
+	if !strings.Contains(raw, relayed+"\nSubject: hi\n\nAuthentication-Results: mx.falcon.test; body\n") {
+		t.Errorf("results of other servers and body should be kept:\n%s", raw)
+	}
+	if values := email.MessageHeaders["Authentication-Results"]; len(values) != 1 || !strings.HasPrefix(values[0], "mx.example.org") {
+		t.Errorf("unexpected parsed results %q", values)
+	}
+}
+
+func TestHeloSpfResult(t *testing.T) {
+	results := &authenticationResults{Spf: "fail"}
+	envelop := &smtpd.BasicEnvelope{Helo: "client.example.org", SpfResult: "fail", SpfIdentity: spf.IDENTITY_HELO}
+	header := authres.Format("mx.falcon.test", results.headerResults(envelop))
+	if !strings.Contains(header, "spf=fail smtp.helo=client.example.org") {
+		t.Errorf("expected helo identity, got %q", header)
+	}
+}
@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/dedup"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/storage"
+)
+
+var (
+	duplicateDetector *dedup.Detector
+)
+
+// fingerprint of message and stored original, if message is duplicate
+type duplicate struct {
+	fingerprint string
+	original    int
+	action      string
+}
+
+// duplicate is dropped
+func (d *duplicate) skip() bool {
+	return d.original > 0 && d.action == dedup.ACTION_SKIP
+}
+
+// duplicate is stored with link to original, without notifications
+func (d *duplicate) linked() bool {
+	return d.original > 0 && d.action == dedup.ACTION_LINK
+}
+
+// start duplicates detector
+
+func startDedup(config *config.Config) {
+	if !config.Dedup.Enabled || duplicateDetector != nil {
+		return
+	}
+	duplicateDetector = dedup.NewDetector(config.CacheStore, time.Duration(config.Dedup.Window)*time.Second)
+}
+
+// check message against recent messages of inbox, action of inbox
+// settings overrides global action
+
+func checkDuplicate(config *config.Config, email *parser.ParsedEmail, inboxSettings storage.InboxSettings) *duplicate {
+	d := &duplicate{action: config.Dedup.Action}
+	if inboxSettings.DuplicateAction != "" {
+		d.action = inboxSettings.DuplicateAction
+	}
+	if duplicateDetector == nil || d.action == dedup.ACTION_STORE {
+		return d
+	}
+	d.fingerprint = dedup.Fingerprint(email.MessageID, email.RawMail, config.Dedup.Require_Message_Id)
+	d.original = duplicateDetector.Original(email.MailboxID, d.fingerprint)
+	if d.original > 0 {
+		dedup.Count(d.action)
+		log.Infof("Message %q to inbox %d is duplicate of %d, action: %s", email.MessageID, email.MailboxID, d.original, d.action)
+	}
+	return d
+}
+
+// remember stored original for next deliveries
+
+func rememberFingerprint(email *parser.ParsedEmail, d *duplicate, messageId int) {
+	if duplicateDetector == nil || d.original > 0 {
+		return
+	}
+	duplicateDetector.Remember(email.MailboxID, d.fingerprint, messageId)
+}
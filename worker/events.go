@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/Polymail/go-falcon/events"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spamassassin"
+	"github.com/Polymail/go-falcon/storage"
+)
+
+// message.received event of parsed email
+
+func emitReceived(envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail) {
+	data := map[string]string{
+		"from": email.From.Address,
+		"to":   email.To.Address,
+		"size": strconv.Itoa(len(email.RawMail)),
+		"helo": envelop.Helo,
+	}
+	if envelop.QueueId != "" {
+		data["queue_id"] = envelop.QueueId
+	}
+	if envelop.RemoteIP != nil {
+		data["remote_ip"] = envelop.RemoteIP.String()
+	}
+	events.Emit(events.MESSAGE_RECEIVED, email.MailboxID, 0, data)
+}
+
+// message.stored event
+
+func emitStored(email *parser.ParsedEmail, messageID int) {
+	events.Emit(events.MESSAGE_STORED, email.MailboxID, messageID, map[string]string{
+		"subject":     email.Subject,
+		"from":        email.From.Address,
+		"to":          email.To.Address,
+		"size":        strconv.Itoa(len(email.RawMail)),
+		"attachments": strconv.Itoa(len(email.Attachments)),
+		"queue_id":    email.QueueID,
+	})
+}
+
+// events of spam and virus checks of stored email
+
+func emitChecks(mailboxID, messageID int, checks *messageChecks) {
+	if checks.SpamReport != "" {
+		emitSpamScored(mailboxID, messageID, checks.SpamReport)
+	}
+	if checks.VirusReport != "" {
+		events.Emit(events.MESSAGE_VIRUS_FOUND, mailboxID, messageID, map[string]string{"virus": checks.VirusReport})
+	}
+}
+
+// message.cleaned_up events of messages past max messages
+
+func emitCleanedUp(mailboxID int, messageIDs []int, inboxSettings storage.InboxSettings) {
+	events.EmitCleanedUp(mailboxID, messageIDs, map[string]string{"max_messages": strconv.Itoa(inboxSettings.MaxMessages)})
+}
+
+// message.spam_scored event from spamassassin JSON report
+
+func emitSpamScored(mailboxID, messageID int, report string) {
+	var spamResponse spamassassin.SpamassassinResponse
+	if err := json.Unmarshal([]byte(report), &spamResponse); err != nil {
+		return
+	}
+	events.Emit(events.MESSAGE_SPAM_SCORED, mailboxID, messageID, map[string]string{
+		"score":     strconv.FormatFloat(spamResponse.Score, 'f', -1, 64),
+		"threshold": strconv.FormatFloat(spamResponse.Threshold, 'f', -1, 64),
+		"spam":      strconv.FormatBool(spamResponse.Spam),
+	})
+}
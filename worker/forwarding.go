@@ -0,0 +1,181 @@
+package worker
+
+import (
+	"crypto/rand"
+	"reflect"
+	"sync"
+
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/forward"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/storage"
+	"github.com/Polymail/go-falcon/utils"
+)
+
+var (
+	compiledRules     = &compiledForwardingRules{inboxes: make(map[int]*compiledInboxRules)}
+	forwardSecret     []byte
+	forwardSecretOnce sync.Once
+)
+
+// compiled rules of inboxes, recompiled when cached rules change
+
+type compiledForwardingRules struct {
+	sync.Mutex
+	inboxes map[int]*compiledInboxRules
+}
+
+type compiledInboxRules struct {
+	stored []storage.ForwardingRule
+	rules  []*forward.Rule
+}
+
+func (c *compiledForwardingRules) get(mailboxID int, stored []storage.ForwardingRule) []*forward.Rule {
+	c.Lock()
+	defer c.Unlock()
+	if len(stored) == 0 {
+		delete(c.inboxes, mailboxID)
+		return nil
+	}
+	if compiled, ok := c.inboxes[mailboxID]; ok && reflect.DeepEqual(compiled.stored, stored) {
+		return compiled.rules
+	}
+	var rules []*forward.Rule
+	for _, rule := range stored {
+		compiled, err := forward.Compile(rule.Id, rule.Field, rule.Header, rule.Pattern, rule.Action, rule.Target)
+		if err != nil {
+			log.Errorf("Forwarding rule of inbox %d skipped: %v", mailboxID, err)
+			continue
+		}
+		rules = append(rules, compiled)
+	}
+	c.inboxes[mailboxID] = &compiledInboxRules{stored: stored, rules: rules}
+	return rules
+}
+
+// init forwarding rules
+
+func initForwarding(config *config.Config) {
+	if config.Forwarding.Enabled && !(config.Webhook.Enabled && config.Redis.Enabled) {
+		log.Infof("Forwarding: webhook rules need webhook and redis to be enabled")
+	}
+}
+
+// key of forwarding trace header, random key of process detects loops of
+// this server only
+
+func forwardingSecret(config *config.Config) []byte {
+	forwardSecretOnce.Do(func() {
+		if config.Forwarding.Secret != "" {
+			forwardSecret = []byte(config.Forwarding.Secret)
+			return
+		}
+		forwardSecret = make([]byte, 32)
+		rand.Read(forwardSecret)
+	})
+	return forwardSecret
+}
+
+// forwarding of email, matched rules are applied after storage
+
+type forwarding struct {
+	Fields *forward.Fields
+	Rules  []*forward.Rule
+}
+
+// evaluate forwarding rules of inbox, false if email should be dropped
+
+func evaluateForwarding(config *config.Config, envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail) (*forwarding, bool) {
+	if !config.Forwarding.Enabled {
+		return nil, true
+	}
+	storedRules, err := cache.LoadForwardingRules(config.CacheStore, config.DbPool, email.MailboxID)
+	if err != nil {
+		return nil, true
+	}
+	rules := compiledRules.get(email.MailboxID, storedRules)
+	if len(rules) == 0 {
+		return nil, true
+	}
+	fields := &forward.Fields{
+		Subject: email.Subject,
+		Headers: email.Headers,
+	}
+	if envelop.From != nil {
+		fields.Sender = envelop.From.Email()
+	}
+	for _, rcpt := range envelop.Rcpts {
+		fields.Recipients = append(fields.Recipients, rcpt.Email())
+	}
+	matched, dropped := forward.Evaluate(rules, fields)
+	if dropped {
+		log.Infof("Message from %q to inbox %d dropped by forwarding rule", fields.Sender, email.MailboxID)
+		return nil, false
+	}
+	return &forwarding{Fields: fields, Rules: matched}, true
+}
+
+// apply matched forwarding rules to stored email
+
+func (f *forwarding) apply(config *config.Config, email *parser.ParsedEmail, messageID int) {
+	if f == nil {
+		return
+	}
+	for _, rule := range f.Rules {
+		switch rule.Action {
+		case forward.ACTION_FORWARD:
+			if outboundRelay == nil {
+				log.Errorf("Forwarding rule %d: relay should be enabled to forward to %s", rule.ID, rule.Target)
+				continue
+			}
+			if forward.Forwarded(forwardingSecret(config), email.MessageHeaders, email.MailboxID) {
+				log.Infof("Forwarding rule %d: message of inbox %d forwarded already, skipped", rule.ID, email.MailboxID)
+				continue
+			}
+			if _, err := outboundRelay.Enqueue(email.MailboxID, f.Fields.Sender, []string{rule.Target}, forwardedMail(config, email)); err != nil {
+				log.Errorf("Forwarding rule %d: %v", rule.ID, err)
+			}
+		case forward.ACTION_WEBHOOK:
+			if messageNotifier == nil {
+				log.Errorf("Forwarding rule %d: webhook should be enabled to post to %s", rule.ID, rule.Target)
+				continue
+			}
+			if err := messageNotifier.Enqueue(email.MailboxID, rule.Target, "", forward.NewPayload(rule, email, messageID, f.Fields)); err != nil {
+				log.Errorf("Forwarding rule %d: %v", rule.ID, err)
+			}
+		}
+	}
+}
+
+// forward email to targets of inbox settings
+
+func forwardToTargets(config *config.Config, envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail, targets []string) {
+	if len(targets) == 0 {
+		return
+	}
+	if outboundRelay == nil {
+		log.Errorf("Forwarding of inbox %d: relay should be enabled to forward to %v", email.MailboxID, targets)
+		return
+	}
+	if forward.Forwarded(forwardingSecret(config), email.MessageHeaders, email.MailboxID) {
+		log.Infof("Forwarding of inbox %d: message forwarded already, skipped", email.MailboxID)
+		return
+	}
+	sender := ""
+	if envelop.From != nil {
+		sender = envelop.From.Email()
+	}
+	if _, err := outboundRelay.Enqueue(email.MailboxID, sender, targets, forwardedMail(config, email)); err != nil {
+		log.Errorf("Forwarding of inbox %d: %v", email.MailboxID, err)
+	}
+}
+
+// raw email with trace header of forwarding, forwarded messages are not
+// forwarded again
+
+func forwardedMail(config *config.Config, email *parser.ParsedEmail) []byte {
+	return utils.PrependHeaders(email.RawMail, forward.ForwardedHeader(forwardingSecret(config), config.Adapter.Hostname, email.MailboxID))
+}
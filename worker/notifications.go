@@ -0,0 +1,89 @@
+package worker
+
+import (
+	"strings"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/notify"
+)
+
+var (
+	notificationDispatcher *notify.Dispatcher
+)
+
+// build notification sinks selected in config
+
+func startNotifications(config *config.Config) {
+	if notificationDispatcher != nil {
+		return
+	}
+	var sinks []notify.Sink
+	for _, name := range config.Notifications.Sinks {
+		switch name {
+		case notify.SINK_FAYE, notify.SINK_SIDEKIQ, notify.SINK_STREAM, notify.SINK_PUBSUB:
+			if !config.Redis.Enabled {
+				log.Errorf("Notification sink %s disabled: redis should be enabled", name)
+				continue
+			}
+		}
+		switch name {
+		case notify.SINK_FAYE:
+			sinks = append(sinks, &notify.FayeSink{
+				Pool:     config.RedisPool,
+				Username: config.Redis.Hook_Username,
+				Password: config.Redis.Hook_Password,
+			})
+		case notify.SINK_SIDEKIQ:
+			if len(config.Redis.Cluster.Addrs) > 0 && !strings.Contains(config.Redis.Sidekiq_Namespace, "{") {
+				log.Errorf("Notification sink sidekiq disabled: redis cluster needs hash tag in sidekiq namespace")
+				continue
+			}
+			sinks = append(sinks, &notify.SidekiqSink{
+				Pool:      config.RedisPool,
+				Queue:     config.Redis.Sidekiq_Queue,
+				Class:     config.Redis.Sidekiq_Class,
+				Format:    config.Notifications.Sidekiq_Format,
+				Namespace: config.Redis.Sidekiq_Namespace,
+			})
+		case notify.SINK_STREAM:
+			sinks = append(sinks, &notify.StreamSink{
+				Pool:   config.RedisPool,
+				Stream: config.Notifications.Stream.Name,
+				MaxLen: config.Notifications.Stream.Max_Len,
+			})
+		case notify.SINK_PUBSUB:
+			sinks = append(sinks, &notify.PubSubSink{
+				Pool:    config.RedisPool,
+				Channel: config.Notifications.Pubsub.Channel,
+			})
+		case notify.SINK_NATS:
+			sink, err := notify.NewNATSSink(config.Notifications.Nats.Url, config.Notifications.Nats.Subject)
+			if err != nil {
+				log.Errorf("Notification sink nats disabled: %v", err)
+				continue
+			}
+			sinks = append(sinks, sink)
+		case notify.SINK_AMQP:
+			amqp := config.Notifications.Amqp
+			sink, err := notify.NewAMQPSink(amqp.Url, amqp.Exchange, amqp.Routing_Key)
+			if err != nil {
+				log.Errorf("Notification sink amqp disabled: %v", err)
+				continue
+			}
+			sinks = append(sinks, sink)
+		default:
+			log.Errorf("Unknown notification sink: %s", name)
+		}
+	}
+	notificationDispatcher = notify.NewDispatcher(sinks...)
+}
+
+// notify sinks about stored email
+
+func sendNotifications(mailboxID, messageID int, subject, queueID string) {
+	if notificationDispatcher == nil || len(notificationDispatcher.Sinks) == 0 {
+		return
+	}
+	notificationDispatcher.Notify(notify.NewNotification(mailboxID, messageID, subject, queueID))
+}
@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/redisworker"
+	"github.com/Polymail/go-falcon/relay"
+	"github.com/Polymail/go-falcon/spf"
+)
+
+var (
+	outboundRelay *relay.Relay
+)
+
+// start outbound delivery of released inboxes
+
+func startRelay(config *config.Config) {
+	if !config.Relay.Enabled || outboundRelay != nil {
+		return
+	}
+	if !config.Redis.Enabled {
+		log.Errorf("Relay disabled: redis should be enabled for relay queue")
+		return
+	}
+	timeout := time.Duration(config.Relay.Timeout) * time.Second
+	outboundRelay = &relay.Relay{
+		Hostname:     config.Adapter.Hostname,
+		SmartHost:    config.Relay.Smart_Host,
+		Username:     config.Relay.Username,
+		Password:     config.Relay.Password,
+		StartTLS:     config.Relay.Starttls,
+		RequireTLS:   config.Relay.Require_Tls,
+		Port:         config.Relay.Port,
+		Resolver:     spf.NewDNSResolver(timeout),
+		Queue:        redisworker.NewRelayQueue(config),
+		Timeout:      timeout,
+		RetryBase:    time.Duration(config.Relay.Retry_Base) * time.Second,
+		RetryMax:     time.Duration(config.Relay.Retry_Max) * time.Second,
+		MaxAge:       time.Duration(config.Relay.Max_Age) * time.Second,
+		PollInterval: time.Duration(config.Relay.Poll_Interval) * time.Second,
+		Workers:      config.Relay.Workers,
+	}
+	go outboundRelay.Run(nil)
+}
+
+// queue stored email to real recipients if inbox is released, only
+// authenticated submissions are relayed, inbound mail is not
+
+func relayEmail(config *config.Config, envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail) {
+	if outboundRelay == nil || len(envelop.Rcpts) == 0 || envelop.AuthMethod == "" {
+		return
+	}
+	enabled, err := config.DbPool.IsRelayEnabled(email.MailboxID)
+	if err != nil || !enabled {
+		return
+	}
+	from := ""
+	if envelop.From != nil {
+		from = envelop.From.Email()
+	}
+	var to []string
+	for _, rcpt := range envelop.Rcpts {
+		// own domains would deliver back to us
+		if isLocalDomain(config, rcpt.Hostname()) {
+			continue
+		}
+		to = append(to, rcpt.Email())
+	}
+	if len(to) == 0 {
+		return
+	}
+	if _, err = outboundRelay.Enqueue(email.MailboxID, from, to, email.RawMail); err != nil {
+		log.Errorf("Relay enqueue: %v", err)
+	}
+}
+
+// domains of address mode and hostname of server
+
+func isLocalDomain(config *config.Config, domain string) bool {
+	if domain == "" {
+		return false
+	}
+	if strings.EqualFold(domain, config.Adapter.Hostname) {
+		return true
+	}
+	for _, local := range config.Email_Address_Mode.Domains {
+		if strings.EqualFold(domain, local) {
+			return true
+		}
+	}
+	return false
+}
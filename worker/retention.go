@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/retention"
+)
+
+var (
+	retentionScheduler *retention.Scheduler
+)
+
+// NewRetentionScheduler with policies of inbox settings and global limits.
+func NewRetentionScheduler(config *config.Config) *retention.Scheduler {
+	scheduler := retention.NewScheduler(config.DbPool, func(mailboxID int) (retention.Policy, error) {
+		return retentionPolicy(config, mailboxID)
+	}, time.Duration(config.Retention.Interval)*time.Second, config.Retention.Batch_Size)
+	scheduler.BatchPause = time.Duration(config.Retention.Batch_Pause_Ms) * time.Millisecond
+	if index := config.SearchIndex(); index != nil {
+		scheduler.Store = &indexedStore{Store: config.DbPool, index: index}
+	}
+	if config.Redis.Enabled {
+		scheduler.Lock = config.CacheStore
+	}
+	return scheduler
+}
+
+// policy of inbox, settings override global limits
+
+func retentionPolicy(config *config.Config, mailboxID int) (retention.Policy, error) {
+	settings, err := cache.LoadInboxSettings(config.CacheStore, config.DbPool, mailboxID)
+	if err != nil {
+		return retention.Policy{}, err
+	}
+	policy := retention.Policy{
+		MaxAge:      time.Duration(config.Retention.Max_Age_Days) * 24 * time.Hour,
+		MaxBytes:    config.Retention.Max_Bytes,
+		MaxMessages: config.Retention.Max_Messages,
+	}
+	if settings.RetentionDays > 0 {
+		policy.MaxAge = time.Duration(settings.RetentionDays) * 24 * time.Hour
+	}
+	if settings.MaxBytes > 0 {
+		policy.MaxBytes = settings.MaxBytes
+	}
+	if settings.MaxMessages > 0 {
+		policy.MaxMessages = settings.MaxMessages
+	}
+	return policy, nil
+}
+
+// start retention scheduler
+
+func startRetention(config *config.Config) {
+	if !config.Retention.Enabled || retentionScheduler != nil {
+		return
+	}
+	retentionScheduler = NewRetentionScheduler(config)
+	log.Debugf("Retention every %v", retentionScheduler.Interval)
+	go retentionScheduler.Run(nil)
+}
@@ -0,0 +1,57 @@
+package worker
+
+import (
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/retention"
+	"github.com/Polymail/go-falcon/search"
+)
+
+// add stored message to search index and remove cleaned up messages,
+// postgres keeps search_vector by triggers
+
+func indexEmail(config *config.Config, email *parser.ParsedEmail, messageId int, cleaned []int) {
+	index := config.SearchIndex()
+	if index == nil {
+		return
+	}
+	doc := &search.Document{
+		MailboxID: email.MailboxID,
+		MessageID: messageId,
+		Subject:   email.Subject,
+		From:      email.From.Address,
+		Addresses: []string{email.From.Address, email.From.Name, email.To.Address, email.To.Name},
+		Text:      email.TextPart,
+		Html:      email.HtmlPart,
+		Date:      email.Date,
+	}
+	for _, attachment := range email.Attachments {
+		doc.Attachments = append(doc.Attachments, attachment.AttachmentFileName)
+	}
+	if err := index.Index(doc); err != nil {
+		log.Errorf("Search index: %v", err)
+	}
+	if len(cleaned) > 0 {
+		if err := index.Delete(email.MailboxID, cleaned...); err != nil {
+			log.Errorf("Search index: %v", err)
+		}
+	}
+}
+
+// retention store removing deleted messages from search index
+
+type indexedStore struct {
+	retention.Store
+	index search.Index
+}
+
+func (s *indexedStore) DeleteMessages(mailboxID int, messageIDs []int) ([]int, int64, error) {
+	deleted, bytes, err := s.Store.DeleteMessages(mailboxID, messageIDs)
+	if err == nil && len(deleted) > 0 {
+		if err := s.index.Delete(mailboxID, deleted...); err != nil {
+			log.Errorf("Search index: %v", err)
+		}
+	}
+	return deleted, bytes, err
+}
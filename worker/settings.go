@@ -0,0 +1,22 @@
+package worker
+
+import (
+	"github.com/Polymail/go-falcon/cache"
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+)
+
+var (
+	settingsInvalidation bool
+)
+
+// drop cached inbox settings published to invalidation channel
+
+func startSettingsInvalidation(config *config.Config) {
+	if settingsInvalidation || !config.Redis.Enabled {
+		return
+	}
+	settingsInvalidation = true
+	log.Debugf("Inbox settings invalidation on %s", config.Cache.Invalidation_Channel)
+	go cache.SubscribeInvalidations(config.RedisPool, config.Cache.Invalidation_Channel, config.CacheStore, nil)
+}
@@ -0,0 +1,140 @@
+package worker
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/Polymail/go-falcon/campaign"
+	"github.com/Polymail/go-falcon/clamav"
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/protocol/smtpd"
+	"github.com/Polymail/go-falcon/spamassassin"
+	"github.com/Polymail/go-falcon/storage"
+)
+
+// spam and virus checks of email, run before storage so reports are stored
+// with message
+
+func checkEmail(config *config.Config, email *parser.ParsedEmail, inboxSettings storage.InboxSettings) *messageChecks {
+	checks := &messageChecks{}
+	// spamassassin
+	if config.Spamassassin.Enabled {
+		report, err := spamassassin.CheckSpamEmail(config, email.RawMail, inboxSettings.SpamThreshold)
+		if err == nil {
+			checks.SpamReport = report
+		} else {
+			log.Errorf("CheckSpamEmail: %v", err)
+		}
+	}
+	// clamav
+	if config.Clamav.Enabled {
+		report, err := clamav.CheckEmailForViruses(config, email.RawMail)
+		if err == nil {
+			checks.VirusChecked = true
+			checks.VirusReport = report
+		} else {
+			log.Errorf("CheckEmailForViruses: %v", err)
+		}
+	}
+	return checks
+}
+
+// message of parsed email with spam score and fingerprint
+
+func storedMessage(email *parser.ParsedEmail, checks *messageChecks, duplicate *duplicate) *storage.Message {
+	message := &storage.Message{
+		MailboxID:    email.MailboxID,
+		Subject:      email.Subject,
+		Date:         email.Date,
+		From:         email.From.Address,
+		FromName:     email.From.Name,
+		To:           email.To.Address,
+		ToName:       email.To.Name,
+		Html:         email.HtmlPart,
+		Text:         email.TextPart,
+		Raw:          email.RawMail,
+		Cc:           email.MessageHeaders.Get("Cc"),
+		ReplyTo:      email.MessageHeaders.Get("Reply-To"),
+		MessageID:    email.MessageID,
+		Fingerprint:  duplicate.fingerprint,
+		FromList:     email.FromList,
+		ToList:       email.ToList,
+		CcList:       email.CcList,
+		BccList:      email.BccList,
+		ReplyToList:  email.ReplyToList,
+		InReplyTo:    email.InReplyTo,
+		References:   email.References,
+		EnvelopeFrom: email.EnvelopeFrom,
+		EnvelopeTo:   email.EnvelopeTo,
+		Headers:      email.MessageHeaders,
+		QueueID:      email.QueueID,
+	}
+	if duplicate.linked() {
+		message.DuplicateOf = sql.NullInt64{Int64: int64(duplicate.original), Valid: true}
+	}
+	var spamResponse spamassassin.SpamassassinResponse
+	if checks.SpamReport != "" && json.Unmarshal([]byte(checks.SpamReport), &spamResponse) == nil {
+		message.SpamScore = sql.NullFloat64{Float64: spamResponse.Score, Valid: true}
+		message.Spam = sql.NullBool{Bool: spamResponse.Spam, Valid: true}
+	}
+	return message
+}
+
+// store message, attachments, reports and cleanup in one transaction,
+// returns id of message and ids of cleaned up messages
+
+func storeEmail(config *config.Config, envelop *smtpd.BasicEnvelope, email *parser.ParsedEmail, inboxSettings storage.InboxSettings, checks *messageChecks, authResults *authenticationResults, quarantine string, duplicate *duplicate) (int, []int, error) {
+	var (
+		messageId int
+		cleaned   []int
+	)
+	err := config.DbPool.InTx(func(tx *storage.DBConn) error {
+		var err error
+		messageId, err = tx.StoreMail(storedMessage(email, checks, duplicate))
+		if err != nil {
+			return err
+		}
+		for _, attachment := range email.Attachments {
+			_, err = tx.StoreAttachment(email.MailboxID, messageId, attachment.AttachmentFileName, attachment.AttachmentType, attachment.AttachmentContentType, attachment.AttachmentContentID, attachment.AttachmentTransferEncoding, attachment.AttachmentBody)
+			if err != nil {
+				return err
+			}
+		}
+		// update spam info
+		if checks.SpamReport != "" {
+			if _, err = tx.UpdateSpamReport(email.MailboxID, messageId, checks.SpamReport); err != nil {
+				return err
+			}
+		}
+		// update viruses info
+		if checks.VirusReport != "" {
+			if _, err = tx.UpdateVirusesReport(email.MailboxID, messageId, checks.VirusReport); err != nil {
+				return err
+			}
+		}
+		// spf, dkim and dmarc
+		if err = storeAuthenticationResults(tx, config, authResults, email.MailboxID, messageId); err != nil {
+			return err
+		}
+		// spam campaign
+		if envelop.Campaign != "" {
+			if _, err = tx.UpdateCampaign(email.MailboxID, messageId, envelop.Campaign, config.Campaign.Action == campaign.ACTION_QUARANTINE); err != nil {
+				return err
+			}
+		}
+		// dmarc policy, after campaign which also sets quarantined
+		if quarantine != "" {
+			if _, err = tx.QuarantineMessage(email.MailboxID, messageId, quarantine); err != nil {
+				return err
+			}
+		}
+		cleaned, err = tx.CleanupMessages(email.MailboxID, inboxSettings)
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageId, cleaned, nil
+}
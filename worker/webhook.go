@@ -0,0 +1,108 @@
+package worker
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Polymail/go-falcon/config"
+	"github.com/Polymail/go-falcon/log"
+	"github.com/Polymail/go-falcon/parser"
+	"github.com/Polymail/go-falcon/redisworker"
+	"github.com/Polymail/go-falcon/spamassassin"
+	"github.com/Polymail/go-falcon/webhook"
+)
+
+const (
+	WEBHOOK_EVENT_STORED = "message.stored"
+)
+
+var (
+	messageNotifier *webhook.Notifier
+)
+
+// results of spam and virus checks of stored email
+
+type messageChecks struct {
+	SpamReport   string // spamassassin JSON, empty if not checked
+	VirusChecked bool
+	VirusReport  string // virus name, empty if clean
+}
+
+// start webhook notifier and its retry queue
+
+func startWebhooks(config *config.Config) {
+	if !config.Webhook.Enabled || messageNotifier != nil {
+		return
+	}
+	if !config.Redis.Enabled {
+		log.Errorf("Webhook disabled: redis should be enabled for retry queue")
+		return
+	}
+	messageNotifier = &webhook.Notifier{
+		Client:       &http.Client{Timeout: time.Duration(config.Webhook.Timeout) * time.Second},
+		Queue:        redisworker.NewWebhookQueue(config),
+		MaxAttempts:  config.Webhook.Max_Attempts,
+		RetryBase:    time.Duration(config.Webhook.Retry_Base) * time.Second,
+		RetryMax:     time.Duration(config.Webhook.Retry_Max) * time.Second,
+		PollInterval: time.Duration(config.Webhook.Poll_Interval) * time.Second,
+		Workers:      config.Webhook.Workers,
+		OnAttempt: func(attempt *webhook.Attempt) {
+			redisworker.LogWebhookAttempt(config, attempt)
+		},
+	}
+	go messageNotifier.Run(nil)
+}
+
+// notify global and inbox webhooks about stored email
+
+func notifyWebhooks(config *config.Config, email *parser.ParsedEmail, messageID int, checks *messageChecks) {
+	if messageNotifier == nil {
+		return
+	}
+	payload := &webhook.Payload{
+		Event:       WEBHOOK_EVENT_STORED,
+		MailboxID:   email.MailboxID,
+		MessageID:   messageID,
+		Subject:     email.Subject,
+		QueueID:     email.QueueID,
+		From:        email.From.Address,
+		FromName:    email.From.Name,
+		To:          email.To.Address,
+		ToName:      email.To.Name,
+		Size:        len(email.RawMail),
+		VirusStatus: "unchecked",
+		Timestamp:   time.Now().Unix(),
+	}
+	if checks.SpamReport != "" {
+		var spamResponse spamassassin.SpamassassinResponse
+		if err := json.Unmarshal([]byte(checks.SpamReport), &spamResponse); err == nil {
+			payload.SpamScore = &spamResponse.Score
+			payload.Spam = spamResponse.Spam
+		}
+	}
+	if checks.VirusChecked {
+		payload.VirusStatus = "clean"
+		if checks.VirusReport != "" {
+			payload.VirusStatus = checks.VirusReport
+		}
+	}
+	type endpoint struct{ url, secret string }
+	var endpoints []endpoint
+	if config.Webhook.Url != "" {
+		endpoints = append(endpoints, endpoint{config.Webhook.Url, config.Webhook.Secret})
+	}
+	if config.Webhook.Per_Inbox {
+		url, secret, err := config.DbPool.GetInboxWebhook(email.MailboxID)
+		if err == nil && url != "" {
+			endpoints = append(endpoints, endpoint{url, secret})
+		}
+	}
+	for _, e := range endpoints {
+		go func(url, secret string) {
+			if err := messageNotifier.Notify(url, secret, payload); err != nil {
+				log.Errorf("Webhook notify %s: %v", url, err)
+			}
+		}(e.url, e.secret)
+	}
+}
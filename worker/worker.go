@@ -1,103 +1,103 @@
 package worker
 
 import (
-	"github.com/Polymail/go-falcon/clamav"
+	"github.com/Polymail/go-falcon/cache"
 	"github.com/Polymail/go-falcon/config"
 	"github.com/Polymail/go-falcon/log"
 	"github.com/Polymail/go-falcon/parser"
 	"github.com/Polymail/go-falcon/protocol/smtpd"
-	"github.com/Polymail/go-falcon/redisworker"
-	"github.com/Polymail/go-falcon/spamassassin"
 )
 
 // start worker
 func startParserAndStorageWorker(config *config.Config, channel chan *smtpd.BasicEnvelope) {
 	var (
 		email     *parser.ParsedEmail
-		report    string
 		messageId int
+		cleaned   []int
 	)
 	log.Debugf("Starting storage worker")
 	for {
 		envelop := <-channel
 
 		// get settings
-		inboxSettings, err := redisworker.GetCachedInboxSettings(config, envelop.MailboxID)
-		if err != nil || 0 == inboxSettings.MaxMessages || 0 == inboxSettings.RateLimit {
-			// inbox setting from database
-			inboxSettings, err = config.DbPool.GeInboxSettings(envelop.MailboxID)
-			// check settings
-			if err != nil {
-				// invalid settings
-				continue
-			} else {
-				// cache setting in redis
-				redisworker.StoreCachedInboxSettings(config, envelop.MailboxID, inboxSettings)
-			}
+		inboxSettings, err := cache.LoadInboxSettings(config.CacheStore, config.DbPool, envelop.MailboxID)
+		if err != nil {
+			// invalid settings
+			continue
+		}
+		if inboxSettings.Disabled {
+			log.Infof("Message %s to disabled inbox %d dropped", envelop.QueueId, envelop.MailboxID)
+			continue
 		}
 		// parse email
 		email, err = parser.ParseMail(envelop)
 		if err == nil {
-			messageId, err = config.DbPool.StoreMail(email.MailboxID, email.Subject, email.Date, email.From.Address, email.From.Name, email.To.Address, email.To.Name, email.HtmlPart, email.TextPart, email.RawMail)
-			// store attachments
-			if err == nil {
-				for _, attachment := range email.Attachments {
-					_, err := config.DbPool.StoreAttachment(email.MailboxID, messageId, attachment.AttachmentFileName, attachment.AttachmentType, attachment.AttachmentContentType, attachment.AttachmentContentID, attachment.AttachmentTransferEncoding, attachment.AttachmentBody)
-					if err != nil {
-						log.Errorf("StoreAttachment: %v", err)
-					}
-				}
-
-				//cleanup messages
-				config.DbPool.CleanupMessages(email.MailboxID, inboxSettings)
-				// redis counter
-				if messageId > 0 && redisworker.IsNotSpamAttackCampaign(config, envelop.MailboxID) {
-					// spamassassin
-					if config.Spamassassin.Enabled {
-						report, err = spamassassin.CheckSpamEmail(config, email.RawMail)
-						if err == nil {
-							// update spam info
-							_, err = config.DbPool.UpdateSpamReport(email.MailboxID, messageId, report)
-							if err != nil {
-								log.Errorf("UpdateSpamReport: %v", err)
-							}
-						} else {
-							log.Errorf("CheckSpamEmail: %v", err)
-						}
-					}
-					// clamav
-					if config.Clamav.Enabled {
-						report, err = clamav.CheckEmailForViruses(config, email.RawMail)
-						if err == nil {
-							if len(report) > 0 {
-								// update viruses info
-								_, err = config.DbPool.UpdateVirusesReport(email.MailboxID, messageId, report)
-								if err != nil {
-									log.Errorf("UpdateVirusesReport: %v", err)
-								}
-							}
-						} else {
-							log.Errorf("CheckEmailForViruses: %v", err)
-						}
-					}
-					// redis hooks
-					if config.Redis.Enabled {
-						redisworker.SendNotifications(config, email.MailboxID, messageId, email.Subject)
-					}
-				}
-
-			} else {
-				log.Errorf("StoreMail: %v", err)
+			emitReceived(envelop, email)
+			// retried deliveries
+			duplicate := checkDuplicate(config, email, inboxSettings)
+			if duplicate.skip() {
+				continue
+			}
+			// authentication
+			authResults := authenticateEmail(config, envelop, email)
+			quarantine := authResults.quarantineReason(config)
+			// forwarding rules
+			forwarding, keep := evaluateForwarding(config, envelop, email)
+			if !keep {
+				continue
+			}
+			// spam and viruses
+			checks := checkEmail(config, email, inboxSettings)
+			// message, attachments and reports
+			messageId, cleaned, err = storeEmail(config, envelop, email, inboxSettings, checks, authResults, quarantine, duplicate)
+			if err != nil {
+				log.Errorf("StoreMail %s: %v", envelop.QueueId, err)
+				continue
+			}
+			log.Infof("Message %s stored as %d in inbox %d", envelop.QueueId, messageId, email.MailboxID)
+			rememberFingerprint(email, duplicate, messageId)
+			emitStored(email, messageId)
+			emitChecks(email.MailboxID, messageId, checks)
+			emitCleanedUp(email.MailboxID, cleaned, inboxSettings)
+			// search index
+			indexEmail(config, email, messageId, cleaned)
+			// linked duplicate was delivered with original
+			if duplicate.linked() {
+				continue
+			}
+			// failed dmarc policy, kept only for review
+			if quarantine != "" {
+				log.Infof("Message %s from %q quarantined by DMARC policy of %q: %s", envelop.QueueId, email.From.Address, authResults.Dmarc.Domain, quarantine)
+				continue
+			}
+			// outbound relay
+			relayEmail(config, envelop, email)
+			// forwarding
+			forwarding.apply(config, email, messageId)
+			forwardToTargets(config, envelop, email, inboxSettings.ForwardTargets)
+			// campaign messages are stored without notifications
+			if envelop.Campaign == "" {
+				// notification sinks
+				sendNotifications(email.MailboxID, messageId, email.Subject, email.QueueID)
+				// http hooks
+				notifyWebhooks(config, email, messageId, checks)
 			}
-
 		} else {
-			log.Errorf("ParseMail: %v", err)
+			log.Errorf("ParseMail %s: %v", envelop.QueueId, err)
 		}
 	}
 }
 
 // workers
 func StartWorkers(config *config.Config, channel chan *smtpd.BasicEnvelope) {
+	initAuthentication(config)
+	startRelay(config)
+	initForwarding(config)
+	startWebhooks(config)
+	startNotifications(config)
+	startSettingsInvalidation(config)
+	startRetention(config)
+	startDedup(config)
 	for i := 0; i < config.Adapter.Workers_Size; i++ {
 		go startParserAndStorageWorker(config, channel)
 	}